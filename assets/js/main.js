@@ -17,3 +17,16 @@ if (pres !== undefined) {
 		hljs.highlightBlock(code);
 	}
 }
+
+const moduleVersionCount = document.getElementById("moduleVersionCount");
+const dailyDownloadCount = document.getElementById("dailyDownloadCount");
+if (moduleVersionCount !== null && dailyDownloadCount !== null) {
+	setInterval(function() {
+		fetch("/stats/counters").then(function(response) {
+			return response.json();
+		}).then(function(counters) {
+			moduleVersionCount.textContent = counters.module_version_count.toLocaleString("en-US");
+			dailyDownloadCount.textContent = counters.daily_download_count.toLocaleString("en-US");
+		}).catch(function() {});
+	}, 60000);
+}
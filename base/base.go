@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aofei/air"
@@ -17,8 +19,10 @@ import (
 )
 
 var (
-	// Viper is the global instace of the `viper.Viper`.
-	Viper = viper.New()
+	// Viper is the global instace of the `viper.Viper`. It holds the
+	// configuration at startup and is never changed afterwards, see the
+	// `Config` for the reloaded one.
+	Viper *viper.Viper
 
 	// Logger is the global instace of the `zerolog.Logger`.
 	Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
@@ -31,20 +35,48 @@ var (
 
 	// Cron is the global instance of the `cron.Cron`.
 	Cron *cron.Cron
+
+	// configFile is the path of the configuration file.
+	configFile string
+
+	// configModTime is the modification time of the `configFile` when it
+	// was last read.
+	configModTime time.Time
+
+	// configReloadHooks is the functions called after the configuration
+	// file is reloaded.
+	configReloadHooks []func()
+
+	// configReloadMutex is used to serialize the configuration reloads.
+	configReloadMutex sync.Mutex
+
+	// config is the latest configuration, which is replaced as a whole
+	// instead of being changed in place when the `configFile` is reloaded.
+	config atomic.Pointer[viper.Viper]
 )
 
+// configEnvPrefix is the prefix of the environment variables that override the
+// configuration items. For example, the "goproxy.fetch_timeout" can be
+// overridden by the GOPROXY_CN_GOPROXY_FETCH_TIMEOUT.
+const configEnvPrefix = "GOPROXY_CN"
+
 func init() {
 	cf := pflag.StringP("config", "c", "config.toml", "configuration file")
 	pflag.Parse()
 
-	ext := filepath.Ext(*cf)
-	Viper.AddConfigPath(filepath.Dir(*cf))
-	Viper.SetConfigName(strings.TrimSuffix(filepath.Base(*cf), ext))
-	Viper.SetConfigType(strings.TrimPrefix(ext, "."))
-	if err := Viper.ReadInConfig(); err != nil {
+	configFile = *cf
+
+	var err error
+	if Viper, err = readConfig(); err != nil {
 		panic(fmt.Errorf("failed to read configuration file: %v", err))
 	}
 
+	config.Store(Viper)
+
+	if fi, err := os.Stat(configFile); err == nil {
+		configModTime = fi.ModTime()
+	}
+
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	Logger = Logger.With().
 		Str("app_name", Viper.GetString("air.app_name")).
@@ -75,4 +107,138 @@ func init() {
 	Air.AddShutdownJob(func() {
 		<-Cron.Stop().Done()
 	})
+
+	if _, err := Cron.AddFunc("@every 10s", func() {
+		configReloadMutex.Lock()
+		defer configReloadMutex.Unlock()
+
+		fi, err := os.Stat(configFile)
+		if err != nil || fi.ModTime().Equal(configModTime) {
+			return
+		}
+
+		if err := reloadConfig(); err != nil {
+			Logger.Error().Err(err).
+				Msg("failed to reload configuration file")
+		}
+	}); err != nil {
+		Logger.Fatal().Err(err).
+			Msg("failed to add configuration reload cron job")
+	}
+}
+
+// OnConfigReload registers the f to be called after the configuration file is
+// reloaded.
+func OnConfigReload(f func()) {
+	configReloadMutex.Lock()
+	defer configReloadMutex.Unlock()
+
+	configReloadHooks = append(configReloadHooks, f)
+}
+
+// Config returns the latest configuration. Unlike the `Viper`, it reflects the
+// reloads of the configuration file, so it is what the functions registered by
+// the `OnConfigReload` should read. The returned `viper.Viper` is never
+// changed, and a new one is returned after each reload.
+func Config() *viper.Viper {
+	return config.Load()
+}
+
+// ReloadConfig rereads the configuration file and then calls the functions
+// registered by the `OnConfigReload`. It is called when the configuration file
+// changes, and can also be called manually (for example, on SIGHUP).
+func ReloadConfig() error {
+	configReloadMutex.Lock()
+	defer configReloadMutex.Unlock()
+
+	return reloadConfig()
+}
+
+// reloadConfig is like the `ReloadConfig`, but without locking the
+// `configReloadMutex`.
+func reloadConfig() error {
+	if fi, err := os.Stat(configFile); err == nil {
+		configModTime = fi.ModTime()
+	}
+
+	v, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	config.Store(v)
+
+	for _, f := range configReloadHooks {
+		f()
+	}
+
+	Logger.Info().Msg("reloaded configuration file")
+
+	return nil
+}
+
+// readConfig reads the `configFile` into a new `viper.Viper` and applies the
+// environment variable overrides to it.
+func readConfig() (*viper.Viper, error) {
+	ext := filepath.Ext(configFile)
+
+	v := viper.New()
+	v.AddConfigPath(filepath.Dir(configFile))
+	v.SetConfigName(strings.TrimSuffix(filepath.Base(configFile), ext))
+	v.SetConfigType(strings.TrimPrefix(ext, "."))
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	if err := applyConfigEnvOverrides(v); err != nil {
+		return nil, fmt.Errorf(
+			"apply configuration environment variables: %w",
+			err,
+		)
+	}
+
+	return v, nil
+}
+
+// applyConfigEnvOverrides overrides the configuration items of the v with
+// the environment variables named after their keys, uppercased, with the dots
+// replaced by underscores and prefixed with the `configEnvPrefix`. Only the
+// keys present in the configuration file can be overridden, and the values of
+// the lists are separated by spaces.
+//
+// The overrides are merged into the configuration instead of being set with
+// the `viper.Viper.Set`, so that they are also visible through the
+// `viper.Viper.Sub` and the `viper.Viper.UnmarshalKey`.
+func applyConfigEnvOverrides(v *viper.Viper) error {
+	overrides := map[string]any{}
+	for _, key := range v.AllKeys() {
+		value, ok := os.LookupEnv(fmt.Sprint(
+			configEnvPrefix,
+			"_",
+			strings.ToUpper(strings.ReplaceAll(key, ".", "_")),
+		))
+		if !ok {
+			continue
+		}
+
+		m := overrides
+		path := strings.Split(key, ".")
+		for _, k := range path[:len(path)-1] {
+			sm, ok := m[k].(map[string]any)
+			if !ok {
+				sm = map[string]any{}
+				m[k] = sm
+			}
+
+			m = sm
+		}
+
+		m[path[len(path)-1]] = value
+	}
+
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	return v.MergeConfigMap(overrides)
 }
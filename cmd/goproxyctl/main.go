@@ -0,0 +1,331 @@
+// Command goproxyctl manages a goproxy.cn deployment through its admin API.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// usage is the usage of the goproxyctl.
+const usage = `Usage: goproxyctl [flags] <command> [arguments]
+
+Commands:
+  purge <name>              purge a cache, such as "golang.org/x/mod/@v/list"
+  soft-purge <name>         mark a cache stale, so that it keeps being served
+                            while the next request re-fetches it in the
+                            background
+  refetch <module@version>  purge and re-fetch a module version
+  blocklist                 list the blocked module patterns
+  block <pattern>           block a module pattern
+  unblock <pattern>         unblock a module pattern
+  uploads                   list the in-flight cache uploads
+  upstreams                 show the health of the upstream proxies
+  stats                     show the runtime statistics
+  gc                        trigger the cache garbage collection
+  webhooks                  list the webhooks
+  webhook-add <pattern> <url>
+                            register a webhook fired when a new version of
+                            a module matching the pattern is cached
+  webhook-remove <id>       remove a webhook
+  usage                     show the usages of the API tokens
+  abuse                     list the abusive client IPs
+  abuse-pardon <ip>         lift the action on an abusive client IP
+  audit                     show today's audit log of the admin actions
+  tenants                   show the storage quotas and usages of the tenants
+  tenant-purge <tenant> <name>
+                            purge a cache in the namespace of a tenant
+  rotate-credentials        rotate the storage credentials of the server to
+                            the GOPROXYCTL_ACCESS_KEY, GOPROXYCTL_SECRET_KEY
+                            and GOPROXYCTL_SESSION_TOKEN (optional)
+  cache-only                show whether the cache-only mode is on
+  cache-only-on             stop fetching from the upstreams and serve
+                            strictly from the caches
+  cache-only-off            resume fetching from the upstreams
+  maintenance               show whether the maintenance mode is on
+  maintenance-on            suspend the writes to the storage
+  maintenance-off           resume the writes to the storage
+
+Flags:
+`
+
+var (
+	// server is the base URL of the goproxy.cn deployment.
+	server = flag.String(
+		"server",
+		envOr("GOPROXYCTL_SERVER", "http://localhost:8080"),
+		"base URL of the server (GOPROXYCTL_SERVER)",
+	)
+
+	// token is the admin token of the goproxy.cn deployment.
+	token = flag.String(
+		"token",
+		os.Getenv("GOPROXYCTL_TOKEN"),
+		"admin token (GOPROXYCTL_TOKEN)",
+	)
+
+	// timeout is the timeout of the requests.
+	timeout = flag.Duration("timeout", 5*time.Minute, "request timeout")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "goproxyctl:", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command with the args.
+func run(command string, args []string) error {
+	nargs := map[string]int{
+		"purge":              1,
+		"soft-purge":         1,
+		"refetch":            1,
+		"blocklist":          0,
+		"block":              1,
+		"unblock":            1,
+		"uploads":            0,
+		"upstreams":          0,
+		"stats":              0,
+		"gc":                 0,
+		"webhooks":           0,
+		"webhook-add":        2,
+		"webhook-remove":     1,
+		"usage":              0,
+		"abuse":              0,
+		"abuse-pardon":       1,
+		"audit":              0,
+		"tenants":            0,
+		"tenant-purge":       2,
+		"rotate-credentials": 0,
+		"cache-only":         0,
+		"cache-only-on":      0,
+		"cache-only-off":     0,
+		"maintenance":        0,
+		"maintenance-on":     0,
+		"maintenance-off":    0,
+	}
+
+	n, ok := nargs[command]
+	if !ok {
+		return fmt.Errorf("unknown command %q", command)
+	} else if len(args) != n {
+		return fmt.Errorf("%s takes %d argument(s)", command, n)
+	}
+
+	switch command {
+	case "purge":
+		return call(
+			http.MethodDelete,
+			"/admin/cache/"+strings.TrimPrefix(args[0], "/"),
+			nil,
+		)
+	case "soft-purge":
+		return call(
+			http.MethodDelete,
+			"/admin/cache/"+strings.TrimPrefix(args[0], "/"),
+			url.Values{"soft": []string{"true"}},
+		)
+	case "refetch":
+		return call(
+			http.MethodPost,
+			"/admin/refetch",
+			url.Values{"module": []string{args[0]}},
+		)
+	case "blocklist":
+		return call(http.MethodGet, "/admin/blocklist", nil)
+	case "block":
+		return call(
+			http.MethodPut,
+			"/admin/blocklist",
+			url.Values{"pattern": []string{args[0]}},
+		)
+	case "unblock":
+		return call(
+			http.MethodDelete,
+			"/admin/blocklist",
+			url.Values{"pattern": []string{args[0]}},
+		)
+	case "uploads":
+		return call(http.MethodGet, "/admin/uploads", nil)
+	case "upstreams":
+		return call(http.MethodGet, "/admin/upstreams", nil)
+	case "stats":
+		return call(http.MethodGet, "/admin/stats", nil)
+	case "gc":
+		return call(http.MethodPost, "/admin/gc", nil)
+	case "webhooks":
+		return call(http.MethodGet, "/admin/webhooks", nil)
+	case "webhook-add":
+		return call(
+			http.MethodPost,
+			"/admin/webhooks",
+			url.Values{
+				"pattern": []string{args[0]},
+				"url":     []string{args[1]},
+			},
+		)
+	case "webhook-remove":
+		return call(
+			http.MethodDelete,
+			"/admin/webhooks",
+			url.Values{"id": []string{args[0]}},
+		)
+	case "usage":
+		return call(http.MethodGet, "/admin/auth/usage", nil)
+	case "abuse":
+		return call(http.MethodGet, "/admin/abuse", nil)
+	case "abuse-pardon":
+		return call(
+			http.MethodDelete,
+			"/admin/abuse",
+			url.Values{"ip": []string{args[0]}},
+		)
+	case "audit":
+		return call(http.MethodGet, "/admin/audit", nil)
+	case "tenants":
+		return call(http.MethodGet, "/admin/tenants", nil)
+	case "tenant-purge":
+		return call(
+			http.MethodDelete,
+			"/admin/cache/"+strings.TrimPrefix(args[1], "/"),
+			url.Values{"tenant": []string{args[0]}},
+		)
+	case "rotate-credentials":
+		form := url.Values{}
+		for name, key := range map[string]string{
+			"access_key":    "GOPROXYCTL_ACCESS_KEY",
+			"secret_key":    "GOPROXYCTL_SECRET_KEY",
+			"session_token": "GOPROXYCTL_SESSION_TOKEN",
+		} {
+			if v := os.Getenv(key); v != "" {
+				form.Set(name, v)
+			}
+		}
+
+		return callForm(http.MethodPost, "/admin/credentials", form)
+	case "cache-only":
+		return call(http.MethodGet, "/admin/cache-only", nil)
+	case "cache-only-on":
+		return call(http.MethodPut, "/admin/cache-only", nil)
+	case "cache-only-off":
+		return call(http.MethodDelete, "/admin/cache-only", nil)
+	case "maintenance":
+		return call(http.MethodGet, "/admin/maintenance", nil)
+	case "maintenance-on":
+		return call(http.MethodPut, "/admin/maintenance", nil)
+	case "maintenance-off":
+		return call(http.MethodDelete, "/admin/maintenance", nil)
+	}
+
+	return nil
+}
+
+// call calls the admin API at the path with the method and the query, and
+// prints the response body to the standard output.
+func call(method, path string, query url.Values) error {
+	u, err := url.Parse(strings.TrimSuffix(*server, "/") + path)
+	if err != nil {
+		return err
+	}
+
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	return send(req)
+}
+
+// callForm is like the `call`, but sends the form in the request body instead,
+// which keeps it out of the URL (and thus the access logs).
+func callForm(method, path string, form url.Values) error {
+	req, err := http.NewRequest(
+		method,
+		strings.TrimSuffix(*server, "/")+path,
+		strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return send(req)
+}
+
+// send sends the req with the `token`, and prints the response body to the
+// standard output.
+func send(req *http.Request) error {
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode >= http.StatusBadRequest {
+		if msg := strings.TrimSpace(string(b)); msg != "" {
+			return fmt.Errorf("%s: %s", res.Status, msg)
+		}
+
+		return errors.New(res.Status)
+	}
+
+	if len(b) == 0 {
+		fmt.Println(res.Status)
+		return nil
+	}
+
+	var out bytes.Buffer
+	if json.Indent(&out, b, "", "\t") == nil {
+		b = append(out.Bytes(), '\n')
+	}
+
+	_, err = os.Stdout.Write(b)
+
+	return err
+}
+
+// envOr returns the value of the environment variable named by the key, or the
+// fallback if it is empty.
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+
+	return fallback
+}
@@ -0,0 +1,362 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// abuseDetectionEnabled indicates whether the abusive crawling
+	// detection is enabled.
+	abuseDetectionEnabled = goproxyViper.GetBool("abuse_detection_enabled")
+
+	// abuseWindow is the length of the windows in which the requests of
+	// each client IP are observed.
+	abuseWindow = goproxyViper.GetDuration("abuse_window")
+
+	// abuseMinRequests is the minimum number of the requests of a client
+	// IP in a window before the ratios are considered.
+	abuseMinRequests = goproxyViper.GetInt("abuse_min_requests")
+
+	// abuseMaxDistinctModules is the maximum number of the distinct module
+	// paths a client IP can request in a window.
+	abuseMaxDistinctModules = goproxyViper.GetInt(
+		"abuse_max_distinct_modules",
+	)
+
+	// abuseMaxListRatio is the maximum ratio of the list requests of a
+	// client IP in a window.
+	abuseMaxListRatio = goproxyViper.GetFloat64("abuse_max_list_ratio")
+
+	// abuseMaxErrorRatio is the maximum ratio of the error responses of a
+	// client IP in a window.
+	abuseMaxErrorRatio = goproxyViper.GetFloat64("abuse_max_error_ratio")
+
+	// abuseAction is the action applied to the abusive client IPs, which
+	// is "throttle" or "tarpit".
+	abuseAction = goproxyViper.GetString("abuse_action")
+
+	// abusePenalty is how long the action is applied to an abusive client
+	// IP.
+	abusePenalty = goproxyViper.GetDuration("abuse_penalty")
+
+	// abuseTarpitDelay is how long each request of a tarpitted client IP
+	// is delayed.
+	abuseTarpitDelay = goproxyViper.GetDuration("abuse_tarpit_delay")
+
+	// abuseThrottleRate is the number of requests per second allowed for
+	// a throttled client IP.
+	abuseThrottleRate = goproxyViper.GetFloat64("abuse_throttle_rate")
+
+	// abuseClients is the observations of the client IPs in their current
+	// windows.
+	abuseClients = map[string]*abuseClient{}
+
+	// abuseDecisions is the decisions on the abusive client IPs.
+	abuseDecisions = map[string]*abuseDecision{}
+
+	// abuseMutex is used to protect the `abuseClients` and the
+	// `abuseDecisions`.
+	abuseMutex sync.Mutex
+)
+
+// abuseClient is the observation of a client IP in a window.
+type abuseClient struct {
+	windowStart  time.Time
+	requests     int
+	listRequests int
+	errors       int
+	modulePaths  map[string]struct{}
+}
+
+// abuseDecision is a decision on an abusive client IP.
+type abuseDecision struct {
+	ClientIP          string    `json:"client_ip"`
+	Reason            string    `json:"reason"`
+	Action            string    `json:"action"`
+	DecidedAt         time.Time `json:"decided_at"`
+	Until             time.Time `json:"until"`
+	Requests          int       `json:"requests"`
+	DistinctModules   int       `json:"distinct_modules"`
+	ListRatio         float64   `json:"list_ratio"`
+	ErrorRatio        float64   `json:"error_ratio"`
+	ThrottledRequests int       `json:"throttled_requests"`
+
+	nextAllowedAt time.Time
+}
+
+func init() {
+	if !abuseDetectionEnabled {
+		return
+	}
+
+	switch abuseAction {
+	case "throttle":
+		if abuseThrottleRate <= 0 {
+			base.Logger.Fatal().
+				Msg("abuse throttle rate must be positive")
+		}
+	case "tarpit":
+	default:
+		base.Logger.Fatal().
+			Str("action", abuseAction).
+			Msg("unsupported abuse action")
+	}
+
+	if _, err := base.Cron.AddFunc(
+		"* * * * *", // Every minute
+		pruneAbuseClients,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add abuse client prune cron job")
+	}
+
+	if !adminEnabled {
+		return
+	}
+
+	base.Air.GET("/admin/abuse", hAdminAbuse, adminGas, globalAdminGas)
+	base.Air.DELETE(
+		"/admin/abuse",
+		hAdminPardonAbuse,
+		adminGas,
+		globalAdminGas,
+	)
+}
+
+// abuseGas is used to detect the abusive crawling of each client IP and to
+// apply the `abuseAction` to those detected. The client IPs exempted from the
+// rate limiting are exempted from it too.
+func abuseGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if !abuseDetectionEnabled {
+			return next(req, res)
+		}
+
+		clientIP := req.ClientHost()
+
+		rateLimitMutex.Lock()
+		exempted := isRateLimitExempted(clientIP)
+		rateLimitMutex.Unlock()
+
+		if exempted {
+			return next(req, res)
+		}
+
+		now := time.Now()
+
+		switch action, wait := checkAbuseDecision(clientIP, now); action {
+		case "throttle":
+			if wait > 0 {
+				res.Status = http.StatusTooManyRequests
+				res.Header.Set("Retry-After", strconv.Itoa(int(
+					math.Ceil(wait.Seconds()),
+				)))
+				return errors.New(strings.ToLower(
+					http.StatusText(res.Status),
+				))
+			}
+		case "tarpit":
+			timer := time.NewTimer(abuseTarpitDelay)
+			select {
+			case <-timer.C:
+			case <-req.Context.Done():
+				timer.Stop()
+				return req.Context.Err()
+			}
+		}
+
+		name, _ := url.PathUnescape(req.ParamValue("*").String())
+		res.Defer(func() {
+			observeAbuse(clientIP, name, res.Status, time.Now())
+		})
+
+		return next(req, res)
+	}
+}
+
+// checkAbuseDecision returns the action applied to the clientIP at the now, or
+// an empty string if there is none. For the "throttle", it also returns how
+// long to wait before the next request is allowed.
+func checkAbuseDecision(
+	clientIP string,
+	now time.Time,
+) (string, time.Duration) {
+	abuseMutex.Lock()
+	defer abuseMutex.Unlock()
+
+	ad, ok := abuseDecisions[clientIP]
+	if !ok || now.After(ad.Until) {
+		return "", 0
+	}
+
+	if ad.Action == "throttle" {
+		if wait := ad.nextAllowedAt.Sub(now); wait > 0 {
+			ad.ThrottledRequests++
+			return ad.Action, wait
+		}
+
+		ad.nextAllowedAt = now.Add(time.Duration(
+			float64(time.Second) / abuseThrottleRate,
+		))
+	}
+
+	return ad.Action, 0
+}
+
+// observeAbuse observes a request of the clientIP to the Goproxy cache with the
+// name that was responded with the status at the now, and makes a decision on
+// the clientIP once it looks abusive.
+func observeAbuse(clientIP, name string, status int, now time.Time) {
+	abuseMutex.Lock()
+	defer abuseMutex.Unlock()
+
+	ac, ok := abuseClients[clientIP]
+	if !ok || now.Sub(ac.windowStart) > abuseWindow {
+		ac = &abuseClient{
+			windowStart: now,
+			modulePaths: map[string]struct{}{},
+		}
+		abuseClients[clientIP] = ac
+	}
+
+	ac.requests++
+	if goproxyCacheNameType(name) == "list" {
+		ac.listRequests++
+	}
+
+	if status >= http.StatusBadRequest {
+		ac.errors++
+	}
+
+	if modulePath, _, ok := parseGoproxyCacheName(name); ok &&
+		len(ac.modulePaths) <= abuseMaxDistinctModules {
+		ac.modulePaths[modulePath] = struct{}{}
+	}
+
+	if ad, ok := abuseDecisions[clientIP]; ok && now.Before(ad.Until) {
+		return
+	}
+
+	listRatio := float64(ac.listRequests) / float64(ac.requests)
+	errorRatio := float64(ac.errors) / float64(ac.requests)
+
+	var reason string
+	switch {
+	case abuseMaxDistinctModules > 0 &&
+		len(ac.modulePaths) > abuseMaxDistinctModules:
+		reason = "too many distinct modules"
+	case ac.requests < abuseMinRequests:
+		return
+	case abuseMaxListRatio > 0 && listRatio > abuseMaxListRatio:
+		reason = "too many list requests"
+	case abuseMaxErrorRatio > 0 && errorRatio > abuseMaxErrorRatio:
+		reason = "too many errors"
+	default:
+		return
+	}
+
+	ad := &abuseDecision{
+		ClientIP:        clientIP,
+		Reason:          reason,
+		Action:          abuseAction,
+		DecidedAt:       now,
+		Until:           now.Add(abusePenalty),
+		Requests:        ac.requests,
+		DistinctModules: len(ac.modulePaths),
+		ListRatio:       listRatio,
+		ErrorRatio:      errorRatio,
+	}
+	abuseDecisions[clientIP] = ad
+	delete(abuseClients, clientIP)
+
+	base.Logger.Warn().
+		Str("client_ip", clientIP).
+		Str("reason", ad.Reason).
+		Str("action", ad.Action).
+		Time("until", ad.Until).
+		Int("requests", ad.Requests).
+		Int("distinct_modules", ad.DistinctModules).
+		Float64("list_ratio", ad.ListRatio).
+		Float64("error_ratio", ad.ErrorRatio).
+		Msg("detected abusive crawling")
+}
+
+// pruneAbuseClients removes the expired observations and decisions from the
+// `abuseClients` and the `abuseDecisions`.
+func pruneAbuseClients() {
+	abuseMutex.Lock()
+	defer abuseMutex.Unlock()
+
+	now := time.Now()
+	for clientIP, ac := range abuseClients {
+		if now.Sub(ac.windowStart) > abuseWindow {
+			delete(abuseClients, clientIP)
+		}
+	}
+
+	for clientIP, ad := range abuseDecisions {
+		if now.After(ad.Until) {
+			delete(abuseDecisions, clientIP)
+		}
+	}
+}
+
+// hAdminAbuse handles requests to list the active decisions on the abusive
+// client IPs made by the current instance.
+func hAdminAbuse(req *air.Request, res *air.Response) error {
+	abuseMutex.Lock()
+	defer abuseMutex.Unlock()
+
+	now := time.Now()
+	ads := make([]abuseDecision, 0, len(abuseDecisions))
+	for _, ad := range abuseDecisions {
+		if now.Before(ad.Until) {
+			ads = append(ads, *ad)
+		}
+	}
+
+	sort.Slice(ads, func(i, j int) bool {
+		return ads[i].DecidedAt.After(ads[j].DecidedAt)
+	})
+
+	return res.WriteJSON(ads)
+}
+
+// hAdminPardonAbuse handles requests to lift the decision on an abusive client
+// IP made by the current instance.
+func hAdminPardonAbuse(req *air.Request, res *air.Response) error {
+	var clientIP string
+	if p := req.Param("ip"); p != nil {
+		clientIP = p.Value().String()
+	}
+
+	abuseMutex.Lock()
+	_, ok := abuseDecisions[clientIP]
+	delete(abuseDecisions, clientIP)
+	delete(abuseClients, clientIP)
+	abuseMutex.Unlock()
+
+	if !ok {
+		return NotFound(req, res)
+	}
+
+	base.Logger.Info().
+		Str("client_ip", clientIP).
+		Str("client_address", req.ClientAddress()).
+		Msg("pardoned abusive client")
+
+	res.Status = http.StatusNoContent
+
+	return res.Write(nil)
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/air-gases/logger"
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/rs/zerolog"
+)
+
+var (
+	// accessLogViper is used to get the configuration items of the access
+	// log.
+	accessLogViper = base.Viper.Sub("access_log")
+
+	// accessLogEnabled indicates whether the access log is enabled.
+	accessLogEnabled = accessLogViper.GetBool("enabled")
+
+	// accessLogFormat is the format of the access log, which is "json" or
+	// "clf".
+	accessLogFormat = accessLogViper.GetString("format")
+
+	// accessLogWriter is where the access log is written to.
+	accessLogWriter io.Writer
+
+	// accessLogger is the logger that writes the JSON access log to the
+	// `accessLogWriter`.
+	accessLogger zerolog.Logger
+
+	// accessLogMutex is used to serialize the writes to the
+	// `accessLogWriter`.
+	accessLogMutex sync.Mutex
+)
+
+func init() {
+	if !accessLogEnabled {
+		return
+	}
+
+	switch accessLogFormat {
+	case "json", "clf":
+	default:
+		base.Logger.Fatal().
+			Str("format", accessLogFormat).
+			Msg("unsupported access log format")
+	}
+
+	switch output := accessLogViper.GetString("output"); output {
+	case "", "stdout":
+		accessLogWriter = os.Stdout
+	case "stderr":
+		accessLogWriter = os.Stderr
+	default:
+		file, err := os.OpenFile(
+			output,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+			0o644,
+		)
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to open access log file")
+		}
+
+		accessLogWriter = file
+		base.Air.AddShutdownJob(func() {
+			file.Close()
+		})
+	}
+
+	accessLogger = zerolog.New(accessLogWriter)
+}
+
+// AccessLogGas is used to log every request. It writes one structured record
+// per request to the access log when the access log is enabled, otherwise it
+// logs the requests with the `base.Logger`.
+func AccessLogGas(next air.Handler) air.Handler {
+	if !accessLogEnabled {
+		return func(req *air.Request, res *air.Response) error {
+			requestLogger := base.Logger.With().
+				Str("request_id", requestIDOf(req.Context)).
+				Logger()
+			return logger.Gas(logger.GasConfig{
+				Logger:               &requestLogger,
+				IncludeClientAddress: true,
+			})(next)(req, res)
+		}
+	}
+
+	return func(req *air.Request, res *air.Response) error {
+		startTime := time.Now()
+		res.Defer(func() {
+			writeAccessLog(
+				req,
+				res,
+				startTime,
+				loadCacheOutcome(req.Context),
+			)
+		})
+
+		return next(req, res)
+	}
+}
+
+// writeAccessLog writes the access log record of the req.
+func writeAccessLog(
+	req *air.Request,
+	res *air.Response,
+	startTime time.Time,
+	outcome string,
+) {
+	duration := time.Since(startTime)
+	bytesOut := res.ContentLength
+	if bytesOut < 0 {
+		bytesOut = 0
+	}
+
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+
+	if accessLogFormat == "clf" {
+		// The Common Log Format followed by the cache outcome, the
+		// redirect target, the duration in milliseconds and the
+		// request ID.
+		fmt.Fprintf(
+			accessLogWriter,
+			"%s - - [%s] %q %d %d %q %q %d %s\n",
+			req.ClientHost(),
+			startTime.Format("02/Jan/2006:15:04:05 -0700"),
+			fmt.Sprint(
+				req.Method,
+				" ",
+				req.Path,
+				" ",
+				req.HTTPRequest().Proto,
+			),
+			res.Status,
+			bytesOut,
+			accessLogValue(outcome),
+			accessLogValue(res.Header.Get("Location")),
+			duration.Milliseconds(),
+			accessLogValue(requestIDOf(req.Context)),
+		)
+
+		return
+	}
+
+	accessLogger.Log().
+		Time("time", startTime).
+		Str("client_ip", req.ClientHost()).
+		Str("method", req.Method).
+		Str("path", req.Path).
+		Int("status", res.Status).
+		Int64("bytes", bytesOut).
+		Dur("duration", duration).
+		Str("cache", outcome).
+		Str("redirect", res.Header.Get("Location")).
+		Str("user_agent", req.Header.Get("User-Agent")).
+		Str("request_id", requestIDOf(req.Context)).
+		Send()
+}
+
+// accessLogValue returns the s, or "-" if the s is empty.
+func accessLogValue(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "-"
+	}
+
+	return s
+}
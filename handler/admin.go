@@ -0,0 +1,337 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/mod/module"
+)
+
+var (
+	// adminViper is used to get the configuration items of the admin API.
+	adminViper = base.Viper.Sub("admin")
+
+	// adminToken is the bearer token required by the admin API.
+	adminToken = adminViper.GetString("token")
+
+	// adminEnabled indicates whether the admin API is enabled. It is enabled
+	// when the `adminToken` is set or the API token authentication is
+	// enabled, in which case the API tokens with the "admin" scope are also
+	// accepted.
+	adminEnabled = adminToken != "" || authEnabled
+)
+
+func init() {
+	if !adminEnabled {
+		return
+	}
+
+	base.Air.DELETE(
+		"/admin/cache/*",
+		hAdminPurgeCache,
+		adminGas,
+		maintenanceGas,
+	)
+	base.Air.POST(
+		"/admin/refetch",
+		hAdminRefetch,
+		adminGas,
+		maintenanceGas,
+	)
+	base.Air.GET("/admin/uploads", hAdminUploads, adminGas, globalAdminGas)
+	base.Air.GET("/admin/stats", hAdminStats, adminGas, globalAdminGas)
+}
+
+// adminGas is used to authenticate requests to the admin API. The requests
+// other than the GET and HEAD are recorded to the audit log.
+func adminGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		actor, ok := authenticateAdmin(req.HTTPRequest())
+		if !ok {
+			res.Status = http.StatusUnauthorized
+			res.Header.Set("WWW-Authenticate", `Bearer realm="admin"`)
+			return errors.New(strings.ToLower(
+				http.StatusText(res.Status),
+			))
+		}
+
+		// The admins authenticated with the API tokens of tenants are
+		// confined to the namespaces of their tenants.
+		req.Context = withTenant(
+			req.Context,
+			adminTenantOf(req.HTTPRequest()),
+		)
+
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			res.Defer(func() {
+				recordAuditEntry(req, res, actor)
+			})
+		}
+
+		return next(req, res)
+	}
+}
+
+// globalAdminGas is used to reject the requests of the admins confined to a
+// tenant to the admin API that is not scoped to a tenant, since it affects or
+// reveals all the tenants. It must come after the `adminGas`.
+func globalAdminGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if tenantOf(req.Context) != "" {
+			res.Status = http.StatusForbidden
+			return errors.New("forbidden")
+		}
+
+		return next(req, res)
+	}
+}
+
+// authenticateAdmin returns the actor of the req if it presents the
+// `adminToken` or an API token with the "admin" scope. The actor is "admin"
+// for the former and "token:" followed by the name of the API token for the
+// latter. It reports false if the req is not authenticated.
+func authenticateAdmin(req *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(
+		req.Header.Get("Authorization"),
+		"Bearer ",
+	)
+	if ok && adminToken != "" && subtle.ConstantTimeCompare(
+		[]byte(token),
+		[]byte(adminToken),
+	) == 1 {
+		return "admin", true
+	}
+
+	if at, ok := lookupAuthToken(req); ok && at.hasScope("admin") {
+		return "token:" + at.Name, true
+	}
+
+	return "", false
+}
+
+// adminTenantOf returns the tenant that the admin authenticated by the req is
+// confined to, or an empty string if there is none.
+func adminTenantOf(req *http.Request) string {
+	if at, ok := lookupAuthToken(req); ok && at.hasScope("admin") {
+		return at.Tenant
+	}
+
+	return ""
+}
+
+// hAdminPurgeCache handles requests to purge a Goproxy cache. The purge is
+// scoped to the namespace of a tenant if the "tenant" param is set, and is a
+// soft purge (see the `softPurgeGoproxyCache`) if the "soft" param is true.
+func hAdminPurgeCache(req *air.Request, res *air.Response) error {
+	name, err := url.PathUnescape(req.ParamValue("*").String())
+	if err != nil || strings.HasSuffix(name, "/") {
+		return NotFound(req, res)
+	}
+
+	if strings.Contains(name, "..") {
+		for _, part := range strings.Split(name, "/") {
+			if part == ".." {
+				return NotFound(req, res)
+			}
+		}
+	}
+
+	name = strings.TrimPrefix(path.Clean(name), "/")
+	if !validGoproxyCacheName(name) && !validGoproxyMutableCacheName(name) {
+		return NotFound(req, res)
+	}
+
+	tenant, err := tenantOfPurge(req, res)
+	if err != nil {
+		return err
+	}
+
+	if p := req.Param("soft"); p != nil {
+		if soft, _ := p.Value().Bool(); soft {
+			if err := softPurgeGoproxyCache(
+				withTenant(req.Context, tenant),
+				name,
+			); err != nil {
+				return err
+			}
+
+			base.Logger.Info().
+				Str("name", name).
+				Str("tenant", tenant).
+				Str("client_address", req.ClientAddress()).
+				Msg("soft-purged goproxy cache")
+
+			res.Status = http.StatusNoContent
+
+			return res.Write(nil)
+		}
+	}
+
+	if err := purgeGoproxyCache(
+		withTenant(req.Context, tenant),
+		name,
+	); err != nil {
+		return err
+	}
+
+	base.Logger.Info().
+		Str("name", name).
+		Str("tenant", tenant).
+		Str("client_address", req.ClientAddress()).
+		Msg("purged goproxy cache")
+
+	res.Status = http.StatusNoContent
+
+	return res.Write(nil)
+}
+
+// hAdminRefetch handles requests to force re-fetch a module version.
+func hAdminRefetch(req *air.Request, res *air.Response) error {
+	var modAtVer string
+	if p := req.Param("module"); p != nil {
+		modAtVer = p.Value().String()
+	}
+
+	modulePath, moduleVersion, found := strings.Cut(modAtVer, "@")
+	if !found || module.Check(modulePath, moduleVersion) != nil {
+		res.Status = http.StatusBadRequest
+		return errors.New("invalid module version")
+	}
+
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return err
+	}
+
+	escapedModuleVersion, err := module.EscapeVersion(moduleVersion)
+	if err != nil {
+		return err
+	}
+
+	// The Goproxy caches are refetched as if they were not cached, and
+	// only overwrite the cached ones once the Goproxy has fetched and
+	// verified them, so nothing is lost if the upstreams fail.
+	ctx, cancel := withGoproxyFetchTimeout(
+		withGoproxyCacheRefetch(req.Context),
+		"zip",
+	)
+	defer cancel()
+
+	names := make([]string, 0, 3)
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		name := fmt.Sprint(
+			escapedModulePath,
+			"/@v/",
+			escapedModuleVersion,
+			ext,
+		)
+
+		purgeNegativeCacheEntries(name)
+		if err := serveGoproxyInternally(
+			ctx,
+			&internalResponseWriter{discard: true},
+			name,
+		); err != nil {
+			res.Status = http.StatusBadGateway
+			return err
+		}
+
+		names = append(names, name)
+	}
+
+	for _, name := range names {
+		objectName := goproxyCacheObjectName(ctx, name)
+		invalidateRedirectCache(objectName)
+		invalidateStatCache(objectName)
+	}
+
+	base.Logger.Info().
+		Str("module", modAtVer).
+		Str("client_address", req.ClientAddress()).
+		Msg("refetched module version")
+
+	return res.WriteJSON(map[string]any{
+		"module":  modulePath,
+		"version": moduleVersion,
+		"files":   names,
+	})
+}
+
+// hAdminUploads handles requests to list the in-flight Goproxy cache puts.
+func hAdminUploads(req *air.Request, res *air.Response) error {
+	names := inflightGoproxyCachePutNames()
+	return res.WriteJSON(map[string]any{
+		"count": len(names),
+		"names": names,
+	})
+}
+
+// hAdminStats handles requests to get the runtime statistics published by the
+// `expvar`.
+func hAdminStats(req *air.Request, res *air.Response) error {
+	expvar.Handler().ServeHTTP(res.HTTPResponseWriter(), req.HTTPRequest())
+	return nil
+}
+
+// purgeGoproxyCache removes the Goproxy cache with the name from everywhere it
+// may reside. Only the namespace of the tenant carried by the ctx is purged.
+func purgeGoproxyCache(ctx context.Context, name string) error {
+	purgeNegativeCacheEntries(name)
+
+	name = goproxyCacheObjectName(ctx, name)
+	invalidateRedirectCache(name)
+	invalidateStatCache(name)
+	invalidateMutableCache(name)
+
+	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) error {
+		return qiniuKodoClient.RemoveObject(
+			ctx,
+			qiniuKodoBucketName,
+			name,
+			minio.RemoveObjectOptions{},
+		)
+	}); err != nil && !isNotFoundMinIOError(err) {
+		return err
+	}
+
+	for _, r := range replicas {
+		if err := retryQiniuKodoDo(ctx, func(ctx context.Context) error {
+			return r.client.RemoveObject(
+				ctx,
+				r.BucketName,
+				name,
+				minio.RemoveObjectOptions{},
+			)
+		}); err != nil && !isNotFoundMinIOError(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validGoproxyMutableCacheName reports whether the name is a valid Goproxy
+// cache name of the mutable endpoints, which are "/@v/list" and "/@latest".
+func validGoproxyMutableCacheName(name string) bool {
+	escapedModulePath, found := strings.CutSuffix(name, "/@v/list")
+	if !found {
+		escapedModulePath, found = strings.CutSuffix(name, "/@latest")
+		if !found {
+			return false
+		}
+	}
+
+	_, err := module.UnescapePath(escapedModulePath)
+
+	return err == nil
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/spf13/viper"
+	"golang.org/x/mod/module"
+)
+
+var (
+	// allowlistEnabled indicates whether the allow-list mode is on, in
+	// which only the modules matching the `allowlistPatterns` can be
+	// fetched and cached.
+	allowlistEnabled bool
+
+	// allowlistPatterns is the module patterns allowed by the
+	// configuration. They are in the same form as the blocked module
+	// patterns.
+	allowlistPatterns []string
+
+	// allowlistMutex is used to protect the `allowlistEnabled` and the
+	// `allowlistPatterns`.
+	allowlistMutex sync.RWMutex
+)
+
+func init() {
+	if err := loadAllowlistConfig(goproxyViper); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to load allowlist configuration")
+	}
+}
+
+// loadAllowlistConfig loads the `allowlistEnabled` and the `allowlistPatterns`
+// from the v.
+func loadAllowlistConfig(v *viper.Viper) error {
+	patterns := v.GetStringSlice("allowed_modules")
+	for _, pattern := range patterns {
+		if !validBlocklistPattern(pattern) {
+			return fmt.Errorf(
+				"invalid allowed module pattern: %q",
+				pattern,
+			)
+		}
+	}
+
+	allowlistMutex.Lock()
+	allowlistEnabled = v.GetBool("allowlist_enabled")
+	allowlistPatterns = patterns
+	allowlistMutex.Unlock()
+
+	return nil
+}
+
+// isModuleAllowed reports whether the module version targeted by the
+// modulePath and the moduleVersion is allowed. The moduleVersion may be empty,
+// in which case the patterns with versions also allow the module path.
+func isModuleAllowed(modulePath, moduleVersion string) bool {
+	allowlistMutex.RLock()
+	defer allowlistMutex.RUnlock()
+
+	if !allowlistEnabled {
+		return true
+	}
+
+	for _, pattern := range allowlistPatterns {
+		pathPattern, version, found := strings.Cut(pattern, "@")
+		if found && moduleVersion != "" && version != moduleVersion {
+			continue
+		}
+
+		if module.MatchPrefixPatterns(pathPattern, modulePath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isGoproxyCacheAllowed reports whether the Goproxy cache with the name belongs
+// to an allowed module version. The Goproxy caches not belonging to any module,
+// such as those of the checksum databases, are always allowed.
+func isGoproxyCacheAllowed(name string) bool {
+	modulePath, moduleVersion, ok := parseGoproxyCacheName(name)
+	return !ok || isModuleAllowed(modulePath, moduleVersion)
+}
@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// cachedModuleVersion is a cached version of a module.
+type cachedModuleVersion struct {
+	Version   string    `json:"version"`
+	CachedAt  time.Time `json:"cached_at"`
+	Size      int64     `json:"size"`
+	ZipCached bool      `json:"zip_cached"`
+	ZipOnCDN  bool      `json:"zip_on_cdn"`
+}
+
+func init() {
+	base.Air.BATCH(
+		getHeadMethods,
+		"/api/modules/*",
+		hAPIModules,
+		authGas("proxy"),
+		minutelyCachemanGas,
+	)
+}
+
+// moduleVersionInfo is the .info file of a module version.
+type moduleVersionInfo struct {
+	Version string          `json:"Version"`
+	Time    time.Time       `json:"Time"`
+	Origin  json.RawMessage `json:"Origin,omitempty"`
+}
+
+// moduleRetraction is a retraction of a module.
+type moduleRetraction struct {
+	Low       string `json:"low"`
+	High      string `json:"high"`
+	Rationale string `json:"rationale,omitempty"`
+}
+
+// hAPIModules handles requests to the module API, which serves the metadata of
+// a module at "/api/modules/{module}" and its cached versions at
+// "/api/modules/{module}/versions".
+func hAPIModules(req *air.Request, res *air.Response) error {
+	name, err := url.PathUnescape(req.ParamValue("*").String())
+	if err != nil || strings.HasSuffix(name, "/") {
+		return CacheableNotFound(req, res, 86400)
+	}
+
+	if strings.Contains(name, "..") {
+		for _, part := range strings.Split(name, "/") {
+			if part == ".." {
+				return CacheableNotFound(req, res, 86400)
+			}
+		}
+	}
+
+	name = strings.TrimPrefix(path.Clean(name), "/")
+
+	modulePath, versions := strings.CutSuffix(name, "/versions")
+	if !versions || module.CheckPath(modulePath) != nil {
+		modulePath, versions = name, false
+	}
+
+	if module.CheckPath(modulePath) != nil ||
+		isModuleBlocked(modulePath, "") {
+		return CacheableNotFound(req, res, 60)
+	}
+
+	cmvs, err := listCachedModuleVersions(req.Context, modulePath)
+	if err != nil {
+		return err
+	}
+
+	if len(cmvs) == 0 {
+		return CacheableNotFound(req, res, 60)
+	}
+
+	if versions {
+		return res.WriteJSON(map[string]any{
+			"module_path": modulePath,
+			"versions":    cmvs,
+		})
+	}
+
+	return hAPIModule(req, res, modulePath, cmvs)
+}
+
+// hAPIModule handles requests to get the metadata of the module targeted by
+// the modulePath that has the cmvs cached. Like the go command, the
+// retractions and the deprecation are taken from the go.mod file of the
+// highest version, and the latest version is the highest one not retracted.
+func hAPIModule(
+	req *air.Request,
+	res *air.Response,
+	modulePath string,
+	cmvs []*cachedModuleVersion,
+) error {
+	highestVersion := ""
+	for _, cmv := range cmvs {
+		if compareSearchVersions(cmv.Version, highestVersion) > 0 {
+			highestVersion = cmv.Version
+		}
+	}
+
+	var (
+		retractions []moduleRetraction
+		deprecated  string
+	)
+
+	if f, err := loadModuleModFile(req.Context, module.Version{
+		Path:    modulePath,
+		Version: highestVersion,
+	}); err == nil {
+		for _, r := range f.Retract {
+			retractions = append(retractions, moduleRetraction{
+				Low:       r.Low,
+				High:      r.High,
+				Rationale: r.Rationale,
+			})
+		}
+
+		if f.Module != nil {
+			deprecated = f.Module.Deprecated
+		}
+	}
+
+	retractedVersions := []string{}
+	latestVersion := ""
+	for _, cmv := range cmvs {
+		retracted := false
+		for _, r := range retractions {
+			if semver.Compare(cmv.Version, r.Low) >= 0 &&
+				semver.Compare(cmv.Version, r.High) <= 0 {
+				retracted = true
+				break
+			}
+		}
+
+		if retracted {
+			retractedVersions = append(
+				retractedVersions,
+				cmv.Version,
+			)
+		} else if compareSearchVersions(cmv.Version, latestVersion) > 0 {
+			latestVersion = cmv.Version
+		}
+	}
+
+	if latestVersion == "" {
+		latestVersion = highestVersion
+	}
+
+	latest, err := loadModuleVersionInfo(req.Context, module.Version{
+		Path:    modulePath,
+		Version: latestVersion,
+	})
+	if err != nil {
+		if !isNotFoundMinIOError(err) {
+			return err
+		}
+
+		latest = &moduleVersionInfo{Version: latestVersion}
+	}
+
+	if retractions == nil {
+		retractions = []moduleRetraction{}
+	}
+
+	return res.WriteJSON(map[string]any{
+		"module_path":        modulePath,
+		"latest":             latest,
+		"deprecated":         deprecated,
+		"retractions":        retractions,
+		"retracted_versions": retractedVersions,
+		"version_count":      len(cmvs),
+	})
+}
+
+// loadModuleVersionInfo returns the parsed .info file of the mv from the
+// Goproxy caches.
+func loadModuleVersionInfo(
+	ctx context.Context,
+	mv module.Version,
+) (*moduleVersionInfo, error) {
+	name, err := goproxyCacheNameOf(mv, ".info")
+	if err != nil {
+		return nil, err
+	}
+
+	object, _, err := getGoproxyCacheObject(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	var mvi moduleVersionInfo
+	if err := json.NewDecoder(object).Decode(&mvi); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return &mvi, nil
+}
+
+// listCachedModuleVersions returns the cached versions of the module targeted
+// by the modulePath in semver order. A version is considered cached once its
+// .info file is cached, and the blocked versions are omitted.
+func listCachedModuleVersions(
+	ctx context.Context,
+	modulePath string,
+) ([]*cachedModuleVersion, error) {
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return nil, nil
+	}
+
+	autoRedirectMinSize, autoRedirect := (*goproxyAutoRedirectMinSizes.
+		Load())[".zip"]
+	autoRedirect = autoRedirect && goproxyAutoRedirect.Load()
+
+	cmvs := map[string]*cachedModuleVersion{}
+	zipSizes := map[string]int64{}
+	for objectInfo := range qiniuKodoClient.ListObjects(
+		ctx,
+		qiniuKodoBucketName,
+		minio.ListObjectsOptions{
+			Prefix: escapedModulePath + "/@v/",
+		},
+	) {
+		if objectInfo.Err != nil {
+			return nil, objectInfo.Err
+		}
+
+		_, moduleVersion, ok := parseGoproxyCacheName(objectInfo.Key)
+		if !ok ||
+			!semver.IsValid(moduleVersion) ||
+			isModuleBlocked(modulePath, moduleVersion) {
+			continue
+		}
+
+		switch path.Ext(objectInfo.Key) {
+		case ".info":
+			cmvs[moduleVersion] = &cachedModuleVersion{
+				Version:  moduleVersion,
+				CachedAt: objectInfo.LastModified.UTC(),
+			}
+		case ".zip":
+			zipSizes[moduleVersion] = objectInfo.Size
+		}
+	}
+
+	versions := make([]string, 0, len(cmvs))
+	for moduleVersion, cmv := range cmvs {
+		if size, ok := zipSizes[moduleVersion]; ok {
+			cmv.Size = size
+			cmv.ZipCached = true
+			cmv.ZipOnCDN = autoRedirect && size >= autoRedirectMinSize
+		}
+
+		versions = append(versions, moduleVersion)
+	}
+
+	semver.Sort(versions)
+
+	sorted := make([]*cachedModuleVersion, 0, len(versions))
+	for _, moduleVersion := range versions {
+		sorted = append(sorted, cmvs[moduleVersion])
+	}
+
+	return sorted, nil
+}
@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+)
+
+// auditPrefix is the prefix of the objects where the audit log entries are
+// stored in the Qiniu Cloud Kodo. Each entry is stored as its own object that
+// is never overwritten, so that the audit log is append-only.
+const auditPrefix = "audit/"
+
+// auditEntry is an entry of the audit log.
+type auditEntry struct {
+	Time          time.Time         `json:"time"`
+	Actor         string            `json:"actor"`
+	Action        string            `json:"action"`
+	Params        map[string]string `json:"params,omitempty"`
+	Status        int               `json:"status,omitempty"`
+	ClientAddress string            `json:"client_address,omitempty"`
+	RequestID     string            `json:"request_id,omitempty"`
+	Instance      string            `json:"instance"`
+}
+
+func init() {
+	base.OnConfigReload(func() {
+		putAuditEntry(&auditEntry{
+			Time:   time.Now().UTC(),
+			Actor:  "system",
+			Action: "reload config",
+		})
+	})
+
+	if !adminEnabled {
+		return
+	}
+
+	base.Air.GET("/admin/audit", hAdminAudit, adminGas, globalAdminGas)
+}
+
+// auditRedactedParams is the names of the params that are secrets, which are
+// redacted from the audit log.
+var auditRedactedParams = []string{"secret_key", "session_token"}
+
+// recordAuditEntry records the admin API call of the req made by the actor and
+// responded with the res to the audit log.
+func recordAuditEntry(req *air.Request, res *air.Response, actor string) {
+	params := map[string]string{}
+	for _, p := range req.Params() {
+		if v := p.Value(); v != nil {
+			params[p.Name] = v.String()
+		}
+	}
+
+	for _, name := range auditRedactedParams {
+		if _, ok := params[name]; ok {
+			params[name] = "REDACTED"
+		}
+	}
+
+	putAuditEntry(&auditEntry{
+		Time:          time.Now().UTC(),
+		Actor:         actor,
+		Action:        req.Method + " " + req.RawPath(),
+		Params:        params,
+		Status:        res.Status,
+		ClientAddress: req.ClientAddress(),
+		RequestID:     requestIDOf(req.Context),
+	})
+}
+
+// putAuditEntry puts the ae to the audit log in the Qiniu Cloud Kodo. It is
+// also logged with the `base.Logger`, so that it is never lost.
+func putAuditEntry(ae *auditEntry) {
+	ae.Instance = leaderID
+
+	base.Logger.Info().
+		Str("actor", ae.Actor).
+		Str("action", ae.Action).
+		Interface("params", ae.Params).
+		Int("status", ae.Status).
+		Str("client_address", ae.ClientAddress).
+		Str("request_id", ae.RequestID).
+		Msg("audit")
+
+	if maintenanceMode.Load() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := putStatObject(ctx, auditObjectName(ae), ae); err != nil {
+		base.Logger.Error().Err(err).
+			Str("actor", ae.Actor).
+			Str("action", ae.Action).
+			Msg("failed to put audit entry")
+	}
+}
+
+// auditObjectName returns the name of the object where the ae is stored in the
+// Qiniu Cloud Kodo. The names sort in the order of the entry times.
+func auditObjectName(ae *auditEntry) string {
+	return auditPrefix + path.Join(
+		ae.Time.Format("2006-01-02"),
+		fmt.Sprintf("%019d-%s", ae.Time.UnixNano(), ae.Instance),
+	)
+}
+
+// hAdminAudit handles requests to query the audit log entries of a day, which
+// is today (UTC) unless the "date" param is set in the form of "2006-01-02".
+// The entries are sorted from the newest to the oldest, and up to the "limit"
+// param (default 1000) of them are returned.
+func hAdminAudit(req *air.Request, res *air.Response) error {
+	date := time.Now().UTC().Format("2006-01-02")
+	if p := req.Param("date"); p != nil {
+		date = p.Value().String()
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			res.Status = http.StatusBadRequest
+			return errors.New("invalid date")
+		}
+	}
+
+	limit := 1000
+	if p := req.Param("limit"); p != nil {
+		n, err := strconv.Atoi(p.Value().String())
+		if err != nil || n < 1 {
+			res.Status = http.StatusBadRequest
+			return errors.New("invalid limit")
+		}
+
+		limit = n
+	}
+
+	var names []string
+	for objectInfo := range qiniuKodoClient.ListObjects(
+		req.Context,
+		qiniuKodoBucketName,
+		minio.ListObjectsOptions{
+			Prefix: auditPrefix + date + "/",
+		},
+	) {
+		if objectInfo.Err != nil {
+			return objectInfo.Err
+		}
+
+		names = append(names, objectInfo.Key)
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	if len(names) > limit {
+		names = names[:limit]
+	}
+
+	aes := make([]auditEntry, 0, len(names))
+	for _, name := range names {
+		var ae auditEntry
+		if err := getStatObject(req.Context, name, &ae); err != nil {
+			if isNotFoundMinIOError(err) {
+				continue
+			}
+
+			return err
+		}
+
+		aes = append(aes, ae)
+	}
+
+	return res.WriteJSON(aes)
+}
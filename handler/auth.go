@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// authViper is used to get the configuration items of the API token
+	// authentication.
+	authViper = base.Viper.Sub("auth")
+
+	// authEnabled indicates whether the API token authentication is
+	// enabled. When it is enabled, requests to the Goproxy must present an
+	// API token with the "proxy" scope.
+	authEnabled = authViper.GetBool("enabled")
+
+	// authTokenStore is the store of the API tokens, which is either
+	// "config" or "kodo".
+	authTokenStore = authViper.GetString("token_store")
+
+	// authTokens is the API tokens.
+	authTokens []authToken
+
+	// authTokensMutex is used to protect the `authTokens`.
+	authTokensMutex sync.RWMutex
+)
+
+// authTokensObjectName is the name of the object that stores the API tokens in
+// the Qiniu Cloud Kodo.
+const authTokensObjectName = "auth/tokens"
+
+// authToken is an API token.
+type authToken struct {
+	Name   string   `json:"name" mapstructure:"name"`
+	SHA256 string   `json:"sha256" mapstructure:"sha256"`
+	Scopes []string `json:"scopes" mapstructure:"scopes"`
+
+	// QuotaRequests and QuotaBytes are the maximum number of the requests
+	// and the maximum bytes served within each quota window. There is no
+	// limit when they are not positive.
+	QuotaRequests int64 `json:"quota_requests,omitempty" mapstructure:"quota_requests"`
+	QuotaBytes    int64 `json:"quota_bytes,omitempty" mapstructure:"quota_bytes"`
+
+	// QuotaWindow is the length of the quota windows, such as "1h". The
+	// `authQuotaWindow` is used when it is empty.
+	QuotaWindow string `json:"quota_window,omitempty" mapstructure:"quota_window"`
+
+	// Tenant is the tenant of the API token. The Goproxy caches fetched
+	// with it are stored in the namespace of the tenant, and the admins
+	// authenticated with it are confined to that namespace.
+	Tenant string `json:"tenant,omitempty" mapstructure:"tenant"`
+}
+
+// hasScope reports whether the at has the scope.
+func (at authToken) hasScope(scope string) bool {
+	for _, s := range at.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func init() {
+	if !authEnabled {
+		return
+	}
+
+	switch authTokenStore {
+	case "config":
+		if err := authViper.UnmarshalKey("tokens", &authTokens); err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to unmarshal auth tokens")
+		}
+
+		if err := checkAuthTokens(authTokens); err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("invalid auth tokens")
+		}
+	case "kodo":
+		if err := loadAuthTokens(base.Context); err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to load auth tokens")
+		}
+
+		if _, err := base.Cron.AddFunc(
+			"* * * * *", // Every minute
+			func() {
+				if err := loadAuthTokens(
+					base.Context,
+				); err != nil {
+					base.Logger.Error().Err(err).
+						Msg("failed to load auth tokens")
+				}
+			},
+		); err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to add auth token load cron job")
+		}
+	default:
+		base.Logger.Fatal().
+			Str("token_store", authTokenStore).
+			Msg("unsupported auth token store")
+	}
+}
+
+// loadAuthTokens loads the `authTokens` from the Qiniu Cloud Kodo.
+func loadAuthTokens(ctx context.Context) error {
+	var tokens []authToken
+	if err := getStatObject(
+		ctx,
+		authTokensObjectName,
+		&tokens,
+	); err != nil && !isNotFoundMinIOError(err) {
+		return err
+	}
+
+	if err := checkAuthTokens(tokens); err != nil {
+		return err
+	}
+
+	authTokensMutex.Lock()
+	authTokens = tokens
+	authTokensMutex.Unlock()
+
+	return nil
+}
+
+// checkAuthTokens checks whether the tokens are valid.
+func checkAuthTokens(tokens []authToken) error {
+	for _, at := range tokens {
+		if at.Tenant != "" && !validTenantName(at.Tenant) {
+			return fmt.Errorf(
+				"invalid tenant %q of auth token %q",
+				at.Tenant,
+				at.Name,
+			)
+		}
+	}
+
+	return nil
+}
+
+// authGas returns an `air.Gas` that is used to authenticate requests with the
+// API tokens that have the scope. It does nothing if the API token
+// authentication is disabled.
+func authGas(scope string) air.Gas {
+	return func(next air.Handler) air.Handler {
+		return func(req *air.Request, res *air.Response) error {
+			if !authEnabled {
+				return next(req, res)
+			}
+
+			at, ok := lookupAuthToken(req.HTTPRequest())
+			if !ok || !at.hasScope(scope) {
+				res.Status = http.StatusUnauthorized
+				res.Header.Set(
+					"WWW-Authenticate",
+					`Basic realm="goproxy"`,
+				)
+				return errors.New(strings.ToLower(
+					http.StatusText(res.Status),
+				))
+			}
+
+			if wait := takeAuthQuota(at, time.Now()); wait > 0 {
+				res.Status = http.StatusTooManyRequests
+				res.Header.Set("Retry-After", strconv.Itoa(int(
+					math.Ceil(wait.Seconds()),
+				)))
+				return errors.New("quota exceeded")
+			}
+
+			req.Context = withTenant(req.Context, at.Tenant)
+			res.Defer(func() {
+				if res.ContentLength > 0 {
+					addAuthUsageBytes(
+						at,
+						time.Now(),
+						res.ContentLength,
+					)
+				}
+			})
+
+			return next(req, res)
+		}
+	}
+}
+
+// lookupAuthToken returns the API token presented by the req. The API token can
+// be presented as a bearer token or as the password of the basic
+// authentication, the latter is what the Go command sends for the credentials
+// in the .netrc file. It reports false if there is none or the API token
+// authentication is disabled.
+func lookupAuthToken(req *http.Request) (authToken, bool) {
+	if !authEnabled {
+		return authToken{}, false
+	}
+
+	token, ok := strings.CutPrefix(
+		req.Header.Get("Authorization"),
+		"Bearer ",
+	)
+	if !ok {
+		_, token, ok = req.BasicAuth()
+		if !ok {
+			return authToken{}, false
+		}
+	}
+
+	checksum := sha256.Sum256([]byte(token))
+	tokenSHA256 := []byte(hex.EncodeToString(checksum[:]))
+
+	authTokensMutex.RLock()
+	defer authTokensMutex.RUnlock()
+
+	for _, at := range authTokens {
+		if subtle.ConstantTimeCompare(
+			tokenSHA256,
+			[]byte(strings.ToLower(at.SHA256)),
+		) == 1 {
+			return at, true
+		}
+	}
+
+	return authToken{}, false
+}
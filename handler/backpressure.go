@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"expvar"
+	"sync"
+)
+
+var (
+	// cachePutBacklogMaxCount is the maximum number of the in-flight
+	// Goproxy cache puts. There is no limit when it is not positive.
+	cachePutBacklogMaxCount = goproxyViper.GetInt64("max_inflight_cache_puts")
+
+	// cachePutBacklogMaxBytes is the maximum total size of the in-flight
+	// Goproxy cache puts. There is no limit when it is not positive.
+	cachePutBacklogMaxBytes = goproxyViper.GetInt64(
+		"max_inflight_cache_put_bytes",
+	)
+
+	// cachePutBacklogCount is the number of the in-flight Goproxy cache
+	// puts.
+	cachePutBacklogCount int64
+
+	// cachePutBacklogBytes is the total size of the in-flight Goproxy cache
+	// puts.
+	cachePutBacklogBytes int64
+
+	// cachePutBacklogSkips is the number of the Goproxy cache puts skipped
+	// due to the backlog.
+	cachePutBacklogSkips int64
+
+	// cachePutBacklogMutex is used to protect the `cachePutBacklogCount`,
+	// the `cachePutBacklogBytes` and the `cachePutBacklogSkips`.
+	cachePutBacklogMutex sync.Mutex
+)
+
+func init() {
+	expvar.Publish("cache_put_backlog", expvar.Func(func() any {
+		cachePutBacklogMutex.Lock()
+		defer cachePutBacklogMutex.Unlock()
+
+		return map[string]int64{
+			"count":     cachePutBacklogCount,
+			"bytes":     cachePutBacklogBytes,
+			"skips":     cachePutBacklogSkips,
+			"max_count": cachePutBacklogMaxCount,
+			"max_bytes": cachePutBacklogMaxBytes,
+		}
+	}))
+}
+
+// acquireCachePutBacklog reserves a slot for a Goproxy cache put with the size
+// in the backlog. It reports false if the backlog is full, in which case the
+// put should be skipped so that the request can still be served from the
+// fetched content without waiting for the Qiniu Cloud Kodo. A put larger than
+// the `cachePutBacklogMaxBytes` is still accepted when the backlog is empty.
+//
+// The `releaseCachePutBacklog` must be called with the same size after a
+// successful acquisition.
+func acquireCachePutBacklog(size int64) bool {
+	cachePutBacklogMutex.Lock()
+	defer cachePutBacklogMutex.Unlock()
+
+	if (cachePutBacklogMaxCount > 0 &&
+		cachePutBacklogCount >= cachePutBacklogMaxCount) ||
+		(cachePutBacklogMaxBytes > 0 && cachePutBacklogBytes > 0 &&
+			cachePutBacklogBytes+size > cachePutBacklogMaxBytes) {
+		cachePutBacklogSkips++
+		return false
+	}
+
+	cachePutBacklogCount++
+	cachePutBacklogBytes += size
+
+	return true
+}
+
+// releaseCachePutBacklog releases the slot of a Goproxy cache put with the size
+// in the backlog.
+func releaseCachePutBacklog(size int64) {
+	cachePutBacklogMutex.Lock()
+	defer cachePutBacklogMutex.Unlock()
+
+	cachePutBacklogCount--
+	cachePutBacklogBytes -= size
+}
@@ -0,0 +1,270 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// badgeSVGTemplate is the template of the SVG badges.
+const badgeSVGTemplate = `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[2]s: %[3]s"><title>%[2]s: %[3]s</title><linearGradient id="b" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient><clipPath id="a"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath><g clip-path="url(#a)"><path fill="#555" d="M0 0h%[4]dv20H0z"/><path fill="%[5]s" d="M%[4]d 0h%[6]dv20H%[4]dz"/><path fill="url(#b)" d="M0 0h%[1]dv20H0z"/></g><g fill="#fff" text-anchor="middle" font-family="DejaVu Sans,Verdana,Geneva,sans-serif" font-size="110"><text x="%[7]d" y="150" fill="#010101" fill-opacity=".3" transform="scale(.1)" textLength="%[8]d">%[2]s</text><text x="%[7]d" y="140" transform="scale(.1)" textLength="%[8]d">%[2]s</text><text x="%[9]d" y="150" fill="#010101" fill-opacity=".3" transform="scale(.1)" textLength="%[10]d">%[3]s</text><text x="%[9]d" y="140" transform="scale(.1)" textLength="%[10]d">%[3]s</text></g></svg>`
+
+// badge is a shields.io style badge.
+type badge struct {
+	Label   string
+	Message string
+	Color   string
+}
+
+// SVG returns the SVG representation of the b.
+func (b *badge) SVG() []byte {
+	labelTextLength := badgeTextLength(b.Label)
+	messageTextLength := badgeTextLength(b.Message)
+	labelWidth := labelTextLength/10 + 10
+	messageWidth := messageTextLength/10 + 10
+
+	return []byte(fmt.Sprintf(
+		badgeSVGTemplate,
+		labelWidth+messageWidth,
+		html.EscapeString(b.Label),
+		html.EscapeString(b.Message),
+		labelWidth,
+		b.Color,
+		messageWidth,
+		labelWidth*5,
+		labelTextLength,
+		labelWidth*10+messageWidth*5,
+		messageTextLength,
+	))
+}
+
+// JSON returns the shields.io endpoint schema representation of the b. See
+// https://shields.io/endpoint.
+func (b *badge) JSON() ([]byte, error) {
+	return json.Marshal(struct {
+		SchemaVersion int    `json:"schemaVersion"`
+		Label         string `json:"label"`
+		Message       string `json:"message"`
+		Color         string `json:"color"`
+	}{1, b.Label, b.Message, strings.TrimPrefix(b.Color, "#")})
+}
+
+// badgeTextLength returns the estimated text length of the s in the SVG
+// badges. The unit is a tenth of a pixel.
+func badgeTextLength(s string) int {
+	l := 0
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune("fijlrt.,:;|!'I1 ", r):
+			l += 40
+		case strings.ContainsRune("mwMW@%", r):
+			l += 100
+		case r >= 'A' && r <= 'Z':
+			l += 75
+		default:
+			l += 65
+		}
+	}
+
+	return l
+}
+
+func init() {
+	base.Air.BATCH(
+		getHeadMethods,
+		"/badges/*",
+		hBadge,
+		authGas("proxy"),
+		hourlyCachemanGas,
+	)
+}
+
+// hBadge handles requests to get badges.
+func hBadge(req *air.Request, res *air.Response) error {
+	name, err := url.PathUnescape(req.ParamValue("*").String())
+	if err != nil || strings.HasSuffix(name, "/") {
+		return CacheableNotFound(req, res, 86400)
+	}
+
+	if strings.Contains(name, "..") {
+		for _, part := range strings.Split(name, "/") {
+			if part == ".." {
+				return CacheableNotFound(req, res, 86400)
+			}
+		}
+	}
+
+	name = strings.TrimPrefix(path.Clean(name), "/")
+
+	nameBase := path.Base(name)
+	nameExt := path.Ext(nameBase)
+	switch nameExt {
+	case ".svg", ".json":
+	default:
+		return CacheableNotFound(req, res, 86400)
+	}
+
+	modulePath := path.Dir(name)
+	if module.CheckPath(modulePath) != nil {
+		return CacheableNotFound(req, res, 86400)
+	}
+
+	var b *badge
+	switch strings.TrimSuffix(nameBase, nameExt) {
+	case "downloads":
+		var monthly bool
+		if p := req.Param("period"); p != nil {
+			switch p.Value().String() {
+			case "total":
+			case "monthly":
+				monthly = true
+			default:
+				return CacheableNotFound(req, res, 86400)
+			}
+		}
+
+		b, err = downloadsBadge(req, modulePath, monthly)
+	case "version":
+		b, err = versionBadge(req, modulePath)
+	default:
+		return CacheableNotFound(req, res, 86400)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if nameExt == ".json" {
+		badgeJSON, err := b.JSON()
+		if err != nil {
+			return err
+		}
+
+		res.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+		return res.Write(bytes.NewReader(badgeJSON))
+	}
+
+	res.Header.Set("Content-Type", "image/svg+xml")
+
+	return res.Write(bytes.NewReader(b.SVG()))
+}
+
+// downloadsBadge returns the download count badge of the module targeted by the
+// modulePath. The monthly indicates whether to use the monthly download count
+// instead of the total download count.
+func downloadsBadge(
+	req *air.Request,
+	modulePath string,
+	monthly bool,
+) (*badge, error) {
+	b := &badge{
+		Label:   "goproxy.cn",
+		Message: "unknown",
+		Color:   "#9f9f9f",
+	}
+
+	var stat moduleVersionStat
+	if err := getStatObject(
+		req.Context,
+		path.Join("stats", modulePath),
+		&stat,
+	); err != nil {
+		if isNotFoundMinIOError(err) {
+			return b, nil
+		}
+
+		return nil, err
+	}
+
+	date := time.Now().UTC()
+	stat.updateLast30Days(time.Date(
+		date.Year(),
+		date.Month(),
+		date.Day()-1,
+		0,
+		0,
+		0,
+		0,
+		time.UTC,
+	))
+
+	b.Color = "#007ec6"
+	if monthly {
+		b.Message = fmt.Sprint(
+			abbreviatedCount(int64(stat.MonthlyDownloadCount)),
+			"/month",
+		)
+	} else {
+		b.Message = fmt.Sprint(
+			abbreviatedCount(int64(stat.DownloadCount)),
+			" downloads",
+		)
+	}
+
+	return b, nil
+}
+
+// versionBadge returns the latest cached version badge of the module targeted
+// by the modulePath. The pre-release versions are only shown when no release
+// versions have been cached.
+func versionBadge(req *air.Request, modulePath string) (*badge, error) {
+	b := &badge{
+		Label:   "goproxy.cn",
+		Message: "unknown",
+		Color:   "#9f9f9f",
+	}
+
+	if isModuleBlocked(modulePath, "") {
+		return b, nil
+	}
+
+	cmvs, err := listCachedModuleVersions(req.Context, modulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	latestVersion := ""
+	for _, cmv := range cmvs {
+		if compareSearchVersions(cmv.Version, latestVersion) > 0 {
+			latestVersion = cmv.Version
+		}
+	}
+
+	if latestVersion == "" {
+		return b, nil
+	}
+
+	b.Message = latestVersion
+	b.Color = "#007ec6"
+	if semver.Prerelease(latestVersion) != "" {
+		b.Color = "#fe7d37"
+	}
+
+	return b, nil
+}
+
+// abbreviatedCount returns an abbreviated string for the n, such as "1.2k" and
+// "3.4M".
+func abbreviatedCount(n int64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fG", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fk", float64(n)/1e3)
+	}
+
+	return fmt.Sprint(n)
+}
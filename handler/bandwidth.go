@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// upstreamBandwidthLimit is the maximum number of bytes per second
+	// fetched from the upstreams. There is no limit when it is not
+	// positive.
+	upstreamBandwidthLimit = goproxyViper.GetFloat64(
+		"upstream_bandwidth_limit",
+	)
+
+	// upstreamBandwidthBurst is the maximum number of bytes fetched from
+	// the upstreams in a burst. The `upstreamBandwidthLimit` is used when
+	// it is not positive.
+	upstreamBandwidthBurst = goproxyViper.GetInt("upstream_bandwidth_burst")
+
+	// upstreamBandwidthTokens is the token bucket of the bytes fetched from
+	// the upstreams. It goes negative once the bytes are fetched faster
+	// than the `upstreamBandwidthLimit`.
+	upstreamBandwidthTokens float64
+
+	// upstreamBandwidthUpdatedAt is when the `upstreamBandwidthTokens` was
+	// last refilled.
+	upstreamBandwidthUpdatedAt time.Time
+
+	// upstreamBandwidthMutex is used to protect the
+	// `upstreamBandwidthTokens` and the `upstreamBandwidthUpdatedAt`.
+	upstreamBandwidthMutex sync.Mutex
+
+	// upstreamBandwidthThrottles is the number of the upstream reads
+	// delayed due to the `upstreamBandwidthLimit`.
+	upstreamBandwidthThrottles = expvar.NewInt(
+		"upstream_bandwidth_throttles",
+	)
+)
+
+func init() {
+	if upstreamBandwidthBurst <= 0 {
+		upstreamBandwidthBurst = int(math.Max(
+			math.Ceil(upstreamBandwidthLimit),
+			1,
+		))
+	}
+
+	upstreamBandwidthTokens = float64(upstreamBandwidthBurst)
+	upstreamBandwidthUpdatedAt = time.Now()
+}
+
+// bandwidthLimitingTransport is an `http.RoundTripper` that limits the bytes
+// per second fetched from the upstreams, so that a burst of giant module zips
+// cannot saturate the link of the server.
+//
+// Only the zip files wait for the bandwidth. The bytes of the others, such as
+// the metadata and the checksum database responses, are counted but never
+// delayed, so they are not starved by the zip files. The direct fetches by the
+// go command are not limited.
+type bandwidthLimitingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (blt *bandwidthLimitingTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	res, err := blt.next.RoundTrip(req)
+	if err != nil || upstreamBandwidthLimit <= 0 {
+		return res, err
+	}
+
+	res.Body = &bandwidthLimitedBody{
+		ReadCloser: res.Body,
+		ctx:        req.Context(),
+		wait:       strings.HasSuffix(req.URL.Path, ".zip"),
+	}
+
+	return res, nil
+}
+
+// bandwidthLimitedBody is the body of an upstream fetch response whose bytes
+// are taken from the `upstreamBandwidthTokens`.
+type bandwidthLimitedBody struct {
+	io.ReadCloser
+
+	ctx  context.Context
+	wait bool
+}
+
+// Read implements the `io.Reader`.
+func (blb *bandwidthLimitedBody) Read(b []byte) (int, error) {
+	if blb.wait && len(b) > upstreamBandwidthBurst {
+		b = b[:upstreamBandwidthBurst]
+	}
+
+	n, err := blb.ReadCloser.Read(b)
+	if n > 0 {
+		d := takeUpstreamBandwidth(n, time.Now())
+		if blb.wait && d > 0 {
+			upstreamBandwidthThrottles.Add(1)
+
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-blb.ctx.Done():
+				t.Stop()
+				return n, blb.ctx.Err()
+			}
+		}
+	}
+
+	return n, err
+}
+
+// takeUpstreamBandwidth takes the n bytes from the `upstreamBandwidthTokens` at
+// the now. It returns how long to wait until the bucket is no longer in debt.
+func takeUpstreamBandwidth(n int, now time.Time) time.Duration {
+	upstreamBandwidthMutex.Lock()
+	defer upstreamBandwidthMutex.Unlock()
+
+	upstreamBandwidthTokens = math.Min(
+		upstreamBandwidthTokens+
+			now.Sub(upstreamBandwidthUpdatedAt).Seconds()*
+				upstreamBandwidthLimit,
+		float64(upstreamBandwidthBurst),
+	)
+	upstreamBandwidthUpdatedAt = now
+
+	upstreamBandwidthTokens -= float64(n)
+	if upstreamBandwidthTokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-upstreamBandwidthTokens / upstreamBandwidthLimit *
+		float64(time.Second))
+}
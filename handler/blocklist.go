@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/spf13/viper"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+var (
+	// blocklistConfigPatterns is the module patterns blocked by the
+	// configuration.
+	blocklistConfigPatterns []string
+
+	// blocklistPatterns is the module patterns blocked by the admin API.
+	blocklistPatterns []string
+
+	// blocklistMutex is used to protect the `blocklistConfigPatterns` and
+	// the `blocklistPatterns`.
+	blocklistMutex sync.RWMutex
+)
+
+// blocklistObjectName is the name of the object that persists the module
+// patterns blocked by the admin API in the Qiniu Cloud Kodo.
+const blocklistObjectName = "blocklist"
+
+func init() {
+	if err := loadBlocklistConfig(goproxyViper); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to load blocklist configuration")
+	}
+
+	if err := loadBlocklist(base.Context); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to load blocklist")
+	}
+
+	if _, err := base.Cron.AddFunc(
+		"* * * * *", // Every minute
+		func() {
+			if err := loadBlocklist(base.Context); err != nil {
+				base.Logger.Error().Err(err).
+					Msg("failed to load blocklist")
+			}
+		},
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add blocklist load cron job")
+	}
+
+	if !adminEnabled {
+		return
+	}
+
+	base.Air.GET(
+		"/admin/blocklist",
+		hAdminBlocklist,
+		adminGas,
+		globalAdminGas,
+	)
+	base.Air.PUT(
+		"/admin/blocklist",
+		hAdminBlock,
+		adminGas,
+		globalAdminGas,
+		maintenanceGas,
+	)
+	base.Air.DELETE(
+		"/admin/blocklist",
+		hAdminUnblock,
+		adminGas,
+		globalAdminGas,
+		maintenanceGas,
+	)
+}
+
+// loadBlocklistConfig loads the `blocklistConfigPatterns` from the v.
+func loadBlocklistConfig(v *viper.Viper) error {
+	patterns := v.GetStringSlice("blocked_modules")
+	for _, pattern := range patterns {
+		if !validBlocklistPattern(pattern) {
+			return fmt.Errorf(
+				"invalid blocked module pattern: %q",
+				pattern,
+			)
+		}
+	}
+
+	blocklistMutex.Lock()
+	blocklistConfigPatterns = patterns
+	blocklistMutex.Unlock()
+
+	return nil
+}
+
+// validBlocklistPattern reports whether the pattern is a valid blocked module
+// pattern. A blocked module pattern is a glob pattern of module path prefixes
+// (see the `module.MatchPrefixPatterns`) with an optional "@<version>" suffix.
+func validBlocklistPattern(pattern string) bool {
+	pathPattern, version, found := strings.Cut(pattern, "@")
+	if pathPattern == "" || strings.Contains(pathPattern, ",") {
+		return false
+	}
+
+	return !found || semver.IsValid(version)
+}
+
+// isModuleBlocked reports whether the module version targeted by the
+// modulePath and the moduleVersion is blocked. The moduleVersion may be empty,
+// in which case only the patterns without versions are considered.
+func isModuleBlocked(modulePath, moduleVersion string) bool {
+	blocklistMutex.RLock()
+	defer blocklistMutex.RUnlock()
+
+	for _, patterns := range [][]string{
+		blocklistConfigPatterns,
+		blocklistPatterns,
+	} {
+		for _, pattern := range patterns {
+			pathPattern, version, found := strings.Cut(pattern, "@")
+			if found && version != moduleVersion {
+				continue
+			}
+
+			if module.MatchPrefixPatterns(pathPattern, modulePath) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isGoproxyCacheBlocked reports whether the Goproxy cache with the name belongs
+// to a blocked module version.
+func isGoproxyCacheBlocked(name string) bool {
+	modulePath, moduleVersion, ok := parseGoproxyCacheName(name)
+	return ok && isModuleBlocked(modulePath, moduleVersion)
+}
+
+// parseGoproxyCacheName parses the module path and the module version from the
+// Goproxy cache name. The module version is empty for the mutable endpoints.
+func parseGoproxyCacheName(name string) (string, string, bool) {
+	var (
+		escapedModulePath    string
+		escapedModuleVersion string
+	)
+
+	if p, found := strings.CutSuffix(name, "/@latest"); found {
+		escapedModulePath = p
+	} else if p, found := strings.CutSuffix(name, "/@v/list"); found {
+		escapedModulePath = p
+	} else if p, nameBase, found := strings.Cut(name, "/@v/"); found {
+		escapedModulePath = p
+		escapedModuleVersion = strings.TrimSuffix(
+			nameBase,
+			path.Ext(nameBase),
+		)
+	} else {
+		return "", "", false
+	}
+
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return "", "", false
+	}
+
+	moduleVersion, err := module.UnescapeVersion(escapedModuleVersion)
+	if err != nil {
+		return "", "", false
+	}
+
+	return modulePath, moduleVersion, true
+}
+
+// loadBlocklist loads the `blocklistPatterns` from the Qiniu Cloud Kodo.
+func loadBlocklist(ctx context.Context) error {
+	var patterns []string
+	if err := getStatObject(
+		ctx,
+		blocklistObjectName,
+		&patterns,
+	); err != nil && !isNotFoundMinIOError(err) {
+		return err
+	}
+
+	blocklistMutex.Lock()
+	blocklistPatterns = patterns
+	blocklistMutex.Unlock()
+
+	return nil
+}
+
+// updateBlocklist updates the `blocklistPatterns` with the f and persists it to
+// the Qiniu Cloud Kodo.
+func updateBlocklist(ctx context.Context, f func([]string) []string) error {
+	if err := loadBlocklist(ctx); err != nil {
+		return err
+	}
+
+	blocklistMutex.Lock()
+	defer blocklistMutex.Unlock()
+
+	patterns := f(append([]string(nil), blocklistPatterns...))
+	sort.Strings(patterns)
+	if err := putStatObject(ctx, blocklistObjectName, patterns); err != nil {
+		return err
+	}
+
+	blocklistPatterns = patterns
+
+	return nil
+}
+
+// blockModule adds the pattern to the `blocklistPatterns`.
+func blockModule(ctx context.Context, pattern string) error {
+	return updateBlocklist(ctx, func(patterns []string) []string {
+		for _, p := range patterns {
+			if p == pattern {
+				return patterns
+			}
+		}
+
+		return append(patterns, pattern)
+	})
+}
+
+// hAdminBlocklist handles requests to list the blocked module patterns.
+func hAdminBlocklist(req *air.Request, res *air.Response) error {
+	blocklistMutex.RLock()
+	defer blocklistMutex.RUnlock()
+
+	return res.WriteJSON(map[string][]string{
+		"config": append([]string{}, blocklistConfigPatterns...),
+		"admin":  append([]string{}, blocklistPatterns...),
+	})
+}
+
+// hAdminBlock handles requests to block a module pattern.
+func hAdminBlock(req *air.Request, res *air.Response) error {
+	pattern, err := blocklistPatternParam(req, res)
+	if err != nil {
+		return err
+	}
+
+	if err := blockModule(req.Context, pattern); err != nil {
+		return err
+	}
+
+	base.Logger.Info().
+		Str("pattern", pattern).
+		Str("client_address", req.ClientAddress()).
+		Msg("blocked module pattern")
+
+	res.Status = http.StatusNoContent
+
+	return res.Write(nil)
+}
+
+// hAdminUnblock handles requests to unblock a module pattern.
+func hAdminUnblock(req *air.Request, res *air.Response) error {
+	pattern, err := blocklistPatternParam(req, res)
+	if err != nil {
+		return err
+	}
+
+	if err := updateBlocklist(req.Context, func(
+		patterns []string,
+	) []string {
+		for i, p := range patterns {
+			if p == pattern {
+				return append(patterns[:i], patterns[i+1:]...)
+			}
+		}
+
+		return patterns
+	}); err != nil {
+		return err
+	}
+
+	base.Logger.Info().
+		Str("pattern", pattern).
+		Str("client_address", req.ClientAddress()).
+		Msg("unblocked module pattern")
+
+	res.Status = http.StatusNoContent
+
+	return res.Write(nil)
+}
+
+// blocklistPatternParam returns the valid "pattern" parameter of the req.
+func blocklistPatternParam(
+	req *air.Request,
+	res *air.Response,
+) (string, error) {
+	var pattern string
+	if p := req.Param("pattern"); p != nil {
+		pattern = p.Value().String()
+	}
+
+	if !validBlocklistPattern(pattern) {
+		res.Status = http.StatusBadRequest
+		return "", errors.New("invalid module pattern")
+	}
+
+	return pattern, nil
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers in the `copyBufferPool`.
+const copyBufferSize = 32 << 10
+
+// copyBufferPool is the pool of the buffers used to copy the Goproxy caches,
+// which reduces the GC pressure under heavy write load.
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// getCopyBuffer returns a buffer from the `copyBufferPool`. It must be returned
+// with the `putCopyBuffer` once it is no longer used.
+func getCopyBuffer() *[]byte {
+	return copyBufferPool.Get().(*[]byte)
+}
+
+// putCopyBuffer returns the b to the `copyBufferPool`.
+func putCopyBuffer(b *[]byte) {
+	copyBufferPool.Put(b)
+}
+
+// copyBuffered is like the `io.Copy`, but uses a buffer from the
+// `copyBufferPool` instead of allocating a new one.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	b := getCopyBuffer()
+	defer putCopyBuffer(b)
+
+	return io.CopyBuffer(dst, src, *b)
+}
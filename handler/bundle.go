@@ -0,0 +1,295 @@
+package handler
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// bundleMaxModules is the maximum number of the module versions in the
+// dependency graph of a bundle.
+var bundleMaxModules = goproxyViper.GetInt("bundle_max_modules")
+
+func init() {
+	base.Air.GET(
+		"/bundle",
+		hBundle,
+		rateLimitGas,
+		authGas("proxy"),
+	)
+}
+
+// hBundle handles requests to download a gzipped tarball of all the Goproxy
+// caches needed to build the module version in the "module" query parameter
+// offline. The tarball is laid out as a GOPROXY, so it can be used with a
+// "file://" GOPROXY once extracted.
+//
+// The dependency graph is resolved from the go.mod files of all the module
+// versions it reaches. The go.mod files of all of them are bundled, while the
+// .info and the .zip files are only bundled for the versions selected by the
+// minimal version selection.
+func hBundle(req *air.Request, res *air.Response) error {
+	var modAtVer string
+	if p := req.Param("module"); p != nil {
+		modAtVer = p.Value().String()
+	}
+
+	modulePath, moduleVersion, found := strings.Cut(modAtVer, "@")
+	if !found || module.Check(modulePath, moduleVersion) != nil {
+		res.Status = http.StatusBadRequest
+		return errors.New("invalid module version")
+	}
+
+	graph, err := resolveBundleGraph(req.Context, module.Version{
+		Path:    modulePath,
+		Version: moduleVersion,
+	})
+	if err != nil {
+		var bge *bundleGraphError
+		if errors.As(err, &bge) {
+			res.Status = bge.status
+		}
+
+		return err
+	}
+
+	selected := map[string]string{}
+	for _, mv := range graph {
+		if semver.Compare(mv.Version, selected[mv.Path]) > 0 {
+			selected[mv.Path] = mv.Version
+		}
+	}
+
+	var names []string
+	versions := map[string][]string{}
+	for _, mv := range graph {
+		versions[mv.Path] = append(versions[mv.Path], mv.Version)
+
+		exts := []string{".mod"}
+		if selected[mv.Path] == mv.Version {
+			exts = append(exts, ".info", ".zip")
+		}
+
+		for _, ext := range exts {
+			name, err := goproxyCacheNameOf(mv, ext)
+			if err != nil {
+				return err
+			}
+
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	// All the Goproxy caches are made available before the response is
+	// written, so that a failed fetch is reported with a proper status.
+	for _, name := range names {
+		if _, err := ensureGoproxyCache(req.Context, name); err != nil {
+			res.Status = http.StatusBadGateway
+			return err
+		}
+	}
+
+	res.Header.Set("Content-Type", "application/gzip")
+	res.Header.Set("Content-Disposition", fmt.Sprintf(
+		"attachment; filename=%q",
+		strings.NewReplacer("/", "_", "@", "_").Replace(modAtVer)+
+			".tar.gz",
+	))
+
+	gw := gzip.NewWriter(res.HTTPResponseWriter())
+	tw := tar.NewWriter(gw)
+
+	modulePaths := make([]string, 0, len(versions))
+	for modulePath := range versions {
+		modulePaths = append(modulePaths, modulePath)
+	}
+
+	sort.Strings(modulePaths)
+
+	modTime := time.Now()
+	for _, modulePath := range modulePaths {
+		vs := versions[modulePath]
+		escapedModulePath, err := module.EscapePath(modulePath)
+		if err != nil {
+			return err
+		}
+
+		semver.Sort(vs)
+		list := strings.Join(vs, "\n") + "\n"
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     escapedModulePath + "/@v/list",
+			Size:     int64(len(list)),
+			Mode:     0o644,
+			ModTime:  modTime,
+		}); err != nil {
+			return err
+		}
+
+		if _, err := io.WriteString(tw, list); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		if err := writeBundleEntry(req.Context, tw, name); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+// bundleGraphError is an error of resolving the dependency graph of a bundle
+// that carries the HTTP status code of the response.
+type bundleGraphError struct {
+	status int
+	err    error
+}
+
+// Error implements the `error`.
+func (bge *bundleGraphError) Error() string {
+	return bge.err.Error()
+}
+
+// resolveBundleGraph returns all the module versions reachable from the root
+// in the requirement graph, including the root.
+func resolveBundleGraph(
+	ctx context.Context,
+	root module.Version,
+) ([]module.Version, error) {
+	graph := []module.Version{root}
+	seen := map[module.Version]bool{root: true}
+	for i := 0; i < len(graph); i++ {
+		mv := graph[i]
+		if isModuleBlocked(mv.Path, mv.Version) {
+			return nil, &bundleGraphError{
+				status: http.StatusGone,
+				err:    fmt.Errorf("module blocked: %s", mv),
+			}
+		} else if !isModuleAllowed(mv.Path, mv.Version) {
+			return nil, &bundleGraphError{
+				status: http.StatusForbidden,
+				err:    fmt.Errorf("module not allowed: %s", mv),
+			}
+		}
+
+		name, err := goproxyCacheNameOf(mv, ".mod")
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := loadBundleFile(ctx, name)
+		if err != nil {
+			return nil, &bundleGraphError{
+				status: http.StatusBadGateway,
+				err:    err,
+			}
+		}
+
+		f, err := modfile.ParseLax(name, content, nil)
+		if err != nil {
+			return nil, &bundleGraphError{
+				status: http.StatusBadGateway,
+				err:    fmt.Errorf("%s: %w", name, err),
+			}
+		}
+
+		for _, r := range f.Require {
+			if seen[r.Mod] {
+				continue
+			}
+
+			if len(graph) >= bundleMaxModules {
+				return nil, &bundleGraphError{
+					status: http.StatusUnprocessableEntity,
+					err:    errors.New("too many modules"),
+				}
+			}
+
+			seen[r.Mod] = true
+			graph = append(graph, r.Mod)
+		}
+	}
+
+	return graph, nil
+}
+
+// goproxyCacheNameOf returns the name of the Goproxy cache with the ext of the
+// mv.
+func goproxyCacheNameOf(mv module.Version, ext string) (string, error) {
+	escapedModulePath, err := module.EscapePath(mv.Path)
+	if err != nil {
+		return "", err
+	}
+
+	escapedModuleVersion, err := module.EscapeVersion(mv.Version)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprint(
+		escapedModulePath,
+		"/@v/",
+		escapedModuleVersion,
+		ext,
+	), nil
+}
+
+// loadBundleFile returns the content of the Goproxy cache with the name. The
+// Goproxy cache is fetched first if it is missing.
+func loadBundleFile(ctx context.Context, name string) ([]byte, error) {
+	if _, err := ensureGoproxyCache(ctx, name); err != nil {
+		return nil, err
+	}
+
+	object, _, err := getGoproxyCacheObject(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	return io.ReadAll(object)
+}
+
+// writeBundleEntry writes the Goproxy cache with the name to the tw.
+func writeBundleEntry(ctx context.Context, tw *tar.Writer, name string) error {
+	object, objectInfo, err := getGoproxyCacheObject(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     objectInfo.Size,
+		Mode:     0o644,
+		ModTime:  objectInfo.LastModified,
+	}); err != nil {
+		return err
+	}
+
+	_, err = copyBuffered(tw, object)
+
+	return err
+}
@@ -0,0 +1,251 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/goproxy/goproxy.cn/internal/cacheencryption"
+	"github.com/minio/minio-go/v7"
+)
+
+// cacheEncryptionKey is a key used to encrypt the Goproxy caches on the client
+// side before they are stored in the Qiniu Cloud Kodo.
+type cacheEncryptionKey struct {
+	// ID is the ID of the key, which is stored along with each Goproxy
+	// cache encrypted with it so that the keys can be rotated.
+	ID string `mapstructure:"id"`
+
+	// Key is the base64-encoded 32-byte key.
+	Key string `mapstructure:"key"`
+
+	// KeyFile is the file that contains the `Key`.
+	KeyFile string `mapstructure:"key_file"`
+
+	// KeyCommand is the command that prints the `Key`, such as the one
+	// that decrypts it with a KMS.
+	KeyCommand []string `mapstructure:"key_command"`
+
+	key []byte
+}
+
+var (
+	// cacheEncryptionEnabled indicates whether the Goproxy caches are
+	// encrypted with the first of the `cacheEncryptionKeys` on the client
+	// side before they are stored.
+	cacheEncryptionEnabled = goproxyViper.GetBool("cache_encryption")
+
+	// cacheEncryptionKeys is the keys used to decrypt the Goproxy caches
+	// keyed by their IDs. The ones no longer in use are kept so that the
+	// Goproxy caches encrypted with them stay readable.
+	cacheEncryptionKeys map[string]*cacheEncryptionKey
+
+	// cacheEncryptionKeyInUse is the key used to encrypt the Goproxy
+	// caches.
+	cacheEncryptionKeyInUse *cacheEncryptionKey
+
+	// cacheEncryptionPlaintextUntil is the time until which the Goproxy
+	// caches that have not been encrypted are still served when the
+	// encryption is enabled, so that the ones stored before it was enabled
+	// can be migrated. Otherwise they are refused, since anyone who can
+	// write to the bucket could swap them in.
+	cacheEncryptionPlaintextUntil time.Time
+
+	// cacheEncryptionPlaintextServed is the number of the Goproxy caches
+	// served without having been encrypted when the encryption is enabled.
+	cacheEncryptionPlaintextServed = expvar.NewInt(
+		"cache_encryption_plaintext_served",
+	)
+)
+
+func init() {
+	var keys []*cacheEncryptionKey
+	if err := goproxyViper.UnmarshalKey(
+		"cache_encryption_keys",
+		&keys,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to unmarshal goproxy cache encryption keys")
+	}
+
+	cacheEncryptionKeys = make(map[string]*cacheEncryptionKey, len(keys))
+	for _, cek := range keys {
+		if cek.ID == "" || len(cek.ID) > 255 {
+			base.Logger.Fatal().
+				Str("id", cek.ID).
+				Msg("invalid goproxy cache encryption key id")
+		}
+
+		if cacheEncryptionKeys[cek.ID] != nil {
+			base.Logger.Fatal().
+				Str("id", cek.ID).
+				Msg("duplicate goproxy cache encryption key id")
+		}
+
+		if err := cek.load(); err != nil {
+			base.Logger.Fatal().Err(err).
+				Str("id", cek.ID).
+				Msg("failed to load goproxy cache encryption " +
+					"key")
+		}
+
+		cacheEncryptionKeys[cek.ID] = cek
+	}
+
+	if cacheEncryptionEnabled {
+		if len(keys) == 0 {
+			base.Logger.Fatal().
+				Msg("missing goproxy cache encryption keys")
+		}
+
+		cacheEncryptionKeyInUse = keys[0]
+	}
+
+	if s := goproxyViper.GetString(
+		"cache_encryption_plaintext_until",
+	); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("invalid goproxy cache encryption " +
+					"plaintext until")
+		}
+
+		cacheEncryptionPlaintextUntil = t
+		if cacheEncryptionEnabled && time.Now().Before(t) {
+			base.Logger.Warn().
+				Time("until", t).
+				Msg("serving unencrypted goproxy caches")
+		}
+	}
+}
+
+// load loads the key of the cek from one of the `Key`, the `KeyFile` and the
+// `KeyCommand`.
+func (cek *cacheEncryptionKey) load() error {
+	var s string
+	switch {
+	case cek.Key != "":
+		s = cek.Key
+	case cek.KeyFile != "":
+		b, err := os.ReadFile(cek.KeyFile)
+		if err != nil {
+			return err
+		}
+
+		s = string(b)
+	case len(cek.KeyCommand) > 0:
+		cmd := exec.Command(cek.KeyCommand[0], cek.KeyCommand[1:]...)
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return err
+		}
+
+		s = string(b)
+	default:
+		return errors.New("missing key")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+
+	if len(key) != cacheencryption.KeySize {
+		return fmt.Errorf("invalid key size %d", len(key))
+	}
+
+	cek.key = key
+
+	return nil
+}
+
+// isGoproxyCacheEncrypted reports whether the Goproxy caches may be encrypted
+// on the client side, in which case they can never be redirected to.
+func isGoproxyCacheEncrypted() bool {
+	return len(cacheEncryptionKeys) > 0
+}
+
+// encryptGoproxyCache returns the encrypted content of a Goproxy cache with the
+// `cacheEncryptionKeyInUse` (see the `cacheencryption.NewEncrypter`). It
+// returns the content as is if the encryption is disabled.
+func encryptGoproxyCache(content io.ReadSeeker) (io.ReadSeeker, error) {
+	cek := cacheEncryptionKeyInUse
+	if cek == nil {
+		return content, nil
+	}
+
+	return cacheencryption.NewEncrypter(cek.ID, cek.key, content)
+}
+
+// decryptGoproxyCacheObject returns the decrypted object of a Goproxy cache
+// with the objectInfo, along with the objectInfo whose size is that of the
+// decrypted object. It returns them as is if the object has not been
+// encrypted, which is refused when the encryption is enabled unless it is
+// before the `cacheEncryptionPlaintextUntil`. The object is closed if an error
+// is returned.
+func decryptGoproxyCacheObject(
+	object io.ReadSeekCloser,
+	objectInfo minio.ObjectInfo,
+) (io.ReadSeekCloser, minio.ObjectInfo, error) {
+	if !isGoproxyCacheEncrypted() {
+		return object, objectInfo, nil
+	}
+
+	d, err := cacheencryption.NewDecrypter(
+		object,
+		objectInfo.Size,
+		func(keyID string) []byte {
+			if cek := cacheEncryptionKeys[keyID]; cek != nil {
+				return cek.key
+			}
+
+			return nil
+		},
+	)
+	if err == nil && d == nil {
+		err = checkUnencryptedGoproxyCache(objectInfo.Key)
+	}
+
+	if err != nil {
+		object.Close()
+		return nil, minio.ObjectInfo{}, err
+	}
+
+	if d == nil {
+		return object, objectInfo, nil
+	}
+
+	objectInfo.Size = d.Size()
+
+	return d, objectInfo, nil
+}
+
+// checkUnencryptedGoproxyCache returns an error if the Goproxy cache with the
+// name is not allowed to be served without having been encrypted. When the
+// encryption is disabled, the Goproxy caches are stored unencrypted, so they
+// are always allowed.
+func checkUnencryptedGoproxyCache(name string) error {
+	if !cacheEncryptionEnabled {
+		return nil
+	}
+
+	if !time.Now().Before(cacheEncryptionPlaintextUntil) {
+		return fmt.Errorf("unencrypted goproxy cache %q", name)
+	}
+
+	cacheEncryptionPlaintextServed.Add(1)
+	base.Logger.Warn().
+		Str("name", name).
+		Msg("served unencrypted goproxy cache")
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// goproxyCacheOnly indicates whether the cache-only mode is on, in
+	// which nothing is fetched from the upstreams and the Goproxy caches
+	// that are missing are responded with "404 Not Found". It is loaded
+	// from the "cache_only" when the config is loaded for the first time
+	// or the "cache_only" is changed, and can be toggled at runtime by the
+	// admins.
+	goproxyCacheOnly atomic.Bool
+
+	// configuredGoproxyCacheOnly is the "cache_only" last loaded from the
+	// config.
+	configuredGoproxyCacheOnly bool
+)
+
+func init() {
+	if !adminEnabled {
+		return
+	}
+
+	base.Air.GET(
+		"/admin/cache-only",
+		hAdminCacheOnly,
+		adminGas,
+		globalAdminGas,
+	)
+	base.Air.PUT(
+		"/admin/cache-only",
+		hAdminEnableCacheOnly,
+		adminGas,
+		globalAdminGas,
+	)
+	base.Air.DELETE(
+		"/admin/cache-only",
+		hAdminDisableCacheOnly,
+		adminGas,
+		globalAdminGas,
+	)
+}
+
+// hAdminCacheOnly handles requests to get whether the cache-only mode is on.
+func hAdminCacheOnly(req *air.Request, res *air.Response) error {
+	return res.WriteJSON(map[string]bool{
+		"cache_only": goproxyCacheOnly.Load(),
+	})
+}
+
+// hAdminEnableCacheOnly handles requests to turn on the cache-only mode of the
+// current instance.
+func hAdminEnableCacheOnly(req *air.Request, res *air.Response) error {
+	return setGoproxyCacheOnly(req, res, true)
+}
+
+// hAdminDisableCacheOnly handles requests to turn off the cache-only mode of
+// the current instance.
+func hAdminDisableCacheOnly(req *air.Request, res *air.Response) error {
+	return setGoproxyCacheOnly(req, res, false)
+}
+
+// setGoproxyCacheOnly sets the `goproxyCacheOnly` to the cacheOnly for the req.
+func setGoproxyCacheOnly(
+	req *air.Request,
+	res *air.Response,
+	cacheOnly bool,
+) error {
+	if goproxyCacheOnly.Swap(cacheOnly) != cacheOnly {
+		base.Logger.Info().
+			Bool("cache_only", cacheOnly).
+			Str("client_address", req.ClientAddress()).
+			Msg("toggled cache-only mode")
+	}
+
+	res.Status = http.StatusNoContent
+
+	return res.Write(nil)
+}
+
+// cacheOnlyTransport is an `http.RoundTripper` that fails all the requests to
+// the upstreams with "404 Not Found" while the cache-only mode is on, which
+// makes the Goproxy fall back to its caches.
+type cacheOnlyTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (cot *cacheOnlyTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	if !goproxyCacheOnly.Load() {
+		return cot.next.RoundTrip(req)
+	}
+
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	return &http.Response{
+		Status:     "404 Not Found",
+		StatusCode: http.StatusNotFound,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body: io.NopCloser(strings.NewReader(
+			"not found: cache-only mode",
+		)),
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+var (
+	// cacheOutcomeRequests is the number of the requests to the Goproxy
+	// keyed by the cache outcomes.
+	cacheOutcomeRequests = expvar.NewMap("cache_outcome_requests")
+
+	// cacheOutcomeSeconds is the total seconds spent serving the requests
+	// to the Goproxy keyed by the cache outcomes.
+	cacheOutcomeSeconds = expvar.NewMap("cache_outcome_seconds")
+)
+
+// cacheOutcomeKey is the key of the `cacheOutcome` in the context of a request.
+type cacheOutcomeKey struct{}
+
+// cacheOutcome records how a request to the Goproxy was served, which is one of
+// "hit", "miss", "stale" and "redirect". It is also exposed to the client as
+// the X-Cache header.
+type cacheOutcome struct {
+	header  http.Header
+	outcome string
+}
+
+// cacheOutcomeGas is used to track the cache outcomes of the requests to the
+// Goproxy.
+func cacheOutcomeGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		co := &cacheOutcome{header: res.Header}
+		req.Context = context.WithValue(
+			req.Context,
+			cacheOutcomeKey{},
+			co,
+		)
+
+		startTime := time.Now()
+		res.Defer(func() {
+			outcome := co.outcome
+			if outcome == "" {
+				outcome = "none"
+			}
+
+			cacheOutcomeRequests.Add(outcome, 1)
+			cacheOutcomeSeconds.AddFloat(
+				outcome,
+				time.Since(startTime).Seconds(),
+			)
+		})
+
+		return next(req, res)
+	}
+}
+
+// setCacheOutcome sets the outcome to the `cacheOutcome` carried by the ctx, if
+// any. It must be called before the response header is written.
+func setCacheOutcome(ctx context.Context, outcome string) {
+	co, ok := ctx.Value(cacheOutcomeKey{}).(*cacheOutcome)
+	if !ok {
+		return
+	}
+
+	co.outcome = outcome
+	co.header.Set("X-Cache", strings.ToUpper(outcome))
+}
+
+// loadCacheOutcome returns the outcome of the `cacheOutcome` carried by the
+// ctx, if any.
+func loadCacheOutcome(ctx context.Context) string {
+	if co, ok := ctx.Value(cacheOutcomeKey{}).(*cacheOutcome); ok {
+		return co.outcome
+	}
+
+	return ""
+}
@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+// The Goproxy verifies the fetched .mod and .zip files against the checksum
+// database before caching them, and refuses to cache those disagreeing with
+// it, unless the GOSUMDB is "off" or the module paths match the GONOSUMDB (or
+// the GOPRIVATE). So a public mirror must never run with the GOSUMDB turned
+// off.
+func init() {
+	if !goproxyViper.GetBool("require_checksum_verification") {
+		return
+	}
+
+	if goBinEnv("GOSUMDB") == "off" {
+		base.Logger.Fatal().
+			Msg("checksum verification is required but gosumdb " +
+				"is off")
+	}
+}
+
+// goBinEnv returns the value of the environment variable named by the key in
+// the `hhGoproxy.GoBinEnv`. The last one wins if there are duplicates.
+func goBinEnv(key string) string {
+	var value string
+	for _, env := range hhGoproxy.GoBinEnv {
+		if k, v, ok := strings.Cut(env, "="); ok && k == key {
+			value = v
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,368 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	// coalescedRoundTrips is the in-flight coalesced round trips.
+	coalescedRoundTrips = map[string]*coalescedRoundTrip{}
+
+	// coalescedRoundTripsMutex is used to protect the
+	// `coalescedRoundTrips` and the references of its values.
+	coalescedRoundTripsMutex sync.Mutex
+
+	// coalescedGoproxyCachePuts is the in-flight coalesced Goproxy cache
+	// puts.
+	coalescedGoproxyCachePuts = map[string]*coalescedGoproxyCachePut{}
+
+	// coalescedGoproxyCachePutsMutex is used to protect the
+	// `coalescedGoproxyCachePuts`.
+	coalescedGoproxyCachePutsMutex sync.Mutex
+)
+
+// coalescingTransport is an `http.RoundTripper` that coalesces identical
+// concurrent GET requests into a single round trip, so that many concurrent
+// fetches of the same uncached module file only download it from the upstream
+// once. The response body is streamed to all requests as it arrives, so that
+// none of them has to wait for the whole download.
+type coalescingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (ct *coalescingTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	if req.Method != http.MethodGet ||
+		(req.Body != nil && req.Body != http.NoBody) {
+		return ct.next.RoundTrip(req)
+	}
+
+	key := req.URL.String()
+
+	coalescedRoundTripsMutex.Lock()
+	crt, ok := coalescedRoundTrips[key]
+	if !ok {
+		// The shared round trip outlives the req, but not the fetch
+		// timeout, so that a hung upstream fails it with the
+		// `context.DeadlineExceeded` rather than being canceled by the
+		// last release, which the `upstreamTransport` ignores. It keeps
+		// the values of the req, such as the request ID and the tenant.
+		ctx, cancel := withGoproxyFetchTimeout(
+			context.WithoutCancel(req.Context()),
+			goproxyCacheNameType(req.URL.Path),
+		)
+		crt = &coalescedRoundTrip{
+			key:      key,
+			ready:    make(chan struct{}),
+			done:     make(chan struct{}),
+			progress: make(chan struct{}),
+			cancel:   cancel,
+		}
+		coalescedRoundTrips[key] = crt
+		go crt.do(ct.next, req.Clone(ctx))
+	}
+
+	crt.refs++
+	coalescedRoundTripsMutex.Unlock()
+
+	select {
+	case <-crt.ready:
+	case <-req.Context().Done():
+		crt.release()
+		return nil, req.Context().Err()
+	}
+
+	if crt.err != nil {
+		crt.release()
+		return nil, crt.err
+	}
+
+	res := *crt.res
+	res.Header = crt.res.Header.Clone()
+	res.Body = &coalescedRoundTripBody{
+		ctx: req.Context(),
+		crt: crt,
+	}
+	res.Request = req
+
+	return &res, nil
+}
+
+// coalescedRoundTrip is a round trip shared by identical concurrent requests.
+type coalescedRoundTrip struct {
+	key      string
+	ready    chan struct{}
+	done     chan struct{}
+	progress chan struct{}
+	cancel   context.CancelFunc
+	refs     int
+	res      *http.Response
+	file     *os.File
+	size     int64
+	err      error
+	bodyErr  error
+}
+
+// do performs the req with the rt and buffers the response body into an
+// unlinked temporary file, which is shared by all references of the crt. A
+// successful round trip stays joinable until its last reference is released,
+// so that a request arriving right after the download does not repeat it.
+func (crt *coalescedRoundTrip) do(rt http.RoundTripper, req *http.Request) {
+	defer func() {
+		coalescedRoundTripsMutex.Lock()
+		defer coalescedRoundTripsMutex.Unlock()
+
+		crt.cancel()
+		if crt.refs == 0 || crt.err != nil || crt.bodyErr != nil {
+			delete(coalescedRoundTrips, crt.key)
+		}
+
+		select {
+		case <-crt.ready:
+		default:
+			close(crt.ready)
+		}
+
+		close(crt.done)
+		close(crt.progress)
+		if crt.refs == 0 && crt.file != nil {
+			crt.file.Close()
+		}
+	}()
+
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		crt.err = err
+		return
+	}
+	defer res.Body.Close()
+
+	file, err := os.CreateTemp(hhGoproxy.TempDir, "coalesced-")
+	if err != nil {
+		crt.err = err
+		return
+	}
+
+	os.Remove(file.Name())
+
+	body := res.Body
+	res.Body = nil
+
+	crt.res = res
+	crt.file = file
+	close(crt.ready)
+
+	b := getCopyBuffer()
+	defer putCopyBuffer(b)
+
+	buf := *b
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := file.Write(buf[:n]); err != nil {
+				coalescedRoundTripsMutex.Lock()
+				crt.bodyErr = err
+				coalescedRoundTripsMutex.Unlock()
+				return
+			}
+
+			coalescedRoundTripsMutex.Lock()
+			crt.size += int64(n)
+			close(crt.progress)
+			crt.progress = make(chan struct{})
+			coalescedRoundTripsMutex.Unlock()
+		}
+
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			coalescedRoundTripsMutex.Lock()
+			crt.bodyErr = err
+			coalescedRoundTripsMutex.Unlock()
+			return
+		}
+	}
+}
+
+// release releases a reference of the crt. The round trip is canceled if it is
+// still in flight and there are no references left.
+func (crt *coalescedRoundTrip) release() {
+	coalescedRoundTripsMutex.Lock()
+	defer coalescedRoundTripsMutex.Unlock()
+
+	crt.refs--
+	if crt.refs > 0 {
+		return
+	}
+
+	select {
+	case <-crt.done:
+		if coalescedRoundTrips[crt.key] == crt {
+			delete(coalescedRoundTrips, crt.key)
+		}
+
+		if crt.file != nil {
+			crt.file.Close()
+		}
+	default:
+		crt.cancel()
+	}
+}
+
+// coalescedRoundTripBody is the response body of a coalesced round trip. It
+// reads the buffered response body as it grows.
+type coalescedRoundTripBody struct {
+	ctx    context.Context
+	crt    *coalescedRoundTrip
+	offset int64
+	once   sync.Once
+}
+
+// Read implements the `io.Reader`.
+func (crtb *coalescedRoundTripBody) Read(b []byte) (int, error) {
+	for {
+		coalescedRoundTripsMutex.Lock()
+		size := crtb.crt.size
+		progress := crtb.crt.progress
+		coalescedRoundTripsMutex.Unlock()
+
+		if crtb.offset < size {
+			if int64(len(b)) > size-crtb.offset {
+				b = b[:size-crtb.offset]
+			}
+
+			n, err := crtb.crt.file.ReadAt(b, crtb.offset)
+			crtb.offset += int64(n)
+			if err == io.EOF {
+				err = nil
+			}
+
+			return n, err
+		}
+
+		select {
+		case <-progress:
+			// The `progress` is closed after the `size` grows and
+			// after the round trip is done, so check again.
+			select {
+			case <-crtb.crt.done:
+				coalescedRoundTripsMutex.Lock()
+				size = crtb.crt.size
+				bodyErr := crtb.crt.bodyErr
+				coalescedRoundTripsMutex.Unlock()
+				if crtb.offset < size {
+					continue
+				}
+
+				if bodyErr != nil {
+					return 0, bodyErr
+				}
+
+				return 0, io.EOF
+			default:
+			}
+		case <-crtb.ctx.Done():
+			return 0, crtb.ctx.Err()
+		}
+	}
+}
+
+// Close implements the `io.Closer`.
+func (crtb *coalescedRoundTripBody) Close() error {
+	crtb.once.Do(crtb.crt.release)
+	return nil
+}
+
+// coalescedGoproxyCachePut is a Goproxy cache put shared by identical
+// concurrent puts.
+type coalescedGoproxyCachePut struct {
+	done chan struct{}
+	err  error
+}
+
+// coalesceGoproxyCachePut calls the put for the Goproxy cache with the name
+// unless there is already one in flight, in which case it waits for that one
+// and returns its result instead.
+func coalesceGoproxyCachePut(
+	ctx context.Context,
+	name string,
+	put func() error,
+) error {
+	coalescedGoproxyCachePutsMutex.Lock()
+	if cgcp, ok := coalescedGoproxyCachePuts[name]; ok {
+		coalescedGoproxyCachePutsMutex.Unlock()
+
+		select {
+		case <-cgcp.done:
+			return cgcp.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	cgcp := &coalescedGoproxyCachePut{
+		done: make(chan struct{}),
+	}
+	coalescedGoproxyCachePuts[name] = cgcp
+	coalescedGoproxyCachePutsMutex.Unlock()
+
+	cgcp.err = put()
+
+	coalescedGoproxyCachePutsMutex.Lock()
+	delete(coalescedGoproxyCachePuts, name)
+	coalescedGoproxyCachePutsMutex.Unlock()
+
+	close(cgcp.done)
+
+	return cgcp.err
+}
+
+// inflightGoproxyCachePuts returns the number of the in-flight Goproxy cache
+// puts.
+func inflightGoproxyCachePuts() int {
+	coalescedGoproxyCachePutsMutex.Lock()
+	defer coalescedGoproxyCachePutsMutex.Unlock()
+
+	return len(coalescedGoproxyCachePuts)
+}
+
+// inflightGoproxyCachePutNames returns the sorted names of the in-flight
+// Goproxy cache puts.
+func inflightGoproxyCachePutNames() []string {
+	coalescedGoproxyCachePutsMutex.Lock()
+	defer coalescedGoproxyCachePutsMutex.Unlock()
+
+	names := make([]string, 0, len(coalescedGoproxyCachePuts))
+	for name := range coalescedGoproxyCachePuts {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// inflightUpstreamFetches returns the number of the in-flight coalesced
+// upstream round trips.
+func inflightUpstreamFetches() int {
+	coalescedRoundTripsMutex.Lock()
+	defer coalescedRoundTripsMutex.Unlock()
+
+	n := 0
+	for _, crt := range coalescedRoundTrips {
+		select {
+		case <-crt.done:
+		default:
+			n++
+		}
+	}
+
+	return n
+}
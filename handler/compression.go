@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aofei/air"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// compressionTypes is the types of the Goproxy responses that can be
+	// compressed, which are "info", "mod", "list" and "latest". The zip
+	// files are never compressed since they are already compressed.
+	compressionTypes = goproxyViper.GetStringSlice("compression_types")
+
+	// compressionEncodings is the content encodings of the Goproxy
+	// responses in order of preference, which are "zstd" and "gzip".
+	compressionEncodings = goproxyViper.GetStringSlice(
+		"compression_encodings",
+	)
+
+	// zstdEncoderPool is the pool of the `zstd.Encoder`.
+	zstdEncoderPool = sync.Pool{
+		New: func() any {
+			ze, _ := zstd.NewWriter(
+				nil,
+				zstd.WithEncoderConcurrency(1),
+			)
+			return ze
+		},
+	}
+)
+
+// compressionMinContentLength is the minimum content length of the Goproxy
+// responses to be compressed.
+const compressionMinContentLength = 1 << 10
+
+// compressionGas is used to negotiate the content encoding of the Goproxy
+// responses. The gzip is done by the Air, so the Accept-Encoding header is
+// removed unless the gzip is negotiated.
+func compressionGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		encoding := negotiateCompression(req)
+		if encoding != "gzip" {
+			req.Header.Del("Accept-Encoding")
+		}
+
+		if encoding != "zstd" {
+			return next(req, res)
+		}
+
+		zrw := &zstdResponseWriter{
+			ResponseWriter: res.HTTPResponseWriter(),
+		}
+		res.SetHTTPResponseWriter(zrw)
+
+		// The ETags of the zstd responses are only told apart from
+		// the original ones by the suffix, which must be stripped for
+		// the conditional requests to match them.
+		if inm := req.Header.Get("If-None-Match"); inm != "" {
+			req.Header.Set(
+				"If-None-Match",
+				strings.ReplaceAll(inm, `-zstd"`, `"`),
+			)
+			zrw.zstdETagMatching = strings.Contains(inm, `-zstd"`)
+		}
+
+		err := next(req, res)
+		zrw.Close()
+
+		return err
+	}
+}
+
+// negotiateCompression returns the content encoding of the response to the
+// req. It returns an empty string if the response should not be compressed.
+func negotiateCompression(req *air.Request) string {
+	if req.Header.Get("Range") != "" {
+		return ""
+	}
+
+	name, err := url.PathUnescape(req.ParamValue("*").String())
+	if err != nil {
+		return ""
+	}
+
+	nameType := goproxyCacheNameType(name)
+	if nameType == "" || nameType == "zip" {
+		return ""
+	}
+
+	if !stringSliceContains(compressionTypes, nameType) {
+		return ""
+	}
+
+	accepted := map[string]bool{}
+	for _, ae := range strings.Split(
+		strings.Join(req.Header["Accept-Encoding"], ","),
+		",",
+	) {
+		coding, params, _ := strings.Cut(strings.TrimSpace(ae), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if q, ok := strings.CutPrefix(
+			strings.ReplaceAll(params, " ", ""),
+			"q=",
+		); ok {
+			if qv, err := strconv.ParseFloat(q, 64); err == nil &&
+				qv <= 0 {
+				continue
+			}
+		}
+
+		accepted[coding] = true
+	}
+
+	for _, encoding := range compressionEncodings {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+// zstdResponseWriter is an `http.ResponseWriter` that compresses the "200 OK"
+// responses with the zstd.
+type zstdResponseWriter struct {
+	http.ResponseWriter
+
+	compressing      bool
+	wroteHeader      bool
+	zstdETagMatching bool
+	ze               *zstd.Encoder
+}
+
+// WriteHeader implements the `http.ResponseWriter`.
+func (zrw *zstdResponseWriter) WriteHeader(status int) {
+	if zrw.wroteHeader {
+		return
+	}
+
+	zrw.wroteHeader = true
+
+	h := zrw.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if cl, err := strconv.ParseInt(
+		h.Get("Content-Length"),
+		10,
+		64,
+	); status == http.StatusOK && h.Get("Content-Encoding") == "" &&
+		(err != nil || cl >= compressionMinContentLength) {
+		zrw.compressing = true
+
+		h.Set("Content-Encoding", "zstd")
+		h.Del("Content-Length")
+
+		zrw.setZstdETag()
+	} else if status == http.StatusNotModified && zrw.zstdETagMatching {
+		zrw.setZstdETag()
+	}
+
+	zrw.ResponseWriter.WriteHeader(status)
+}
+
+// setZstdETag appends the "-zstd" suffix to the ETag of the zrw, if any, so
+// that it differs from the one of the uncompressed response (see RFC 7232,
+// section 2.3.3).
+func (zrw *zstdResponseWriter) setZstdETag() {
+	h := zrw.Header()
+	if et := h.Get("ETag"); et != "" {
+		h.Set("ETag", fmt.Sprint(strings.TrimSuffix(et, `"`), `-zstd"`))
+	}
+}
+
+// Write implements the `http.ResponseWriter`.
+func (zrw *zstdResponseWriter) Write(b []byte) (int, error) {
+	if !zrw.wroteHeader {
+		zrw.WriteHeader(http.StatusOK)
+	}
+
+	if !zrw.compressing {
+		return zrw.ResponseWriter.Write(b)
+	}
+
+	if zrw.ze == nil {
+		zrw.ze = zstdEncoderPool.Get().(*zstd.Encoder)
+		zrw.ze.Reset(zrw.ResponseWriter)
+	}
+
+	return zrw.ze.Write(b)
+}
+
+// Close flushes the remaining compressed data of the zrw.
+func (zrw *zstdResponseWriter) Close() error {
+	if zrw.ze == nil {
+		return nil
+	}
+
+	err := zrw.ze.Close()
+	zstdEncoderPool.Put(zrw.ze)
+	zrw.ze = nil
+
+	return err
+}
+
+// stringSliceContains reports whether the ss contains the s.
+func stringSliceContains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
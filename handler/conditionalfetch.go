@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	// conditionalFetchEnabled indicates whether the upstream fetches of the
+	// mutable endpoints are made conditional with the validators of their
+	// previous responses.
+	conditionalFetchEnabled = goproxyViper.GetBool("conditional_fetch")
+
+	// conditionalFetchMaxEntries is the maximum number of the entries of
+	// the `conditionalFetchEntries`.
+	conditionalFetchMaxEntries = goproxyViper.GetInt(
+		"conditional_fetch_max_entries",
+	)
+
+	// conditionalFetchEntries is the validated responses of the mutable
+	// endpoints keyed by their upstream URLs.
+	conditionalFetchEntries = map[string]*conditionalFetchEntry{}
+
+	// conditionalFetchMutex is used to protect the
+	// `conditionalFetchEntries`.
+	conditionalFetchMutex sync.Mutex
+
+	// conditionalFetchNotModified is the number of the upstream fetches
+	// answered with "304 Not Modified".
+	conditionalFetchNotModified = expvar.NewInt(
+		"conditional_fetch_not_modified",
+	)
+)
+
+// conditionalFetchMaxBodyBytes is the maximum size of a response body kept in
+// the `conditionalFetchEntries`.
+const conditionalFetchMaxBodyBytes = 1 << 20
+
+// conditionalFetchEntry is a validated response of a mutable endpoint.
+type conditionalFetchEntry struct {
+	eTag         string
+	lastModified string
+	contentType  string
+	body         []byte
+}
+
+// conditionalFetchTransport is an `http.RoundTripper` that keeps the validators
+// (the ETag and the Last-Modified headers) of the responses of the mutable
+// endpoints ("/@v/list" and "/@latest") along with their bodies, and sends
+// them back with the next GET requests for the same URLs. A "304 Not Modified"
+// response is turned into the kept "200 OK" one, so that a refresh of an
+// unchanged endpoint does not download it again.
+type conditionalFetchTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (cft *conditionalFetchTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	if !conditionalFetchEnabled ||
+		req.Method != http.MethodGet ||
+		req.Header.Get("If-None-Match") != "" ||
+		req.Header.Get("If-Modified-Since") != "" ||
+		(!strings.HasSuffix(req.URL.Path, "/@v/list") &&
+			!strings.HasSuffix(req.URL.Path, "/@latest")) {
+		return cft.next.RoundTrip(req)
+	}
+
+	key := req.URL.String()
+
+	conditionalFetchMutex.Lock()
+	cfe := conditionalFetchEntries[key]
+	conditionalFetchMutex.Unlock()
+
+	if cfe != nil {
+		req = req.Clone(req.Context())
+		if cfe.eTag != "" {
+			req.Header.Set("If-None-Match", cfe.eTag)
+		}
+
+		if cfe.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cfe.lastModified)
+		}
+	}
+
+	res, err := cft.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		if cfe == nil {
+			return res, nil
+		}
+
+		res.Body.Close()
+		conditionalFetchNotModified.Add(1)
+
+		header := http.Header{}
+		if cfe.contentType != "" {
+			header.Set("Content-Type", cfe.contentType)
+		}
+
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         res.Proto,
+			ProtoMajor:    res.ProtoMajor,
+			ProtoMinor:    res.ProtoMinor,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(cfe.body)),
+			ContentLength: int64(len(cfe.body)),
+			Request:       req,
+		}, nil
+	case http.StatusOK:
+	default:
+		return res, nil
+	}
+
+	eTag := res.Header.Get("ETag")
+	lastModified := res.Header.Get("Last-Modified")
+	if eTag == "" && lastModified == "" {
+		return res, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(
+		res.Body,
+		conditionalFetchMaxBodyBytes+1,
+	))
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	if len(body) > conditionalFetchMaxBodyBytes {
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return res, nil
+	}
+
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+
+	conditionalFetchMutex.Lock()
+	if len(conditionalFetchEntries) >= conditionalFetchMaxEntries {
+		for k := range conditionalFetchEntries {
+			if len(conditionalFetchEntries) <
+				conditionalFetchMaxEntries {
+				break
+			}
+
+			delete(conditionalFetchEntries, k)
+		}
+	}
+
+	conditionalFetchEntries[key] = &conditionalFetchEntry{
+		eTag:         eTag,
+		lastModified: lastModified,
+		contentType:  res.Header.Get("Content-Type"),
+		body:         body,
+	}
+	conditionalFetchMutex.Unlock()
+
+	return res, nil
+}
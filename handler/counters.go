@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+)
+
+// liveCounterValues is the values of the live counters of an instance for a
+// day.
+type liveCounterValues struct {
+	ModuleVersionCount int64 `json:"module_version_count"`
+	CacheBytes         int64 `json:"cache_bytes"`
+	DownloadCount      int64 `json:"download_count"`
+}
+
+// liveCountersSnapshot is the live counters of all the instances.
+type liveCountersSnapshot struct {
+	ModuleVersionCount int64 `json:"module_version_count"`
+	CacherSize         int64 `json:"cacher_size"`
+	DailyDownloadCount int64 `json:"daily_download_count"`
+}
+
+var (
+	// liveCounters is the live counters of the current instance keyed by
+	// the date.
+	liveCounters = map[string]*liveCounterValues{}
+
+	// liveCountersDirty is the dates of the `liveCounters` changed since
+	// the last flush.
+	liveCountersDirty = map[string]bool{}
+
+	// liveCountersMutex is used to protect the `liveCounters` and the
+	// `liveCountersDirty`.
+	liveCountersMutex sync.Mutex
+
+	// liveCountersCache is the cached live counters of all the instances.
+	liveCountersCache *liveCountersSnapshot
+
+	// liveCountersCacheExpiry is the expiry of the `liveCountersCache`.
+	liveCountersCacheExpiry time.Time
+
+	// liveCountersCacheMutex is used to protect the `liveCountersCache`
+	// and the `liveCountersCacheExpiry`.
+	liveCountersCacheMutex sync.Mutex
+)
+
+func init() {
+	if _, err := base.Cron.AddFunc(
+		"* * * * *", // Every minute
+		flushLiveCounters,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add live counter flush cron job")
+	}
+
+	base.Air.AddShutdownJob(flushLiveCounters)
+
+	base.Air.BATCH(
+		getHeadMethods,
+		"/stats/counters",
+		hStatCounters,
+		minutelyCachemanGas,
+	)
+}
+
+// hStatCounters handles requests to query the live counters, which the index
+// page polls.
+func hStatCounters(req *air.Request, res *air.Response) error {
+	lcs, err := getLiveCounters(req.Context)
+	if err != nil {
+		return err
+	}
+
+	return res.WriteJSON(lcs)
+}
+
+// addLiveCounters adds the moduleVersionCount, the cacheBytes and the
+// downloadCount to the live counters of the current instance for today.
+func addLiveCounters(moduleVersionCount, cacheBytes, downloadCount int64) {
+	date := time.Now().UTC().Format("2006-01-02")
+
+	liveCountersMutex.Lock()
+	defer liveCountersMutex.Unlock()
+
+	lcv := liveCounters[date]
+	if lcv == nil {
+		lcv = &liveCounterValues{}
+		liveCounters[date] = lcv
+	}
+
+	lcv.ModuleVersionCount += moduleVersionCount
+	lcv.CacheBytes += cacheBytes
+	lcv.DownloadCount += downloadCount
+	liveCountersDirty[date] = true
+}
+
+// flushLiveCounters flushes the changed `liveCounters` to the Qiniu Cloud Kodo.
+// The live counters of the past days are dropped once flushed.
+func flushLiveCounters() {
+	today := time.Now().UTC().Format("2006-01-02")
+
+	liveCountersMutex.Lock()
+	values := make(map[string]liveCounterValues, len(liveCountersDirty))
+	for date := range liveCountersDirty {
+		values[date] = *liveCounters[date]
+		if date != today {
+			delete(liveCounters, date)
+		}
+	}
+
+	liveCountersDirty = map[string]bool{}
+	liveCountersMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for date, lcv := range values {
+		if err := putStatObject(
+			ctx,
+			path.Join("stats", "counters", date, leaderID),
+			lcv,
+		); err != nil {
+			base.Logger.Error().Err(err).
+				Str("date", date).
+				Msg("failed to flush live counters")
+		}
+	}
+}
+
+// getLiveCounters returns the live counters of all the instances. They are the
+// values of the stat summary plus the values of today that have been flushed by
+// all the instances.
+func getLiveCounters(ctx context.Context) (*liveCountersSnapshot, error) {
+	liveCountersCacheMutex.Lock()
+	defer liveCountersCacheMutex.Unlock()
+
+	if time.Now().Before(liveCountersCacheExpiry) {
+		return liveCountersCache, nil
+	}
+
+	lcs := &liveCountersSnapshot{
+		ModuleVersionCount: int64(moduleVersionCount),
+		CacherSize:         cacherSize,
+	}
+
+	for objectInfo := range qiniuKodoClient.ListObjects(
+		ctx,
+		qiniuKodoBucketName,
+		minio.ListObjectsOptions{
+			Prefix: path.Join(
+				"stats",
+				"counters",
+				time.Now().UTC().Format("2006-01-02"),
+			) + "/",
+			Recursive: true,
+		},
+	) {
+		if objectInfo.Err != nil {
+			return nil, objectInfo.Err
+		}
+
+		var lcv liveCounterValues
+		if err := getStatObject(
+			ctx,
+			objectInfo.Key,
+			&lcv,
+		); err != nil && !isNotFoundMinIOError(err) {
+			return nil, err
+		}
+
+		lcs.ModuleVersionCount += lcv.ModuleVersionCount
+		lcs.CacherSize += lcv.CacheBytes
+		lcs.DailyDownloadCount += lcv.DownloadCount
+	}
+
+	liveCountersCache = lcs
+	liveCountersCacheExpiry = time.Now().Add(time.Minute)
+
+	return lcs, nil
+}
@@ -0,0 +1,361 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/spf13/viper"
+)
+
+var (
+	// qiniuKodoCredentials is the credentials of the `qiniuKodoClient`,
+	// which can be rotated at runtime.
+	qiniuKodoCredentials = newRotatableCredentials()
+
+	// qiniuKodoCredentialsConfig is the configuration items of the
+	// `qiniuKodoCredentials` currently in use, which is used to tell
+	// whether they are changed by a configuration reload.
+	qiniuKodoCredentialsConfig = qiniuKodoCredentialsConfigOf(qiniuViper)
+
+	// qiniuKodoCredentialsMutex is used to serialize the rotations of the
+	// `qiniuKodoCredentials`.
+	qiniuKodoCredentialsMutex sync.Mutex
+)
+
+// qiniuKodoCredentialsKeys is the keys of the configuration items of the
+// `qiniuViper` that make up the `qiniuKodoCredentials`.
+var qiniuKodoCredentialsKeys = []string{
+	"kodo_credentials",
+	"access_key",
+	"secret_key",
+	"kodo_credentials_file",
+	"kodo_credentials_profile",
+	"kodo_credentials_refresh_interval",
+	"kodo_sts_endpoint",
+	"kodo_sts_region",
+	"kodo_sts_role_arn",
+	"kodo_sts_role_session_name",
+	"kodo_sts_duration",
+}
+
+func init() {
+	base.OnConfigReload(reloadQiniuKodoCredentials)
+
+	if !adminEnabled {
+		return
+	}
+
+	base.Air.POST(
+		"/admin/credentials",
+		hAdminRotateCredentials,
+		adminGas,
+		globalAdminGas,
+	)
+}
+
+// newRotatableCredentials returns a new `rotatableCredentials` that starts with
+// the credentials configured in the `qiniuViper`.
+func newRotatableCredentials() *rotatableCredentials {
+	creds, err := newQiniuKodoCredentials(qiniuViper)
+	if err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to create qiniu kodo credentials")
+	}
+
+	rc := &rotatableCredentials{}
+	rc.current.Store(creds)
+
+	return rc
+}
+
+// qiniuKodoCredentialsConfigOf returns the configuration items of the v that
+// make up the `qiniuKodoCredentials`.
+func qiniuKodoCredentialsConfigOf(v *viper.Viper) string {
+	values := make([]any, 0, len(qiniuKodoCredentialsKeys))
+	for _, key := range qiniuKodoCredentialsKeys {
+		values = append(values, v.GetString(key))
+	}
+
+	return fmt.Sprintln(values...)
+}
+
+// newQiniuKodoCredentials returns new credentials for the Qiniu Cloud Kodo from
+// the "kodo_credentials" of the v, which is one of:
+//
+//   - "static" (or empty): the "access_key" and the "secret_key" as is.
+//   - "sts": temporary credentials got by assuming the "kodo_sts_role_arn"
+//     from the "kodo_sts_endpoint" with the "access_key" and the
+//     "secret_key", which are refreshed before they expire.
+//   - "file": the "kodo_credentials_profile" of the AWS shared credentials
+//     file at the "kodo_credentials_file", which is read again every
+//     "kodo_credentials_refresh_interval" so that the rotated credentials
+//     written to it are picked up.
+//   - "env": the AWS or the MinIO environment variables.
+//   - "iam": the credentials of the IAM role of the instance, the task or
+//     the web identity token file, which are refreshed before they expire.
+func newQiniuKodoCredentials(v *viper.Viper) (*credentials.Credentials, error) {
+	kind := v.GetString("kodo_credentials")
+	switch kind {
+	case "", "static":
+		return credentials.NewStaticV4(
+			v.GetString("access_key"),
+			v.GetString("secret_key"),
+			"",
+		), nil
+	case "sts":
+		return credentials.NewSTSAssumeRole(
+			v.GetString("kodo_sts_endpoint"),
+			credentials.STSAssumeRoleOptions{
+				AccessKey: v.GetString("access_key"),
+				SecretKey: v.GetString("secret_key"),
+				Location: v.GetString(
+					"kodo_sts_region",
+				),
+				DurationSeconds: int(v.GetDuration(
+					"kodo_sts_duration",
+				).Seconds()),
+				RoleARN: v.GetString(
+					"kodo_sts_role_arn",
+				),
+				RoleSessionName: v.GetString(
+					"kodo_sts_role_session_name",
+				),
+			},
+		)
+	case "file":
+		return credentials.New(&refreshingCredentials{
+			provider: &credentials.FileAWSCredentials{
+				Filename: v.GetString(
+					"kodo_credentials_file",
+				),
+				Profile: v.GetString(
+					"kodo_credentials_profile",
+				),
+			},
+			interval: v.GetDuration(
+				"kodo_credentials_refresh_interval",
+			),
+		}), nil
+	case "env":
+		return credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+		}), nil
+	case "iam":
+		return credentials.NewIAM(""), nil
+	}
+
+	return nil, fmt.Errorf("unsupported qiniu kodo credentials %q", kind)
+}
+
+// rotatableCredentials is a `credentials.Provider` whose credentials can be
+// swapped atomically at runtime. The requests signed with the old credentials
+// are not affected, and the next ones are signed with the new credentials.
+type rotatableCredentials struct {
+	current atomic.Pointer[credentials.Credentials]
+	rotated atomic.Bool
+}
+
+// Retrieve implements the `credentials.Provider`.
+func (rc *rotatableCredentials) Retrieve() (credentials.Value, error) {
+	rc.rotated.Store(false)
+	return rc.current.Load().Get()
+}
+
+// IsExpired implements the `credentials.Provider`.
+func (rc *rotatableCredentials) IsExpired() bool {
+	return rc.rotated.Load() || rc.current.Load().IsExpired()
+}
+
+// rotate swaps the current credentials of the rc with the creds and returns
+// the old ones.
+func (rc *rotatableCredentials) rotate(
+	creds *credentials.Credentials,
+) *credentials.Credentials {
+	old := rc.current.Swap(creds)
+	rc.rotated.Store(true)
+	return old
+}
+
+// rotateQiniuKodoCredentials rotates the `qiniuKodoCredentials` to the creds.
+// The creds are verified against the Qiniu Cloud Kodo with a client of their
+// own first, so the `qiniuKodoClient` never signs with them unless they work,
+// and the old credentials are kept if that fails.
+func rotateQiniuKodoCredentials(
+	ctx context.Context,
+	creds *credentials.Credentials,
+) error {
+	if _, err := creds.Get(); err != nil {
+		return err
+	}
+
+	qiniuKodoCredentialsMutex.Lock()
+	defer qiniuKodoCredentialsMutex.Unlock()
+
+	client, err := newMinIOClient(
+		qiniuViper.GetString("kodo_endpoint"),
+		creds,
+		qiniuViper.GetBool("kodo_force_path_style"),
+	)
+	if err != nil {
+		return err
+	}
+
+	exists, err := client.BucketExists(ctx, qiniuKodoBucketName)
+	if err == nil && !exists {
+		err = errors.New("bucket not found")
+	}
+
+	if err != nil {
+		return fmt.Errorf("verify qiniu kodo credentials: %w", err)
+	}
+
+	qiniuKodoCredentials.rotate(creds)
+
+	return nil
+}
+
+// reloadQiniuKodoCredentials rotates the `qiniuKodoCredentials` to the ones
+// configured in the reloaded configuration file if they are changed.
+func reloadQiniuKodoCredentials() {
+	v := base.Config().Sub("qiniu")
+	if v == nil {
+		return
+	}
+
+	config := qiniuKodoCredentialsConfigOf(v)
+	if config == qiniuKodoCredentialsConfig {
+		return
+	}
+
+	creds, err := newQiniuKodoCredentials(v)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			time.Minute,
+		)
+		defer cancel()
+
+		err = rotateQiniuKodoCredentials(ctx, creds)
+	}
+
+	if err != nil {
+		base.Logger.Error().Err(err).
+			Msg("failed to reload qiniu kodo credentials")
+		return
+	}
+
+	qiniuKodoCredentialsConfig = config
+
+	base.Logger.Info().Msg("rotated qiniu kodo credentials")
+}
+
+// credentialsRotationRequest is the body of the requests handled by the
+// `hAdminRotateCredentials`.
+type credentialsRotationRequest struct {
+	AccessKey    string `json:"access_key"`
+	SecretKey    string `json:"secret_key"`
+	SessionToken string `json:"session_token"`
+}
+
+// hAdminRotateCredentials handles requests to rotate the credentials of the
+// Qiniu Cloud Kodo to the static ones in the "access_key", the "secret_key"
+// and the optional "session_token" of the JSON or form body. They are never
+// taken from the query, so that they do not end up in the URLs and the access
+// logs. They last until the instance is restarted or the credentials in the
+// configuration file are changed, and only apply to the instance that serves
+// the request.
+func hAdminRotateCredentials(req *air.Request, res *air.Response) error {
+	hr := req.HTTPRequest()
+	query := hr.URL.Query()
+	if query.Has("access_key") ||
+		query.Has("secret_key") ||
+		query.Has("session_token") {
+		res.Status = http.StatusBadRequest
+		return errors.New("credentials must not be in the query")
+	}
+
+	var crr credentialsRotationRequest
+	mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch mt {
+	case "application/json":
+		if err := json.NewDecoder(req.Body).Decode(&crr); err != nil {
+			res.Status = http.StatusBadRequest
+			return errors.New("invalid credentials rotation request")
+		}
+	case "application/x-www-form-urlencoded":
+		if err := hr.ParseForm(); err != nil {
+			res.Status = http.StatusBadRequest
+			return errors.New("invalid credentials rotation request")
+		}
+
+		crr.AccessKey = hr.PostForm.Get("access_key")
+		crr.SecretKey = hr.PostForm.Get("secret_key")
+		crr.SessionToken = hr.PostForm.Get("session_token")
+	default:
+		res.Status = http.StatusUnsupportedMediaType
+		return errors.New(strings.ToLower(http.StatusText(res.Status)))
+	}
+
+	if crr.AccessKey == "" || crr.SecretKey == "" {
+		res.Status = http.StatusBadRequest
+		return errors.New("missing access key or secret key")
+	}
+
+	if err := rotateQiniuKodoCredentials(
+		req.Context,
+		credentials.NewStaticV4(
+			crr.AccessKey,
+			crr.SecretKey,
+			crr.SessionToken,
+		),
+	); err != nil {
+		res.Status = http.StatusBadRequest
+		return err
+	}
+
+	base.Logger.Info().
+		Str("access_key", crr.AccessKey).
+		Str("client_address", req.ClientAddress()).
+		Msg("rotated qiniu kodo credentials")
+
+	res.Status = http.StatusNoContent
+
+	return res.Write(nil)
+}
+
+// refreshingCredentials is a `credentials.Provider` that retrieves the
+// credentials from its provider again every interval. It is for the providers
+// that never expire the credentials by themselves (which the MinIO client
+// would otherwise retrieve again for every request).
+type refreshingCredentials struct {
+	credentials.Expiry
+
+	provider credentials.Provider
+	interval time.Duration
+}
+
+// Retrieve implements the `credentials.Provider`.
+func (rc *refreshingCredentials) Retrieve() (credentials.Value, error) {
+	v, err := rc.provider.Retrieve()
+	if err != nil {
+		base.Logger.Error().Err(err).
+			Msg("failed to retrieve qiniu kodo credentials")
+		return credentials.Value{}, err
+	}
+
+	rc.SetExpiration(time.Now().Add(rc.interval), 0)
+
+	return v, nil
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+// debugAddress is the TCP address that the debug server listens on. The debug
+// server is disabled when it is empty.
+var debugAddress = adminViper.GetString("debug_address")
+
+func init() {
+	expvar.Publish("goproxy", expvar.Func(func() any {
+		return map[string]any{
+			"inflight_cache_puts":       inflightGoproxyCachePuts(),
+			"inflight_upstream_fetches": inflightUpstreamFetches(),
+			"goroutines":                runtime.NumGoroutine(),
+		}
+	}))
+
+	if debugAddress == "" {
+		return
+	}
+
+	if !adminEnabled {
+		base.Logger.Fatal().
+			Msg("debug server requires the admin api to be enabled")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", func(
+		rw http.ResponseWriter,
+		req *http.Request,
+	) {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		runtimepprof.Lookup("goroutine").WriteTo(rw, 2)
+	})
+
+	debugServer := &http.Server{
+		Addr: debugAddress,
+		Handler: http.HandlerFunc(func(
+			rw http.ResponseWriter,
+			req *http.Request,
+		) {
+			if _, ok := authenticateAdmin(req); !ok {
+				rw.Header().Set(
+					"WWW-Authenticate",
+					`Bearer realm="admin"`,
+				)
+				http.Error(
+					rw,
+					http.StatusText(http.StatusUnauthorized),
+					http.StatusUnauthorized,
+				)
+				return
+			}
+
+			// The profiles and the variables cover all the
+			// tenants.
+			if adminTenantOf(req) != "" {
+				http.Error(
+					rw,
+					http.StatusText(http.StatusForbidden),
+					http.StatusForbidden,
+				)
+				return
+			}
+
+			mux.ServeHTTP(rw, req)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := debugServer.ListenAndServe(); err != nil &&
+			err != http.ErrServerClosed {
+			base.Logger.Error().Err(err).
+				Msg("debug server error")
+		}
+	}()
+
+	base.Air.AddShutdownJob(func() {
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			10*time.Second,
+		)
+		defer cancel()
+
+		debugServer.Shutdown(ctx)
+	})
+}
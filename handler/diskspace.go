@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync/atomic"
+
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// diskSpaceMinFree is the minimum free space in bytes of the filesystem
+	// hosting the `goproxyTempDir`. Below it, new Goproxy cache puts are
+	// paused so that the in-flight ones can finish and free their
+	// temporary files. The watchdog is disabled when it is not positive.
+	diskSpaceMinFree = goproxyViper.GetInt64("min_free_disk_space")
+
+	// diskSpaceFree is the latest known free space in bytes of the
+	// filesystem hosting the `goproxyTempDir`. It is negative when unknown.
+	diskSpaceFree atomic.Int64
+
+	// diskSpaceLow indicates whether the free space of the filesystem
+	// hosting the `goproxyTempDir` is below the `diskSpaceMinFree`.
+	diskSpaceLow atomic.Bool
+
+	// diskSpaceSkippedCachePuts is the number of the Goproxy cache puts
+	// skipped due to the low disk space.
+	diskSpaceSkippedCachePuts atomic.Int64
+)
+
+func init() {
+	diskSpaceFree.Store(-1)
+
+	expvar.Publish("disk_space", expvar.Func(func() any {
+		return map[string]any{
+			"free_bytes":         diskSpaceFree.Load(),
+			"min_free_bytes":     diskSpaceMinFree,
+			"low":                diskSpaceLow.Load(),
+			"skipped_cache_puts": diskSpaceSkippedCachePuts.Load(),
+		}
+	}))
+
+	if diskSpaceMinFree <= 0 {
+		return
+	}
+
+	checkDiskSpace()
+	if _, err := base.Cron.AddFunc("@every 10s", checkDiskSpace); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add disk space check cron job")
+	}
+}
+
+// checkDiskSpace updates the `diskSpaceFree` and the `diskSpaceLow`, and logs
+// an alert when the disk space becomes low or recovers.
+func checkDiskSpace() {
+	free, err := freeDiskSpace(goproxyTempDir)
+	if err != nil {
+		base.Logger.Error().Err(err).
+			Msg("failed to check disk space")
+		return
+	}
+
+	diskSpaceFree.Store(free)
+
+	low := free < diskSpaceMinFree
+	if diskSpaceLow.Swap(low) == low {
+		return
+	}
+
+	if low {
+		base.Logger.Error().
+			Str("dir", goproxyTempDir).
+			Int64("free_bytes", free).
+			Int64("min_free_bytes", diskSpaceMinFree).
+			Int("inflight_cache_puts", inflightGoproxyCachePuts()).
+			Msg("disk space low, pausing goproxy cache puts")
+	} else {
+		base.Logger.Info().
+			Str("dir", goproxyTempDir).
+			Int64("free_bytes", free).
+			Msg("disk space recovered, resuming goproxy cache puts")
+	}
+}
+
+// checkDiskSpaceHealth checks whether the free space of the filesystem hosting
+// the `goproxyTempDir` is above the `diskSpaceMinFree`.
+func checkDiskSpaceHealth(ctx context.Context) error {
+	if diskSpaceLow.Load() {
+		return errors.New("disk space low")
+	}
+
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package handler
+
+import "errors"
+
+// freeDiskSpace returns the free space in bytes available to unprivileged
+// users of the filesystem hosting the dir.
+func freeDiskSpace(dir string) (int64, error) {
+	return 0, errors.New("disk space check not supported")
+}
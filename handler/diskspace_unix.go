@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package handler
+
+import "syscall"
+
+// freeDiskSpace returns the free space in bytes available to unprivileged
+// users of the filesystem hosting the dir.
+func freeDiskSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,472 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	// dnsCacheEnabled indicates whether the host names of the upstreams are
+	// resolved with the `dnsCache`.
+	dnsCacheEnabled = goproxyViper.GetBool("dns_cache")
+
+	// dnsServers is the addresses of the DNS servers used to resolve the
+	// host names of the upstreams. The resolver of the system is used when
+	// it is empty, in which case the TTLs are unknown and the
+	// `dnsCacheMinTTL` is used.
+	dnsServers = newDNSServers(goproxyViper.GetStringSlice("dns_servers"))
+
+	// dnsTimeout is the maximum duration allowed for a DNS query.
+	dnsTimeout = goproxyViper.GetDuration("dns_timeout")
+
+	// dnsCacheMinTTL is the minimum TTL of the entries of the `dnsCache`.
+	dnsCacheMinTTL = goproxyViper.GetDuration("dns_cache_min_ttl")
+
+	// dnsCacheMaxTTL is the maximum TTL of the entries of the `dnsCache`.
+	dnsCacheMaxTTL = goproxyViper.GetDuration("dns_cache_max_ttl")
+
+	// dnsCacheStaleTTL is how long an expired entry of the `dnsCache` is
+	// still used when the host name cannot be resolved again.
+	dnsCacheStaleTTL = goproxyViper.GetDuration("dns_cache_stale_ttl")
+
+	// dnsCacheMaxEntries is the maximum number of the entries of the
+	// `dnsCache`.
+	dnsCacheMaxEntries = goproxyViper.GetInt("dns_cache_max_entries")
+
+	// dnsCache is the resolved IPs of the host names of the upstreams keyed
+	// by the host names.
+	dnsCache = map[string]*dnsCacheEntry{}
+
+	// dnsCacheMutex is used to protect the `dnsCache`.
+	dnsCacheMutex sync.Mutex
+
+	// dnsCacheHits is the number of the host names resolved from the
+	// `dnsCache`.
+	dnsCacheHits = expvar.NewInt("dns_cache_hits")
+
+	// dnsCacheMisses is the number of the host names resolved with the DNS
+	// servers.
+	dnsCacheMisses = expvar.NewInt("dns_cache_misses")
+
+	// dnsCacheStaleHits is the number of the host names resolved from the
+	// expired entries of the `dnsCache` since they failed to be resolved
+	// with the DNS servers.
+	dnsCacheStaleHits = expvar.NewInt("dns_cache_stale_hits")
+)
+
+// dnsCacheEntry is an entry of the `dnsCache`.
+type dnsCacheEntry struct {
+	addrs     []netip.Addr
+	expiresAt time.Time
+}
+
+// newDNSServers returns a new `dnsServers`. The port 53 is used for the
+// servers without one.
+func newDNSServers(servers []string) []string {
+	for i, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			servers[i] = net.JoinHostPort(
+				strings.Trim(server, "[]"),
+				"53",
+			)
+		}
+	}
+
+	return servers
+}
+
+// dnsCachingDialContext returns a function that dials like the d, but with the
+// host names resolved with the `dnsCache` when it is enabled. The resolved IPs
+// are tried in order until one of them is connected.
+func dnsCachingDialContext(d *net.Dialer) func(
+	ctx context.Context,
+	network string,
+	address string,
+) (net.Conn, error) {
+	return func(
+		ctx context.Context,
+		network string,
+		address string,
+	) (net.Conn, error) {
+		if !dnsCacheEnabled {
+			return d.DialContext(ctx, network, address)
+		}
+
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs, err := lookupDNSCache(ctx, host)
+		if err != nil {
+			return nil, &net.OpError{
+				Op:  "dial",
+				Net: network,
+				Err: err,
+			}
+		}
+
+		var firstErr error
+		for _, addr := range addrs {
+			conn, err := d.DialContext(
+				ctx,
+				network,
+				net.JoinHostPort(addr.String(), port),
+			)
+			if err == nil {
+				return conn, nil
+			}
+
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		return nil, firstErr
+	}
+}
+
+// lookupDNSCache returns the IPs of the host from the `dnsCache`, or resolves
+// them if they are missing or expired. An expired entry is still used within
+// the `dnsCacheStaleTTL` if the host fails to be resolved.
+func lookupDNSCache(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+
+	now := time.Now()
+
+	dnsCacheMutex.Lock()
+	dce, ok := dnsCache[host]
+	dnsCacheMutex.Unlock()
+
+	if ok && now.Before(dce.expiresAt) {
+		dnsCacheHits.Add(1)
+		return dce.addrs, nil
+	}
+
+	dnsCacheMisses.Add(1)
+
+	addrs, ttl, err := resolveHost(ctx, host)
+	if err != nil {
+		if ok && now.Before(dce.expiresAt.Add(dnsCacheStaleTTL)) {
+			dnsCacheStaleHits.Add(1)
+			base.Logger.Warn().Err(err).
+				Str("host", host).
+				Msg("using stale dns cache entry")
+			return dce.addrs, nil
+		}
+
+		return nil, err
+	}
+
+	ttl = max(dnsCacheMinTTL, min(ttl, dnsCacheMaxTTL))
+
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+
+	if len(dnsCache) >= dnsCacheMaxEntries {
+		for k, v := range dnsCache {
+			if now.After(v.expiresAt.Add(dnsCacheStaleTTL)) {
+				delete(dnsCache, k)
+			}
+		}
+
+		for k := range dnsCache {
+			if len(dnsCache) < dnsCacheMaxEntries {
+				break
+			}
+
+			delete(dnsCache, k)
+		}
+	}
+
+	dnsCache[host] = &dnsCacheEntry{
+		addrs:     addrs,
+		expiresAt: now.Add(ttl),
+	}
+
+	return addrs, nil
+}
+
+// resolveHost resolves the IPs of the host, and returns them along with their
+// TTL. The IPv4 addresses come first.
+func resolveHost(
+	ctx context.Context,
+	host string,
+) ([]netip.Addr, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	if len(dnsServers) == 0 {
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		sortDNSAddrs(addrs)
+
+		return addrs, dnsCacheMinTTL, nil
+	}
+
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var lastErr error
+	for _, server := range dnsServers {
+		var (
+			addrs []netip.Addr
+			ttl   time.Duration = -1
+		)
+
+		for _, qtype := range []dnsmessage.Type{
+			dnsmessage.TypeA,
+			dnsmessage.TypeAAAA,
+		} {
+			qaddrs, qttl, err := queryDNS(ctx, server, name, qtype)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			addrs = append(addrs, qaddrs...)
+			if len(qaddrs) > 0 && (ttl < 0 || qttl < ttl) {
+				ttl = qttl
+			}
+		}
+
+		if len(addrs) > 0 {
+			return addrs, ttl, nil
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = &net.DNSError{
+			Err:        "no such host",
+			Name:       host,
+			IsNotFound: true,
+		}
+	}
+
+	return nil, 0, lastErr
+}
+
+// sortDNSAddrs sorts the addrs so that the IPv4 ones come first.
+func sortDNSAddrs(addrs []netip.Addr) {
+	i := 0
+	for j, addr := range addrs {
+		if addr.Unmap().Is4() {
+			addrs[i], addrs[j] = addrs[j], addrs[i]
+			i++
+		}
+	}
+}
+
+// queryDNS queries the DNS server for the records of the name with the qtype,
+// and returns the IPs in them along with their minimum TTL. The query is sent
+// over UDP, and is sent again over TCP if the response is truncated.
+func queryDNS(
+	ctx context.Context,
+	server string,
+	name dnsmessage.Name,
+	qtype dnsmessage.Type,
+) ([]netip.Addr, time.Duration, error) {
+	idBytes := make([]byte, 2)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, 0, err
+	}
+
+	id := binary.BigEndian.Uint16(idBytes)
+	query, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               id,
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}).Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res, err := exchangeDNS(ctx, "udp", server, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var p dnsmessage.Parser
+	header, err := p.Start(res)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if header.Truncated {
+		res, err = exchangeDNS(ctx, "tcp", server, query)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if header, err = p.Start(res); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if header.ID != id || !header.Response {
+		return nil, 0, errors.New("mismatched dns response")
+	}
+
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{
+			Err:        "no such host",
+			Name:       name.String(),
+			Server:     server,
+			IsNotFound: true,
+		}
+	default:
+		return nil, 0, &net.DNSError{
+			Err: fmt.Sprint(
+				"server misbehaving: ",
+				header.RCode,
+			),
+			Name:        name.String(),
+			Server:      server,
+			IsTemporary: true,
+		}
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		addrs    []netip.Addr
+		ttl      time.Duration
+		answered bool
+	)
+
+	for {
+		rh, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		// The TTLs of the CNAME records count as well, since the IPs
+		// expire along with them.
+		rttl := time.Duration(rh.TTL) * time.Second
+		if !answered || rttl < ttl {
+			ttl = rttl
+		}
+
+		answered = true
+
+		var addr netip.Addr
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+
+			addr = netip.AddrFrom4(r.A)
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+
+			addr = netip.AddrFrom16(r.AAAA)
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+
+			continue
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, ttl, nil
+}
+
+// exchangeDNS sends the query to the DNS server over the network ("udp" or
+// "tcp"), and returns the response.
+func exchangeDNS(
+	ctx context.Context,
+	network string,
+	server string,
+	query []byte,
+) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		res := make([]byte, 1232)
+		n, err := conn.Read(res)
+		if err != nil {
+			return nil, err
+		}
+
+		return res[:n], nil
+	}
+
+	b := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(b, uint16(len(query)))
+	copy(b[2:], query)
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, binary.BigEndian.Uint16(b[:2]))
+	if _, err := io.ReadFull(conn, res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+var (
+	// downloadLimitRate is the maximum number of bytes per second of each
+	// zip file served directly. There is no limit when it is not positive.
+	downloadLimitRate = goproxyViper.GetFloat64("zip_download_rate_limit")
+
+	// downloadLimitRatePerIP is the maximum number of bytes per second of
+	// all the zip files served directly to each client IP at the same
+	// time. There is no limit when it is not positive.
+	downloadLimitRatePerIP = goproxyViper.GetFloat64(
+		"zip_download_rate_limit_per_ip",
+	)
+
+	// downloadLimitIPBuckets is the token buckets of the client IPs that
+	// are being served zip files.
+	downloadLimitIPBuckets = map[string]*downloadLimitIPBucket{}
+
+	// downloadLimitIPBucketsMutex is used to protect the
+	// `downloadLimitIPBuckets` and their token buckets.
+	downloadLimitIPBucketsMutex sync.Mutex
+
+	// downloadLimitThrottles is the number of the writes of the zip files
+	// delayed due to the `downloadLimitRate` or the
+	// `downloadLimitRatePerIP`.
+	downloadLimitThrottles = expvar.NewInt("zip_download_throttles")
+)
+
+// downloadLimitBucket is a token bucket of the bytes of the zip files served
+// directly.
+type downloadLimitBucket struct {
+	rate      float64
+	tokens    float64
+	updatedAt time.Time
+}
+
+// newDownloadLimitBucket returns a new instance of the `downloadLimitBucket`
+// that allows the rate bytes per second with a burst of one second.
+func newDownloadLimitBucket(rate float64) *downloadLimitBucket {
+	return &downloadLimitBucket{
+		rate:      rate,
+		tokens:    rate,
+		updatedAt: time.Now(),
+	}
+}
+
+// take takes the n bytes from the dlb at the now. It returns how long to wait
+// until the dlb is no longer in debt.
+func (dlb *downloadLimitBucket) take(n int, now time.Time) time.Duration {
+	dlb.tokens = math.Min(
+		dlb.tokens+now.Sub(dlb.updatedAt).Seconds()*dlb.rate,
+		dlb.rate,
+	)
+	dlb.updatedAt = now
+
+	dlb.tokens -= float64(n)
+	if dlb.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-dlb.tokens / dlb.rate * float64(time.Second))
+}
+
+// downloadLimitIPBucket is the token bucket shared by the zip files being
+// served directly to a client IP.
+type downloadLimitIPBucket struct {
+	*downloadLimitBucket
+
+	refs int
+}
+
+// downloadLimitGas is used to limit the download speed of the zip files served
+// directly, per response and per client IP, so that a few clients pulling giant
+// zip files in parallel cannot use up the bandwidth of the server. The
+// redirected zip files are not affected.
+func downloadLimitGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if downloadLimitRate <= 0 && downloadLimitRatePerIP <= 0 {
+			return next(req, res)
+		}
+
+		if !strings.HasSuffix(req.HTTPRequest().URL.Path, ".zip") {
+			return next(req, res)
+		}
+
+		dlrw := &downloadLimitResponseWriter{
+			ResponseWriter: res.HTTPResponseWriter(),
+			ctx:            req.Context,
+			chunkSize:      math.MaxInt,
+		}
+
+		if downloadLimitRate > 0 {
+			dlrw.bucket = newDownloadLimitBucket(downloadLimitRate)
+			dlrw.chunkSize = int(math.Max(downloadLimitRate, 1))
+		}
+
+		if downloadLimitRatePerIP > 0 {
+			clientHost := req.ClientHost()
+			dlrw.ipBucket = acquireDownloadLimitIPBucket(clientHost)
+			defer releaseDownloadLimitIPBucket(clientHost)
+
+			dlrw.chunkSize = min(
+				dlrw.chunkSize,
+				int(math.Max(downloadLimitRatePerIP, 1)),
+			)
+		}
+
+		res.SetHTTPResponseWriter(dlrw)
+
+		return next(req, res)
+	}
+}
+
+// acquireDownloadLimitIPBucket returns the token bucket of the clientHost. The
+// `releaseDownloadLimitIPBucket` must be called once it is no longer used.
+func acquireDownloadLimitIPBucket(clientHost string) *downloadLimitIPBucket {
+	downloadLimitIPBucketsMutex.Lock()
+	defer downloadLimitIPBucketsMutex.Unlock()
+
+	dlipb := downloadLimitIPBuckets[clientHost]
+	if dlipb == nil {
+		dlipb = &downloadLimitIPBucket{
+			downloadLimitBucket: newDownloadLimitBucket(
+				downloadLimitRatePerIP,
+			),
+		}
+		downloadLimitIPBuckets[clientHost] = dlipb
+	}
+
+	dlipb.refs++
+
+	return dlipb
+}
+
+// releaseDownloadLimitIPBucket releases the token bucket of the clientHost
+// acquired by the `acquireDownloadLimitIPBucket`.
+func releaseDownloadLimitIPBucket(clientHost string) {
+	downloadLimitIPBucketsMutex.Lock()
+	defer downloadLimitIPBucketsMutex.Unlock()
+
+	dlipb := downloadLimitIPBuckets[clientHost]
+	if dlipb.refs--; dlipb.refs == 0 {
+		delete(downloadLimitIPBuckets, clientHost)
+	}
+}
+
+// downloadLimitResponseWriter is an `http.ResponseWriter` that writes no faster
+// than its token buckets allow.
+type downloadLimitResponseWriter struct {
+	http.ResponseWriter
+
+	ctx       context.Context
+	bucket    *downloadLimitBucket
+	ipBucket  *downloadLimitIPBucket
+	chunkSize int
+}
+
+// Write implements the `http.ResponseWriter`.
+func (dlrw *downloadLimitResponseWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), dlrw.chunkSize)]
+		n, err := dlrw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+		if err := dlrw.wait(n); err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// wait takes the n bytes from the token buckets of the dlrw and waits until
+// they are no longer in debt.
+func (dlrw *downloadLimitResponseWriter) wait(n int) error {
+	now := time.Now()
+
+	var d time.Duration
+	if dlrw.bucket != nil {
+		d = dlrw.bucket.take(n, now)
+	}
+
+	if dlrw.ipBucket != nil {
+		downloadLimitIPBucketsMutex.Lock()
+		d = max(d, dlrw.ipBucket.take(n, now))
+		downloadLimitIPBucketsMutex.Unlock()
+	}
+
+	if d <= 0 {
+		return nil
+	}
+
+	downloadLimitThrottles.Add(1)
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-dlrw.ctx.Done():
+		return dlrw.ctx.Err()
+	}
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"encoding/base64"
+	"os"
+	"strings"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// qiniuKodoSSE is the server-side encryption of the objects stored in the Qiniu
+// Cloud Kodo. There is none when it is nil.
+var qiniuKodoSSE = newQiniuKodoSSE()
+
+// newQiniuKodoSSE returns a new `qiniuKodoSSE` from the "kodo_sse" of the
+// `qiniuViper`, which is one of "sse-s3", "sse-kms" and "sse-c", or empty for
+// none.
+func newQiniuKodoSSE() encrypt.ServerSide {
+	switch sse := qiniuViper.GetString("kodo_sse"); sse {
+	case "":
+		return nil
+	case "sse-s3":
+		return encrypt.NewSSE()
+	case "sse-kms":
+		sse, err := encrypt.NewSSEKMS(
+			qiniuViper.GetString("kodo_sse_kms_key_id"),
+			nil,
+		)
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to create qiniu kodo sse-kms")
+		}
+
+		return sse
+	case "sse-c":
+		b, err := os.ReadFile(qiniuViper.GetString("kodo_sse_c_key_file"))
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to read qiniu kodo sse-c key file")
+		}
+
+		key, err := base64.StdEncoding.DecodeString(
+			strings.TrimSpace(string(b)),
+		)
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to decode qiniu kodo sse-c key")
+		}
+
+		sse, err := encrypt.NewSSEC(key)
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to create qiniu kodo sse-c")
+		}
+
+		return sse
+	default:
+		base.Logger.Fatal().
+			Str("kodo_sse", sse).
+			Msg("unsupported qiniu kodo sse")
+	}
+
+	return nil
+}
+
+// isQiniuKodoSSEC reports whether the objects stored in the Qiniu Cloud Kodo
+// are encrypted with the customer-provided keys, in which case they can only
+// be read by those who present the keys, so they can never be redirected to.
+func isQiniuKodoSSEC() bool {
+	return qiniuKodoSSE != nil && qiniuKodoSSE.Type() == encrypt.SSEC
+}
+
+// qiniuKodoGetObjectOptions returns the `minio.GetObjectOptions` (which is also
+// the `minio.StatObjectOptions`) used to read the objects stored in the Qiniu
+// Cloud Kodo with the `qiniuKodoSSE`.
+func qiniuKodoGetObjectOptions() minio.GetObjectOptions {
+	return minio.GetObjectOptions{
+		ServerSideEncryption: qiniuKodoSSE,
+	}
+}
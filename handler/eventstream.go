@@ -0,0 +1,369 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/nsqio/go-nsq"
+)
+
+var (
+	// eventStreamViper is used to get the configuration items of the event
+	// stream.
+	eventStreamViper = base.Viper.Sub("event_stream")
+
+	// eventStreamTopic is the topic that the stream events are published
+	// to.
+	eventStreamTopic = eventStreamViper.GetString("topic")
+
+	// eventStreamPublisher is the publisher of the stream events. It is nil
+	// when the event stream is disabled.
+	eventStreamPublisher streamEventPublisher
+
+	// eventStreamQueue is the queue of the stream events waiting to be
+	// published.
+	eventStreamQueue chan *streamEvent
+
+	// eventStreamStop is closed to stop the stream event publisher.
+	eventStreamStop = make(chan struct{})
+
+	// eventStreamDone is closed when the stream event publisher stops.
+	eventStreamDone = make(chan struct{})
+
+	// eventStreamPublished is the number of the published stream events.
+	eventStreamPublished atomic.Int64
+
+	// eventStreamDropped is the number of the stream events dropped because
+	// the `eventStreamQueue` was full or the broker failed to accept them.
+	eventStreamDropped atomic.Int64
+)
+
+// eventStreamBatchSize is the maximum number of the stream events published in
+// a batch.
+const eventStreamBatchSize = 100
+
+// streamEvent is an event of the Goproxy published to the event stream.
+type streamEvent struct {
+	Type          string    `json:"type"`
+	Time          time.Time `json:"time"`
+	Instance      string    `json:"instance"`
+	Name          string    `json:"name,omitempty"`
+	ModulePath    string    `json:"module_path,omitempty"`
+	ModuleVersion string    `json:"module_version,omitempty"`
+	Size          int64     `json:"size,omitempty"`
+	Upstream      string    `json:"upstream,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// streamEventPublisher publishes the stream events to a message broker.
+type streamEventPublisher interface {
+	// publish publishes the events to the topic.
+	publish(ctx context.Context, topic string, events []*streamEvent) error
+
+	// stop stops the publisher.
+	stop()
+}
+
+func init() {
+	if !eventStreamViper.GetBool("enabled") {
+		return
+	}
+
+	if eventStreamTopic == "" {
+		base.Logger.Fatal().
+			Msg("event stream requires a topic")
+	}
+
+	switch broker := eventStreamViper.GetString("broker"); broker {
+	case "nsq":
+		p, err := newNSQStreamEventPublisher(
+			eventStreamViper.GetString("nsqd_address"),
+		)
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to create nsq producer")
+		}
+
+		eventStreamPublisher = p
+	case "kafka":
+		restProxyURL := eventStreamViper.GetString(
+			"kafka_rest_proxy_url",
+		)
+		if _, err := url.Parse(restProxyURL); err != nil ||
+			restProxyURL == "" {
+			base.Logger.Fatal().
+				Str("kafka_rest_proxy_url", restProxyURL).
+				Msg("invalid kafka rest proxy url")
+		}
+
+		eventStreamPublisher = &kafkaStreamEventPublisher{
+			restProxyURL: strings.TrimSuffix(restProxyURL, "/"),
+			httpClient: &http.Client{
+				Timeout: 30 * time.Second,
+			},
+		}
+	default:
+		base.Logger.Fatal().
+			Str("broker", broker).
+			Msg("unsupported event stream broker")
+	}
+
+	eventStreamQueue = make(
+		chan *streamEvent,
+		eventStreamViper.GetInt("queue_size"),
+	)
+
+	go publishStreamEvents()
+
+	base.Air.AddShutdownJob(func() {
+		close(eventStreamStop)
+		<-eventStreamDone
+	})
+
+	expvar.Publish("event_stream", expvar.Func(func() any {
+		return map[string]int64{
+			"queue_length": int64(len(eventStreamQueue)),
+			"published":    eventStreamPublished.Load(),
+			"dropped":      eventStreamDropped.Load(),
+		}
+	}))
+}
+
+// publishStreamEvent queues the event of the eventType for the Goproxy cache
+// with the name. The event is dropped if the queue is full, so that the
+// requests are never blocked by the broker.
+func publishStreamEvent(eventType, name string, size int64) {
+	if eventStreamQueue == nil {
+		return
+	}
+
+	se := &streamEvent{
+		Type:     eventType,
+		Time:     time.Now().UTC(),
+		Instance: leaderID,
+		Name:     name,
+		Size:     size,
+	}
+
+	se.ModulePath, se.ModuleVersion, _ = parseGoproxyCacheName(name)
+
+	queueStreamEvent(se)
+}
+
+// publishUpstreamFailureStreamEvent queues the "upstream_failure" event of the
+// upstream host that failed with the err.
+func publishUpstreamFailureStreamEvent(host string, err error) {
+	if eventStreamQueue == nil {
+		return
+	}
+
+	queueStreamEvent(&streamEvent{
+		Type:     "upstream_failure",
+		Time:     time.Now().UTC(),
+		Instance: leaderID,
+		Upstream: host,
+		Error:    err.Error(),
+	})
+}
+
+// queueStreamEvent queues the se for publishing.
+func queueStreamEvent(se *streamEvent) {
+	select {
+	case eventStreamQueue <- se:
+	default:
+		eventStreamDropped.Add(1)
+	}
+}
+
+// isModuleStreamEventName reports whether the Goproxy cache with the name is a
+// module file whose events are published to the event stream.
+func isModuleStreamEventName(name string) bool {
+	switch goproxyCacheNameType(name) {
+	case "info", "mod", "zip":
+		return !strings.HasPrefix(name, "sumdb/")
+	}
+
+	return false
+}
+
+// publishStreamEvents publishes the stream events in the `eventStreamQueue` in
+// batches until the `eventStreamStop` is closed. The stream events are best
+// effort, so a batch rejected by the broker is dropped rather than retried.
+func publishStreamEvents() {
+	defer close(eventStreamDone)
+	defer eventStreamPublisher.stop()
+
+	batch := make([]*streamEvent, 0, eventStreamBatchSize)
+	publish := func() {
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			30*time.Second,
+		)
+		defer cancel()
+
+		if err := eventStreamPublisher.publish(
+			ctx,
+			eventStreamTopic,
+			batch,
+		); err != nil {
+			eventStreamDropped.Add(int64(len(batch)))
+			base.Logger.Error().Err(err).
+				Int("count", len(batch)).
+				Msg("failed to publish stream events")
+		} else {
+			eventStreamPublished.Add(int64(len(batch)))
+		}
+
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case se := <-eventStreamQueue:
+			batch = append(batch, se)
+			for len(batch) < eventStreamBatchSize &&
+				len(eventStreamQueue) > 0 {
+				batch = append(batch, <-eventStreamQueue)
+			}
+
+			publish()
+		case <-eventStreamStop:
+			for len(eventStreamQueue) > 0 {
+				batch = append(batch, <-eventStreamQueue)
+				if len(batch) == eventStreamBatchSize {
+					publish()
+				}
+			}
+
+			if len(batch) > 0 {
+				publish()
+			}
+
+			return
+		}
+	}
+}
+
+// nsqStreamEventPublisher is a `streamEventPublisher` that publishes the stream
+// events to an nsqd.
+type nsqStreamEventPublisher struct {
+	producer *nsq.Producer
+}
+
+// newNSQStreamEventPublisher returns a new `nsqStreamEventPublisher` that
+// publishes to the nsqd at the address.
+func newNSQStreamEventPublisher(
+	address string,
+) (*nsqStreamEventPublisher, error) {
+	producer, err := nsq.NewProducer(address, nsq.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	producer.SetLogger(log.New(base.Logger, "", 0), nsq.LogLevelWarning)
+
+	return &nsqStreamEventPublisher{
+		producer: producer,
+	}, nil
+}
+
+// publish implements the `streamEventPublisher`.
+func (nsep *nsqStreamEventPublisher) publish(
+	_ context.Context,
+	topic string,
+	events []*streamEvent,
+) error {
+	bodies := make([][]byte, 0, len(events))
+	for _, se := range events {
+		b, err := json.Marshal(se)
+		if err != nil {
+			return err
+		}
+
+		bodies = append(bodies, b)
+	}
+
+	return nsep.producer.MultiPublish(topic, bodies)
+}
+
+// stop implements the `streamEventPublisher`.
+func (nsep *nsqStreamEventPublisher) stop() {
+	nsep.producer.Stop()
+}
+
+// kafkaStreamEventPublisher is a `streamEventPublisher` that publishes the
+// stream events to a Kafka through a Kafka REST Proxy (v2 API). The module path
+// is used as the record key, so that the events of a module stay in order.
+type kafkaStreamEventPublisher struct {
+	restProxyURL string
+	httpClient   *http.Client
+}
+
+// publish implements the `streamEventPublisher`.
+func (ksep *kafkaStreamEventPublisher) publish(
+	ctx context.Context,
+	topic string,
+	events []*streamEvent,
+) error {
+	type record struct {
+		Key   string       `json:"key,omitempty"`
+		Value *streamEvent `json:"value"`
+	}
+
+	records := make([]record, 0, len(events))
+	for _, se := range events {
+		records = append(records, record{
+			Key:   se.ModulePath,
+			Value: se,
+		})
+	}
+
+	b, err := json.Marshal(map[string]any{"records": records})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		ksep.restProxyURL+path.Join("/topics", url.PathEscape(topic)),
+		bytes.NewReader(b),
+	)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	res, err := ksep.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < http.StatusOK ||
+		res.StatusCode >= http.StatusMultipleChoices {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(b))
+	}
+
+	return nil
+}
+
+// stop implements the `streamEventPublisher`.
+func (ksep *kafkaStreamEventPublisher) stop() {
+	ksep.httpClient.CloseIdleConnections()
+}
@@ -0,0 +1,345 @@
+package handler
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/mod/module"
+)
+
+const (
+	// feedNewVersionsPrefix is the prefix of the objects where the
+	// instances persist their recently cached module versions.
+	feedNewVersionsPrefix = "feeds/new-versions/"
+
+	// feedNewVersionsMaxAge is the maximum age of the module versions in
+	// the new version feeds.
+	feedNewVersionsMaxAge = 7 * 24 * time.Hour
+
+	// feedNewVersionsInstanceLimit is the maximum number of the recently
+	// cached module versions kept by an instance.
+	feedNewVersionsInstanceLimit = 1000
+
+	// feedNewVersionsEntryLimit is the maximum number of the entries in a
+	// new version feed.
+	feedNewVersionsEntryLimit = 50
+)
+
+// feedNewVersion is a newly cached module version.
+type feedNewVersion struct {
+	ModulePath string    `json:"module_path"`
+	Version    string    `json:"version"`
+	CachedAt   time.Time `json:"cached_at"`
+}
+
+var (
+	// feedNewVersions is the module versions recently cached by the
+	// current instance, oldest first.
+	feedNewVersions []feedNewVersion
+
+	// feedNewVersionsDirty indicates whether the `feedNewVersions` has been
+	// changed since the last flush.
+	feedNewVersionsDirty bool
+
+	// feedNewVersionsMutex is used to protect the `feedNewVersions` and
+	// the `feedNewVersionsDirty`.
+	feedNewVersionsMutex sync.Mutex
+
+	// feedNewVersionsCache is the cached module versions recently cached
+	// by all the instances, newest first.
+	feedNewVersionsCache []feedNewVersion
+
+	// feedNewVersionsCacheExpiry is the expiry of the
+	// `feedNewVersionsCache`.
+	feedNewVersionsCacheExpiry time.Time
+
+	// feedNewVersionsCacheMutex is used to protect the
+	// `feedNewVersionsCache` and the `feedNewVersionsCacheExpiry`.
+	feedNewVersionsCacheMutex sync.Mutex
+)
+
+func init() {
+	if _, err := base.Cron.AddFunc(
+		"* * * * *", // Every minute
+		flushFeedNewVersions,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add new version feed flush cron job")
+	}
+
+	base.Air.AddShutdownJob(flushFeedNewVersions)
+
+	base.Air.BATCH(
+		getHeadMethods,
+		"/feeds/new-versions.atom",
+		hFeedNewVersions,
+		authGas("proxy"),
+		minutelyCachemanGas,
+	)
+}
+
+// addFeedNewVersion adds the mv newly cached by the current instance to the
+// `feedNewVersions`.
+func addFeedNewVersion(mv module.Version) {
+	feedNewVersionsMutex.Lock()
+	defer feedNewVersionsMutex.Unlock()
+
+	feedNewVersions = append(feedNewVersions, feedNewVersion{
+		ModulePath: mv.Path,
+		Version:    mv.Version,
+		CachedAt:   time.Now().UTC(),
+	})
+	if n := len(feedNewVersions); n > feedNewVersionsInstanceLimit {
+		feedNewVersions = append(
+			[]feedNewVersion(nil),
+			feedNewVersions[n-feedNewVersionsInstanceLimit:]...,
+		)
+	}
+
+	feedNewVersionsDirty = true
+}
+
+// flushFeedNewVersions flushes the `feedNewVersions` to the Qiniu Cloud Kodo if
+// it has been changed.
+func flushFeedNewVersions() {
+	feedNewVersionsMutex.Lock()
+	if !feedNewVersionsDirty {
+		feedNewVersionsMutex.Unlock()
+		return
+	}
+
+	fnvs := append([]feedNewVersion(nil), feedNewVersions...)
+	feedNewVersionsDirty = false
+	feedNewVersionsMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := putStatObject(
+		ctx,
+		feedNewVersionsPrefix+leaderID,
+		fnvs,
+	); err != nil {
+		base.Logger.Error().Err(err).
+			Msg("failed to flush new version feed")
+	}
+}
+
+// getFeedNewVersions returns the module versions recently cached by all the
+// instances, newest first. The objects left by the instances that have not
+// flushed within the `feedNewVersionsMaxAge` are removed.
+func getFeedNewVersions(ctx context.Context) ([]feedNewVersion, error) {
+	feedNewVersionsCacheMutex.Lock()
+	defer feedNewVersionsCacheMutex.Unlock()
+
+	if time.Now().Before(feedNewVersionsCacheExpiry) {
+		return feedNewVersionsCache, nil
+	}
+
+	since := time.Now().Add(-feedNewVersionsMaxAge)
+	seen := map[module.Version]bool{}
+
+	var fnvs []feedNewVersion
+	for objectInfo := range qiniuKodoClient.ListObjects(
+		ctx,
+		qiniuKodoBucketName,
+		minio.ListObjectsOptions{
+			Prefix:    feedNewVersionsPrefix,
+			Recursive: true,
+		},
+	) {
+		if objectInfo.Err != nil {
+			return nil, objectInfo.Err
+		}
+
+		if objectInfo.LastModified.Before(since) {
+			if err := qiniuKodoClient.RemoveObject(
+				ctx,
+				qiniuKodoBucketName,
+				objectInfo.Key,
+				minio.RemoveObjectOptions{},
+			); err != nil && !isNotFoundMinIOError(err) {
+				base.Logger.Error().Err(err).
+					Str("name", objectInfo.Key).
+					Msg("failed to remove new version feed")
+			}
+
+			continue
+		}
+
+		var instanceFNVs []feedNewVersion
+		if err := getStatObject(
+			ctx,
+			objectInfo.Key,
+			&instanceFNVs,
+		); err != nil {
+			if isNotFoundMinIOError(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		for _, fnv := range instanceFNVs {
+			mv := module.Version{
+				Path:    fnv.ModulePath,
+				Version: fnv.Version,
+			}
+			if fnv.CachedAt.Before(since) || seen[mv] {
+				continue
+			}
+
+			seen[mv] = true
+			fnvs = append(fnvs, fnv)
+		}
+	}
+
+	sort.Slice(fnvs, func(i, j int) bool {
+		return fnvs[i].CachedAt.After(fnvs[j].CachedAt)
+	})
+
+	feedNewVersionsCache = fnvs
+	feedNewVersionsCacheExpiry = time.Now().Add(time.Minute)
+
+	return fnvs, nil
+}
+
+// atomFeed is an Atom feed.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// atomLink is a link of an Atom feed or entry.
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+// atomEntry is an entry of an Atom feed.
+type atomEntry struct {
+	ID      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+// hFeedNewVersions handles requests to get the Atom feed of the newly cached
+// module versions. The optional "prefix" parameter limits the feed to the
+// modules matching it (see the `module.MatchPrefixPatterns`).
+func hFeedNewVersions(req *air.Request, res *air.Response) error {
+	var prefix string
+	if p := req.Param("prefix"); p != nil {
+		prefix = strings.Trim(p.Value().String(), "/")
+	}
+
+	if strings.Contains(prefix, ",") {
+		res.Status = http.StatusBadRequest
+		return errors.New("invalid prefix")
+	}
+
+	fnvs, err := getFeedNewVersions(req.Context)
+	if err != nil {
+		return err
+	}
+
+	const baseURL = "https://goproxy.cn"
+
+	selfURL := baseURL + "/feeds/new-versions.atom"
+	title := "Goproxy.cn: New Module Versions"
+	if prefix != "" {
+		selfURL += "?prefix=" + url.QueryEscape(prefix)
+		title += " of " + prefix
+	}
+
+	feed := atomFeed{
+		ID:    selfURL,
+		Title: title,
+		Links: []atomLink{
+			{
+				Rel:  "self",
+				Type: "application/atom+xml",
+				Href: selfURL,
+			},
+			{
+				Rel:  "alternate",
+				Type: "text/html",
+				Href: baseURL + "/",
+			},
+		},
+	}
+
+	for _, fnv := range fnvs {
+		if len(feed.Entries) == feedNewVersionsEntryLimit {
+			break
+		}
+
+		if prefix != "" &&
+			!module.MatchPrefixPatterns(prefix, fnv.ModulePath) {
+			continue
+		}
+
+		if isModuleBlocked(fnv.ModulePath, fnv.Version) {
+			continue
+		}
+
+		escapedModulePath, err := module.EscapePath(fnv.ModulePath)
+		if err != nil {
+			continue
+		}
+
+		escapedVersion, err := module.EscapeVersion(fnv.Version)
+		if err != nil {
+			continue
+		}
+
+		updated := fnv.CachedAt.UTC().Format(time.RFC3339)
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID: baseURL + "/" + path.Join(
+				escapedModulePath,
+				"@v",
+				escapedVersion+".info",
+			),
+			Title:   fnv.ModulePath + " " + fnv.Version,
+			Updated: updated,
+			Link: atomLink{
+				Rel:  "alternate",
+				Type: "text/html",
+				Href: baseURL + "/" + fnv.ModulePath,
+			},
+			Summary: fnv.ModulePath + "@" + fnv.Version +
+				" was cached at " + updated + ".",
+		})
+	}
+
+	feed.Updated = time.Now().UTC().Format(time.RFC3339)
+	if len(feed.Entries) > 0 {
+		feed.Updated = feed.Entries[0].Updated
+	}
+
+	b, err := xml.MarshalIndent(feed, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	res.Header.Set("Content-Type", "application/atom+xml; charset=utf-8")
+
+	return res.Write(strings.NewReader(xml.Header + string(b)))
+}
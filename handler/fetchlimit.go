@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	// fetchLimitGlobal is the maximum number of the concurrent upstream
+	// fetches. There is no limit when it is not positive.
+	fetchLimitGlobal = goproxyViper.GetInt("max_upstream_fetches")
+
+	// fetchLimitPerModule is the maximum number of the concurrent upstream
+	// fetches of each module. There is no limit when it is not positive.
+	fetchLimitPerModule = goproxyViper.GetInt(
+		"max_upstream_fetches_per_module",
+	)
+
+	// fetchLimitGlobalSlots is the slots of the concurrent upstream
+	// fetches.
+	fetchLimitGlobalSlots chan struct{}
+
+	// fetchLimitModuleSlots is the slots of the concurrent upstream
+	// fetches keyed by the modules.
+	fetchLimitModuleSlots = map[string]*fetchLimitModuleSlot{}
+
+	// fetchLimitModuleSlotsMutex is used to protect the
+	// `fetchLimitModuleSlots`.
+	fetchLimitModuleSlotsMutex sync.Mutex
+)
+
+// fetchLimitModuleSlot is the slots of the concurrent upstream fetches of a
+// module.
+type fetchLimitModuleSlot struct {
+	slots chan struct{}
+	refs  int
+}
+
+func init() {
+	if fetchLimitGlobal > 0 {
+		fetchLimitGlobalSlots = make(chan struct{}, fetchLimitGlobal)
+	}
+
+	expvar.Publish("upstream_fetch_limits", expvar.Func(func() any {
+		fetchLimitModuleSlotsMutex.Lock()
+		defer fetchLimitModuleSlotsMutex.Unlock()
+
+		return map[string]int{
+			"global_inflight": len(fetchLimitGlobalSlots),
+			"global_limit":    fetchLimitGlobal,
+			"module_limit":    fetchLimitPerModule,
+			"limited_modules": len(fetchLimitModuleSlots),
+		}
+	}))
+}
+
+// fetchLimitingTransport is an `http.RoundTripper` that limits the concurrent
+// upstream fetches globally and per module, so that a traffic spike cannot
+// open too many connections to the upstreams and trigger their throttling.
+type fetchLimitingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (flt *fetchLimitingTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	release, err := acquireFetchSlots(req.Context(), fetchModule(req))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := flt.next.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	res.Body = &fetchLimitedBody{
+		ReadCloser: res.Body,
+		release:    release,
+	}
+
+	return res, nil
+}
+
+// fetchModule returns the module targeted by the upstream fetch req. It returns
+// an empty string if the req does not target a module, such as the requests to
+// the checksum databases.
+func fetchModule(req *http.Request) string {
+	for _, sep := range []string{"/@v/", "/@latest"} {
+		if i := strings.Index(req.URL.Path, sep); i >= 0 {
+			return req.URL.Host + req.URL.Path[:i]
+		}
+	}
+
+	return ""
+}
+
+// acquireFetchSlots acquires a global slot and a slot of the module for an
+// upstream fetch. The returned function must be called to release them.
+func acquireFetchSlots(
+	ctx context.Context,
+	module string,
+) (func(), error) {
+	var moduleSlot *fetchLimitModuleSlot
+	if fetchLimitPerModule > 0 && module != "" {
+		fetchLimitModuleSlotsMutex.Lock()
+		moduleSlot = fetchLimitModuleSlots[module]
+		if moduleSlot == nil {
+			moduleSlot = &fetchLimitModuleSlot{
+				slots: make(chan struct{}, fetchLimitPerModule),
+			}
+			fetchLimitModuleSlots[module] = moduleSlot
+		}
+
+		moduleSlot.refs++
+		fetchLimitModuleSlotsMutex.Unlock()
+	}
+
+	releaseModuleSlot := func(acquired bool) {
+		if moduleSlot == nil {
+			return
+		}
+
+		if acquired {
+			<-moduleSlot.slots
+		}
+
+		fetchLimitModuleSlotsMutex.Lock()
+		if moduleSlot.refs--; moduleSlot.refs == 0 {
+			delete(fetchLimitModuleSlots, module)
+		}
+		fetchLimitModuleSlotsMutex.Unlock()
+	}
+
+	if moduleSlot != nil {
+		select {
+		case moduleSlot.slots <- struct{}{}:
+		case <-ctx.Done():
+			releaseModuleSlot(false)
+			return nil, ctx.Err()
+		}
+	}
+
+	if fetchLimitGlobalSlots != nil {
+		select {
+		case fetchLimitGlobalSlots <- struct{}{}:
+		case <-ctx.Done():
+			releaseModuleSlot(true)
+			return nil, ctx.Err()
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if fetchLimitGlobalSlots != nil {
+				<-fetchLimitGlobalSlots
+			}
+
+			releaseModuleSlot(true)
+		})
+	}, nil
+}
+
+// fetchLimitedBody is the body of an upstream fetch response that releases the
+// fetch slots when closed.
+type fetchLimitedBody struct {
+	io.ReadCloser
+
+	release func()
+}
+
+// Close implements the `io.Closer`.
+func (flb *fetchLimitedBody) Close() error {
+	err := flb.ReadCloser.Close()
+	flb.release()
+	return err
+}
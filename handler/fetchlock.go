@@ -0,0 +1,341 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// fetchLocker is the distributed lock that makes sure only one
+	// instance fetches an uncached module file from the upstream and
+	// uploads it, while the others wait for it to be cached. There is no
+	// lock when it is nil.
+	fetchLocker = newFetchLocker()
+
+	// fetchLockTTL is how long a fetch lock is held at most, in case its
+	// holder dies before releasing it.
+	fetchLockTTL = goproxyViper.GetDuration("fetch_lock_ttl")
+
+	// fetchLockWait is how long an instance waits for another one that
+	// holds the fetch lock before fetching by itself anyway.
+	fetchLockWait = goproxyViper.GetDuration("fetch_lock_wait")
+
+	// fetchLockPollInterval is the interval between two checks of whether
+	// the waited module file has been cached.
+	fetchLockPollInterval = goproxyViper.GetDuration(
+		"fetch_lock_poll_interval",
+	)
+
+	// fetchLockAcquired is the number of the fetch locks acquired.
+	fetchLockAcquired = expvar.NewInt("fetch_lock_acquired")
+
+	// fetchLockWaited is the number of the fetches that were saved by
+	// waiting for another instance.
+	fetchLockWaited = expvar.NewInt("fetch_lock_waited")
+
+	// fetchLockTimeouts is the number of the waits that timed out.
+	fetchLockTimeouts = expvar.NewInt("fetch_lock_timeouts")
+
+	// fetchLockHolds is the fetch locks held or being acquired by the
+	// current instance, keyed by their names.
+	fetchLockHolds = map[string]*fetchLockHold{}
+
+	// fetchLockHoldsMutex is used to protect the `fetchLockHolds`.
+	fetchLockHoldsMutex sync.Mutex
+)
+
+// fetchLock is a distributed lock keyed by names.
+type fetchLock interface {
+	// tryLock tries to lock the name for the ttl. It reports whether the
+	// current instance holds the lock.
+	tryLock(
+		ctx context.Context,
+		name string,
+		ttl time.Duration,
+	) (bool, error)
+
+	// unlock unlocks the name if the current instance holds the lock.
+	unlock(ctx context.Context, name string) error
+}
+
+// newFetchLocker returns a new `fetchLocker` from the "fetch_lock" of the
+// `goproxyViper`, which is one of "kodo" and "redis", or empty for none.
+func newFetchLocker() fetchLock {
+	switch backend := goproxyViper.GetString("fetch_lock"); backend {
+	case "":
+		return nil
+	case "kodo":
+		return kodoFetchLock{}
+	case "redis":
+		options := &redis.Options{
+			Addr: goproxyViper.GetString(
+				"fetch_lock_redis_address",
+			),
+			Username: goproxyViper.GetString(
+				"fetch_lock_redis_username",
+			),
+			Password: goproxyViper.GetString(
+				"fetch_lock_redis_password",
+			),
+			DB: goproxyViper.GetInt("fetch_lock_redis_db"),
+		}
+		if goproxyViper.GetBool("fetch_lock_redis_tls") {
+			options.TLSConfig = &tls.Config{
+				MinVersion: tls.VersionTLS12,
+			}
+		}
+
+		return &redisFetchLock{
+			client: redis.NewClient(options),
+		}
+	default:
+		base.Logger.Fatal().
+			Str("fetch_lock", backend).
+			Msg("unsupported fetch lock")
+	}
+
+	return nil
+}
+
+// lockGoproxyFetch locks the fetch of the uncached Goproxy cache with the name
+// across the instances. It returns a function that releases the lock, or nil
+// if the current instance does not hold it, in which case the lock is either
+// disabled, unnecessary, or held by another instance that has cached the
+// Goproxy cache or failed to do so within the `fetchLockWait`.
+//
+// The refetches (see the `withGoproxyCacheRefetch`) of the cached Goproxy
+// caches are locked too, and wait for the lock until the `fetchLockWait` even
+// if the Goproxy cache is present.
+//
+// Errors of the `fetchLocker` are logged and never fail the fetch.
+func lockGoproxyFetch(ctx context.Context, name string) func() {
+	if fetchLocker == nil ||
+		goproxyCacheOnly.Load() ||
+		maintenanceMode.Load() {
+		return nil
+	}
+
+	switch goproxyCacheNameType(name) {
+	case "info", "mod", "zip":
+	default:
+		return nil
+	}
+
+	refetch := isGoproxyCacheRefetch(ctx)
+	if !refetch && !isGoproxyCacheMissing(ctx, name) {
+		return nil
+	}
+
+	objectName := goproxyCacheObjectName(ctx, name)
+	lockName := "fetch/" + objectName
+	deadline := time.Now().Add(fetchLockWait)
+	for waited := false; ; waited = true {
+		flh, err := holdFetchLock(ctx, lockName)
+		if err != nil {
+			base.Logger.Warn().Err(err).
+				Str("name", name).
+				Str("request_id", requestIDOf(ctx)).
+				Msg("failed to lock goproxy fetch")
+			return nil
+		}
+
+		if flh != nil {
+			fetchLockAcquired.Add(1)
+			return func() {
+				ctx, cancel := context.WithTimeout(
+					context.WithoutCancel(ctx),
+					time.Minute,
+				)
+				defer cancel()
+
+				if err := flh.release(ctx); err != nil {
+					base.Logger.Warn().Err(err).
+						Str("name", name).
+						Msg("failed to unlock " +
+							"goproxy fetch")
+				}
+			}
+		}
+
+		if waited && !refetch {
+			// The absence cached by the `statCache` is stale once
+			// the holder of the lock has uploaded it.
+			invalidateStatCache(objectName)
+			if !isGoproxyCacheMissing(ctx, name) {
+				fetchLockWaited.Add(1)
+				return nil
+			}
+		}
+
+		if !time.Now().Before(deadline) {
+			fetchLockTimeouts.Add(1)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(fetchLockPollInterval):
+		}
+	}
+}
+
+// fetchLockHold is a fetch lock of the current instance, which is shared by
+// its concurrent fetches of the same Goproxy cache. The lock is taken from the
+// `fetchLocker` by the first of them and only released back to it by the last
+// one, so that none of them loses it while the others are still fetching.
+type fetchLockHold struct {
+	name    string
+	mutex   sync.Mutex
+	holders int
+	users   int
+}
+
+// holdFetchLock holds the fetch lock with the name, which is taken from the
+// `fetchLocker` unless the current instance already holds it. It returns nil if
+// the lock is held by another instance.
+func holdFetchLock(ctx context.Context, name string) (*fetchLockHold, error) {
+	fetchLockHoldsMutex.Lock()
+	flh, ok := fetchLockHolds[name]
+	if !ok {
+		flh = &fetchLockHold{name: name}
+		fetchLockHolds[name] = flh
+	}
+
+	flh.users++
+	fetchLockHoldsMutex.Unlock()
+
+	flh.mutex.Lock()
+	defer flh.mutex.Unlock()
+
+	if flh.holders == 0 {
+		locked, err := fetchLocker.tryLock(ctx, name, fetchLockTTL)
+		if err != nil || !locked {
+			flh.done()
+			return nil, err
+		}
+	}
+
+	flh.holders++
+
+	return flh, nil
+}
+
+// release releases the flh, which unlocks it with the `fetchLocker` if it is
+// the last holder.
+func (flh *fetchLockHold) release(ctx context.Context) error {
+	defer flh.done()
+
+	flh.mutex.Lock()
+	defer flh.mutex.Unlock()
+
+	if flh.holders--; flh.holders > 0 {
+		return nil
+	}
+
+	return fetchLocker.unlock(ctx, flh.name)
+}
+
+// done removes the flh from the `fetchLockHolds` once it is no longer used.
+func (flh *fetchLockHold) done() {
+	fetchLockHoldsMutex.Lock()
+	defer fetchLockHoldsMutex.Unlock()
+
+	if flh.users--; flh.users == 0 {
+		delete(fetchLockHolds, flh.name)
+	}
+}
+
+// kodoFetchLock is a `fetchLock` based on the leases stored in the Qiniu Cloud
+// Kodo (see the `acquireLeadership`). It needs nothing else, but each lock
+// takes a couple of seconds to acquire.
+type kodoFetchLock struct{}
+
+// kodoFetchLockUnlockMargin is how long a lease of the `kodoFetchLock` must
+// still be valid for to be deleted when it is unlocked.
+const kodoFetchLockUnlockMargin = time.Minute
+
+// tryLock implements the `fetchLock`.
+func (kodoFetchLock) tryLock(
+	ctx context.Context,
+	name string,
+	ttl time.Duration,
+) (bool, error) {
+	return acquireLeadership(ctx, name, ttl)
+}
+
+// unlock implements the `fetchLock`.
+//
+// The Qiniu Cloud Kodo has no conditional deletes, so the lease is checked and
+// then deleted in two steps, between which another instance may take it over
+// once it expires. To keep that from happening, a lease that expires within
+// the `kodoFetchLockUnlockMargin` is left to expire instead.
+func (kodoFetchLock) unlock(ctx context.Context, name string) error {
+	leaseName := "leases/" + name
+
+	lease, err := getLeaderLease(ctx, leaseName)
+	if err != nil {
+		if isNotFoundMinIOError(err) {
+			return nil
+		}
+
+		return err
+	} else if lease.Holder != leaderID ||
+		time.Until(lease.ExpiresAt) < kodoFetchLockUnlockMargin {
+		return nil
+	}
+
+	return retryQiniuKodoDo(ctx, func(ctx context.Context) error {
+		err := qiniuKodoClient.RemoveObject(
+			ctx,
+			qiniuKodoBucketName,
+			leaseName,
+			minio.RemoveObjectOptions{},
+		)
+		if isNotFoundMinIOError(err) {
+			return nil
+		}
+
+		return err
+	})
+}
+
+// redisFetchLock is a `fetchLock` based on a Redis server, which is held by
+// setting a key to the `leaderID` only if it does not exist. The connections to
+// the server are pooled by its client.
+type redisFetchLock struct {
+	client *redis.Client
+}
+
+// redisFetchLockUnlockScript is the Lua script that deletes a key only if it is
+// still set to the `leaderID`, so that a lock taken over by another instance
+// after expiring is never released by mistake.
+var redisFetchLockUnlockScript = redis.NewScript(`if redis.call("GET", ` +
+	`KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) ` +
+	`else return 0 end`)
+
+// tryLock implements the `fetchLock`.
+func (rfl *redisFetchLock) tryLock(
+	ctx context.Context,
+	name string,
+	ttl time.Duration,
+) (bool, error) {
+	return rfl.client.SetNX(ctx, "goproxy.cn/"+name, leaderID, ttl).Result()
+}
+
+// unlock implements the `fetchLock`.
+func (rfl *redisFetchLock) unlock(ctx context.Context, name string) error {
+	return redisFetchLockUnlockScript.Run(
+		ctx,
+		rfl.client,
+		[]string{"goproxy.cn/" + name},
+		leaderID,
+	).Err()
+}
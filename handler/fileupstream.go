@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileUpstreamTransport is an `http.RoundTripper` that serves the requests to
+// the "file://" upstreams from the local filesystem, and passes the others to
+// the next. A "file://" upstream is a directory laid out as a GOPROXY, such as
+// the "cache/download" directory of a pre-populated GOMODCACHE, which lets an
+// air-gapped deployment serve the modules in it through the proxy protocol.
+type fileUpstreamTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (fut *fileUpstreamTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	if req.URL.Scheme != "file" {
+		return fut.next.RoundTrip(req)
+	}
+
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return fileUpstreamResponse(
+			req,
+			http.StatusMethodNotAllowed,
+			"method not allowed",
+		), nil
+	}
+
+	for _, elem := range strings.Split(req.URL.Path, "/") {
+		if elem == ".." {
+			return fileUpstreamResponse(
+				req,
+				http.StatusNotFound,
+				"not found: invalid path",
+			), nil
+		}
+	}
+
+	f, err := os.Open(filepath.FromSlash(req.URL.Path))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fileUpstreamResponse(
+				req,
+				http.StatusNotFound,
+				"not found",
+			), nil
+		}
+
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		f.Close()
+		return fileUpstreamResponse(
+			req,
+			http.StatusNotFound,
+			"not found",
+		), nil
+	}
+
+	res := fileUpstreamResponse(req, http.StatusOK, "")
+	res.Header.Set(
+		"Last-Modified",
+		fi.ModTime().UTC().Format(http.TimeFormat),
+	)
+	res.ContentLength = fi.Size()
+	if req.Method == http.MethodHead {
+		f.Close()
+	} else {
+		res.Body = f
+	}
+
+	return res, nil
+}
+
+// fileUpstreamResponse returns a response of the req with the status and the
+// body.
+func fileUpstreamResponse(
+	req *http.Request,
+	status int,
+	body string,
+) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprint(status, " ", http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// checkFileUpstreamHealth checks the health of the "file://" upstream with the
+// dir.
+func checkFileUpstreamHealth(dir string) error {
+	fi, err := os.Stat(filepath.FromSlash(dir))
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return errors.New("not a directory")
+	}
+
+	return nil
+}
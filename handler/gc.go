@@ -0,0 +1,358 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+)
+
+var (
+	// gcSchedule is the cron schedule of the Goproxy cache garbage
+	// collection. The garbage collection is disabled when it is empty.
+	gcSchedule = goproxyViper.GetString("gc_schedule")
+
+	// gcZipMaxIdle is the maximum duration that a Goproxy zip cache can go
+	// without being accessed before it is evicted.
+	gcZipMaxIdle = goproxyViper.GetDuration("gc_zip_max_idle")
+
+	// gcMaxBucketSize is the maximum total size of the Qiniu Cloud Kodo
+	// bucket. The least recently accessed Goproxy zip caches are evicted
+	// until the total size is within it.
+	gcMaxBucketSize = goproxyViper.GetInt64("gc_max_bucket_size")
+
+	// gcAccesses is the names of the Goproxy zip caches accessed since the
+	// last flush.
+	gcAccesses = map[string]struct{}{}
+
+	// gcAccessesMutex is used to protect the `gcAccesses`.
+	gcAccessesMutex sync.Mutex
+
+	// gcRunning indicates whether a garbage collection is running.
+	gcRunning atomic.Bool
+
+	// gcMetrics is the metrics of the Goproxy cache garbage collection.
+	gcMetrics = expvar.NewMap("gc")
+)
+
+func init() {
+	if gcSchedule == "" {
+		return
+	}
+
+	if _, err := base.Cron.AddFunc(
+		"*/10 * * * *", // Every 10 minutes
+		flushGCAccesses,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add gc access flush cron job")
+	}
+
+	base.Air.AddShutdownJob(flushGCAccesses)
+
+	if _, err := base.Cron.AddJob(
+		gcSchedule,
+		leaderJob("gc", time.Hour, func() {
+			if !gcRunning.CompareAndSwap(false, true) {
+				return
+			}
+			defer gcRunning.Store(false)
+
+			if err := collectGarbage(base.Context); err != nil {
+				base.Logger.Error().Err(err).
+					Msg("failed to collect garbage")
+			}
+		}),
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add gc cron job")
+	}
+
+	if adminEnabled {
+		base.Air.POST(
+			"/admin/gc",
+			hAdminGC,
+			adminGas,
+			globalAdminGas,
+			maintenanceGas,
+		)
+	}
+}
+
+// hAdminGC handles requests to trigger the Goproxy cache garbage collection in
+// the background.
+func hAdminGC(req *air.Request, res *air.Response) error {
+	if !gcRunning.CompareAndSwap(false, true) {
+		res.Status = http.StatusConflict
+		return errors.New("garbage collection already running")
+	}
+
+	go func() {
+		defer gcRunning.Store(false)
+		if err := collectGarbage(base.Context); err != nil {
+			base.Logger.Error().Err(err).
+				Msg("failed to collect garbage")
+		}
+	}()
+
+	base.Logger.Info().
+		Str("client_address", req.ClientAddress()).
+		Msg("triggered garbage collection")
+
+	res.Status = http.StatusAccepted
+
+	return res.Write(nil)
+}
+
+// recordGCAccess records an access to the Goproxy cache with the name.
+func recordGCAccess(name string) {
+	if gcSchedule == "" || path.Ext(name) != ".zip" {
+		return
+	}
+
+	gcAccessesMutex.Lock()
+	gcAccesses[name] = struct{}{}
+	gcAccessesMutex.Unlock()
+}
+
+// flushGCAccesses flushes the `gcAccesses` to the Qiniu Cloud Kodo.
+func flushGCAccesses() {
+	gcAccessesMutex.Lock()
+	accesses := gcAccesses
+	gcAccesses = map[string]struct{}{}
+	gcAccessesMutex.Unlock()
+
+	if len(accesses) == 0 {
+		return
+	}
+
+	buf := bytes.Buffer{}
+	for name := range accesses {
+		buf.WriteString(name)
+		buf.WriteByte('\n')
+	}
+
+	now := time.Now().UTC()
+	name := path.Join(
+		"gc",
+		"accesses",
+		now.Format("2006-01-02"),
+		leaderID+"-"+now.Format("150405"),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := qiniuKodoUpload(
+		ctx,
+		name,
+		bytes.NewReader(buf.Bytes()),
+	); err != nil {
+		base.Logger.Error().Err(err).
+			Msg("failed to flush gc accesses")
+	}
+}
+
+// collectGarbage applies the retention policies to the Qiniu Cloud Kodo bucket.
+// Only Goproxy zip caches are evicted, the .info and .mod files are kept
+// forever.
+func collectGarbage(ctx context.Context) error {
+	startTime := time.Now()
+
+	accesses, err := loadGCAccesses(ctx)
+	if err != nil {
+		return err
+	}
+
+	type zipCache struct {
+		name     string
+		size     int64
+		lastUsed time.Time
+	}
+
+	var (
+		zipCaches      []zipCache
+		totalSize      int64
+		reclaimedBytes int64
+		evictedObjects int64
+	)
+
+	evict := func(zc zipCache) error {
+		if err := retryQiniuKodoDo(ctx, func(
+			ctx context.Context,
+		) error {
+			return qiniuKodoClient.RemoveObject(
+				ctx,
+				qiniuKodoBucketName,
+				zc.name,
+				minio.RemoveObjectOptions{},
+			)
+		}); err != nil && !isNotFoundMinIOError(err) {
+			return err
+		}
+
+		invalidateRedirectCache(zc.name)
+		invalidateStatCache(zc.name)
+		reclaimedBytes += zc.size
+		evictedObjects++
+
+		return nil
+	}
+
+	for objectInfo := range qiniuKodoClient.ListObjects(
+		ctx,
+		qiniuKodoBucketName,
+		minio.ListObjectsOptions{
+			Recursive: true,
+		},
+	) {
+		if objectInfo.Err != nil {
+			return objectInfo.Err
+		}
+
+		if path.Ext(objectInfo.Key) != ".zip" ||
+			!validGoproxyCacheName(objectInfo.Key) {
+			totalSize += objectInfo.Size
+			continue
+		}
+
+		zc := zipCache{
+			name:     objectInfo.Key,
+			size:     objectInfo.Size,
+			lastUsed: objectInfo.LastModified,
+		}
+		if t, ok := accesses[zc.name]; ok && t.After(zc.lastUsed) {
+			zc.lastUsed = t
+		}
+
+		if gcZipMaxIdle > 0 && startTime.Sub(zc.lastUsed) > gcZipMaxIdle {
+			if err := evict(zc); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		zipCaches = append(zipCaches, zc)
+		totalSize += zc.size
+	}
+
+	if gcMaxBucketSize > 0 && totalSize > gcMaxBucketSize {
+		sort.Slice(zipCaches, func(i, j int) bool {
+			return zipCaches[i].lastUsed.Before(zipCaches[j].lastUsed)
+		})
+
+		for _, zc := range zipCaches {
+			if totalSize <= gcMaxBucketSize {
+				break
+			}
+
+			if err := evict(zc); err != nil {
+				return err
+			}
+
+			totalSize -= zc.size
+		}
+	}
+
+	gcMetrics.Add("runs", 1)
+	gcMetrics.Add("reclaimed_bytes", reclaimedBytes)
+	gcMetrics.Add("evicted_objects", evictedObjects)
+
+	base.Logger.Info().
+		Int64("reclaimed_bytes", reclaimedBytes).
+		Int64("evicted_objects", evictedObjects).
+		Int64("bucket_size", totalSize).
+		Dur("duration", time.Since(startTime)).
+		Msg("collected garbage")
+
+	return nil
+}
+
+// loadGCAccesses loads the Goproxy zip cache accesses recorded within the
+// `gcZipMaxIdle` from the Qiniu Cloud Kodo. It also removes the outdated access
+// records.
+func loadGCAccesses(ctx context.Context) (map[string]time.Time, error) {
+	accesses := map[string]time.Time{}
+	for objectInfo := range qiniuKodoClient.ListObjects(
+		ctx,
+		qiniuKodoBucketName,
+		minio.ListObjectsOptions{
+			Prefix:    "gc/accesses/",
+			Recursive: true,
+		},
+	) {
+		if objectInfo.Err != nil {
+			return nil, objectInfo.Err
+		}
+
+		date, _, _ := strings.Cut(
+			strings.TrimPrefix(objectInfo.Key, "gc/accesses/"),
+			"/",
+		)
+
+		t, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			continue
+		}
+
+		if gcZipMaxIdle > 0 &&
+			time.Since(t) > gcZipMaxIdle+24*time.Hour {
+			if err := retryQiniuKodoDo(ctx, func(
+				ctx context.Context,
+			) error {
+				return qiniuKodoClient.RemoveObject(
+					ctx,
+					qiniuKodoBucketName,
+					objectInfo.Key,
+					minio.RemoveObjectOptions{},
+				)
+			}); err != nil && !isNotFoundMinIOError(err) {
+				return nil, err
+			}
+
+			continue
+		}
+
+		t = t.Add(24 * time.Hour)
+		if err := retryQiniuKodoDo(ctx, func(
+			ctx context.Context,
+		) error {
+			object, err := qiniuKodoClient.GetObject(
+				ctx,
+				qiniuKodoBucketName,
+				objectInfo.Key,
+				qiniuKodoGetObjectOptions(),
+			)
+			if err != nil {
+				return err
+			}
+			defer object.Close()
+
+			s := bufio.NewScanner(object)
+			for s.Scan() {
+				if at, ok := accesses[s.Text()]; !ok || t.After(at) {
+					accesses[s.Text()] = t
+				}
+			}
+
+			return s.Err()
+		}); err != nil && !isNotFoundMinIOError(err) {
+			return nil, err
+		}
+	}
+
+	return accesses, nil
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net"
+	"strings"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var (
+	// statGeoIPDatabaseFile is the path of the MaxMind DB file used to
+	// resolve the client regions of the statistic events from the client
+	// IP addresses. The GeoIP resolution is disabled when it is empty.
+	statGeoIPDatabaseFile = statsViper.GetString("geoip_database_file")
+
+	// statGeoIPReader is the reader of the `statGeoIPDatabaseFile`.
+	statGeoIPReader *maxminddb.Reader
+)
+
+// geoIPRecord is the part of a GeoIP2 or GeoLite2 City (or Country) record
+// used by the statistics.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+func init() {
+	if statGeoIPDatabaseFile == "" {
+		return
+	}
+
+	var err error
+	statGeoIPReader, err = maxminddb.Open(statGeoIPDatabaseFile)
+	if err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to open geoip database")
+	}
+}
+
+// lookupGeoIP returns the country code and the province code (in the form of
+// ISO 3166-2, such as "CN-BJ") of the clientHost. Either of them is empty if
+// it cannot be resolved.
+func lookupGeoIP(clientHost string) (string, string) {
+	if statGeoIPReader == nil {
+		return "", ""
+	}
+
+	ip := net.ParseIP(clientHost)
+	if ip == nil {
+		return "", ""
+	}
+
+	var record geoIPRecord
+	if err := statGeoIPReader.Lookup(ip, &record); err != nil {
+		return "", ""
+	}
+
+	country := strings.ToUpper(record.Country.ISOCode)
+	if country == "" || len(record.Subdivisions) == 0 ||
+		record.Subdivisions[0].ISOCode == "" {
+		return country, ""
+	}
+
+	return country, country + "-" +
+		strings.ToUpper(record.Subdivisions[0].ISOCode)
+}
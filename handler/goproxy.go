@@ -3,88 +3,344 @@ package handler
 import (
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aofei/air"
 	"github.com/goproxy/goproxy"
 	"github.com/goproxy/goproxy.cn/base"
-	"github.com/minio/minio-go/v7"
+	"github.com/spf13/viper"
 	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
 )
 
 var (
-	// goproxyViper is used to get the configuration items of the Goproxy.
+	// goproxyViper is used to get the configuration items of the Goproxy
+	// at startup. The reloaded ones are passed to the loaders by the
+	// `reloadGoproxyConfig` instead, so it is never reassigned.
 	goproxyViper = base.Viper.Sub("goproxy")
 
 	// hhGoproxy is an instance of the `goproxy.Goproxy`.
 	hhGoproxy = &goproxy.Goproxy{
-		GoBinName:           goproxyViper.GetString("go_bin_name"),
+		GoBinName: goproxyViper.GetString("go_bin_name"),
+		GoBinEnv: append(
+			os.Environ(),
+			fmt.Sprint("GOPROXY=", goproxyUpstreams),
+		),
 		Cacher:              &goproxyCacher{},
 		CacherMaxCacheBytes: goproxyViper.GetInt("cacher_max_cache_bytes"),
 		ProxiedSUMDBs:       goproxyViper.GetStringSlice("proxied_sumdbs"),
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-				DualStack: true,
-			}).DialContext,
-			MaxIdleConnsPerHost:   200,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-			ForceAttemptHTTP2:     true,
-		},
-		ErrorLogger: log.New(base.Logger, "", 0),
+		TempDir:             goproxyTempDir,
+		Transport:           newGoproxyTransport(),
+		ErrorLogger:         log.New(base.Logger, "", 0),
 	}
 
 	// goproxyFetchTimeout is the maximum duration allowed for Goproxy to
 	// fetch a module.
-	goproxyFetchTimeout = goproxyViper.GetDuration("fetch_timeout")
+	goproxyFetchTimeout atomic.Int64
+
+	// goproxyFetchTimeouts is the maximum durations allowed for Goproxy to
+	// fetch a module keyed by the Goproxy cache name types (see the
+	// `goproxyCacheNameType`). The `goproxyFetchTimeout` is used for the
+	// missing ones.
+	goproxyFetchTimeouts atomic.Pointer[map[string]time.Duration]
 
 	// goproxyAutoRedirect indicates whether the automatic redirection
 	// feature is enabled for Goproxy.
-	goproxyAutoRedirect = goproxyViper.GetBool("auto_redirect")
+	goproxyAutoRedirect atomic.Bool
 
-	// goproxyAutoRedirectMinSize is the minimum size of the Goproxy used to
-	// limit at least how big Goproxy cache can be automatically redirected.
-	goproxyAutoRedirectMinSize = goproxyViper.GetInt64("auto_redirect_min_size")
+	// goproxyAutoRedirectMinSizes is the minimum sizes of the Goproxy used
+	// to limit at least how big Goproxy cache can be automatically
+	// redirected, keyed by the file extensions. The Goproxy caches with
+	// other file extensions are never automatically redirected.
+	goproxyAutoRedirectMinSizes atomic.Pointer[map[string]int64]
 )
 
+// goproxyTransportLayer wraps the next `http.RoundTripper` of the
+// `hhGoproxy.Transport` into a layer of it.
+type goproxyTransportLayer func(next http.RoundTripper) http.RoundTripper
+
+// newGoproxyTransport returns a new `http.RoundTripper` for the `hhGoproxy`.
+//
+// The layers are listed from the outermost to the innermost, and the order
+// matters:
+//
+//   - the routing and the request ID come first, so that every layer below
+//     sees the routed URLs and the X-Request-Id header;
+//   - the zip size limit and the coalescing come before all the caches, so
+//     that a single download is shared and bounded no matter where it is
+//     served from;
+//   - the cache-only mode comes after the checksum database caches, which can
+//     still serve, and before all the layers that reach the upstreams;
+//   - the hedging and the retrying wrap the per-host health tracking, so that
+//     every attempt is counted by the circuit breakers;
+//   - the negative caching, the conditional fetches and the fetch limits only
+//     apply to the requests that actually go upstream;
+//   - the credentials, the "file://" upstreams and the bandwidth limit are
+//     closest to the network.
+func newGoproxyTransport() http.RoundTripper {
+	layers := []goproxyTransportLayer{
+		func(next http.RoundTripper) http.RoundTripper {
+			return &routingTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &requestIDTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &zipSizeLimitingTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &coalescingTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &sumdbCachingTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &cacheOnlyTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &sumdbVerifyingTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &hedgingTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &retryingTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &upstreamTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &negativeCachingTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &conditionalFetchTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &fetchLimitingTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &upstreamAuthTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &fileUpstreamTransport{next: next}
+		},
+		func(next http.RoundTripper) http.RoundTripper {
+			return &bandwidthLimitingTransport{next: next}
+		},
+	}
+
+	var rt http.RoundTripper = &http.Transport{
+		Proxy: outboundProxy,
+		DialContext: dnsCachingDialContext(&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}),
+		MaxIdleConnsPerHost:   200,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	for i := len(layers) - 1; i >= 0; i-- {
+		rt = layers[i](rt)
+	}
+
+	return rt
+}
+
+// newGoproxyAutoRedirectMinSizes returns a new `goproxyAutoRedirectMinSizes`.
+// The .zip files fall back to the "auto_redirect_min_size" for compatibility.
+func newGoproxyAutoRedirectMinSizes(v *viper.Viper) map[string]int64 {
+	minSizes := map[string]int64{
+		".zip": v.GetInt64("auto_redirect_min_size"),
+	}
+
+	for _, ext := range []string{"info", "mod", "zip"} {
+		key := fmt.Sprint("auto_redirect_min_sizes.", ext)
+		if v.IsSet(key) {
+			minSizes["."+ext] = v.GetInt64(key)
+		}
+	}
+
+	return minSizes
+}
+
+// loadGoproxyOptions loads the reloadable options of the Goproxy from the v.
+// It must not be called concurrently.
+func loadGoproxyOptions(v *viper.Viper) {
+	goproxyFetchTimeout.Store(int64(
+		v.GetDuration("fetch_timeout"),
+	))
+
+	fetchTimeouts := map[string]time.Duration{}
+	for _, nameType := range []string{
+		"list",
+		"latest",
+		"info",
+		"mod",
+		"zip",
+	} {
+		key := fmt.Sprint("fetch_timeouts.", nameType)
+		if v.IsSet(key) {
+			fetchTimeouts[nameType] = v.GetDuration(key)
+		}
+	}
+
+	goproxyFetchTimeouts.Store(&fetchTimeouts)
+	goproxyAutoRedirect.Store(
+		v.GetBool("auto_redirect") &&
+			!isQiniuKodoSSEC() &&
+			!isGoproxyCacheEncrypted(),
+	)
+	streamColdZips.Store(v.GetBool("stream_cold_zips"))
+
+	minSizes := newGoproxyAutoRedirectMinSizes(v)
+	goproxyAutoRedirectMinSizes.Store(&minSizes)
+
+	// The modes toggled at runtime by the admins are only overridden when
+	// they are changed in the config, so that a reload does not undo the
+	// toggles, such as in the middle of a bucket migration.
+	if cacheOnly := v.GetBool("cache_only"); cacheOnly !=
+		configuredGoproxyCacheOnly {
+		configuredGoproxyCacheOnly = cacheOnly
+		goproxyCacheOnly.Store(cacheOnly)
+	}
+
+	if maintenance := v.GetBool("maintenance_mode"); maintenance !=
+		configuredMaintenanceMode {
+		configuredMaintenanceMode = maintenance
+		maintenanceMode.Store(maintenance)
+	}
+}
+
+// withGoproxyFetchTimeout returns a copy of the ctx that is canceled after the
+// fetch timeout of the nameType (see the `goproxyCacheNameType`).
+func withGoproxyFetchTimeout(
+	ctx context.Context,
+	nameType string,
+) (context.Context, context.CancelFunc) {
+	fetchTimeout, ok := (*goproxyFetchTimeouts.Load())[nameType]
+	if !ok {
+		fetchTimeout = time.Duration(goproxyFetchTimeout.Load())
+	}
+
+	if fetchTimeout != 0 {
+		return context.WithTimeout(ctx, fetchTimeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// goproxyCacheNameType returns the type of the Goproxy cache with the name,
+// which is one of "list", "latest", "info", "mod" and "zip". It returns an
+// empty string for the others, such as those of the checksum databases.
+func goproxyCacheNameType(name string) string {
+	switch {
+	case strings.HasSuffix(name, "/@v/list"):
+		return "list"
+	case strings.HasSuffix(name, "/@latest"):
+		return "latest"
+	case strings.Contains(name, "/@v/"):
+		switch ext := path.Ext(name); ext {
+		case ".info", ".mod", ".zip":
+			return strings.TrimPrefix(ext, ".")
+		}
+	}
+
+	return ""
+}
+
 func init() {
-	base.Air.BATCH(getHeadMethods, "/*", hGoproxy)
+	loadGoproxyOptions(goproxyViper)
+
+	base.Air.BATCH(
+		getHeadMethods,
+		"/*",
+		hGoproxy,
+		altSvcGas,
+		cacheOutcomeGas,
+		abuseGas,
+		rateLimitGas,
+		loadSheddingGas,
+		authGas("proxy"),
+		downloadLimitGas,
+		compressionGas,
+	)
 }
 
 // hGoproxy handles requests to play with Go module proxy.
 func hGoproxy(req *air.Request, res *air.Response) error {
-	if goproxyFetchTimeout != 0 {
-		var cancel context.CancelFunc
-		req.Context, cancel = context.WithTimeout(
-			req.Context,
-			goproxyFetchTimeout,
-		)
-		defer cancel()
-	}
-
 	name, err := url.PathUnescape(req.ParamValue("*").String())
 	if err != nil || strings.HasSuffix(name, "/") {
 		return CacheableNotFound(req, res, 86400)
 	}
 
+	var cancel context.CancelFunc
+	req.Context, cancel = withGoproxyFetchTimeout(
+		req.Context,
+		goproxyCacheNameType(name),
+	)
+	defer cancel()
+
 	req.Header.Del("Disable-Module-Fetch")
+	if goproxyCacheOnly.Load() {
+		req.Header.Set("Disable-Module-Fetch", "true")
+	}
+
+	if goproxyCacheNameType(name) == "zip" {
+		req.Context = withZipSizeLimit(req.Context)
+	}
+
+	cleanName := strings.TrimPrefix(path.Clean(name), "/")
+	if modulePath, ok := modulePagePath(cleanName); ok {
+		return hModulePage(req, res, modulePath)
+	}
+
+	if isGoproxyCacheBlocked(cleanName) {
+		res.Status = http.StatusGone
+		return errors.New("module blocked")
+	}
+
+	if !isGoproxyCacheAllowed(cleanName) {
+		res.Status = http.StatusForbidden
+		return errors.New("module not allowed")
+	}
+
+	if isGoproxyCacheRejected(cleanName) || isSUMDBLookupBypassed(cleanName) {
+		return NotFound(req, res)
+	}
+
+	if serveMutableGoproxyCache(req, res, cleanName) {
+		return nil
+	}
+
+	refetchSoftPurgedGoproxyCache(req.Context, cleanName)
 
-	if !goproxyAutoRedirect || path.Ext(name) != ".zip" {
-		hhGoproxy.ServeHTTP(res.HTTPResponseWriter(), req.HTTPRequest())
+	autoRedirectMinSizes := *goproxyAutoRedirectMinSizes.Load()
+	autoRedirectMinSize, ok := autoRedirectMinSizes[path.Ext(name)]
+	if !goproxyAutoRedirect.Load() || !ok {
+		if u := goproxyStreamURL(req, cleanName); u != nil &&
+			isGoproxyCacheMissing(req.Context, cleanName) &&
+			streamGoproxyCache(req, res, cleanName, u) {
+			return nil
+		}
+
+		serveGoproxy(req, res, name)
 		return nil
 	}
 
@@ -101,54 +357,87 @@ func hGoproxy(req *air.Request, res *air.Response) error {
 		return CacheableNotFound(req, res, 86400)
 	}
 
-	var objectInfo minio.ObjectInfo
-	if err := retryQiniuKodoDo(req.Context, func(
-		ctx context.Context,
-	) (err error) {
-		objectInfo, err = qiniuKodoClient.StatObject(
-			ctx,
-			qiniuKodoBucketName,
-			name,
-			minio.StatObjectOptions{},
-		)
-		return err
-	}); err != nil {
+	objectInfo, err := statGoproxyCacheObject(
+		req.Context,
+		goproxyCacheObjectName(req.Context, name),
+	)
+	if err != nil {
 		if isNotFoundMinIOError(err) {
-			hhGoproxy.ServeHTTP(
-				res.HTTPResponseWriter(),
-				req.HTTPRequest(),
-			)
+			if u := goproxyStreamURL(req, name); u != nil &&
+				streamGoproxyCache(req, res, name, u) {
+				return nil
+			}
+
+			serveGoproxy(req, res, name)
 			return nil
 		}
 
 		return err
 	}
 
-	if objectInfo.Size < goproxyAutoRedirectMinSize {
-		hhGoproxy.ServeHTTP(res.HTTPResponseWriter(), req.HTTPRequest())
+	if objectInfo.Size < autoRedirectMinSize {
+		serveGoproxy(req, res, name)
 		return nil
 	}
 
-	u, err := qiniuKodoClient.Presign(
+	u, err := signRedirectURL(
 		req.Context,
+		redirectSigner(req),
 		req.Method,
-		qiniuKodoBucketName,
 		objectInfo.Key,
-		7*24*time.Hour,
-		url.Values{
-			"response-cache-control": []string{
-				"public, max-age=604800",
-			},
-		},
 	)
 	if err != nil {
 		return err
 	}
 
+	recordGCAccess(objectInfo.Key)
+	recordStatEvent(req, name, objectInfo.Size)
+	setCacheOutcome(req.Context, "redirect")
+	if tenantOf(req.Context) == "" && isModuleStreamEventName(name) {
+		publishStreamEvent("redirect_issued", name, objectInfo.Size)
+	}
+
 	return res.Redirect(u.String())
 }
 
-// goproxyCacher implements the `goproxy.Cacher`.
+// serveGoproxy serves the req with the `hhGoproxy` and records the statistic
+// event when the Goproxy cache with the name is served successfully. The fetch
+// of the uncached Goproxy cache is locked across the instances (see the
+// `lockGoproxyFetch`).
+func serveGoproxy(req *air.Request, res *air.Response, name string) {
+	if isZipTooLarge(req.Context) {
+		writeZipTooLarge(res.HTTPResponseWriter())
+		return
+	}
+
+	if unlock := lockGoproxyFetch(
+		req.Context,
+		strings.TrimPrefix(path.Clean(name), "/"),
+	); unlock != nil {
+		defer unlock()
+	}
+
+	hhGoproxy.ServeHTTP(&zipSizeLimitResponseWriter{
+		ResponseWriter: res.HTTPResponseWriter(),
+		ctx:            req.Context,
+	}, req.HTTPRequest())
+	if res.Status == http.StatusOK {
+		recordStatEvent(
+			req,
+			strings.TrimPrefix(path.Clean(name), "/"),
+			res.ContentLength,
+		)
+	}
+}
+
+// goproxyCacheChecksumMetadataKey is the key of the user metadata of the
+// objects of the Goproxy caches that holds the hex-encoded SHA-256 checksums of
+// their contents. It is in the canonical form in which the user metadata is
+// returned.
+const goproxyCacheChecksumMetadataKey = "Sha256"
+
+// goproxyCacher implements the `goproxy.Cacher`. The Goproxy caches are stored
+// in the namespace of the tenant carried by the context, if any.
 type goproxyCacher struct{}
 
 // Get implements the `goproxy.Cacher`.
@@ -156,29 +445,17 @@ func (gc *goproxyCacher) Get(
 	ctx context.Context,
 	name string,
 ) (io.ReadCloser, error) {
-	var (
-		object     *minio.Object
-		objectInfo minio.ObjectInfo
-	)
-
-	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) (err error) {
-		object, err = qiniuKodoClient.GetObject(
-			ctx,
-			qiniuKodoBucketName,
-			name,
-			minio.GetObjectOptions{},
-		)
-		if err != nil {
-			return err
-		}
-
-		objectInfo, err = object.Stat()
-		if err != nil {
-			object.Close()
-		}
+	// The soft-purged Goproxy caches are refetched as if they were not
+	// cached.
+	if isGoproxyCacheRefetch(ctx) {
+		return nil, fs.ErrNotExist
+	}
 
-		return err
-	}); err != nil {
+	object, objectInfo, err := getGoproxyCacheObject(
+		ctx,
+		goproxyCacheObjectName(ctx, name),
+	)
+	if err != nil {
 		if isNotFoundMinIOError(err) {
 			return nil, fs.ErrNotExist
 		}
@@ -186,10 +463,33 @@ func (gc *goproxyCacher) Get(
 		return nil, err
 	}
 
-	checksum, _ := hex.DecodeString(objectInfo.ETag)
-	if len(checksum) != md5.Size {
-		eTagChecksum := md5.Sum([]byte(objectInfo.ETag))
-		checksum = eTagChecksum[:]
+	checksum, _ := hex.DecodeString(
+		objectInfo.UserMetadata[goproxyCacheChecksumMetadataKey],
+	)
+	if len(checksum) != sha256.Size {
+		// The Goproxy caches stored without the checksums, such as
+		// the encrypted ones and the ones stored before the checksums
+		// were added, keep deriving them from their ETags as before,
+		// so that the ETags served for them do not change.
+		checksum, _ = hex.DecodeString(objectInfo.ETag)
+		if len(checksum) != md5.Size {
+			eTagChecksum := md5.Sum([]byte(objectInfo.ETag))
+			checksum = eTagChecksum[:]
+		}
+	}
+
+	recordGCAccess(objectInfo.Key)
+
+	// The Goproxy only falls back to the caches of the mutable endpoints
+	// when it fails to fetch them.
+	switch path.Ext(name) {
+	case ".info", ".mod", ".zip":
+		setCacheOutcome(ctx, "hit")
+		if tenantOf(ctx) == "" && isModuleStreamEventName(name) {
+			publishStreamEvent("cache_hit", name, objectInfo.Size)
+		}
+	default:
+		setCacheOutcome(ctx, "stale")
 	}
 
 	return &goproxyCacheReader{
@@ -205,24 +505,208 @@ func (gc *goproxyCacher) Put(
 	name string,
 	content io.ReadSeeker,
 ) error {
-	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) error {
-		_, err := qiniuKodoClient.StatObject(
-			ctx,
-			qiniuKodoBucketName,
-			name,
-			minio.StatObjectOptions{},
-		)
-		return err
-	}); err == nil {
+	if isGoproxyCacheBlocked(name) || !isGoproxyCacheAllowed(name) {
+		return nil
+	}
+
+	setCacheOutcome(ctx, "miss")
+
+	if cachePutDraining.Load() {
+		return nil
+	}
+
+	if maintenanceMode.Load() {
+		maintenanceSkippedCachePuts.Add(1)
+		return nil
+	}
+
+	if diskSpaceLow.Load() {
+		diskSpaceSkippedCachePuts.Add(1)
+		base.Logger.Warn().
+			Str("name", name).
+			Str("request_id", requestIDOf(ctx)).
+			Msg("skipped goproxy cache put due to low disk space")
+		return nil
+	}
+
+	if tenant := tenantOf(ctx); isTenantCacheFull(tenant) {
+		base.Logger.Warn().
+			Str("name", name).
+			Str("tenant", tenant).
+			Str("request_id", requestIDOf(ctx)).
+			Msg("skipped goproxy cache put due to tenant quota")
 		return nil
-	} else if !isNotFoundMinIOError(err) {
+	}
+
+	objectName := goproxyCacheObjectName(ctx, name)
+
+	return coalesceGoproxyCachePut(ctx, objectName, func() error {
+		size, err := content.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		} else if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		if zipSizeLimit > 0 &&
+			goproxyCacheNameType(name) == "zip" &&
+			size > zipSizeLimit {
+			zipSizeRejections.Add(1)
+			base.Logger.Warn().
+				Str("name", name).
+				Str("request_id", requestIDOf(ctx)).
+				Int64("size", size).
+				Int64("max_zip_size", zipSizeLimit).
+				Msg("skipped goproxy cache put of oversized zip file")
+			return nil
+		}
+
+		if !acquireCachePutBacklog(size) {
+			base.Logger.Warn().
+				Str("name", name).
+				Str("request_id", requestIDOf(ctx)).
+				Int64("size", size).
+				Msg("skipped goproxy cache put due to backlog")
+			return nil
+		}
+		defer releaseCachePutBacklog(size)
+
+		objectInfo, err := statGoproxyCacheObject(ctx, objectName)
+		if err == nil {
+			// The lookup responses of the proxied checksum
+			// databases are overwritten to refresh them once they
+			// are older than the `sumdbLookupCacheTTL`.
+			if isSUMDBLookupCacheName(name) &&
+				time.Since(objectInfo.LastModified) >
+					sumdbLookupCacheTTL {
+				return uploadGoproxyCache(ctx, name, content)
+			}
+
+			// The soft-purged Goproxy caches are overwritten by
+			// their refetches.
+			if !isGoproxyCacheRefetch(ctx) {
+				return nil
+			}
+		} else if !isNotFoundMinIOError(err) {
+			return err
+		}
+
+		if err := scanGoproxyCache(ctx, name, content); err != nil {
+			return err
+		}
+
+		return uploadGoproxyCache(ctx, name, content)
+	})
+}
+
+// uploadGoproxyCache uploads the content of the Goproxy cache with the name to
+// the Qiniu Cloud Kodo, and then queues it for replication to the `replicas`.
+// It is uploaded to the namespace of the tenant carried by the ctx, if any, in
+// which case it is kept out of the public search index, feeds, webhooks and
+// counters.
+func uploadGoproxyCache(
+	ctx context.Context,
+	name string,
+	content io.ReadSeeker,
+) error {
+	// The checksums of the encrypted Goproxy caches are not stored, since
+	// they would let the storage tell whose contents they are.
+	var userMetadata map[string]string
+	if cacheEncryptionKeyInUse == nil {
+		checksum, err := contentSHA256(content)
+		if err != nil {
+			return err
+		}
+
+		userMetadata = map[string]string{
+			goproxyCacheChecksumMetadataKey: hex.EncodeToString(
+				checksum,
+			),
+		}
+	}
+
+	encryptedContent, err := encryptGoproxyCache(content)
+	if err != nil {
+		return err
+	}
+
+	objectName := goproxyCacheObjectName(ctx, name)
+	err = qiniuKodoUploadWithMetadata(
+		ctx,
+		objectName,
+		encryptedContent,
+		userMetadata,
+	)
+	invalidateStatCache(objectName)
+	if err != nil {
 		return err
 	}
 
-	return qiniuKodoUpload(ctx, name, content)
+	replicateGoproxyCache(objectName)
+
+	if tenant := tenantOf(ctx); tenant != "" {
+		size, _ := content.Seek(0, io.SeekEnd)
+		addTenantCacheBytes(tenant, size)
+		return nil
+	}
+
+	addSearchEntry(name)
+	if mv, ok := newlyCachedModuleVersion(name); ok {
+		addFeedNewVersion(mv)
+		fireWebhooks(mv)
+	}
+
+	var moduleVersionCount int64
+	if path.Ext(name) == ".info" {
+		moduleVersionCount = 1
+	}
+
+	size, _ := content.Seek(0, io.SeekEnd)
+	addLiveCounters(moduleVersionCount, size, 0)
+
+	if isModuleStreamEventName(name) {
+		publishStreamEvent("module_cached", name, size)
+	}
+
+	return nil
+}
+
+// contentSHA256 returns the SHA-256 checksum of the content.
+func contentSHA256(content io.ReadSeeker) ([]byte, error) {
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// newlyCachedModuleVersion returns the module version that is newly cached when
+// the Goproxy cache with the name is uploaded. It reports false unless the name
+// targets the .info file of a module version, which is the first file the go
+// command fetches for a module version.
+func newlyCachedModuleVersion(name string) (module.Version, bool) {
+	if path.Ext(name) != ".info" || strings.HasPrefix(name, "sumdb/") {
+		return module.Version{}, false
+	}
+
+	modulePath, moduleVersion, ok := parseGoproxyCacheName(name)
+	if !ok || moduleVersion == "" {
+		return module.Version{}, false
+	}
+
+	return module.Version{Path: modulePath, Version: moduleVersion}, true
 }
 
 // goproxyCacheReader is the reader of the cache unit of the `goproxyCacher`.
+//
+// It must stay seekable, since that is what makes the Goproxy serve it with the
+// `http.ServeContent`, which handles the Range and If-Range headers so that
+// interrupted zip downloads can be resumed.
 type goproxyCacheReader struct {
 	io.ReadSeekCloser
 
@@ -235,11 +719,18 @@ func (gcr *goproxyCacheReader) ModTime() time.Time {
 	return gcr.modTime
 }
 
-// Checksum returns the checksum of the gcr.
+// Checksum returns the checksum of the gcr, which is the SHA-256 checksum of
+// its content if that has been stored.
 func (gcr *goproxyCacheReader) Checksum() []byte {
 	return gcr.checksum
 }
 
+// ETag returns the strong entity tag of the gcr, which enables the Goproxy to
+// answer conditional requests with "304 Not Modified".
+func (gcr *goproxyCacheReader) ETag() string {
+	return fmt.Sprintf("%q", hex.EncodeToString(gcr.checksum))
+}
+
 // validGoproxyCacheName reports whether the name is a valid Goproxy cache name.
 func validGoproxyCacheName(name string) bool {
 	escapedModulePath, _, found := strings.Cut(name, "/@v/")
@@ -267,3 +758,89 @@ func validGoproxyCacheName(name string) bool {
 
 	return semver.IsValid(moduleVersion)
 }
+
+// ensureGoproxyCache fetches the Goproxy cache with the name with the
+// `hhGoproxy` if it is missing. It reports whether it was missing.
+func ensureGoproxyCache(ctx context.Context, name string) (bool, error) {
+	if !isGoproxyCacheMissing(ctx, name) {
+		return false, nil
+	}
+
+	ctx, cancel := withGoproxyFetchTimeout(ctx, goproxyCacheNameType(name))
+	defer cancel()
+
+	return true, serveGoproxyInternally(
+		ctx,
+		&internalResponseWriter{discard: true},
+		name,
+	)
+}
+
+// serveGoproxyInternally serves an internal GET request for the Goproxy cache
+// with the name with the `hhGoproxy`. The fetch of the uncached Goproxy cache
+// is locked across the instances (see the `lockGoproxyFetch`).
+func serveGoproxyInternally(
+	ctx context.Context,
+	rw *internalResponseWriter,
+	name string,
+) error {
+	if unlock := lockGoproxyFetch(ctx, name); unlock != nil {
+		defer unlock()
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		"/"+name,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	if goproxyCacheOnly.Load() {
+		req.Header.Set("Disable-Module-Fetch", "true")
+	}
+
+	hhGoproxy.ServeHTTP(rw, req)
+	if rw.status != http.StatusOK {
+		return fmt.Errorf("%s: %s", name, http.StatusText(rw.status))
+	}
+
+	return nil
+}
+
+// internalResponseWriter is an `http.ResponseWriter` used by the internal
+// requests to the `hhGoproxy`.
+type internalResponseWriter struct {
+	header  http.Header
+	status  int
+	body    []byte
+	discard bool
+}
+
+// Header implements the `http.ResponseWriter`.
+func (irw *internalResponseWriter) Header() http.Header {
+	if irw.header == nil {
+		irw.header = http.Header{}
+	}
+
+	return irw.header
+}
+
+// WriteHeader implements the `http.ResponseWriter`.
+func (irw *internalResponseWriter) WriteHeader(status int) {
+	if irw.status == 0 {
+		irw.status = status
+	}
+}
+
+// Write implements the `http.ResponseWriter`.
+func (irw *internalResponseWriter) Write(b []byte) (int, error) {
+	irw.WriteHeader(http.StatusOK)
+	if !irw.discard {
+		irw.body = append(irw.body, b...)
+	}
+
+	return len(b), nil
+}
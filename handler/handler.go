@@ -2,6 +2,7 @@ package handler
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -34,10 +35,12 @@ var (
 	qiniuKodoMultipartUploadPartSize = qiniuViper.GetInt64("kodo_multipart_upload_part_size")
 
 	// qiniuKodoClient is the client for the Qiniu Cloud Kodo.
-	qiniuKodoClient *minio.Client
+	qiniuKodoClient = newQiniuKodoClient()
 
 	// qiniuKodoCore is the core for the Qiniu Cloud Kodo.
-	qiniuKodoCore *minio.Core
+	qiniuKodoCore = &minio.Core{
+		Client: qiniuKodoClient,
+	}
 
 	// getHeadMethods is an array contains the GET and HEAD methods.
 	getHeadMethods = []string{http.MethodGet, http.MethodHead}
@@ -58,46 +61,12 @@ var (
 
 	// moduleVersionCount is the module version count.
 	moduleVersionCount int
+
+	// cacherSize is the total size of the Goproxy caches.
+	cacherSize int64
 )
 
 func init() {
-	qiniuKodoEndpoint, err := url.Parse(
-		qiniuViper.GetString("kodo_endpoint"),
-	)
-	if err != nil {
-		base.Logger.Fatal().Err(err).
-			Msg("failed to parse qiniu kodo endpoint")
-	}
-
-	qiniuKodoClientOptions := &minio.Options{
-		Creds: credentials.NewStaticV4(
-			qiniuViper.GetString("access_key"),
-			qiniuViper.GetString("secret_key"),
-			"",
-		),
-		Secure: qiniuKodoEndpoint.Scheme == "https",
-	}
-
-	if qiniuViper.GetBool("kodo_force_path_style") {
-		qiniuKodoClientOptions.BucketLookup = minio.BucketLookupPath
-	} else {
-		qiniuKodoClientOptions.BucketLookup = minio.BucketLookupDNS
-	}
-
-	qiniuKodoEndpoint.Scheme = ""
-	qiniuKodoClient, err = minio.New(
-		strings.TrimPrefix(qiniuKodoEndpoint.String(), "//"),
-		qiniuKodoClientOptions,
-	)
-	if err != nil {
-		base.Logger.Fatal().Err(err).
-			Msg("failed to create qiniu kodo client")
-	}
-
-	qiniuKodoCore = &minio.Core{
-		Client: qiniuKodoClient,
-	}
-
 	if err := updateModuleVersionsCount(); err != nil {
 		base.Logger.Fatal().Err(err).
 			Msg("failed to initialize module version count")
@@ -135,6 +104,52 @@ func init() {
 	base.Air.BATCH(getHeadMethods, "/", hIndexPage)
 }
 
+// newQiniuKodoClient returns a new client for the Qiniu Cloud Kodo.
+func newQiniuKodoClient() *minio.Client {
+	qiniuKodoClient, err := newMinIOClient(
+		qiniuViper.GetString("kodo_endpoint"),
+		credentials.New(qiniuKodoCredentials),
+		qiniuViper.GetBool("kodo_force_path_style"),
+	)
+	if err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to create qiniu kodo client")
+	}
+
+	return qiniuKodoClient
+}
+
+// newMinIOClient returns a new MinIO client for the S3-compatible object
+// storage at the endpoint with the creds.
+func newMinIOClient(
+	endpoint string,
+	creds *credentials.Credentials,
+	forcePathStyle bool,
+) (*minio.Client, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &minio.Options{
+		Creds:  creds,
+		Secure: endpointURL.Scheme == "https",
+	}
+
+	if forcePathStyle {
+		options.BucketLookup = minio.BucketLookupPath
+	} else {
+		options.BucketLookup = minio.BucketLookupDNS
+	}
+
+	endpointURL.Scheme = ""
+
+	return minio.New(
+		strings.TrimPrefix(endpointURL.String(), "//"),
+		options,
+	)
+}
+
 // NotFound returns not found error.
 func NotFound(req *air.Request, res *air.Response) error {
 	res.Status = http.StatusNotFound
@@ -171,18 +186,31 @@ func Error(err error, req *air.Request, res *air.Response) {
 
 // hIndexPage handles requests to get index page.
 func hIndexPage(req *air.Request, res *air.Response) error {
+	lcs, err := getLiveCounters(req.Context)
+	if err != nil {
+		base.Logger.Warn().Err(err).Msg("failed to get live counters")
+		lcs = &liveCountersSnapshot{
+			ModuleVersionCount: int64(moduleVersionCount),
+		}
+	}
+
 	return res.Render(map[string]any{
 		"IsIndexPage": true,
 		"ModuleVersionCount": thousandsCommaSeperated(
-			int64(moduleVersionCount),
+			lcs.ModuleVersionCount,
+		),
+		"DailyDownloadCount": thousandsCommaSeperated(
+			lcs.DailyDownloadCount,
 		),
 	}, req.LocalizedString("index.html"), "layouts/default.html")
 }
 
-// updateModuleVersionsCount updates the `moduleVersionCount`.
+// updateModuleVersionsCount updates the `moduleVersionCount` and the
+// `cacherSize`.
 func updateModuleVersionsCount() error {
 	var statSummary struct {
-		ModuleVersionCount int `json:"module_version_count"`
+		CacherSize         int64 `json:"cacher_size"`
+		ModuleVersionCount int   `json:"module_version_count"`
 	}
 
 	if err := retryQiniuKodoDo(base.Context, func(
@@ -192,7 +220,7 @@ func updateModuleVersionsCount() error {
 			ctx,
 			qiniuKodoBucketName,
 			"stats/summary",
-			minio.GetObjectOptions{},
+			qiniuKodoGetObjectOptions(),
 		)
 		if err != nil {
 			return err
@@ -205,30 +233,56 @@ func updateModuleVersionsCount() error {
 	}
 
 	moduleVersionCount = statSummary.ModuleVersionCount
+	cacherSize = statSummary.CacherSize
 
 	return nil
 }
 
-// qiniuKodoUpload uploads the content with the name to the Qiniu Cloud Kodo.
+// qiniuKodoUpload uploads the content with the name to the Qiniu Cloud Kodo. It
+// is encrypted with the `qiniuKodoSSE`, if any, and is tagged and stored with
+// the storage class for the lifecycle rules of the bucket. It is verified after
+// the upload if the `qiniuKodoVerifyUploads` is enabled.
 func qiniuKodoUpload(
 	ctx context.Context,
 	name string,
 	content io.ReadSeeker,
+) error {
+	return qiniuKodoUploadWithMetadata(ctx, name, content, nil)
+}
+
+// qiniuKodoUploadWithMetadata is like the `qiniuKodoUpload`, but also stores
+// the userMetadata with the uploaded object.
+func qiniuKodoUploadWithMetadata(
+	ctx context.Context,
+	name string,
+	content io.ReadSeeker,
+	userMetadata map[string]string,
 ) (err error) {
+	if maintenanceMode.Load() {
+		return errMaintenanceMode
+	}
+
 	var contentType string
-	switch path.Base(name) {
-	case "@latest":
+	if strings.HasPrefix(name, "stats/") {
 		contentType = "application/json; charset=utf-8"
-	case "list":
-		contentType = "text/plain; charset=utf-8"
-	default:
-		switch path.Ext(name) {
-		case ".info":
+		if path.Ext(name) == ".svg" {
+			contentType = "image/svg+xml"
+		}
+	} else {
+		switch path.Base(name) {
+		case "@latest":
 			contentType = "application/json; charset=utf-8"
-		case ".mod":
+		case "list":
 			contentType = "text/plain; charset=utf-8"
-		case ".zip":
-			contentType = "application/zip"
+		default:
+			switch path.Ext(name) {
+			case ".info":
+				contentType = "application/json; charset=utf-8"
+			case ".mod":
+				contentType = "text/plain; charset=utf-8"
+			case ".zip":
+				contentType = "application/zip"
+			}
 		}
 	}
 
@@ -246,7 +300,18 @@ func qiniuKodoUpload(
 		return err
 	}
 
+	userTags := qiniuKodoObjectTags(name, size)
+	storageClass := qiniuKodoStorageClass(name)
+
 	if size <= qiniuKodoMultipartUploadPartSize {
+		var checksum []byte
+		if qiniuKodoVerifyUploads {
+			checksum, err = contentMD5(content, 0, size)
+			if err != nil {
+				return err
+			}
+		}
+
 		content := content
 		if ra, ok := content.(io.ReaderAt); ok {
 			content = io.NewSectionReader(ra, 0, size)
@@ -254,121 +319,75 @@ func qiniuKodoUpload(
 			return err
 		}
 
-		return retryQiniuKodoDo(ctx, func(ctx context.Context) error {
+		if err := retryQiniuKodoDo(ctx, func(
+			ctx context.Context,
+		) error {
 			_, err := qiniuKodoCore.PutObject(
 				ctx,
 				qiniuKodoBucketName,
 				name,
 				content,
 				size,
-				"",
+				base64OrEmpty(checksum),
 				"",
 				minio.PutObjectOptions{
-					ContentType: contentType,
+					ContentType:          contentType,
+					ServerSideEncryption: qiniuKodoSSE,
+					UserMetadata:         userMetadata,
+					UserTags:             userTags,
+					StorageClass:         storageClass,
 				},
 			)
-			return err
-		})
-	}
-
-	var uploadID string
-	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) (err error) {
-		uploadID, err = qiniuKodoCore.NewMultipartUpload(
-			ctx,
-			qiniuKodoBucketName,
-			name,
-			minio.PutObjectOptions{
-				ContentType: contentType,
-			},
-		)
-		return err
-	}); err != nil {
-		return err
-	}
-	defer func() {
-		if err != nil {
-			retryQiniuKodoDo(ctx, func(ctx context.Context) error {
-				return qiniuKodoCore.AbortMultipartUpload(
-					ctx,
-					qiniuKodoBucketName,
-					name,
-					uploadID,
-				)
-			})
-		}
-	}()
-
-	var completeParts []minio.CompletePart
-	for offset := int64(0); offset < size; {
-		partSize := qiniuKodoMultipartUploadPartSize
-		if r := size - offset; r < partSize {
-			partSize = r
-		}
-
-		var part minio.ObjectPart
-		if err := retryQiniuKodoDo(ctx, func(
-			ctx context.Context,
-		) (err error) {
-			content := content
-			if ra, ok := content.(io.ReaderAt); ok {
-				content = io.NewSectionReader(
-					ra,
-					offset,
-					partSize,
-				)
-			} else if _, err := content.Seek(
-				offset,
-				io.SeekStart,
-			); err != nil {
-				return err
-			}
-
-			part, err = qiniuKodoCore.PutObjectPart(
-				ctx,
-				qiniuKodoBucketName,
-				name,
-				uploadID,
-				len(completeParts)+1,
-				io.LimitReader(content, partSize),
-				partSize,
-				minio.PutObjectPartOptions{},
-			)
-
 			return err
 		}); err != nil {
 			return err
 		}
 
-		completeParts = append(completeParts, minio.CompletePart{
-			PartNumber: part.PartNumber,
-			ETag:       part.ETag,
-		})
-
-		offset += part.Size
-	}
+		if !qiniuKodoVerifyUploads {
+			return nil
+		}
 
-	return retryQiniuKodoDo(ctx, func(ctx context.Context) error {
-		_, err := qiniuKodoCore.CompleteMultipartUpload(
+		return verifyQiniuKodoUpload(
 			ctx,
-			qiniuKodoBucketName,
 			name,
-			uploadID,
-			completeParts,
-			minio.PutObjectOptions{
-				ContentType: contentType,
-			},
+			size,
+			hex.EncodeToString(checksum),
 		)
+	}
+
+	eTag, err := qiniuKodoMultipartUpload(
+		ctx,
+		name,
+		content,
+		size,
+		minio.PutObjectOptions{
+			ContentType:          contentType,
+			ServerSideEncryption: qiniuKodoSSE,
+			UserMetadata:         userMetadata,
+			UserTags:             userTags,
+			StorageClass:         storageClass,
+		},
+	)
+	if err != nil {
 		return err
-	})
+	}
+
+	if !qiniuKodoVerifyUploads {
+		return nil
+	}
+
+	return verifyQiniuKodoUpload(ctx, name, size, eTag)
 }
 
 // retryQiniuKodoDo retries a Qiniu Cloud Kodo operation in case of some special
-// errors.
+// errors. The latency and the result of the operation are recorded for the
+// status page.
 func retryQiniuKodoDo(
 	ctx context.Context,
 	f func(ctx context.Context) error,
 ) error {
-	return base.RetryN(ctx, f, func(err error) bool {
+	startTime := time.Now()
+	err := base.RetryN(ctx, f, func(err error) bool {
 		switch minio.ToErrorResponse(err).StatusCode {
 		case 573, 579, 599:
 			return true
@@ -376,6 +395,15 @@ func retryQiniuKodoDo(
 
 		return false
 	}, 100*time.Millisecond, 10)
+	if ctx.Err() == nil {
+		recordStatusSample(
+			"kodo",
+			time.Since(startTime),
+			err != nil && !isNotFoundMinIOError(err),
+		)
+	}
+
+	return err
 }
 
 // isNotFoundMinIOError reports whether the err is MinIO not found error.
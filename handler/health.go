@@ -0,0 +1,284 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+)
+
+var (
+	// healthCanaryKey is the key of the object in the Qiniu Cloud Kodo
+	// that is used to check the health of the Qiniu Cloud Kodo.
+	healthCanaryKey = goproxyViper.GetString("health_canary_key")
+
+	// healthDrainDelay is how long the `Drain` waits for the load balancers
+	// to stop routing traffic after the readiness starts failing.
+	healthDrainDelay = goproxyViper.GetDuration("drain_delay")
+
+	// healthMaxInflightCachePuts is the maximum number of the in-flight
+	// Goproxy cache puts for the readiness. There is no limit when it is
+	// not positive.
+	healthMaxInflightCachePuts = goproxyViper.GetInt(
+		"readiness_max_inflight_cache_puts",
+	)
+
+	// healthDraining indicates whether the drain mode is on.
+	healthDraining atomic.Bool
+
+	// healthReport is the latest health report.
+	healthReport *healthReportResult
+
+	// healthReportMutex is used to protect the `healthReport`.
+	healthReportMutex sync.Mutex
+
+	// healthCheckClient is the HTTP client used to check the health of the
+	// upstream proxies.
+	healthCheckClient = &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+)
+
+// healthReportTTL is how long a health report is reused, so that frequent
+// probes do not hammer the dependencies.
+const healthReportTTL = 5 * time.Second
+
+// healthReportResult is a health report.
+type healthReportResult struct {
+	Status    string                  `json:"status"`
+	Checks    map[string]*healthCheck `json:"checks"`
+	CheckedAt time.Time               `json:"checked_at"`
+}
+
+// healthCheck is the result of checking the health of a dependency.
+type healthCheck struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency"`
+}
+
+func init() {
+	base.Air.BATCH(getHeadMethods, "/healthz", hHealthz)
+	base.Air.BATCH(getHeadMethods, "/livez", hLivez)
+	base.Air.BATCH(getHeadMethods, "/readyz", hReadyz)
+}
+
+// Drain turns on the drain mode, in which the readiness fails, and then waits
+// for the drain delay so that the load balancers can stop routing traffic
+// before the server shuts down.
+func Drain() {
+	healthDraining.Store(true)
+	time.Sleep(healthDrainDelay)
+}
+
+// hLivez handles requests to check whether the process is alive.
+func hLivez(req *air.Request, res *air.Response) error {
+	res.Header.Set("Cache-Control", "no-store")
+	return res.WriteString("ok")
+}
+
+// hReadyz handles requests to check whether the process is ready to serve
+// traffic.
+func hReadyz(req *air.Request, res *air.Response) error {
+	draining := healthDraining.Load()
+	inflightCachePuts := inflightGoproxyCachePuts()
+	hr := checkHealth(base.Context)
+
+	status := "ok"
+	if draining || hr.Status != "ok" || (healthMaxInflightCachePuts > 0 &&
+		inflightCachePuts >= healthMaxInflightCachePuts) {
+		status = "error"
+		res.Status = http.StatusServiceUnavailable
+	}
+
+	res.Header.Set("Cache-Control", "no-store")
+
+	return res.WriteJSON(map[string]any{
+		"status":              status,
+		"draining":            draining,
+		"cache_only":          goproxyCacheOnly.Load(),
+		"maintenance":         maintenanceMode.Load(),
+		"inflight_cache_puts": inflightCachePuts,
+		"health":              hr,
+	})
+}
+
+// hHealthz handles requests to check the health of the dependencies.
+func hHealthz(req *air.Request, res *air.Response) error {
+	hr := checkHealth(base.Context)
+	if hr.Status != "ok" {
+		res.Status = http.StatusServiceUnavailable
+	}
+
+	res.Header.Set("Cache-Control", "no-store")
+
+	return res.WriteJSON(hr)
+}
+
+// checkHealth returns the health report of the dependencies. It reuses the
+// latest one if it is younger than the `healthReportTTL`, so the ctx should not
+// be bound to a single request.
+func checkHealth(ctx context.Context) *healthReportResult {
+	healthReportMutex.Lock()
+	defer healthReportMutex.Unlock()
+
+	if healthReport != nil &&
+		time.Since(healthReport.CheckedAt) < healthReportTTL {
+		return healthReport
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"kodo":       checkKodoHealth,
+		"temp_dir":   checkTempDirHealth,
+		"disk_space": checkDiskSpaceHealth,
+	}
+
+	// The upstreams are not used in the cache-only mode, so their outages
+	// must not fail the readiness.
+	upstreams := goproxyUpstreams
+	if goproxyCacheOnly.Load() {
+		upstreams = ""
+	}
+
+	for _, proxy := range strings.FieldsFunc(upstreams, func(
+		r rune,
+	) bool {
+		return r == ',' || r == '|'
+	}) {
+		switch proxy {
+		case "direct", "off":
+			continue
+		}
+
+		proxy := proxy
+		checks["upstream:"+proxy] = func(ctx context.Context) error {
+			return checkUpstreamHealth(ctx, proxy)
+		}
+	}
+
+	hr := &healthReportResult{
+		Status:    "ok",
+		Checks:    make(map[string]*healthCheck, len(checks)),
+		CheckedAt: time.Now(),
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+
+			startTime := time.Now()
+			err := check(ctx)
+			hc := &healthCheck{
+				Status:  "ok",
+				Latency: time.Since(startTime).String(),
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				hc.Status = "error"
+				hc.Error = err.Error()
+				hr.Status = "error"
+			}
+
+			hr.Checks[name] = hc
+		}(name, check)
+	}
+
+	wg.Wait()
+
+	healthReport = hr
+
+	return hr
+}
+
+// checkKodoHealth checks the health of the Qiniu Cloud Kodo by stating the
+// `healthCanaryKey`. A missing canary still proves that the Qiniu Cloud Kodo is
+// reachable and the credentials are valid.
+func checkKodoHealth(ctx context.Context) error {
+	if _, err := qiniuKodoClient.StatObject(
+		ctx,
+		qiniuKodoBucketName,
+		healthCanaryKey,
+		minio.StatObjectOptions{},
+	); err != nil && !isNotFoundMinIOError(err) {
+		return err
+	}
+
+	return nil
+}
+
+// checkTempDirHealth checks whether the temporary directory of the Goproxy is
+// writable.
+func checkTempDirHealth(ctx context.Context) error {
+	file, err := os.CreateTemp(hhGoproxy.TempDir, "healthz-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write([]byte("ok")); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// checkUpstreamHealth checks whether the upstream proxy is reachable. Any HTTP
+// response counts as reachable except the server errors.
+func checkUpstreamHealth(ctx context.Context, proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme == "file" {
+		return checkFileUpstreamHealth(u.Path)
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodHead,
+		u.String(),
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	res, err := healthCheckClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return errors.New(res.Status)
+	}
+
+	return nil
+}
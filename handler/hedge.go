@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// hedgeDelay is how long a request to an upstream proxy for a small
+	// Goproxy cache waits before a hedged request is sent to an alternate
+	// upstream proxy. The hedging is disabled when it is not positive.
+	hedgeDelay = goproxyViper.GetDuration("hedge_delay")
+
+	// hedgeNameTypes is the Goproxy cache name types (see the
+	// `goproxyCacheNameType`) whose fetches are hedged.
+	hedgeNameTypes = goproxyViper.GetStringSlice("hedge_name_types")
+
+	// hedgeUpstreams is the base URLs of the upstream proxies in the
+	// `goproxyUpstreams`, which are the candidates of the hedged requests.
+	hedgeUpstreams = newHedgeUpstreams()
+
+	// hedgedRequests is the number of the hedged requests sent.
+	hedgedRequests = expvar.NewInt("hedged_requests")
+
+	// hedgedRequestWins is the number of the hedged requests that
+	// responded first.
+	hedgedRequestWins = expvar.NewInt("hedged_request_wins")
+)
+
+// newHedgeUpstreams returns a new `hedgeUpstreams`.
+func newHedgeUpstreams() []*url.URL {
+	var upstreams []*url.URL
+	for _, proxy := range strings.FieldsFunc(
+		goproxyUpstreams,
+		func(r rune) bool { return r == ',' || r == '|' },
+	) {
+		u, err := url.Parse(proxy)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		upstreams = append(upstreams, u)
+	}
+
+	return upstreams
+}
+
+// hedgedRequestOf returns the hedged request of the req, which is the req
+// targeting the next upstream proxy in the `hedgeUpstreams` after the one the
+// req targets. It returns nil if the req should not be hedged.
+func hedgedRequestOf(req *http.Request) *http.Request {
+	if hedgeDelay <= 0 ||
+		req.Method != http.MethodGet ||
+		len(hedgeUpstreams) < 2 {
+		return nil
+	}
+
+	for i, u := range hedgeUpstreams {
+		if req.URL.Scheme != u.Scheme || req.URL.Host != u.Host {
+			continue
+		}
+
+		name, ok := strings.CutPrefix(req.URL.Path, u.Path+"/")
+		if !ok {
+			continue
+		}
+
+		hedgeable := false
+		nameType := goproxyCacheNameType(name)
+		for _, t := range hedgeNameTypes {
+			if t == nameType {
+				hedgeable = true
+				break
+			}
+		}
+
+		if !hedgeable {
+			return nil
+		}
+
+		alt := hedgeUpstreams[(i+1)%len(hedgeUpstreams)]
+		hreq := req.Clone(req.Context())
+		hreq.URL.Scheme = alt.Scheme
+		hreq.URL.Host = alt.Host
+		hreq.URL.Path = alt.Path + "/" + name
+		hreq.URL.RawPath = ""
+		hreq.Host = ""
+
+		return hreq
+	}
+
+	return nil
+}
+
+// hedgingTransport is an `http.RoundTripper` that masks the latency spikes of
+// the upstream proxies. When a request for a small Goproxy cache has not been
+// responded within the `hedgeDelay`, the same request is sent to an alternate
+// upstream proxy, and whichever responds first is used while the other is
+// canceled.
+type hedgingTransport struct {
+	next http.RoundTripper
+}
+
+// hedgedResult is the result of a request sent by the `hedgingTransport`.
+type hedgedResult struct {
+	res    *http.Response
+	err    error
+	hedged bool
+}
+
+// usable reports whether the hr can be used as the response, which is when the
+// upstream proxy has answered without failing.
+func (hr hedgedResult) usable() bool {
+	return hr.err == nil &&
+		hr.res.StatusCode < http.StatusInternalServerError &&
+		hr.res.StatusCode != http.StatusTooManyRequests
+}
+
+// discard releases the resources of the hr.
+func (hr hedgedResult) discard() {
+	if hr.err == nil {
+		hr.res.Body.Close()
+	}
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (ht *hedgingTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	hreq := hedgedRequestOf(req)
+	if hreq == nil {
+		return ht.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	hctx, hcancel := context.WithCancel(req.Context())
+
+	results := make(chan hedgedResult, 2)
+	send := func(ctx context.Context, req *http.Request, hedged bool) {
+		res, err := ht.next.RoundTrip(req.WithContext(ctx))
+		results <- hedgedResult{res: res, err: err, hedged: hedged}
+	}
+
+	go send(ctx, req, false)
+
+	timer := time.NewTimer(hedgeDelay)
+	defer timer.Stop()
+
+	pending := 1
+	select {
+	case hr := <-results:
+		hcancel()
+		return hedgedResponse(hr, cancel)
+	case <-timer.C:
+		hedgedRequests.Add(1)
+		go send(hctx, hreq, true)
+		pending++
+	}
+
+	var fallback *hedgedResult
+	for ; pending > 0; pending-- {
+		hr := <-results
+		if !hr.usable() {
+			if fallback == nil || !hr.hedged {
+				if fallback != nil {
+					fallback.discard()
+				}
+
+				fallback = &hr
+			} else {
+				hr.discard()
+			}
+
+			continue
+		}
+
+		if fallback != nil {
+			fallback.discard()
+		}
+
+		if pending > 1 {
+			go func() { (<-results).discard() }()
+		}
+
+		if hr.hedged {
+			hedgedRequestWins.Add(1)
+			cancel()
+			return hedgedResponse(hr, hcancel)
+		}
+
+		hcancel()
+
+		return hedgedResponse(hr, cancel)
+	}
+
+	if fallback.hedged {
+		cancel()
+		return hedgedResponse(*fallback, hcancel)
+	}
+
+	hcancel()
+
+	return hedgedResponse(*fallback, cancel)
+}
+
+// hedgedResponse returns the response of the hr whose body calls the cancel
+// when it is closed.
+func hedgedResponse(
+	hr hedgedResult,
+	cancel context.CancelFunc,
+) (*http.Response, error) {
+	if hr.err != nil {
+		cancel()
+		return nil, hr.err
+	}
+
+	hr.res.Body = &hedgedBody{ReadCloser: hr.res.Body, cancel: cancel}
+
+	return hr.res, nil
+}
+
+// hedgedBody is the response body of a request sent by the `hedgingTransport`.
+type hedgedBody struct {
+	io.ReadCloser
+
+	cancel context.CancelFunc
+}
+
+// Close implements the `io.Closer`.
+func (hb *hedgedBody) Close() error {
+	err := hb.ReadCloser.Close()
+	hb.cancel()
+	return err
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/quic-go/quic-go/http3"
+)
+
+var (
+	// http3Viper is used to get the configuration items of the HTTP/3.
+	http3Viper = base.Viper.Sub("http3")
+
+	// http3Server is the HTTP/3 server. It is nil when the HTTP/3 is
+	// disabled.
+	http3Server *http3.Server
+)
+
+func init() {
+	if !http3Viper.GetBool("enabled") {
+		return
+	}
+
+	tlsCertFile := http3Viper.GetString("tls_cert_file")
+	tlsKeyFile := http3Viper.GetString("tls_key_file")
+	if tlsCertFile == "" && tlsKeyFile == "" {
+		tlsCertFile = base.Air.TLSCertFile
+		tlsKeyFile = base.Air.TLSKeyFile
+	}
+
+	if tlsCertFile == "" || tlsKeyFile == "" {
+		base.Logger.Fatal().
+			Msg("http3 requires a tls certificate and key")
+	}
+
+	http3Server = &http3.Server{
+		Addr:    http3Viper.GetString("address"),
+		Handler: base.Air,
+	}
+
+	go func() {
+		if err := http3Server.ListenAndServeTLS(
+			tlsCertFile,
+			tlsKeyFile,
+		); err != nil && err != http.ErrServerClosed {
+			base.Logger.Error().Err(err).
+				Msg("http3 server error")
+		}
+	}()
+
+	base.Air.AddShutdownJob(func() {
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			10*time.Second,
+		)
+		defer cancel()
+
+		http3Server.Shutdown(ctx)
+	})
+}
+
+// altSvcGas is used to advertise the HTTP/3 with the Alt-Svc header.
+func altSvcGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if http3Server != nil && req.HTTPRequest().ProtoMajor < 3 {
+			// It fails only before the server starts listening,
+			// in which case there is nothing to advertise yet.
+			http3Server.SetQUICHeaders(res.Header)
+		}
+
+		return next(req, res)
+	}
+}
@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// ipAccessAllowedPrefixes is the client IP prefixes allowed to access.
+	// All client IPs are allowed when it is empty.
+	ipAccessAllowedPrefixes []netip.Prefix
+
+	// ipAccessDeniedPrefixes is the client IP prefixes denied to access.
+	// They take precedence over the `ipAccessAllowedPrefixes`.
+	ipAccessDeniedPrefixes []netip.Prefix
+
+	// ipAccessTrustedProxyPrefixes is the IP prefixes of the reverse
+	// proxies whose X-Forwarded-For headers are trusted.
+	ipAccessTrustedProxyPrefixes []netip.Prefix
+
+	// ipAccessMutex is used to protect the `ipAccessAllowedPrefixes`, the
+	// `ipAccessDeniedPrefixes` and the `ipAccessTrustedProxyPrefixes`.
+	ipAccessMutex sync.RWMutex
+)
+
+func init() {
+	if err := loadIPAccessConfig(); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to load ip access configuration")
+	}
+
+	base.OnConfigReload(func() {
+		if err := loadIPAccessConfig(); err != nil {
+			base.Logger.Error().Err(err).
+				Msg("failed to reload ip access configuration")
+		}
+	})
+}
+
+// loadIPAccessConfig loads the `ipAccessAllowedPrefixes`, the
+// `ipAccessDeniedPrefixes` and the `ipAccessTrustedProxyPrefixes` from the
+// configuration.
+func loadIPAccessConfig() error {
+	v := base.Config().Sub("ip_access")
+	if v == nil {
+		return errors.New("missing ip_access section")
+	}
+
+	allowedPrefixes, err := parseIPPrefixes(
+		v.GetStringSlice("allowed_cidrs"),
+	)
+	if err != nil {
+		return err
+	}
+
+	deniedPrefixes, err := parseIPPrefixes(v.GetStringSlice("denied_cidrs"))
+	if err != nil {
+		return err
+	}
+
+	trustedProxyPrefixes, err := parseIPPrefixes(
+		v.GetStringSlice("trusted_proxy_cidrs"),
+	)
+	if err != nil {
+		return err
+	}
+
+	ipAccessMutex.Lock()
+	ipAccessAllowedPrefixes = allowedPrefixes
+	ipAccessDeniedPrefixes = deniedPrefixes
+	ipAccessTrustedProxyPrefixes = trustedProxyPrefixes
+	ipAccessMutex.Unlock()
+
+	return nil
+}
+
+// parseIPPrefixes parses the ss into IP prefixes. A bare IP is treated as a
+// single-IP prefix.
+func parseIPPrefixes(ss []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(ss))
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+
+			addr = addr.Unmap()
+			prefixes = append(
+				prefixes,
+				netip.PrefixFrom(addr, addr.BitLen()),
+			)
+
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// containsIP reports whether any of the prefixes contains the addr.
+func containsIP(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIPGas is used to make the client IP of the request, as seen by the
+// `air.Request.ClientAddress` and the `air.Request.ClientHost`, the one
+// returned by the `trustedClientIP`. The forwarding headers are dropped unless
+// the request comes through the trusted reverse proxies, so that the rate
+// limiting, the statistics and the access logs cannot be fooled by the spoofed
+// ones. It must come before all the other gases that use the client IP.
+func ClientIPGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		ipAccessMutex.RLock()
+		addr, ok := trustedClientIP(req)
+		ipAccessMutex.RUnlock()
+
+		req.Header.Del("Forwarded")
+		req.Header.Del("X-Real-IP")
+		if ok && addr.String() != req.RemoteHost() {
+			req.Header.Set("X-Forwarded-For", addr.String())
+		} else {
+			req.Header.Del("X-Forwarded-For")
+		}
+
+		return next(req, res)
+	}
+}
+
+// IPAccessGas is used to restrict the access by the client IPs.
+func IPAccessGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if !isIPAccessAllowed(req) {
+			res.Status = http.StatusForbidden
+			return errors.New(strings.ToLower(
+				http.StatusText(res.Status),
+			))
+		}
+
+		return next(req, res)
+	}
+}
+
+// isIPAccessAllowed reports whether the client IP of the req is allowed to
+// access. The client IP is taken from the X-Forwarded-For header only when the
+// req comes through the trusted reverse proxies, so that it cannot be spoofed.
+func isIPAccessAllowed(req *air.Request) bool {
+	ipAccessMutex.RLock()
+	defer ipAccessMutex.RUnlock()
+
+	if len(ipAccessAllowedPrefixes) == 0 &&
+		len(ipAccessDeniedPrefixes) == 0 {
+		return true
+	}
+
+	addr, ok := trustedClientIP(req)
+	if !ok || containsIP(ipAccessDeniedPrefixes, addr) {
+		return false
+	}
+
+	return len(ipAccessAllowedPrefixes) == 0 ||
+		containsIP(ipAccessAllowedPrefixes, addr)
+}
+
+// trustedClientIP returns the client IP of the req. It walks the
+// X-Forwarded-For header from right to left as long as the hops are the
+// trusted reverse proxies, and returns the first one that is not. The X-Real-IP
+// header is used instead when there is no X-Forwarded-For header. It must be
+// called with the `ipAccessMutex` held.
+func trustedClientIP(req *air.Request) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(req.RemoteHost())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	addr = addr.Unmap()
+	if !containsIP(ipAccessTrustedProxyPrefixes, addr) {
+		return addr, true
+	}
+
+	xff := req.Header.Values("X-Forwarded-For")
+	if len(xff) == 0 {
+		xff = req.Header.Values("X-Real-IP")
+	}
+
+	hops := strings.Split(strings.Join(xff, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+
+		if host, _, err := net.SplitHostPort(hop); err == nil {
+			hop = host
+		}
+
+		hopAddr, err := netip.ParseAddr(strings.Trim(hop, "[]"))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+
+		addr = hopAddr.Unmap()
+		if !containsIP(ipAccessTrustedProxyPrefixes, addr) {
+			return addr, true
+		}
+	}
+
+	return addr, true
+}
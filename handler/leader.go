@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/robfig/cron/v3"
+)
+
+// leaderID is the ID used to identify the current instance in leader
+// elections.
+var leaderID string
+
+func init() {
+	hostname, _ := os.Hostname()
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to generate leader id")
+	}
+
+	leaderID = hostname + "-" + hex.EncodeToString(b)
+}
+
+// leaderLease is the lease of a leader election.
+type leaderLease struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// acquireLeadership tries to acquire the leadership of the election with the
+// name for the ttl. It reports whether the current instance is the leader.
+//
+// The election is done by a lease object stored in the Qiniu Cloud Kodo. Since
+// the Qiniu Cloud Kodo has no compare-and-swap operations, the lease is read
+// back after a short nap to make sure that no other instance has overwritten
+// it in the meantime.
+func acquireLeadership(
+	ctx context.Context,
+	name string,
+	ttl time.Duration,
+) (bool, error) {
+	leaseName := "leases/" + name
+
+	lease, err := getLeaderLease(ctx, leaseName)
+	if err != nil && !isNotFoundMinIOError(err) {
+		return false, err
+	}
+
+	now := time.Now()
+	if err == nil &&
+		lease.Holder != leaderID &&
+		lease.ExpiresAt.After(now) {
+		return false, nil
+	}
+
+	leaseJSON, err := json.Marshal(leaderLease{
+		Holder:    leaderID,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if err := qiniuKodoUpload(
+		ctx,
+		leaseName,
+		bytes.NewReader(leaseJSON),
+	); err != nil {
+		return false, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-time.After(2 * time.Second):
+	}
+
+	lease, err = getLeaderLease(ctx, leaseName)
+	if err != nil {
+		return false, err
+	}
+
+	return lease.Holder == leaderID, nil
+}
+
+// getLeaderLease gets the leader lease with the name from the Qiniu Cloud
+// Kodo.
+func getLeaderLease(ctx context.Context, name string) (*leaderLease, error) {
+	lease := &leaderLease{}
+	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) error {
+		object, err := qiniuKodoClient.GetObject(
+			ctx,
+			qiniuKodoBucketName,
+			name,
+			qiniuKodoGetObjectOptions(),
+		)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		return json.NewDecoder(object).Decode(lease)
+	}); err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+// leaderJob returns a `cron.Job` that runs the f only when the current
+// instance is the leader of the election with the name. The ttl should be
+// longer than the interval between two runs of the job. The f is skipped in the
+// maintenance mode, since the leader jobs write to the Qiniu Cloud Kodo.
+func leaderJob(name string, ttl time.Duration, f func()) cron.Job {
+	return cron.NewChain(
+		cron.SkipIfStillRunning(cron.DiscardLogger),
+	).Then(cron.FuncJob(func() {
+		if maintenanceMode.Load() {
+			return
+		}
+
+		isLeader, err := acquireLeadership(base.Context, name, ttl)
+		if err != nil {
+			base.Logger.Error().Err(err).
+				Str("election", name).
+				Msg("failed to acquire leadership")
+			return
+		} else if !isLeader {
+			return
+		}
+
+		f()
+	}))
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+var (
+	// qiniuKodoObjectTagging indicates whether the objects uploaded to the
+	// Qiniu Cloud Kodo are tagged, so that the lifecycle rules of the
+	// bucket can filter them by the tags.
+	qiniuKodoObjectTagging = qiniuViper.GetBool("kodo_object_tagging")
+
+	// qiniuKodoStorageClasses is the storage classes of the objects
+	// uploaded to the Qiniu Cloud Kodo keyed by the Goproxy cache name
+	// types (see the `goproxyCacheNameType`). The "kodo_storage_class" is
+	// used for the missing ones, and the default storage class of the
+	// bucket is used when that is empty too.
+	qiniuKodoStorageClasses = newQiniuKodoStorageClasses()
+)
+
+// newQiniuKodoStorageClasses returns a new `qiniuKodoStorageClasses`.
+func newQiniuKodoStorageClasses() map[string]string {
+	storageClasses := map[string]string{}
+	for _, nameType := range []string{
+		"list",
+		"latest",
+		"info",
+		"mod",
+		"zip",
+	} {
+		key := fmt.Sprint("kodo_storage_classes.", nameType)
+		if qiniuViper.IsSet(key) {
+			storageClasses[nameType] = qiniuViper.GetString(key)
+		}
+	}
+
+	return storageClasses
+}
+
+// qiniuKodoStorageClass returns the storage class of the object with the name
+// uploaded to the Qiniu Cloud Kodo.
+func qiniuKodoStorageClass(name string) string {
+	_, name = cutTenantCachePrefix(name)
+	if sc, ok := qiniuKodoStorageClasses[goproxyCacheNameType(name)]; ok {
+		return sc
+	}
+
+	return qiniuViper.GetString("kodo_storage_class")
+}
+
+// qiniuKodoObjectTags returns the tags of the object with the name and the size
+// uploaded to the Qiniu Cloud Kodo, or nil if the `qiniuKodoObjectTagging` is
+// disabled.
+//
+// The tags are the "type" (see the `goproxyCacheNameType`, or "other"), the
+// "size_class" (see the `sizeClass`), the "module" that is the truncated
+// SHA-256 of the module path for the Goproxy caches, and the "tenant" for the
+// Goproxy caches in the namespaces of the tenants. Tag values are limited in
+// both length and charset, hence the hashed module paths.
+func qiniuKodoObjectTags(name string, size int64) map[string]string {
+	if !qiniuKodoObjectTagging {
+		return nil
+	}
+
+	tenant, name := cutTenantCachePrefix(name)
+
+	nameType := goproxyCacheNameType(name)
+	if nameType == "" || strings.HasPrefix(name, "sumdb/") {
+		nameType = "other"
+	}
+
+	tags := map[string]string{
+		"type":       nameType,
+		"size_class": sizeClass(size),
+	}
+
+	if nameType != "other" {
+		if modulePath, _, ok := parseGoproxyCacheName(name); ok {
+			checksum := sha256.Sum256([]byte(modulePath))
+			tags["module"] = hex.EncodeToString(checksum[:8])
+		}
+	}
+
+	if tenant != "" {
+		tags["tenant"] = tenant
+	}
+
+	return tags
+}
+
+// sizeClass returns the size class of the size, which is "small" for less than
+// 1 MiB, "medium" for less than 64 MiB and "large" for the rest.
+func sizeClass(size int64) string {
+	switch {
+	case size < 1<<20:
+		return "small"
+	case size < 64<<20:
+		return "medium"
+	}
+
+	return "large"
+}
+
+// cutTenantCachePrefix returns the tenant and the Goproxy cache name of the
+// object with the name if it is in the namespace of a tenant. Otherwise, it
+// returns an empty tenant and the name as is.
+func cutTenantCachePrefix(name string) (string, string) {
+	rest, ok := strings.CutPrefix(name, tenantCachePrefix)
+	if !ok {
+		return "", name
+	}
+
+	tenant, name, ok := strings.Cut(rest, "/")
+	if !ok || !validTenantName(tenant) {
+		return "", tenantCachePrefix + rest
+	}
+
+	return tenant, name
+}
@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"errors"
+	"expvar"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+)
+
+var (
+	// adaptiveConcurrencyEnabled indicates whether the concurrency of the
+	// Goproxy requests is limited adaptively.
+	adaptiveConcurrencyEnabled = goproxyViper.GetBool(
+		"adaptive_concurrency",
+	)
+
+	// adaptiveConcurrencyMinLimit is the minimum of the
+	// `adaptiveConcurrencyLimit`.
+	adaptiveConcurrencyMinLimit = goproxyViper.GetFloat64(
+		"adaptive_concurrency_min_limit",
+	)
+
+	// adaptiveConcurrencyMaxLimit is the maximum of the
+	// `adaptiveConcurrencyLimit`.
+	adaptiveConcurrencyMaxLimit = goproxyViper.GetFloat64(
+		"adaptive_concurrency_max_limit",
+	)
+
+	// adaptiveConcurrencyTolerance is how many times the short-term latency
+	// can be of the long-term one before the `adaptiveConcurrencyLimit`
+	// starts to decrease.
+	adaptiveConcurrencyTolerance = goproxyViper.GetFloat64(
+		"adaptive_concurrency_tolerance",
+	)
+
+	// adaptiveConcurrencyRetryAfter is the Retry-After of the shed
+	// requests.
+	adaptiveConcurrencyRetryAfter = goproxyViper.GetDuration(
+		"adaptive_concurrency_retry_after",
+	)
+
+	// adaptiveConcurrencyLimit is the current limit of the in-flight
+	// Goproxy requests.
+	adaptiveConcurrencyLimit = goproxyViper.GetFloat64(
+		"adaptive_concurrency_initial_limit",
+	)
+
+	// adaptiveConcurrencyInflight is the number of the in-flight Goproxy
+	// requests.
+	adaptiveConcurrencyInflight int
+
+	// adaptiveConcurrencyShortLatency is the short-term moving average of
+	// the latencies of the Goproxy requests in seconds.
+	adaptiveConcurrencyShortLatency float64
+
+	// adaptiveConcurrencyLongLatency is the long-term moving average of the
+	// latencies of the Goproxy requests in seconds, which is the baseline
+	// of the `adaptiveConcurrencyShortLatency`.
+	adaptiveConcurrencyLongLatency float64
+
+	// adaptiveConcurrencyMutex is used to protect the
+	// `adaptiveConcurrencyLimit`, the `adaptiveConcurrencyInflight`, the
+	// `adaptiveConcurrencyShortLatency` and the
+	// `adaptiveConcurrencyLongLatency`.
+	adaptiveConcurrencyMutex sync.Mutex
+
+	// adaptiveConcurrencyShed is the number of the Goproxy requests shed
+	// due to the `adaptiveConcurrencyLimit`.
+	adaptiveConcurrencyShed = expvar.NewInt("adaptive_concurrency_shed")
+)
+
+const (
+	// adaptiveConcurrencyShortWeight is the weight of a new latency in the
+	// `adaptiveConcurrencyShortLatency`.
+	adaptiveConcurrencyShortWeight = 0.1
+
+	// adaptiveConcurrencyLongWeight is the weight of a new latency in the
+	// `adaptiveConcurrencyLongLatency`.
+	adaptiveConcurrencyLongWeight = 1.0 / 600
+
+	// adaptiveConcurrencySmoothing is the weight of a new limit in the
+	// `adaptiveConcurrencyLimit`.
+	adaptiveConcurrencySmoothing = 0.2
+)
+
+func init() {
+	expvar.Publish("adaptive_concurrency", expvar.Func(func() any {
+		adaptiveConcurrencyMutex.Lock()
+		defer adaptiveConcurrencyMutex.Unlock()
+
+		return map[string]any{
+			"enabled":       adaptiveConcurrencyEnabled,
+			"limit":         int(adaptiveConcurrencyLimit),
+			"inflight":      adaptiveConcurrencyInflight,
+			"short_latency": adaptiveConcurrencyShortLatency,
+			"long_latency":  adaptiveConcurrencyLongLatency,
+			"min_limit":     int(adaptiveConcurrencyMinLimit),
+			"max_limit":     int(adaptiveConcurrencyMaxLimit),
+			"tolerance":     adaptiveConcurrencyTolerance,
+			"retry_after":   adaptiveConcurrencyRetryAfter.String(),
+		}
+	}))
+}
+
+// loadSheddingGas is used to shed the Goproxy requests with "503 Service
+// Unavailable" once the in-flight ones reach the `adaptiveConcurrencyLimit`,
+// so that the goroutines do not pile up while the Qiniu Cloud Kodo or the
+// upstreams slow down.
+func loadSheddingGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) (err error) {
+		if !adaptiveConcurrencyEnabled {
+			return next(req, res)
+		}
+
+		if !acquireAdaptiveConcurrency() {
+			adaptiveConcurrencyShed.Add(1)
+			res.Status = http.StatusServiceUnavailable
+			res.Header.Set(
+				"Retry-After",
+				strconv.Itoa(int(math.Ceil(
+					adaptiveConcurrencyRetryAfter.Seconds(),
+				))),
+			)
+			return errors.New(strings.ToLower(
+				http.StatusText(res.Status),
+			))
+		}
+
+		// The latencies of the zip files are dominated by the
+		// bandwidths of the clients, so they are not sampled.
+		sampled := !strings.HasSuffix(
+			req.HTTPRequest().URL.Path,
+			".zip",
+		)
+
+		// The slot is released even if the next panics, in which case
+		// the latency is not sampled.
+		startTime := time.Now()
+		returned := false
+		defer func() {
+			releaseAdaptiveConcurrency(
+				time.Since(startTime),
+				sampled && returned && err == nil &&
+					res.Status < 500,
+			)
+		}()
+
+		err = next(req, res)
+		returned = true
+
+		return err
+	}
+}
+
+// acquireAdaptiveConcurrency reserves a slot for an in-flight Goproxy request.
+// It reports false if the `adaptiveConcurrencyLimit` has been reached.
+//
+// The `releaseAdaptiveConcurrency` must be called after a successful
+// acquisition.
+func acquireAdaptiveConcurrency() bool {
+	adaptiveConcurrencyMutex.Lock()
+	defer adaptiveConcurrencyMutex.Unlock()
+
+	if float64(adaptiveConcurrencyInflight) >= adaptiveConcurrencyLimit {
+		return false
+	}
+
+	adaptiveConcurrencyInflight++
+
+	return true
+}
+
+// releaseAdaptiveConcurrency releases the slot of an in-flight Goproxy request
+// that took the latency. If the sampled is true, the latency is used to adjust
+// the `adaptiveConcurrencyLimit` by the gradient of the long-term latency to
+// the short-term one: the limit shrinks as the short-term latency exceeds the
+// long-term one by more than the `adaptiveConcurrencyTolerance`, and otherwise
+// grows by the square root of itself while it is actually being used.
+func releaseAdaptiveConcurrency(latency time.Duration, sampled bool) {
+	adaptiveConcurrencyMutex.Lock()
+	defer adaptiveConcurrencyMutex.Unlock()
+
+	inflight := adaptiveConcurrencyInflight
+	adaptiveConcurrencyInflight--
+	if !sampled {
+		return
+	}
+
+	l := latency.Seconds()
+	if adaptiveConcurrencyLongLatency == 0 {
+		adaptiveConcurrencyShortLatency = l
+		adaptiveConcurrencyLongLatency = l
+		return
+	}
+
+	adaptiveConcurrencyShortLatency += adaptiveConcurrencyShortWeight *
+		(l - adaptiveConcurrencyShortLatency)
+	adaptiveConcurrencyLongLatency += adaptiveConcurrencyLongWeight *
+		(l - adaptiveConcurrencyLongLatency)
+
+	// A long-lasting slowdown must not become the new baseline, so the
+	// long-term latency recovers quickly once the slowdown is over.
+	if adaptiveConcurrencyLongLatency > 2*adaptiveConcurrencyShortLatency {
+		adaptiveConcurrencyLongLatency *= 0.95
+	}
+
+	if adaptiveConcurrencyShortLatency <= 0 {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(
+		1,
+		adaptiveConcurrencyTolerance*adaptiveConcurrencyLongLatency/
+			adaptiveConcurrencyShortLatency,
+	))
+
+	limit := adaptiveConcurrencyLimit*gradient +
+		math.Sqrt(adaptiveConcurrencyLimit)
+	if limit > adaptiveConcurrencyLimit &&
+		float64(inflight) < adaptiveConcurrencyLimit/2 {
+		return
+	}
+
+	limit = adaptiveConcurrencyLimit*(1-adaptiveConcurrencySmoothing) +
+		limit*adaptiveConcurrencySmoothing
+	adaptiveConcurrencyLimit = math.Max(
+		adaptiveConcurrencyMinLimit,
+		math.Min(limit, adaptiveConcurrencyMaxLimit),
+	)
+}
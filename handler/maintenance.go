@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// maintenanceMode indicates whether the maintenance mode is on, in
+	// which the writes to the Qiniu Cloud Kodo are suspended while the
+	// cached reads and redirects continue, such as during a bucket
+	// migration. It is loaded from the "maintenance_mode" when the config
+	// is loaded for the first time or the "maintenance_mode" is changed,
+	// and can be toggled at runtime by the admins.
+	maintenanceMode atomic.Bool
+
+	// configuredMaintenanceMode is the "maintenance_mode" last loaded from
+	// the config.
+	configuredMaintenanceMode bool
+
+	// maintenanceSkippedCachePuts is the number of the Goproxy cache puts
+	// skipped due to the maintenance mode.
+	maintenanceSkippedCachePuts = expvar.NewInt(
+		"maintenance_skipped_cache_puts",
+	)
+
+	// errMaintenanceMode is returned by the writes to the Qiniu Cloud Kodo
+	// in the maintenance mode.
+	errMaintenanceMode = errors.New(
+		"storage writes are suspended in maintenance mode",
+	)
+)
+
+func init() {
+	if !adminEnabled {
+		return
+	}
+
+	base.Air.GET(
+		"/admin/maintenance",
+		hAdminMaintenance,
+		adminGas,
+		globalAdminGas,
+	)
+	base.Air.PUT(
+		"/admin/maintenance",
+		hAdminEnableMaintenance,
+		adminGas,
+		globalAdminGas,
+	)
+	base.Air.DELETE(
+		"/admin/maintenance",
+		hAdminDisableMaintenance,
+		adminGas,
+		globalAdminGas,
+	)
+}
+
+// hAdminMaintenance handles requests to get whether the maintenance mode is
+// on.
+func hAdminMaintenance(req *air.Request, res *air.Response) error {
+	return res.WriteJSON(map[string]any{
+		"maintenance":         maintenanceMode.Load(),
+		"skipped_cache_puts":  maintenanceSkippedCachePuts.Value(),
+		"inflight_cache_puts": inflightGoproxyCachePuts(),
+	})
+}
+
+// hAdminEnableMaintenance handles requests to turn on the maintenance mode of
+// the current instance.
+func hAdminEnableMaintenance(req *air.Request, res *air.Response) error {
+	return setMaintenanceMode(req, res, true)
+}
+
+// hAdminDisableMaintenance handles requests to turn off the maintenance mode of
+// the current instance.
+func hAdminDisableMaintenance(req *air.Request, res *air.Response) error {
+	return setMaintenanceMode(req, res, false)
+}
+
+// setMaintenanceMode sets the `maintenanceMode` to the maintenance for the req.
+func setMaintenanceMode(
+	req *air.Request,
+	res *air.Response,
+	maintenance bool,
+) error {
+	if maintenanceMode.Swap(maintenance) != maintenance {
+		base.Logger.Info().
+			Bool("maintenance", maintenance).
+			Str("client_address", req.ClientAddress()).
+			Msg("toggled maintenance mode")
+	}
+
+	res.Status = http.StatusNoContent
+
+	return res.Write(nil)
+}
+
+// maintenanceGas is used to reject the requests to the admin API that write to
+// the Qiniu Cloud Kodo in the maintenance mode. It must come after the
+// `adminGas`.
+func maintenanceGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if maintenanceMode.Load() {
+			res.Status = http.StatusServiceUnavailable
+			return errMaintenanceMode
+		}
+
+		return next(req, res)
+	}
+}
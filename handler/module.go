@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// modulePageVersion is a cached version shown on a module page.
+type modulePageVersion struct {
+	Version   string
+	CachedAt  string
+	Retracted bool
+	Rationale string
+}
+
+// modulePagePath returns the module path of the module page targeted by the
+// name. It reports false if the name does not target a module page.
+func modulePagePath(name string) (string, bool) {
+	if strings.Contains(name, "@") ||
+		strings.HasPrefix(name, "sumdb/") ||
+		module.CheckPath(name) != nil {
+		return "", false
+	}
+
+	return name, true
+}
+
+// hModulePage handles requests to get the page of the module targeted by the
+// modulePath. The page shows the cached versions of the module, along with
+// their retraction status, the deprecation status and the download statistics
+// of the module.
+func hModulePage(req *air.Request, res *air.Response, modulePath string) error {
+	if isModuleBlocked(modulePath, "") {
+		return NotFound(req, res)
+	}
+
+	cmvs, err := listCachedModuleVersions(req.Context, modulePath)
+	if err != nil {
+		return err
+	}
+
+	if len(cmvs) == 0 {
+		res.Header.Set("Cache-Control", "public, max-age=60")
+		return NotFound(req, res)
+	}
+
+	latestVersion := ""
+	for _, cmv := range cmvs {
+		if compareSearchVersions(cmv.Version, latestVersion) > 0 {
+			latestVersion = cmv.Version
+		}
+	}
+
+	// Like the go command, the retractions and the deprecation are taken
+	// from the go.mod file of the latest version.
+	var (
+		retractions []*modfile.Retract
+		deprecated  string
+	)
+
+	if f, err := loadModuleModFile(req.Context, module.Version{
+		Path:    modulePath,
+		Version: latestVersion,
+	}); err == nil {
+		retractions = f.Retract
+		if f.Module != nil {
+			deprecated = f.Module.Deprecated
+		}
+	}
+
+	pageVersions := make([]*modulePageVersion, 0, len(cmvs))
+	for i := len(cmvs) - 1; i >= 0; i-- {
+		pv := &modulePageVersion{
+			Version:  cmvs[i].Version,
+			CachedAt: cmvs[i].CachedAt.Format("2006-01-02"),
+		}
+
+		for _, r := range retractions {
+			if semver.Compare(pv.Version, r.Low) >= 0 &&
+				semver.Compare(pv.Version, r.High) <= 0 {
+				pv.Retracted = true
+				pv.Rationale = r.Rationale
+				break
+			}
+		}
+
+		pageVersions = append(pageVersions, pv)
+	}
+
+	var stat moduleVersionStat
+	if err := getStatObject(
+		req.Context,
+		path.Join("stats", modulePath),
+		&stat,
+	); err != nil && !isNotFoundMinIOError(err) {
+		return err
+	}
+
+	date := time.Now().UTC()
+	stat.updateLast30Days(time.Date(
+		date.Year(),
+		date.Month(),
+		date.Day()-1,
+		0,
+		0,
+		0,
+		0,
+		time.UTC,
+	))
+
+	res.Header.Set("Cache-Control", "public, max-age=60")
+
+	return res.Render(map[string]any{
+		"PageTitle":     modulePath,
+		"CanonicalPath": "/" + modulePath,
+		"FeedPath": "/feeds/new-versions.atom?prefix=" +
+			url.QueryEscape(modulePath),
+		"ModulePath":    modulePath,
+		"LatestVersion": latestVersion,
+		"Deprecated":    deprecated,
+		"Versions":      pageVersions,
+		"DownloadCount": thousandsCommaSeperated(
+			int64(stat.DownloadCount),
+		),
+		"DailyDownloadCount": thousandsCommaSeperated(
+			int64(stat.DailyDownloadCount),
+		),
+		"WeeklyDownloadCount": thousandsCommaSeperated(
+			int64(stat.WeeklyDownloadCount),
+		),
+		"MonthlyDownloadCount": thousandsCommaSeperated(
+			int64(stat.MonthlyDownloadCount),
+		),
+	}, req.LocalizedString("module.html"), "layouts/default.html")
+}
+
+// loadModuleModFile returns the parsed go.mod file of the mv from the Goproxy
+// caches.
+func loadModuleModFile(
+	ctx context.Context,
+	mv module.Version,
+) (*modfile.File, error) {
+	name, err := goproxyCacheNameOf(mv, ".mod")
+	if err != nil {
+		return nil, err
+	}
+
+	object, _, err := getGoproxyCacheObject(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	b, err := io.ReadAll(object)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := modfile.ParseLax(name, b, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,530 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/goproxy/goproxy.cn/internal/cacheencryption"
+	"github.com/minio/minio-go/v7"
+)
+
+var (
+	// qiniuKodoMultipartUploadConcurrency is the maximum number of the
+	// parts of a multipart upload to the Qiniu Cloud Kodo that are uploaded
+	// concurrently.
+	qiniuKodoMultipartUploadConcurrency = qiniuViper.GetInt(
+		"kodo_multipart_upload_concurrency",
+	)
+
+	// qiniuKodoMultipartUploadStaleAge is how long an incomplete multipart
+	// upload to the Qiniu Cloud Kodo is kept for resuming before it is
+	// aborted.
+	qiniuKodoMultipartUploadStaleAge = qiniuViper.GetDuration(
+		"kodo_multipart_upload_stale_age",
+	)
+)
+
+// multipartUploadStatePrefix is the prefix of the objects where the states of
+// the multipart uploads are stored in the Qiniu Cloud Kodo.
+const multipartUploadStatePrefix = "uploads/multipart/"
+
+// multipartUploadState is the state of a multipart upload to the Qiniu Cloud
+// Kodo. It is persisted as the parts are uploaded, so that an interrupted
+// multipart upload can be resumed from where it stopped.
+//
+// The salt of an encrypted content (see the `encryptGoproxyCache`) is kept
+// along with its fingerprint, so that the same content is encrypted into the
+// same parts when resuming, and a salt is never reused for another content.
+type multipartUploadState struct {
+	UploadID    string                `json:"upload_id"`
+	Size        int64                 `json:"size"`
+	PartSize    int64                 `json:"part_size"`
+	Salt        []byte                `json:"salt,omitempty"`
+	Fingerprint []byte                `json:"fingerprint,omitempty"`
+	Parts       []multipartUploadPart `json:"parts"`
+	UpdatedAt   time.Time             `json:"updated_at"`
+}
+
+// multipartUploadPart is an uploaded part of a multipart upload.
+type multipartUploadPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+	MD5        string `json:"md5"`
+}
+
+func init() {
+	if qiniuKodoMultipartUploadStaleAge <= 0 {
+		return
+	}
+
+	if _, err := base.Cron.AddJob(
+		"30 * * * *", // Every hour
+		leaderJob("multipart-uploads", time.Hour, func() {
+			if err := abortStaleMultipartUploads(
+				base.Context,
+			); err != nil {
+				base.Logger.Error().Err(err).
+					Msg("failed to abort stale multipart " +
+						"uploads")
+			}
+		}),
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add multipart upload abort cron job")
+	}
+}
+
+// qiniuKodoMultipartUpload uploads the content with the name and the size to
+// the Qiniu Cloud Kodo in parts with the opts, up to the
+// `qiniuKodoMultipartUploadConcurrency` parts at a time. It resumes the
+// interrupted multipart upload of the same content if there is one, in which
+// case the parts that have already been uploaded are skipped. It returns the
+// expected ETag of the uploaded object.
+func qiniuKodoMultipartUpload(
+	ctx context.Context,
+	name string,
+	content io.ReadSeeker,
+	size int64,
+	opts minio.PutObjectOptions,
+) (string, error) {
+	mus, uploadedParts := resumableMultipartUpload(ctx, name, size)
+
+	encrypter := cacheencryption.EncrypterOf(content)
+	if mus != nil && encrypter != nil {
+		resumable, err := resumeEncryptedMultipartUpload(encrypter, mus)
+		if err != nil {
+			return "", err
+		}
+
+		if !resumable {
+			mus, uploadedParts = nil, nil
+		}
+	}
+
+	if mus == nil {
+		mus = &multipartUploadState{
+			Size:     size,
+			PartSize: qiniuKodoMultipartUploadPartSize,
+		}
+		if encrypter != nil {
+			fingerprint, err := encrypter.Fingerprint()
+			if err != nil {
+				return "", err
+			}
+
+			mus.Salt = encrypter.Salt()
+			mus.Fingerprint = fingerprint
+		}
+
+		if err := retryQiniuKodoDo(ctx, func(
+			ctx context.Context,
+		) (err error) {
+			mus.UploadID, err = qiniuKodoCore.NewMultipartUpload(
+				ctx,
+				qiniuKodoBucketName,
+				name,
+				opts,
+			)
+			return err
+		}); err != nil {
+			return "", err
+		}
+	}
+
+	partCount := int((size + mus.PartSize - 1) / mus.PartSize)
+	mups := make([]multipartUploadPart, partCount)
+	partMD5s := make([][]byte, partCount)
+	mus.Parts = nil
+
+	// The parts can only be read concurrently from an `io.ReaderAt`.
+	concurrency := qiniuKodoMultipartUploadConcurrency
+	if _, ok := content.(io.ReaderAt); !ok || concurrency < 1 {
+		concurrency = 1
+	}
+
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		partIndexes = make(chan int)
+		wg          sync.WaitGroup
+		mutex       sync.Mutex
+		uploadErr   error
+		stateSaves  = make(chan struct{}, 1)
+		stateSaved  = make(chan struct{})
+	)
+
+	// The state is saved by a single goroutine outside the mutex, so that
+	// the parts are not serialized on the saves. The saves requested while
+	// one is in progress are coalesced into the next one.
+	go func() {
+		defer close(stateSaved)
+		for range stateSaves {
+			mutex.Lock()
+			state := *mus
+			state.Parts = slices.Clone(mus.Parts)
+			mutex.Unlock()
+
+			saveMultipartUploadState(ctx, name, &state)
+		}
+	}()
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range partIndexes {
+				offset := int64(i) * mus.PartSize
+				partSize := min(mus.PartSize, size-offset)
+
+				mup, partMD5, err := uploadMultipartPart(
+					uploadCtx,
+					name,
+					content,
+					mus.UploadID,
+					i+1,
+					offset,
+					partSize,
+					uploadedParts,
+					opts,
+				)
+
+				mutex.Lock()
+				if err != nil {
+					if uploadErr == nil {
+						uploadErr = err
+						cancel()
+					}
+				} else {
+					mups[i] = mup
+					partMD5s[i] = partMD5
+					mus.Parts = append(mus.Parts, mup)
+				}
+				mutex.Unlock()
+
+				if err == nil {
+					select {
+					case stateSaves <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < partCount && uploadCtx.Err() == nil; i++ {
+		select {
+		case partIndexes <- i:
+		case <-uploadCtx.Done():
+		}
+	}
+
+	close(partIndexes)
+	wg.Wait()
+	close(stateSaves)
+	<-stateSaved
+
+	if uploadErr == nil {
+		uploadErr = uploadCtx.Err()
+	}
+
+	if uploadErr != nil {
+		return "", uploadErr
+	}
+
+	completeParts := make([]minio.CompletePart, 0, partCount)
+	for _, mup := range mups {
+		completeParts = append(completeParts, minio.CompletePart{
+			PartNumber: mup.PartNumber,
+			ETag:       mup.ETag,
+		})
+	}
+
+	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) error {
+		_, err := qiniuKodoCore.CompleteMultipartUpload(
+			ctx,
+			qiniuKodoBucketName,
+			name,
+			mus.UploadID,
+			completeParts,
+			minio.PutObjectOptions{
+				ContentType:          opts.ContentType,
+				ServerSideEncryption: opts.ServerSideEncryption,
+			},
+		)
+		return err
+	}); err != nil {
+		return "", err
+	}
+
+	removeMultipartUploadState(ctx, name)
+
+	return qiniuKodoMultipartETag(partMD5s), nil
+}
+
+// resumeEncryptedMultipartUpload sets the salt of the encrypter to the one of
+// the interrupted multipart upload with the mus, so that the parts that have
+// already been uploaded can be skipped. It reports false, leaving the encrypter
+// as is, if the encrypter does not encrypt the same content with the same key.
+func resumeEncryptedMultipartUpload(
+	encrypter *cacheencryption.Encrypter,
+	mus *multipartUploadState,
+) (bool, error) {
+	if mus.Salt == nil || mus.Fingerprint == nil {
+		return false, nil
+	}
+
+	salt := encrypter.Salt()
+	if err := encrypter.SetSalt(mus.Salt); err != nil {
+		return false, err
+	}
+
+	fingerprint, err := encrypter.Fingerprint()
+	if err != nil {
+		return false, err
+	}
+
+	if bytes.Equal(fingerprint, mus.Fingerprint) {
+		return true, nil
+	}
+
+	return false, encrypter.SetSalt(salt)
+}
+
+// uploadMultipartPart uploads the part with the partNumber of the content,
+// which is the partSize bytes starting at the offset, to the multipart upload
+// with the uploadID of the object with the name. The upload is skipped if the
+// same part is found in the uploadedParts. It returns the uploaded part and
+// its MD5 checksum.
+func uploadMultipartPart(
+	ctx context.Context,
+	name string,
+	content io.ReadSeeker,
+	uploadID string,
+	partNumber int,
+	offset int64,
+	partSize int64,
+	uploadedParts map[int]multipartUploadPart,
+	opts minio.PutObjectOptions,
+) (multipartUploadPart, []byte, error) {
+	partMD5, err := contentMD5(content, offset, partSize)
+	if err != nil {
+		return multipartUploadPart{}, nil, err
+	}
+
+	if mup, ok := uploadedParts[partNumber]; ok &&
+		mup.MD5 == hex.EncodeToString(partMD5) {
+		return mup, partMD5, nil
+	}
+
+	var part minio.ObjectPart
+	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) (err error) {
+		content := content
+		if ra, ok := content.(io.ReaderAt); ok {
+			content = io.NewSectionReader(ra, offset, partSize)
+		} else if _, err := content.Seek(
+			offset,
+			io.SeekStart,
+		); err != nil {
+			return err
+		}
+
+		part, err = qiniuKodoCore.PutObjectPart(
+			ctx,
+			qiniuKodoBucketName,
+			name,
+			uploadID,
+			partNumber,
+			io.LimitReader(content, partSize),
+			partSize,
+			minio.PutObjectPartOptions{
+				Md5Base64: base64OrEmpty(partMD5),
+				SSE:       opts.ServerSideEncryption,
+			},
+		)
+
+		return err
+	}); err != nil {
+		return multipartUploadPart{}, nil, err
+	}
+
+	return multipartUploadPart{
+		PartNumber: part.PartNumber,
+		ETag:       part.ETag,
+		MD5:        hex.EncodeToString(partMD5),
+	}, partMD5, nil
+}
+
+// resumableMultipartUpload returns the state of the interrupted multipart
+// upload of the object with the name and the size to the Qiniu Cloud Kodo, and
+// its parts that are still there keyed by their part numbers. It returns nil
+// if there is none to resume.
+func resumableMultipartUpload(
+	ctx context.Context,
+	name string,
+	size int64,
+) (*multipartUploadState, map[int]multipartUploadPart) {
+	var mus multipartUploadState
+	if err := getStatObject(
+		ctx,
+		multipartUploadStatePrefix+name,
+		&mus,
+	); err != nil {
+		if !isNotFoundMinIOError(err) {
+			base.Logger.Warn().Err(err).
+				Str("name", name).
+				Msg("failed to load multipart upload state")
+		}
+
+		return nil, nil
+	}
+
+	if mus.UploadID == "" ||
+		mus.Size != size ||
+		mus.PartSize != qiniuKodoMultipartUploadPartSize {
+		return nil, nil
+	}
+
+	liveParts := map[int]string{}
+	for partNumberMarker := 0; ; {
+		var lopr minio.ListObjectPartsResult
+		if err := retryQiniuKodoDo(ctx, func(
+			ctx context.Context,
+		) (err error) {
+			lopr, err = qiniuKodoCore.ListObjectParts(
+				ctx,
+				qiniuKodoBucketName,
+				name,
+				mus.UploadID,
+				partNumberMarker,
+				1000,
+			)
+			return err
+		}); err != nil {
+			// The multipart upload has been completed or aborted.
+			return nil, nil
+		}
+
+		for _, op := range lopr.ObjectParts {
+			liveParts[op.PartNumber] = op.ETag
+		}
+
+		if !lopr.IsTruncated {
+			break
+		}
+
+		partNumberMarker = lopr.NextPartNumberMarker
+	}
+
+	uploadedParts := map[int]multipartUploadPart{}
+	for _, mup := range mus.Parts {
+		if liveParts[mup.PartNumber] == mup.ETag {
+			uploadedParts[mup.PartNumber] = mup
+		}
+	}
+
+	base.Logger.Info().
+		Str("name", name).
+		Str("upload_id", mus.UploadID).
+		Int("uploaded_parts", len(uploadedParts)).
+		Msg("resuming multipart upload")
+
+	return &mus, uploadedParts
+}
+
+// saveMultipartUploadState saves the mus of the multipart upload of the object
+// with the name to the Qiniu Cloud Kodo.
+func saveMultipartUploadState(
+	ctx context.Context,
+	name string,
+	mus *multipartUploadState,
+) {
+	mus.UpdatedAt = time.Now().UTC()
+	if err := putStatObject(
+		ctx,
+		multipartUploadStatePrefix+name,
+		mus,
+	); err != nil {
+		base.Logger.Warn().Err(err).
+			Str("name", name).
+			Msg("failed to save multipart upload state")
+	}
+}
+
+// removeMultipartUploadState removes the state of the multipart upload of the
+// object with the name from the Qiniu Cloud Kodo.
+func removeMultipartUploadState(ctx context.Context, name string) {
+	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) error {
+		return qiniuKodoClient.RemoveObject(
+			ctx,
+			qiniuKodoBucketName,
+			multipartUploadStatePrefix+name,
+			minio.RemoveObjectOptions{},
+		)
+	}); err != nil && !isNotFoundMinIOError(err) {
+		base.Logger.Warn().Err(err).
+			Str("name", name).
+			Msg("failed to remove multipart upload state")
+	}
+}
+
+// abortStaleMultipartUploads aborts the incomplete multipart uploads to the
+// Qiniu Cloud Kodo that were initiated more than the
+// `qiniuKodoMultipartUploadStaleAge` ago, so that their orphaned parts stop
+// being billed.
+func abortStaleMultipartUploads(ctx context.Context) error {
+	var aborted int
+	for omi := range qiniuKodoClient.ListIncompleteUploads(
+		ctx,
+		qiniuKodoBucketName,
+		"",
+		true,
+	) {
+		if omi.Err != nil {
+			return omi.Err
+		}
+
+		if time.Since(omi.Initiated) <
+			qiniuKodoMultipartUploadStaleAge {
+			continue
+		}
+
+		if err := retryQiniuKodoDo(ctx, func(
+			ctx context.Context,
+		) error {
+			return qiniuKodoCore.AbortMultipartUpload(
+				ctx,
+				qiniuKodoBucketName,
+				omi.Key,
+				omi.UploadID,
+			)
+		}); err != nil && !isNotFoundMinIOError(err) {
+			return err
+		}
+
+		var mus multipartUploadState
+		if err := getStatObject(
+			ctx,
+			multipartUploadStatePrefix+omi.Key,
+			&mus,
+		); err == nil && mus.UploadID == omi.UploadID {
+			removeMultipartUploadState(ctx, omi.Key)
+		}
+
+		aborted++
+	}
+
+	if aborted > 0 {
+		base.Logger.Info().
+			Int("aborted", aborted).
+			Msg("aborted stale multipart uploads")
+	}
+
+	return nil
+}
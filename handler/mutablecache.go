@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// mutableCacheTTL is how long the responses of the mutable Goproxy
+	// caches (the "/@v/list" and the "/@latest") are served from the
+	// memory without asking the upstream. Nothing is cached when it is not
+	// positive.
+	mutableCacheTTL = goproxyViper.GetDuration("mutable_cache_ttl")
+
+	// mutableCacheStaleTTL is how long the responses of the mutable Goproxy
+	// caches are still served from the memory after the `mutableCacheTTL`,
+	// while they are being revalidated in the background.
+	mutableCacheStaleTTL = goproxyViper.GetDuration(
+		"mutable_cache_stale_ttl",
+	)
+
+	// mutableCacheMaxEntries is the maximum number of the entries of the
+	// `mutableCache`.
+	mutableCacheMaxEntries = goproxyViper.GetInt(
+		"mutable_cache_max_entries",
+	)
+
+	// mutableCache is the cached responses of the mutable Goproxy caches
+	// keyed by their object names.
+	mutableCache = map[string]*mutableCacheEntry{}
+
+	// mutableCacheMutex is used to protect the `mutableCache`.
+	mutableCacheMutex sync.Mutex
+
+	// mutableCacheRevalidations is the number of the background
+	// revalidations of the `mutableCache`.
+	mutableCacheRevalidations = expvar.NewInt(
+		"mutable_cache_revalidations",
+	)
+)
+
+// mutableCacheEntry is an entry of the `mutableCache`.
+type mutableCacheEntry struct {
+	contentType  string
+	content      []byte
+	fetchedAt    time.Time
+	stale        bool
+	revalidating bool
+}
+
+// serveMutableGoproxyCache serves the req for the mutable Goproxy cache with
+// the name from the `mutableCache` if it is fresh, or stale but still within
+// the `mutableCacheStaleTTL`, in which case it is revalidated in the
+// background. Otherwise, the req is served by the `serveGoproxy`, and its
+// successful response is cached. It reports false if the name is not of a
+// mutable Goproxy cache or the `mutableCache` is disabled.
+func serveMutableGoproxyCache(
+	req *air.Request,
+	res *air.Response,
+	name string,
+) bool {
+	if mutableCacheTTL <= 0 || !validGoproxyMutableCacheName(name) {
+		return false
+	}
+
+	objectName := goproxyCacheObjectName(req.Context, name)
+
+	mutableCacheMutex.Lock()
+	mce, ok := mutableCache[objectName]
+	stale := false
+	if ok {
+		age := time.Since(mce.fetchedAt)
+		stale = age > mutableCacheTTL || mce.stale
+		if age > mutableCacheTTL+mutableCacheStaleTTL {
+			ok = false
+		} else if stale &&
+			!mce.revalidating &&
+			!goproxyCacheOnly.Load() {
+			mce.revalidating = true
+			go revalidateMutableGoproxyCache(
+				withTenant(base.Context, tenantOf(req.Context)),
+				name,
+				objectName,
+			)
+		}
+	}
+	mutableCacheMutex.Unlock()
+
+	if ok {
+		if stale {
+			setCacheOutcome(req.Context, "stale")
+		} else {
+			setCacheOutcome(req.Context, "hit")
+		}
+
+		res.Header.Set("Content-Type", mce.contentType)
+		res.Header.Set("Cache-Control", "public, max-age=60")
+		res.Write(bytes.NewReader(mce.content))
+
+		return true
+	}
+
+	hrw := res.HTTPResponseWriter()
+	mcrw := &mutableCacheResponseWriter{ResponseWriter: hrw}
+	res.SetHTTPResponseWriter(mcrw)
+	serveGoproxy(req, res, name)
+	res.SetHTTPResponseWriter(hrw)
+
+	if req.Method == http.MethodGet &&
+		mcrw.status == http.StatusOK &&
+		!mcrw.overflowed {
+		storeMutableCache(
+			objectName,
+			mcrw.Header().Get("Content-Type"),
+			mcrw.content.Bytes(),
+		)
+	}
+
+	return true
+}
+
+// revalidateMutableGoproxyCache fetches the mutable Goproxy cache with the name
+// again with the `hhGoproxy` and updates its entry in the `mutableCache` with
+// the objectName. The stale entry is kept if that fails.
+func revalidateMutableGoproxyCache(
+	ctx context.Context,
+	name string,
+	objectName string,
+) {
+	mutableCacheRevalidations.Add(1)
+
+	ctx, cancel := withGoproxyFetchTimeout(ctx, goproxyCacheNameType(name))
+	defer cancel()
+
+	rw := &internalResponseWriter{}
+	if err := serveGoproxyInternally(ctx, rw, name); err != nil {
+		base.Logger.Warn().Err(err).
+			Str("name", name).
+			Msg("failed to revalidate mutable goproxy cache")
+
+		mutableCacheMutex.Lock()
+		if mce, ok := mutableCache[objectName]; ok {
+			mce.revalidating = false
+		}
+		mutableCacheMutex.Unlock()
+
+		return
+	}
+
+	storeMutableCache(
+		objectName,
+		rw.Header().Get("Content-Type"),
+		rw.body,
+	)
+}
+
+// storeMutableCache stores the content of the mutable Goproxy cache with the
+// objectName and the contentType in the `mutableCache`. When the
+// `mutableCache` is full, the expired entries are removed, or arbitrary ones if
+// none has expired.
+func storeMutableCache(objectName, contentType string, content []byte) {
+	now := time.Now()
+
+	mutableCacheMutex.Lock()
+	defer mutableCacheMutex.Unlock()
+
+	if len(mutableCache) >= mutableCacheMaxEntries {
+		for k, v := range mutableCache {
+			if now.Sub(v.fetchedAt) >
+				mutableCacheTTL+mutableCacheStaleTTL {
+				delete(mutableCache, k)
+			}
+		}
+
+		for k := range mutableCache {
+			if len(mutableCache) < mutableCacheMaxEntries {
+				break
+			}
+
+			delete(mutableCache, k)
+		}
+	}
+
+	mutableCache[objectName] = &mutableCacheEntry{
+		contentType: contentType,
+		content:     content,
+		fetchedAt:   now,
+	}
+}
+
+// markMutableCacheStale marks the entry of the mutable Goproxy cache with the
+// objectName in the `mutableCache` of the current instance stale, so that it is
+// revalidated in the background by the next request for it.
+func markMutableCacheStale(objectName string) {
+	mutableCacheMutex.Lock()
+	defer mutableCacheMutex.Unlock()
+
+	if mce, ok := mutableCache[objectName]; ok {
+		mce.stale = true
+	}
+}
+
+// invalidateMutableCache removes the entry of the mutable Goproxy cache with
+// the objectName from the `mutableCache` of the current instance.
+func invalidateMutableCache(objectName string) {
+	mutableCacheMutex.Lock()
+	defer mutableCacheMutex.Unlock()
+
+	delete(mutableCache, objectName)
+}
+
+// mutableCacheMaxContentSize is the maximum size of a response cached by the
+// `mutableCache`.
+const mutableCacheMaxContentSize = 1 << 20
+
+// mutableCacheResponseWriter is an `http.ResponseWriter` that keeps a copy of
+// the response written to it for the `mutableCache`.
+type mutableCacheResponseWriter struct {
+	http.ResponseWriter
+
+	status     int
+	content    bytes.Buffer
+	overflowed bool
+}
+
+// WriteHeader implements the `http.ResponseWriter`.
+func (mcrw *mutableCacheResponseWriter) WriteHeader(status int) {
+	if mcrw.status == 0 {
+		mcrw.status = status
+	}
+
+	mcrw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the `http.ResponseWriter`.
+func (mcrw *mutableCacheResponseWriter) Write(b []byte) (int, error) {
+	if mcrw.status == 0 {
+		mcrw.status = http.StatusOK
+	}
+
+	if !mcrw.overflowed {
+		if mcrw.content.Len()+len(b) > mutableCacheMaxContentSize {
+			mcrw.overflowed = true
+			mcrw.content = bytes.Buffer{}
+		} else {
+			mcrw.content.Write(b)
+		}
+	}
+
+	return mcrw.ResponseWriter.Write(b)
+}
@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// negativeCacheTTL is how long the "not found" responses of the
+	// upstream proxies are cached. The negative caching is disabled when it
+	// is not positive.
+	negativeCacheTTL = goproxyViper.GetDuration("negative_cache_ttl")
+
+	// negativeCacheMaxEntries is the maximum number of the cached "not
+	// found" responses.
+	negativeCacheMaxEntries = goproxyViper.GetInt("negative_cache_max_entries")
+
+	// negativeCacheEntries is the cached "not found" responses.
+	negativeCacheEntries = map[string]*negativeCacheEntry{}
+
+	// negativeCacheMutex is used to protect the `negativeCacheEntries`.
+	negativeCacheMutex sync.Mutex
+)
+
+// negativeCacheMaxBodyBytes is the maximum size of a cacheable "not found"
+// response body.
+const negativeCacheMaxBodyBytes = 4 << 10
+
+// negativeCacheEntry is a cached "not found" response.
+type negativeCacheEntry struct {
+	status     string
+	statusCode int
+	body       []byte
+	expiresAt  time.Time
+}
+
+func init() {
+	if negativeCacheTTL <= 0 {
+		return
+	}
+
+	if _, err := base.Cron.AddFunc(
+		"* * * * *", // Every minute
+		pruneNegativeCacheEntries,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add negative cache prune cron job")
+	}
+}
+
+// pruneNegativeCacheEntries removes the expired entries from the
+// `negativeCacheEntries`.
+func pruneNegativeCacheEntries() {
+	negativeCacheMutex.Lock()
+	defer negativeCacheMutex.Unlock()
+
+	now := time.Now()
+	for key, nce := range negativeCacheEntries {
+		if now.After(nce.expiresAt) {
+			delete(negativeCacheEntries, key)
+		}
+	}
+}
+
+// purgeNegativeCacheEntries removes the entries of the Goproxy cache with the
+// name from the `negativeCacheEntries`.
+func purgeNegativeCacheEntries(name string) {
+	negativeCacheMutex.Lock()
+	defer negativeCacheMutex.Unlock()
+
+	for key := range negativeCacheEntries {
+		if strings.HasSuffix(key, "/"+name) {
+			delete(negativeCacheEntries, key)
+		}
+	}
+}
+
+// negativeCachingTransport is an `http.RoundTripper` that caches the "404 Not
+// Found" and "410 Gone" responses of the GET requests for the
+// `negativeCacheTTL`.
+type negativeCachingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (nct *negativeCachingTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	if negativeCacheTTL <= 0 || req.Method != http.MethodGet {
+		return nct.next.RoundTrip(req)
+	}
+
+	key := req.URL.String()
+
+	negativeCacheMutex.Lock()
+	nce, ok := negativeCacheEntries[key]
+	if ok && time.Now().After(nce.expiresAt) {
+		delete(negativeCacheEntries, key)
+		ok = false
+	}
+	negativeCacheMutex.Unlock()
+
+	if ok {
+		return &http.Response{
+			Status:        nce.status,
+			StatusCode:    nce.statusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{},
+			Body:          io.NopCloser(bytes.NewReader(nce.body)),
+			ContentLength: int64(len(nce.body)),
+			Request:       req,
+		}, nil
+	}
+
+	res, err := nct.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+	default:
+		return res, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(
+		res.Body,
+		negativeCacheMaxBodyBytes+1,
+	))
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > negativeCacheMaxBodyBytes {
+		body = body[:negativeCacheMaxBodyBytes]
+	}
+
+	negativeCacheMutex.Lock()
+	if negativeCacheMaxEntries <= 0 ||
+		len(negativeCacheEntries) < negativeCacheMaxEntries {
+		negativeCacheEntries[key] = &negativeCacheEntry{
+			status:     res.Status,
+			statusCode: res.StatusCode,
+			body:       body,
+			expiresAt:  time.Now().Add(negativeCacheTTL),
+		}
+	}
+	negativeCacheMutex.Unlock()
+
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+
+	return res, nil
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+// outboundProxyRule is a rule that maps the upstreams to the outbound proxy
+// used to reach them.
+type outboundProxyRule struct {
+	// Hosts is the glob patterns (see the `path.Match`) of the hosts (with
+	// the ports, if any) of the upstreams.
+	Hosts []string `mapstructure:"hosts"`
+
+	// SUMDB indicates whether the requests to the proxied checksum
+	// databases are matched, whatever their hosts are.
+	SUMDB bool `mapstructure:"sumdb"`
+
+	// Proxy is the URL of the outbound proxy, whose scheme is one of
+	// "http", "https" (HTTP CONNECT), "socks5" and "socks5h". The
+	// credentials, if any, are taken from its user info. The matched
+	// requests are sent directly when it is "direct".
+	Proxy string `mapstructure:"proxy"`
+
+	proxyURL *url.URL
+}
+
+// outboundProxyRules is the outbound proxy rules of the upstream fetches. The
+// first matched rule wins, and the proxy of the environment is used when none
+// is matched. The direct fetches by the go command always use the proxy of the
+// environment.
+var outboundProxyRules []*outboundProxyRule
+
+func init() {
+	if err := goproxyViper.UnmarshalKey(
+		"outbound_proxies",
+		&outboundProxyRules,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to unmarshal goproxy outbound proxies")
+	}
+
+	for _, opr := range outboundProxyRules {
+		if len(opr.Hosts) == 0 && !opr.SUMDB {
+			base.Logger.Fatal().
+				Msg("missing goproxy outbound proxy hosts")
+		}
+
+		for _, host := range opr.Hosts {
+			if _, err := path.Match(host, ""); err != nil {
+				base.Logger.Fatal().Err(err).
+					Str("host", host).
+					Msg("invalid goproxy outbound proxy " +
+						"host")
+			}
+		}
+
+		if opr.Proxy == "direct" {
+			continue
+		}
+
+		u, err := url.Parse(opr.Proxy)
+		if err == nil && u.Host == "" {
+			err = errors.New("missing host")
+		}
+
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Str("proxy", u.Redacted()).
+				Msg("invalid goproxy outbound proxy")
+		}
+
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			base.Logger.Fatal().
+				Str("proxy", u.Redacted()).
+				Msg("unsupported goproxy outbound proxy scheme")
+		}
+
+		opr.proxyURL = u
+	}
+}
+
+// matches reports whether the opr matches the req.
+func (opr *outboundProxyRule) matches(req *http.Request) bool {
+	if opr.SUMDB && isSUMDBURL(req.URL) {
+		return true
+	}
+
+	for _, host := range opr.Hosts {
+		if ok, _ := path.Match(host, req.URL.Host); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// outboundProxy returns the URL of the outbound proxy for the req (see the
+// `outboundProxyRules`), or nil if it should be sent directly. It is meant to
+// be used as the `http.Transport.Proxy`.
+func outboundProxy(req *http.Request) (*url.URL, error) {
+	for _, opr := range outboundProxyRules {
+		if opr.matches(req) {
+			return opr.proxyURL, nil
+		}
+	}
+
+	return http.ProxyFromEnvironment(req)
+}
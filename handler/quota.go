@@ -0,0 +1,267 @@
+package handler
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+)
+
+var (
+	// authQuotaWindow is the default length of the quota windows of the
+	// API tokens.
+	authQuotaWindow = authViper.GetDuration("quota_window")
+
+	// authUsages is the usages of the API tokens served by the current
+	// instance in their current quota windows keyed by their names.
+	authUsages = map[string]*authUsage{}
+
+	// authUsagesDirty is the names of the API tokens whose `authUsages`
+	// changed since the last flush.
+	authUsagesDirty = map[string]bool{}
+
+	// authPeerUsages is the usages of the API tokens served by the other
+	// instances in their current quota windows keyed by their names, as of
+	// the last load.
+	authPeerUsages = map[string]*authUsage{}
+
+	// authUsagesMutex is used to protect the `authUsages`, the
+	// `authUsagesDirty` and the `authPeerUsages`.
+	authUsagesMutex sync.Mutex
+)
+
+// authUsagePrefix is the prefix of the objects where the usages of the API
+// tokens are stored in the Qiniu Cloud Kodo.
+const authUsagePrefix = "auth/usage/"
+
+// authUsage is the usage of an API token in a quota window.
+type authUsage struct {
+	WindowStart time.Time `json:"window_start"`
+	Requests    int64     `json:"requests"`
+	Bytes       int64     `json:"bytes"`
+}
+
+func init() {
+	if !authEnabled {
+		return
+	}
+
+	if authQuotaWindow <= 0 {
+		authQuotaWindow = 24 * time.Hour
+	}
+
+	if _, err := base.Cron.AddFunc(
+		"* * * * *", // Every minute
+		func() {
+			flushAuthUsages()
+			if err := loadAuthPeerUsages(base.Context); err != nil {
+				base.Logger.Error().Err(err).
+					Msg("failed to load auth peer usages")
+			}
+		},
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add auth usage flush cron job")
+	}
+
+	base.Air.AddShutdownJob(flushAuthUsages)
+
+	base.Air.GET(
+		"/admin/auth/usage",
+		hAdminAuthUsage,
+		adminGas,
+		globalAdminGas,
+	)
+}
+
+// authQuotaWindowOf returns the length of the quota windows of the at.
+func authQuotaWindowOf(at authToken) time.Duration {
+	if d, err := time.ParseDuration(at.QuotaWindow); err == nil && d > 0 {
+		return d
+	}
+
+	return authQuotaWindow
+}
+
+// authUsageObjectPrefix returns the prefix of the objects where the usages of
+// the at in the quota window starting at the windowStart are stored in the
+// Qiniu Cloud Kodo, one for each instance.
+func authUsageObjectPrefix(at authToken, windowStart time.Time) string {
+	return authUsagePrefix + path.Join(
+		url.PathEscape(at.Name),
+		strconv.FormatInt(windowStart.Unix(), 10),
+	) + "/"
+}
+
+// localAuthUsage returns the usage of the at served by the current instance in
+// the quota window at the now. It must be called with the `authUsagesMutex`
+// held.
+func localAuthUsage(at authToken, now time.Time) *authUsage {
+	windowStart := now.Truncate(authQuotaWindowOf(at)).UTC()
+
+	au := authUsages[at.Name]
+	if au == nil || !au.WindowStart.Equal(windowStart) {
+		au = &authUsage{WindowStart: windowStart}
+		authUsages[at.Name] = au
+	}
+
+	return au
+}
+
+// totalAuthUsage returns the usage of the at served by all the instances in
+// the quota window at the now. It must be called with the `authUsagesMutex`
+// held.
+func totalAuthUsage(at authToken, now time.Time) authUsage {
+	total := *localAuthUsage(at, now)
+	if pau := authPeerUsages[at.Name]; pau != nil &&
+		pau.WindowStart.Equal(total.WindowStart) {
+		total.Requests += pau.Requests
+		total.Bytes += pau.Bytes
+	}
+
+	return total
+}
+
+// takeAuthQuota counts a request of the at at the now. It returns how long to
+// wait for the next quota window if the quota of the at has been exhausted, in
+// which case the request is not counted. The quotas are enforced across the
+// instances with a delay of up to about a minute.
+func takeAuthQuota(at authToken, now time.Time) time.Duration {
+	authUsagesMutex.Lock()
+	defer authUsagesMutex.Unlock()
+
+	total := totalAuthUsage(at, now)
+	if (at.QuotaRequests > 0 && total.Requests >= at.QuotaRequests) ||
+		(at.QuotaBytes > 0 && total.Bytes >= at.QuotaBytes) {
+		return total.WindowStart.Add(authQuotaWindowOf(at)).Sub(now)
+	}
+
+	localAuthUsage(at, now).Requests++
+	authUsagesDirty[at.Name] = true
+
+	return 0
+}
+
+// addAuthUsageBytes adds the n bytes served to the at at the now.
+func addAuthUsageBytes(at authToken, now time.Time, n int64) {
+	authUsagesMutex.Lock()
+	defer authUsagesMutex.Unlock()
+
+	localAuthUsage(at, now).Bytes += n
+	authUsagesDirty[at.Name] = true
+}
+
+// flushAuthUsages flushes the changed `authUsages` to the Qiniu Cloud Kodo.
+func flushAuthUsages() {
+	authUsagesMutex.Lock()
+	usages := make(map[string]authUsage, len(authUsagesDirty))
+	for name := range authUsagesDirty {
+		usages[name] = *authUsages[name]
+	}
+
+	authUsagesDirty = map[string]bool{}
+	authUsagesMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for name, au := range usages {
+		if err := putStatObject(
+			ctx,
+			authUsageObjectPrefix(
+				authToken{Name: name},
+				au.WindowStart,
+			)+leaderID,
+			au,
+		); err != nil {
+			base.Logger.Error().Err(err).
+				Str("token_name", name).
+				Msg("failed to flush auth usage")
+		}
+	}
+}
+
+// loadAuthPeerUsages loads the `authPeerUsages` from the Qiniu Cloud Kodo.
+func loadAuthPeerUsages(ctx context.Context) error {
+	authTokensMutex.RLock()
+	ats := append([]authToken(nil), authTokens...)
+	authTokensMutex.RUnlock()
+
+	now := time.Now()
+	peerUsages := make(map[string]*authUsage, len(ats))
+	for _, at := range ats {
+		windowStart := now.Truncate(authQuotaWindowOf(at)).UTC()
+		pau := &authUsage{WindowStart: windowStart}
+		for objectInfo := range qiniuKodoClient.ListObjects(
+			ctx,
+			qiniuKodoBucketName,
+			minio.ListObjectsOptions{
+				Prefix: authUsageObjectPrefix(at, windowStart),
+			},
+		) {
+			if objectInfo.Err != nil {
+				return objectInfo.Err
+			}
+
+			if path.Base(objectInfo.Key) == leaderID {
+				continue
+			}
+
+			var au authUsage
+			if err := getStatObject(
+				ctx,
+				objectInfo.Key,
+				&au,
+			); err != nil && !isNotFoundMinIOError(err) {
+				return err
+			}
+
+			pau.Requests += au.Requests
+			pau.Bytes += au.Bytes
+		}
+
+		peerUsages[at.Name] = pau
+	}
+
+	authUsagesMutex.Lock()
+	authPeerUsages = peerUsages
+	authUsagesMutex.Unlock()
+
+	return nil
+}
+
+// hAdminAuthUsage handles requests to query the usages of the API tokens in
+// their current quota windows across all the instances.
+func hAdminAuthUsage(req *air.Request, res *air.Response) error {
+	authTokensMutex.RLock()
+	ats := append([]authToken(nil), authTokens...)
+	authTokensMutex.RUnlock()
+
+	now := time.Now()
+
+	authUsagesMutex.Lock()
+	defer authUsagesMutex.Unlock()
+
+	usages := make([]map[string]any, 0, len(ats))
+	for _, at := range ats {
+		total := totalAuthUsage(at, now)
+		windowEnd := total.WindowStart.Add(authQuotaWindowOf(at))
+		usages = append(usages, map[string]any{
+			"name":           at.Name,
+			"window_start":   total.WindowStart,
+			"window_end":     windowEnd,
+			"requests":       total.Requests,
+			"bytes":          total.Bytes,
+			"quota_requests": at.QuotaRequests,
+			"quota_bytes":    at.QuotaBytes,
+		})
+	}
+
+	return res.WriteJSON(usages)
+}
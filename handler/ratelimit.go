@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/spf13/viper"
+)
+
+var (
+	// rateLimitRate is the number of requests per second allowed for each
+	// client IP. The rate limiting is disabled when it is not positive.
+	rateLimitRate float64
+
+	// rateLimitBurst is the maximum number of requests allowed for each
+	// client IP in a burst.
+	rateLimitBurst int
+
+	// rateLimitExemptPrefixes is the client IP prefixes exempted from the
+	// rate limiting.
+	rateLimitExemptPrefixes []netip.Prefix
+
+	// rateLimitBuckets is the token buckets of the client IPs.
+	rateLimitBuckets = map[string]*rateLimitBucket{}
+
+	// rateLimitEnabled indicates whether the `rateLimitRate` is positive.
+	// It is checked before locking the `rateLimitMutex`, so that the
+	// requests are not serialized when the rate limiting is disabled.
+	rateLimitEnabled atomic.Bool
+
+	// rateLimitMutex is used to protect the `rateLimitRate`, the
+	// `rateLimitBurst`, the `rateLimitExemptPrefixes` and the
+	// `rateLimitBuckets`.
+	rateLimitMutex sync.Mutex
+)
+
+// rateLimitBucket is a token bucket of a client IP.
+type rateLimitBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// refill refills the rlb with the tokens accumulated until the now.
+func (rlb *rateLimitBucket) refill(now time.Time) {
+	rlb.tokens = math.Min(
+		rlb.tokens+now.Sub(rlb.updatedAt).Seconds()*rateLimitRate,
+		float64(rateLimitBurst),
+	)
+	rlb.updatedAt = now
+}
+
+func init() {
+	if err := loadRateLimitConfig(goproxyViper); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to load rate limit configuration")
+	}
+
+	if _, err := base.Cron.AddFunc(
+		"* * * * *", // Every minute
+		pruneRateLimitBuckets,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add rate limit bucket prune cron job")
+	}
+}
+
+// loadRateLimitConfig loads the `rateLimitRate`, the `rateLimitBurst` and the
+// `rateLimitExemptPrefixes` from the v.
+func loadRateLimitConfig(v *viper.Viper) error {
+	rate := v.GetFloat64("rate_limit_rate")
+	burst := v.GetInt("rate_limit_burst")
+	if burst < 1 {
+		burst = int(math.Max(math.Ceil(rate), 1))
+	}
+
+	var exemptPrefixes []netip.Prefix
+	for _, s := range v.GetStringSlice(
+		"rate_limit_exempt_cidrs",
+	) {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return err
+		}
+
+		exemptPrefixes = append(exemptPrefixes, prefix.Masked())
+	}
+
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	rateLimitRate = rate
+	rateLimitBurst = burst
+	rateLimitExemptPrefixes = exemptPrefixes
+	rateLimitEnabled.Store(rate > 0)
+
+	return nil
+}
+
+// rateLimitGas is used to limit the request rate of each client IP.
+func rateLimitGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if wait := takeRateLimitToken(
+			req.ClientHost(),
+			time.Now(),
+		); wait > 0 {
+			res.Status = http.StatusTooManyRequests
+			res.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(
+				wait.Seconds(),
+			))))
+			return errors.New(strings.ToLower(
+				http.StatusText(res.Status),
+			))
+		}
+
+		return next(req, res)
+	}
+}
+
+// takeRateLimitToken takes a token from the bucket of the clientHost at the
+// now. It returns how long to wait for the next token if the bucket is empty.
+// It always returns zero if the rate limiting is disabled or the clientHost is
+// exempted.
+func takeRateLimitToken(clientHost string, now time.Time) time.Duration {
+	if !rateLimitEnabled.Load() {
+		return 0
+	}
+
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	if rateLimitRate <= 0 {
+		return 0
+	}
+
+	if isRateLimitExempted(clientHost) {
+		return 0
+	}
+
+	rlb, ok := rateLimitBuckets[clientHost]
+	if !ok {
+		rlb = &rateLimitBucket{
+			tokens:    float64(rateLimitBurst),
+			updatedAt: now,
+		}
+		rateLimitBuckets[clientHost] = rlb
+	}
+
+	rlb.refill(now)
+	if rlb.tokens < 1 {
+		return time.Duration((1 - rlb.tokens) / rateLimitRate *
+			float64(time.Second))
+	}
+
+	rlb.tokens--
+
+	return 0
+}
+
+// isRateLimitExempted reports whether the clientHost is exempted from the rate
+// limiting. It must be called with the `rateLimitMutex` held.
+func isRateLimitExempted(clientHost string) bool {
+	addr, err := netip.ParseAddr(clientHost)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+	for _, prefix := range rateLimitExemptPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pruneRateLimitBuckets removes the full buckets from the `rateLimitBuckets`,
+// since they are no different from the new ones.
+func pruneRateLimitBuckets() {
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	if rateLimitRate <= 0 {
+		rateLimitBuckets = map[string]*rateLimitBucket{}
+		return
+	}
+
+	now := time.Now()
+	for clientHost, rlb := range rateLimitBuckets {
+		rlb.refill(now)
+		if rlb.tokens >= float64(rateLimitBurst) {
+			delete(rateLimitBuckets, clientHost)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+)
+
+var (
+	// readFallbackTimeout is the maximum duration allowed for a bucket to
+	// start responding to a read before the next one is tried. It only
+	// applies when there are `replicas`.
+	readFallbackTimeout = goproxyViper.GetDuration("read_fallback_timeout")
+
+	// readFallbackCooldown is how long a bucket that failed a read is
+	// tried after the healthy ones.
+	readFallbackCooldown = goproxyViper.GetDuration("read_fallback_cooldown")
+
+	// readFallbackPrimary is the Qiniu Cloud Kodo bucket as a read source.
+	readFallbackPrimary = &replica{
+		Name:       "primary",
+		BucketName: qiniuKodoBucketName,
+		client:     qiniuKodoClient,
+	}
+
+	// readFallbacks is the number of the reads served by the `replicas`.
+	readFallbacks atomic.Int64
+)
+
+func init() {
+	expvar.Publish("read_fallback", expvar.Func(func() any {
+		unhealthy := []string{}
+		for _, r := range readFallbackSources() {
+			if r.unhealthy() {
+				unhealthy = append(unhealthy, r.Name)
+			}
+		}
+
+		return map[string]any{
+			"fallbacks": readFallbacks.Load(),
+			"unhealthy": unhealthy,
+		}
+	}))
+}
+
+// readFallbackSources returns the buckets to read the Goproxy caches from in
+// order of preference. The healthy ones come first, with the primary first
+// among them.
+func readFallbackSources() []*replica {
+	sources := make([]*replica, 0, len(replicas)+1)
+	var unhealthy []*replica
+	for _, r := range append([]*replica{readFallbackPrimary}, replicas...) {
+		if r.unhealthy() {
+			unhealthy = append(unhealthy, r)
+		} else {
+			sources = append(sources, r)
+		}
+	}
+
+	return append(sources, unhealthy...)
+}
+
+// unhealthy reports whether the r failed a read within the
+// `readFallbackCooldown`.
+func (r *replica) unhealthy() bool {
+	return time.Now().UnixNano() < r.unhealthyUntil.Load()
+}
+
+// getGoproxyCacheObject returns the object of the Goproxy cache with the name.
+// When there are `replicas`, it falls back to them if the Qiniu Cloud Kodo
+// fails with a server error or a timeout. A bucket that fails is tried last
+// until the `readFallbackCooldown` passes. Only the Qiniu Cloud Kodo is
+// authoritative for missing objects.
+//
+// The object is decrypted if it has been encrypted on the client side (see the
+// `encryptGoproxyCache`).
+func getGoproxyCacheObject(
+	ctx context.Context,
+	name string,
+) (io.ReadSeekCloser, minio.ObjectInfo, error) {
+	if len(replicas) == 0 {
+		object, objectInfo, err := getObject(
+			ctx,
+			readFallbackPrimary,
+			name,
+		)
+		if err != nil {
+			return nil, minio.ObjectInfo{}, err
+		}
+
+		return decryptGoproxyCacheObject(object, objectInfo)
+	}
+
+	var lastErr error
+	for _, r := range readFallbackSources() {
+		object, objectInfo, err := getObjectWithTimeout(ctx, r, name)
+		if err == nil {
+			r.unhealthyUntil.Store(0)
+			if r != readFallbackPrimary {
+				readFallbacks.Add(1)
+			}
+
+			return decryptGoproxyCacheObject(object, objectInfo)
+		}
+
+		if isNotFoundMinIOError(err) {
+			if r == readFallbackPrimary {
+				return nil, minio.ObjectInfo{}, err
+			}
+		} else if ctx.Err() != nil || !isReadFallbackError(err) {
+			return nil, minio.ObjectInfo{}, err
+		} else if !r.unhealthy() {
+			r.unhealthyUntil.Store(
+				time.Now().Add(readFallbackCooldown).UnixNano(),
+			)
+			base.Logger.Warn().Err(err).
+				Str("bucket", r.Name).
+				Msg("bucket read failed, falling back")
+		}
+
+		if lastErr == nil || !isNotFoundMinIOError(err) {
+			lastErr = err
+		}
+	}
+
+	return nil, minio.ObjectInfo{}, lastErr
+}
+
+// isReadFallbackError reports whether the err is worth falling back to another
+// bucket for, which is either a server error or not an HTTP error at all, such
+// as a timeout.
+func isReadFallbackError(err error) bool {
+	statusCode := minio.ToErrorResponse(err).StatusCode
+	return statusCode == 0 || statusCode >= 500
+}
+
+// getObjectWithTimeout is like the `getObject`, but gives up when the r does
+// not start responding within the `readFallbackTimeout`.
+func getObjectWithTimeout(
+	ctx context.Context,
+	r *replica,
+	name string,
+) (io.ReadSeekCloser, minio.ObjectInfo, error) {
+	if readFallbackTimeout <= 0 {
+		return getObject(ctx, r, name)
+	}
+
+	// The returned object keeps reading with the ctx, so it must only be
+	// canceled on a timeout or when the object is closed.
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(readFallbackTimeout, cancel)
+	object, objectInfo, err := getObject(ctx, r, name)
+	if !timer.Stop() && err != nil {
+		err = errors.Join(context.DeadlineExceeded, err)
+	}
+
+	if err != nil {
+		cancel()
+		return nil, minio.ObjectInfo{}, err
+	}
+
+	return &cancelOnCloseObject{
+		ReadSeekCloser: object,
+		cancel:         cancel,
+	}, objectInfo, nil
+}
+
+// getObject returns the object with the name in the r.
+func getObject(
+	ctx context.Context,
+	r *replica,
+	name string,
+) (io.ReadSeekCloser, minio.ObjectInfo, error) {
+	var (
+		object     *minio.Object
+		objectInfo minio.ObjectInfo
+	)
+
+	opts := minio.GetObjectOptions{}
+	if r == readFallbackPrimary {
+		opts = qiniuKodoGetObjectOptions()
+	}
+
+	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) (err error) {
+		object, err = r.client.GetObject(
+			ctx,
+			r.BucketName,
+			name,
+			opts,
+		)
+		if err != nil {
+			return err
+		}
+
+		objectInfo, err = object.Stat()
+		if err != nil {
+			object.Close()
+		}
+
+		return err
+	}); err != nil {
+		return nil, minio.ObjectInfo{}, err
+	}
+
+	return object, objectInfo, nil
+}
+
+// cancelOnCloseObject is an object that cancels its context when it is closed.
+type cancelOnCloseObject struct {
+	io.ReadSeekCloser
+
+	cancel context.CancelFunc
+}
+
+// Close implements the `io.Closer`.
+func (coco *cancelOnCloseObject) Close() error {
+	defer coco.cancel()
+	return coco.ReadSeekCloser.Close()
+}
@@ -0,0 +1,362 @@
+package handler
+
+import (
+	"context"
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+// RedirectSigner signs the URLs that the Goproxy caches are automatically
+// redirected to.
+type RedirectSigner interface {
+	// SignRedirectURL returns a URL that grants the method access to the
+	// Goproxy cache with the name for the expiry.
+	SignRedirectURL(
+		ctx context.Context,
+		method string,
+		name string,
+		expiry time.Duration,
+	) (*url.URL, error)
+}
+
+// goproxyRedirectSigner is the `RedirectSigner` of the Goproxy.
+var goproxyRedirectSigner = newRedirectSigner(redirectSignerConfig{
+	Signer:      goproxyViper.GetString("redirect_signer"),
+	BaseURL:     goproxyViper.GetString("redirect_base_url"),
+	QiniuCDNKey: goproxyViper.GetString("redirect_qiniu_cdn_key"),
+	CloudFrontKeyPairID: goproxyViper.GetString(
+		"redirect_cloudfront_key_pair_id",
+	),
+	CloudFrontPrivateKeyFile: goproxyViper.GetString(
+		"redirect_cloudfront_private_key_file",
+	),
+})
+
+var (
+	// redirectURLExpiries is the expiries of the signed URLs that the
+	// Goproxy caches are automatically redirected to keyed by the file
+	// extensions. The "redirect_url_expiry" is used for the missing ones.
+	redirectURLExpiries = newRedirectURLExpiries()
+
+	// redirectCacheControls is the Cache-Control headers of the responses
+	// of the presigned URLs keyed by the file extensions. The
+	// "redirect_cache_control" is used for the missing ones.
+	redirectCacheControls = newRedirectCacheControls()
+
+	// redirectImmutableZips indicates whether the responses of the
+	// presigned URLs of the zip files, which never change once a module
+	// version is published, are marked as immutable.
+	redirectImmutableZips = goproxyViper.GetBool("redirect_immutable_zips")
+)
+
+// newRedirectURLExpiries returns a new `redirectURLExpiries`.
+func newRedirectURLExpiries() map[string]time.Duration {
+	expiries := map[string]time.Duration{}
+	for _, ext := range []string{"info", "mod", "zip"} {
+		key := fmt.Sprint("redirect_url_expiries.", ext)
+		if goproxyViper.IsSet(key) {
+			expiries["."+ext] = goproxyViper.GetDuration(key)
+		}
+	}
+
+	return expiries
+}
+
+// newRedirectCacheControls returns a new `redirectCacheControls`.
+func newRedirectCacheControls() map[string]string {
+	cacheControls := map[string]string{}
+	for _, ext := range []string{"info", "mod", "zip"} {
+		key := fmt.Sprint("redirect_cache_controls.", ext)
+		if goproxyViper.IsSet(key) {
+			cacheControls["."+ext] = goproxyViper.GetString(key)
+		}
+	}
+
+	return cacheControls
+}
+
+// redirectURLExpiryOf returns the expiry of the signed URL that the Goproxy
+// cache with the name is automatically redirected to.
+func redirectURLExpiryOf(name string) time.Duration {
+	if expiry, ok := redirectURLExpiries[path.Ext(name)]; ok {
+		return expiry
+	}
+
+	if expiry := goproxyViper.GetDuration(
+		"redirect_url_expiry",
+	); expiry > 0 {
+		return expiry
+	}
+
+	return 7 * 24 * time.Hour
+}
+
+// redirectCacheControl returns the Cache-Control header of the response of
+// the presigned URL of the Goproxy cache with the name that expires after the
+// expiry. It defaults to being public and fresh until the expiry.
+func redirectCacheControl(name string, expiry time.Duration) string {
+	ext := path.Ext(name)
+	if cacheControl, ok := redirectCacheControls[ext]; ok {
+		return cacheControl
+	}
+
+	cacheControl := goproxyViper.GetString("redirect_cache_control")
+	if cacheControl == "" {
+		cacheControl = fmt.Sprintf(
+			"public, max-age=%d",
+			int(expiry.Seconds()),
+		)
+	}
+
+	if ext == ".zip" && redirectImmutableZips {
+		cacheControl += ", immutable"
+	}
+
+	return cacheControl
+}
+
+// redirectSignerConfig is the configuration of a `RedirectSigner`.
+type redirectSignerConfig struct {
+	// Signer is one of "presign", "qiniu_cdn" and "cloudfront".
+	Signer string `mapstructure:"signer"`
+
+	// BaseURL is the base URL of the signed URLs. It is required by the
+	// "qiniu_cdn" and the "cloudfront".
+	BaseURL string `mapstructure:"base_url"`
+
+	// QiniuCDNKey is the timestamp anti-leech key of the "qiniu_cdn".
+	QiniuCDNKey string `mapstructure:"qiniu_cdn_key"`
+
+	// CloudFrontKeyPairID is the key pair ID of the "cloudfront".
+	CloudFrontKeyPairID string `mapstructure:"cloudfront_key_pair_id"`
+
+	// CloudFrontPrivateKeyFile is the PEM encoded RSA private key file of
+	// the "cloudfront".
+	CloudFrontPrivateKeyFile string `mapstructure:"cloudfront_private_key_file"`
+}
+
+// newRedirectSigner returns a new `RedirectSigner` based on the rsc.
+func newRedirectSigner(rsc redirectSignerConfig) RedirectSigner {
+	switch rsc.Signer {
+	case "", "presign":
+		return presignRedirectSigner{}
+	case "qiniu_cdn":
+		baseURL := mustParseRedirectBaseURL(rsc.BaseURL)
+		if rsc.QiniuCDNKey == "" {
+			base.Logger.Fatal().
+				Msg("missing qiniu cdn anti-leech key")
+		}
+
+		return &qiniuCDNRedirectSigner{
+			baseURL: baseURL,
+			key:     rsc.QiniuCDNKey,
+		}
+	case "cloudfront":
+		baseURL := mustParseRedirectBaseURL(rsc.BaseURL)
+		if rsc.CloudFrontKeyPairID == "" {
+			base.Logger.Fatal().
+				Msg("missing cloudfront key pair id")
+		}
+
+		privateKey, err := loadRSAPrivateKey(
+			rsc.CloudFrontPrivateKeyFile,
+		)
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to load cloudfront private key")
+		}
+
+		return &cloudFrontRedirectSigner{
+			baseURL:    baseURL,
+			keyPairID:  rsc.CloudFrontKeyPairID,
+			privateKey: privateKey,
+		}
+	default:
+		base.Logger.Fatal().
+			Str("signer", rsc.Signer).
+			Msg("unsupported redirect signer")
+	}
+
+	return nil
+}
+
+// mustParseRedirectBaseURL parses the rawBaseURL.
+func mustParseRedirectBaseURL(rawBaseURL string) *url.URL {
+	baseURL, err := url.Parse(rawBaseURL)
+	if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") {
+		base.Logger.Fatal().
+			Str("base_url", rawBaseURL).
+			Msg("invalid redirect base url")
+	}
+
+	return baseURL
+}
+
+// loadRSAPrivateKey loads the PEM encoded RSA private key from the filename.
+func loadRSAPrivateKey(filename string) (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no pem data found")
+	}
+
+	if privateKey, err := x509.ParsePKCS1PrivateKey(
+		block.Bytes,
+	); err == nil {
+		return privateKey, nil
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaPrivateKey, ok := privateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an rsa private key")
+	}
+
+	return rsaPrivateKey, nil
+}
+
+// redirectURL returns the URL of the Goproxy cache with the name under the
+// baseURL.
+func redirectURL(baseURL *url.URL, name string) *url.URL {
+	return baseURL.JoinPath(name)
+}
+
+// presignRedirectSigner is a `RedirectSigner` that presigns the URLs of the
+// objects in the Qiniu Cloud Kodo bucket.
+type presignRedirectSigner struct{}
+
+// SignRedirectURL implements the `RedirectSigner`.
+func (presignRedirectSigner) SignRedirectURL(
+	ctx context.Context,
+	method string,
+	name string,
+	expiry time.Duration,
+) (*url.URL, error) {
+	return qiniuKodoClient.Presign(
+		ctx,
+		method,
+		qiniuKodoBucketName,
+		name,
+		expiry,
+		url.Values{
+			"response-cache-control": []string{
+				redirectCacheControl(name, expiry),
+			},
+		},
+	)
+}
+
+// qiniuCDNRedirectSigner is a `RedirectSigner` that signs the URLs with the
+// timestamp anti-leech of the Qiniu Cloud CDN.
+type qiniuCDNRedirectSigner struct {
+	baseURL *url.URL
+	key     string
+}
+
+// SignRedirectURL implements the `RedirectSigner`.
+func (qcrs *qiniuCDNRedirectSigner) SignRedirectURL(
+	ctx context.Context,
+	method string,
+	name string,
+	expiry time.Duration,
+) (*url.URL, error) {
+	u := redirectURL(qcrs.baseURL, name)
+	t := strconv.FormatInt(time.Now().Add(expiry).Unix(), 16)
+	sign := md5.Sum([]byte(fmt.Sprint(qcrs.key, u.EscapedPath(), t)))
+	u.RawQuery = url.Values{
+		"sign": []string{hex.EncodeToString(sign[:])},
+		"t":    []string{t},
+	}.Encode()
+
+	return u, nil
+}
+
+// cloudFrontRedirectSigner is a `RedirectSigner` that signs the URLs with the
+// canned policy of the Amazon CloudFront.
+type cloudFrontRedirectSigner struct {
+	baseURL    *url.URL
+	keyPairID  string
+	privateKey *rsa.PrivateKey
+}
+
+// SignRedirectURL implements the `RedirectSigner`.
+func (cfrs *cloudFrontRedirectSigner) SignRedirectURL(
+	ctx context.Context,
+	method string,
+	name string,
+	expiry time.Duration,
+) (*url.URL, error) {
+	u := redirectURL(cfrs.baseURL, name)
+	expires := time.Now().Add(expiry).Unix()
+
+	type condition struct {
+		DateLessThan struct {
+			EpochTime int64 `json:"AWS:EpochTime"`
+		}
+	}
+
+	type statement struct {
+		Resource  string
+		Condition condition
+	}
+
+	var s statement
+	s.Resource = u.String()
+	s.Condition.DateLessThan.EpochTime = expires
+
+	policy, err := json.Marshal(struct {
+		Statement []statement
+	}{[]statement{s}})
+	if err != nil {
+		return nil, err
+	}
+
+	policyChecksum := sha1.Sum(policy)
+	signature, err := rsa.SignPKCS1v15(
+		rand.Reader,
+		cfrs.privateKey,
+		crypto.SHA1,
+		policyChecksum[:],
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	u.RawQuery = url.Values{
+		"Expires": []string{strconv.FormatInt(expires, 10)},
+		"Signature": []string{strings.NewReplacer(
+			"+", "-",
+			"=", "_",
+			"/", "~",
+		).Replace(base64.StdEncoding.EncodeToString(signature))},
+		"Key-Pair-Id": []string{cfrs.keyPairID},
+	}.Encode()
+
+	return u, nil
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	// redirectCacheTTL is how long the signed URLs of the automatically
+	// redirected Goproxy caches are cached. It is capped to half of their
+	// expiries (see the `redirectURLExpiryOf`), so that a cached signed URL
+	// is always valid for a while after it is handed out. Nothing is cached
+	// when it is not positive.
+	redirectCacheTTL = goproxyViper.GetDuration("redirect_cache_ttl")
+
+	// redirectCacheMaxEntries is the maximum number of the entries of the
+	// `redirectCache`.
+	redirectCacheMaxEntries = goproxyViper.GetInt(
+		"redirect_cache_max_entries",
+	)
+
+	// redirectCache is the cached signed URLs of the automatically
+	// redirected Goproxy caches.
+	redirectCache = map[redirectCacheKey]*redirectCacheEntry{}
+
+	// redirectCacheMutex is used to protect the `redirectCache`.
+	redirectCacheMutex sync.Mutex
+
+	// redirectCacheHits is the number of the URL signings saved by the
+	// `redirectCache`.
+	redirectCacheHits = expvar.NewInt("redirect_cache_hits")
+)
+
+// redirectCacheKey is the key of the `redirectCache`.
+type redirectCacheKey struct {
+	signer     RedirectSigner
+	method     string
+	objectName string
+}
+
+// redirectCacheEntry is an entry of the `redirectCache`.
+type redirectCacheEntry struct {
+	url       *url.URL
+	expiresAt time.Time
+}
+
+// loadRedirectCache returns the unexpired entry of the `redirectCache` with
+// the key.
+func loadRedirectCache(key redirectCacheKey) (*redirectCacheEntry, bool) {
+	redirectCacheMutex.Lock()
+	defer redirectCacheMutex.Unlock()
+
+	rce, ok := redirectCache[key]
+	if !ok || !time.Now().Before(rce.expiresAt) {
+		return nil, false
+	}
+
+	redirectCacheHits.Add(1)
+
+	return rce, true
+}
+
+// storeRedirectCache stores the rce in the `redirectCache` with the key for the
+// ttl. When the `redirectCache` is full, the expired entries are removed, or
+// arbitrary ones if none has expired.
+func storeRedirectCache(
+	key redirectCacheKey,
+	rce *redirectCacheEntry,
+	ttl time.Duration,
+) {
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	rce.expiresAt = now.Add(ttl)
+
+	redirectCacheMutex.Lock()
+	defer redirectCacheMutex.Unlock()
+
+	if len(redirectCache) >= redirectCacheMaxEntries {
+		for k, v := range redirectCache {
+			if !now.Before(v.expiresAt) {
+				delete(redirectCache, k)
+			}
+		}
+
+		for k := range redirectCache {
+			if len(redirectCache) < redirectCacheMaxEntries {
+				break
+			}
+
+			delete(redirectCache, k)
+		}
+	}
+
+	redirectCache[key] = rce
+}
+
+// signRedirectURL returns the URL signed by the signer that grants the method
+// access to the Goproxy cache with the objectName, from the `redirectCache` if
+// it is there.
+func signRedirectURL(
+	ctx context.Context,
+	signer RedirectSigner,
+	method string,
+	objectName string,
+) (*url.URL, error) {
+	key := redirectCacheKey{
+		signer:     signer,
+		method:     method,
+		objectName: objectName,
+	}
+	if rce, ok := loadRedirectCache(key); ok {
+		return rce.url, nil
+	}
+
+	expiry := redirectURLExpiryOf(objectName)
+	u, err := signer.SignRedirectURL(ctx, method, objectName, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	storeRedirectCache(
+		key,
+		&redirectCacheEntry{url: u},
+		min(redirectCacheTTL, expiry/2),
+	)
+
+	return u, nil
+}
+
+// invalidateRedirectCache removes the entries of the Goproxy cache with the
+// objectName from the `redirectCache` of the current instance.
+func invalidateRedirectCache(objectName string) {
+	redirectCacheMutex.Lock()
+	defer redirectCacheMutex.Unlock()
+
+	for key := range redirectCache {
+		if key.objectName == objectName {
+			delete(redirectCache, key)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// redirectOrigins is the origins that the Goproxy caches are
+	// automatically redirected to. When it is empty, the
+	// `goproxyRedirectSigner` is always used.
+	redirectOrigins []*redirectOrigin
+
+	// redirectRegionHeader is the name of the request header that carries
+	// the region of the client, such as a country code or an ISP name set
+	// by the CDN or the load balancer in front. It is used to prefer the
+	// redirect origins that serve the region.
+	redirectRegionHeader = goproxyViper.GetString("redirect_region_header")
+
+	// redirectOriginHealthCheckClient is the HTTP client used to check the
+	// health of the redirect origins.
+	redirectOriginHealthCheckClient = &http.Client{
+		Timeout: 10 * time.Second,
+	}
+)
+
+// redirectOrigin is an origin that the Goproxy caches are automatically
+// redirected to.
+type redirectOrigin struct {
+	redirectSignerConfig `mapstructure:",squash"`
+
+	// Name is the name of the origin.
+	Name string `mapstructure:"name"`
+
+	// Weight is the relative share of the traffic of the origin.
+	Weight int `mapstructure:"weight"`
+
+	// Regions is the client regions served by the origin. An origin
+	// without regions serves the clients whose regions are served by no
+	// other origins.
+	Regions []string `mapstructure:"regions"`
+
+	// HealthCheckURL is the URL used to check the health of the origin.
+	// The origin is always considered healthy when it is empty.
+	HealthCheckURL string `mapstructure:"health_check_url"`
+
+	signer    RedirectSigner
+	unhealthy atomic.Bool
+}
+
+func init() {
+	if err := goproxyViper.UnmarshalKey(
+		"redirect_origins",
+		&redirectOrigins,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to unmarshal redirect origins")
+	}
+
+	if len(redirectOrigins) == 0 {
+		return
+	}
+
+	for _, ro := range redirectOrigins {
+		if ro.Weight <= 0 {
+			ro.Weight = 1
+		}
+
+		for i, region := range ro.Regions {
+			ro.Regions[i] = strings.ToUpper(region)
+		}
+
+		ro.signer = newRedirectSigner(ro.redirectSignerConfig)
+	}
+
+	checkRedirectOriginHealths(base.Context)
+	if _, err := base.Cron.AddFunc("@every 30s", func() {
+		checkRedirectOriginHealths(base.Context)
+	}); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add redirect origin health check cron job")
+	}
+}
+
+// checkRedirectOriginHealths checks the health of the `redirectOrigins`.
+func checkRedirectOriginHealths(ctx context.Context) {
+	for _, ro := range redirectOrigins {
+		if ro.HealthCheckURL == "" {
+			continue
+		}
+
+		healthy := checkRedirectOriginHealth(ctx, ro.HealthCheckURL)
+		if ro.unhealthy.Swap(!healthy) == healthy {
+			base.Logger.Warn().
+				Str("name", ro.Name).
+				Bool("healthy", healthy).
+				Msg("redirect origin health changed")
+		}
+	}
+}
+
+// checkRedirectOriginHealth reports whether the healthCheckURL responds
+// successfully.
+func checkRedirectOriginHealth(ctx context.Context, healthCheckURL string) bool {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodHead,
+		healthCheckURL,
+		nil,
+	)
+	if err != nil {
+		return false
+	}
+
+	res, err := redirectOriginHealthCheckClient.Do(req)
+	if err != nil {
+		return false
+	}
+
+	res.Body.Close()
+
+	return res.StatusCode < http.StatusBadRequest
+}
+
+// redirectSigner returns the `RedirectSigner` for the req. It picks one of the
+// healthy `redirectOrigins` by weight, preferring those serving the region of
+// the req, and falls back to the `goproxyRedirectSigner` when there are none.
+func redirectSigner(req *air.Request) RedirectSigner {
+	if len(redirectOrigins) == 0 {
+		return goproxyRedirectSigner
+	}
+
+	var region string
+	if redirectRegionHeader != "" {
+		region = strings.ToUpper(req.Header.Get(redirectRegionHeader))
+	}
+
+	var regional, general []*redirectOrigin
+	for _, ro := range redirectOrigins {
+		if ro.unhealthy.Load() {
+			continue
+		}
+
+		if len(ro.Regions) == 0 {
+			general = append(general, ro)
+		} else if region != "" && stringSliceContains(ro.Regions, region) {
+			regional = append(regional, ro)
+		}
+	}
+
+	candidates := regional
+	if len(candidates) == 0 {
+		candidates = general
+	}
+
+	if len(candidates) == 0 {
+		return goproxyRedirectSigner
+	}
+
+	totalWeight := 0
+	for _, ro := range candidates {
+		totalWeight += ro.Weight
+	}
+
+	n := rand.Intn(totalWeight)
+	for _, ro := range candidates {
+		if n < ro.Weight {
+			return ro.signer
+		}
+
+		n -= ro.Weight
+	}
+
+	return candidates[len(candidates)-1].signer
+}
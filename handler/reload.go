@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+func init() {
+	base.OnConfigReload(reloadGoproxyConfig)
+}
+
+// reloadGoproxyConfig reloads the configuration items of the Goproxy that can
+// be changed without restarting, which are the fetch timeout, the automatic
+// redirection, the blocked modules, the allowed modules and the rate limiting.
+// The others still require a restart.
+func reloadGoproxyConfig() {
+	v := base.Config().Sub("goproxy")
+	if v == nil {
+		base.Logger.Error().
+			Msg("failed to reload goproxy configuration: " +
+				"missing goproxy section")
+		return
+	}
+
+	loadGoproxyOptions(v)
+
+	if err := loadBlocklistConfig(v); err != nil {
+		base.Logger.Error().Err(err).
+			Msg("failed to reload blocklist configuration")
+	}
+
+	if err := loadAllowlistConfig(v); err != nil {
+		base.Logger.Error().Err(err).
+			Msg("failed to reload allowlist configuration")
+	}
+
+	if err := loadRateLimitConfig(v); err != nil {
+		base.Logger.Error().Err(err).
+			Msg("failed to reload rate limit configuration")
+	}
+}
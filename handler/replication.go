@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"sync/atomic"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// replica is a secondary bucket that the Goproxy caches are mirrored to, so
+// that a regional outage of the Qiniu Cloud Kodo does not invalidate the whole
+// cache.
+type replica struct {
+	// Name is the name of the replica.
+	Name string `mapstructure:"name"`
+
+	// Endpoint is the endpoint of the S3-compatible object storage.
+	Endpoint string `mapstructure:"endpoint"`
+
+	// AccessKey is the access key of the object storage.
+	AccessKey string `mapstructure:"access_key"`
+
+	// SecretKey is the secret key of the object storage.
+	SecretKey string `mapstructure:"secret_key"`
+
+	// BucketName is the name of the bucket.
+	BucketName string `mapstructure:"bucket_name"`
+
+	// ForcePathStyle indicates whether the path-style bucket lookup is
+	// used.
+	ForcePathStyle bool `mapstructure:"force_path_style"`
+
+	client         *minio.Client
+	unhealthyUntil atomic.Int64
+}
+
+var (
+	// replicas is the secondary buckets that the Goproxy caches are
+	// replicated to.
+	replicas []*replica
+
+	// replicationQueue is the queue of the names of the Goproxy caches
+	// waiting to be replicated. It is nil when there are no `replicas`.
+	replicationQueue chan string
+
+	// replicationQueued is the number of the Goproxy caches queued for
+	// replication.
+	replicationQueued atomic.Int64
+
+	// replicationPending is the number of the Goproxy caches in the
+	// `replicationQueue` or being replicated.
+	replicationPending atomic.Int64
+
+	// replicationDropped is the number of the Goproxy caches dropped
+	// because the `replicationQueue` was full.
+	replicationDropped atomic.Int64
+
+	// replicationSucceeded is the number of the successful replications to
+	// a replica.
+	replicationSucceeded atomic.Int64
+
+	// replicationFailed is the number of the failed replications to a
+	// replica.
+	replicationFailed atomic.Int64
+)
+
+// replicationTimeout is the maximum duration allowed to replicate a Goproxy
+// cache to a replica.
+const replicationTimeout = 10 * time.Minute
+
+func init() {
+	if err := goproxyViper.UnmarshalKey("replicas", &replicas); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to unmarshal goproxy replicas")
+	}
+
+	if len(replicas) == 0 {
+		return
+	}
+
+	for _, r := range replicas {
+		if r.Name == "" || r.BucketName == "" {
+			base.Logger.Fatal().
+				Str("name", r.Name).
+				Msg("missing goproxy replica name or bucket name")
+		}
+
+		client, err := newMinIOClient(
+			r.Endpoint,
+			credentials.NewStaticV4(r.AccessKey, r.SecretKey, ""),
+			r.ForcePathStyle,
+		)
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Str("name", r.Name).
+				Msg("failed to create goproxy replica client")
+		}
+
+		r.client = client
+	}
+
+	replicationQueue = make(
+		chan string,
+		goproxyViper.GetInt("replication_queue_size"),
+	)
+
+	workers := goproxyViper.GetInt("replication_workers")
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		go replicateGoproxyCaches()
+	}
+
+	expvar.Publish("replication", expvar.Func(func() any {
+		return map[string]int64{
+			"queue_length": int64(len(replicationQueue)),
+			"queued":       replicationQueued.Load(),
+			"dropped":      replicationDropped.Load(),
+			"succeeded":    replicationSucceeded.Load(),
+			"failed":       replicationFailed.Load(),
+		}
+	}))
+}
+
+// replicateGoproxyCache queues the Goproxy cache with the name for replication
+// to the `replicas`. The queue is kept in memory and flushed on shutdown (see
+// the `DrainGoproxyCachePuts`), so only the Goproxy caches still queued after
+// the drain times out are lost, and those arriving while it is full are
+// dropped.
+func replicateGoproxyCache(name string) {
+	if replicationQueue == nil {
+		return
+	}
+
+	replicationPending.Add(1)
+	select {
+	case replicationQueue <- name:
+		replicationQueued.Add(1)
+	default:
+		replicationPending.Add(-1)
+		replicationDropped.Add(1)
+		base.Logger.Warn().
+			Str("name", name).
+			Msg("dropped goproxy cache replication due to full queue")
+	}
+}
+
+// replicateGoproxyCaches replicates the Goproxy caches in the
+// `replicationQueue` until the `base.Context` is done.
+func replicateGoproxyCaches() {
+	for {
+		select {
+		case name := <-replicationQueue:
+			for _, r := range replicas {
+				if err := replicateObject(r, name); err != nil {
+					replicationFailed.Add(1)
+					base.Logger.Error().Err(err).
+						Str("replica", r.Name).
+						Str("name", name).
+						Msg("failed to replicate goproxy cache")
+					continue
+				}
+
+				replicationSucceeded.Add(1)
+			}
+
+			replicationPending.Add(-1)
+		case <-base.Context.Done():
+			return
+		}
+	}
+}
+
+// replicateObject copies the object with the name from the Qiniu Cloud Kodo to
+// the r.
+func replicateObject(r *replica, name string) error {
+	ctx, cancel := context.WithTimeout(base.Context, replicationTimeout)
+	defer cancel()
+
+	return retryQiniuKodoDo(ctx, func(ctx context.Context) error {
+		object, err := qiniuKodoClient.GetObject(
+			ctx,
+			qiniuKodoBucketName,
+			name,
+			qiniuKodoGetObjectOptions(),
+		)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		objectInfo, err := object.Stat()
+		if err != nil {
+			return err
+		}
+
+		_, err = r.client.PutObject(
+			ctx,
+			r.BucketName,
+			name,
+			object,
+			objectInfo.Size,
+			minio.PutObjectOptions{
+				ContentType:  objectInfo.ContentType,
+				UserMetadata: objectInfo.UserMetadata,
+			},
+		)
+
+		return err
+	})
+}
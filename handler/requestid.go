@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/aofei/air"
+)
+
+// requestIDHeader is the header that carries the request IDs.
+const requestIDHeader = "X-Request-Id"
+
+// requestIDKey is the key of the request ID in the context of a request.
+type requestIDKey struct{}
+
+// RequestIDGas is used to assign an ID to every request, so that the logs of a
+// request can be correlated. The ID presented by the client (or the reverse
+// proxy in front) in the X-Request-Id header is kept if it is valid, otherwise
+// a new one is generated. It is sent back in the X-Request-Id header.
+func RequestIDGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				return err
+			}
+
+			id = hex.EncodeToString(b)
+		}
+
+		req.Context = context.WithValue(req.Context, requestIDKey{}, id)
+		res.Header.Set(requestIDHeader, id)
+
+		return next(req, res)
+	}
+}
+
+// validRequestID reports whether the id is a valid request ID, which is up to
+// 128 printable ASCII characters without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestIDOf returns the request ID carried by the ctx, or an empty string if
+// there is none.
+func requestIDOf(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDTransport is an `http.RoundTripper` that propagates the request IDs
+// carried by the contexts of the requests to the upstreams in the X-Request-Id
+// header.
+type requestIDTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (rit *requestIDTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	if id := requestIDOf(req.Context()); id != "" &&
+		req.Header.Get(requestIDHeader) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	return rit.next.RoundTrip(req)
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// upstreamRetries is the maximum number of the retries of a request to
+	// an upstream that failed transiently. The retries are disabled when
+	// it is not positive.
+	upstreamRetries = goproxyViper.GetInt("upstream_retries")
+
+	// upstreamRetryBaseDelay is the base of the exponential backoff between
+	// two attempts of a request to an upstream.
+	upstreamRetryBaseDelay = goproxyViper.GetDuration(
+		"upstream_retry_base_delay",
+	)
+
+	// upstreamRetryMaxDelay is the cap of the exponential backoff between
+	// two attempts of a request to an upstream.
+	upstreamRetryMaxDelay = goproxyViper.GetDuration(
+		"upstream_retry_max_delay",
+	)
+
+	// upstreamRetryBudgetRatio is the retries earned by each request to the
+	// upstreams, which bounds the retries to that ratio of the requests.
+	upstreamRetryBudgetRatio = goproxyViper.GetFloat64(
+		"upstream_retry_budget_ratio",
+	)
+
+	// upstreamRetryBudgetMax is the maximum retries that can be saved up in
+	// the `upstreamRetryBudget`, which bounds the retry bursts.
+	upstreamRetryBudgetMax = goproxyViper.GetFloat64(
+		"upstream_retry_budget_max",
+	)
+
+	// upstreamRetryBudget is the retries currently available to all the
+	// requests to the upstreams.
+	upstreamRetryBudget = upstreamRetryBudgetMax
+
+	// upstreamRetryBudgetMutex is used to protect the
+	// `upstreamRetryBudget`.
+	upstreamRetryBudgetMutex sync.Mutex
+
+	// upstreamRetriesSent is the number of the retries sent to the
+	// upstreams.
+	upstreamRetriesSent = expvar.NewInt("upstream_retries")
+
+	// upstreamRetriesDenied is the number of the retries denied by the
+	// `upstreamRetryBudget`.
+	upstreamRetriesDenied = expvar.NewInt("upstream_retries_denied")
+)
+
+// depositUpstreamRetryBudget deposits the retries earned by a request into the
+// `upstreamRetryBudget`.
+func depositUpstreamRetryBudget() {
+	upstreamRetryBudgetMutex.Lock()
+	defer upstreamRetryBudgetMutex.Unlock()
+
+	upstreamRetryBudget = min(
+		upstreamRetryBudget+upstreamRetryBudgetRatio,
+		upstreamRetryBudgetMax,
+	)
+}
+
+// withdrawUpstreamRetryBudget withdraws a retry from the
+// `upstreamRetryBudget`. It reports false if there is none left, in which case
+// the upstreams are likely having an outage that retries would only amplify.
+func withdrawUpstreamRetryBudget() bool {
+	upstreamRetryBudgetMutex.Lock()
+	defer upstreamRetryBudgetMutex.Unlock()
+
+	if upstreamRetryBudget < 1 {
+		return false
+	}
+
+	upstreamRetryBudget--
+
+	return true
+}
+
+// upstreamRetryDelay returns the jittered delay before the retry with the
+// attempt number (starting at 1), which is a random duration up to the
+// exponential backoff.
+func upstreamRetryDelay(attempt int) time.Duration {
+	backoff := upstreamRetryMaxDelay
+	if attempt < 32 {
+		backoff = min(upstreamRetryBaseDelay<<(attempt-1), backoff)
+	}
+
+	if backoff <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// retryingTransport is an `http.RoundTripper` that retries the GET requests to
+// the upstreams that failed transiently, which are those that timed out or
+// were responded with "429 Too Many Requests" or the 5xx statuses that the
+// upstreams use for being overloaded or unreachable. The retries are backed
+// off with jitter and bounded by the `upstreamRetryBudget`.
+type retryingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (rt *retryingTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	if upstreamRetries <= 0 || req.Method != http.MethodGet {
+		return rt.next.RoundTrip(req)
+	}
+
+	depositUpstreamRetryBudget()
+
+	for attempt := 1; ; attempt++ {
+		res, err := rt.next.RoundTrip(req)
+		if attempt > upstreamRetries ||
+			!isTransientUpstreamFailure(req, res, err) {
+			return res, err
+		}
+
+		if !withdrawUpstreamRetryBudget() {
+			upstreamRetriesDenied.Add(1)
+			return res, err
+		}
+
+		if err == nil {
+			res.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(upstreamRetryDelay(attempt)):
+		}
+
+		upstreamRetriesSent.Add(1)
+	}
+}
+
+// isTransientUpstreamFailure reports whether the res or the err of the req is
+// a transient failure of an upstream that is worth retrying.
+func isTransientUpstreamFailure(
+	req *http.Request,
+	res *http.Response,
+	err error,
+) bool {
+	if err != nil {
+		if req.Context().Err() != nil {
+			return false
+		}
+
+		var netErr interface{ Timeout() bool }
+		return errors.Is(err, context.DeadlineExceeded) ||
+			(errors.As(err, &netErr) && netErr.Timeout())
+	}
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
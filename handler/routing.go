@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/mod/module"
+)
+
+// routingRule is a rule that maps module path patterns to how the Goproxy
+// should serve them.
+type routingRule struct {
+	// Pattern is a glob pattern of module path prefixes (see the
+	// `module.MatchPrefixPatterns`).
+	Pattern string `mapstructure:"pattern"`
+
+	// Action is one of "proxy", "direct" and "reject". The "proxy" fetches
+	// via the `Upstream`, the "direct" fetches directly from the VCS, and
+	// the "reject" refuses to serve at all.
+	Action string `mapstructure:"action"`
+
+	// Upstream is the URL of the upstream proxy used by the "proxy".
+	Upstream string `mapstructure:"upstream"`
+
+	// Private indicates whether the matched modules are private, in which
+	// case they bypass the checksum databases like those matching the
+	// `sumdbBypassPatterns`.
+	Private bool `mapstructure:"private"`
+
+	upstreamURL *url.URL
+}
+
+var (
+	// routingRules is the routing rules of the Goproxy. The first matched
+	// rule wins.
+	routingRules []*routingRule
+
+	// routingUpstreamURLs is the URLs of the upstream proxies in the
+	// `goproxyUpstreams`.
+	routingUpstreamURLs []*url.URL
+)
+
+func init() {
+	if err := goproxyViper.UnmarshalKey(
+		"routing_rules",
+		&routingRules,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to unmarshal goproxy routing rules")
+	}
+
+	nosumdbPatterns := append([]string(nil), sumdbBypassPatterns...)
+	for _, rr := range routingRules {
+		if rr.Private {
+			nosumdbPatterns = append(nosumdbPatterns, rr.Pattern)
+		}
+	}
+
+	if len(nosumdbPatterns) > 0 {
+		hhGoproxy.GoBinEnv = append(
+			hhGoproxy.GoBinEnv,
+			fmt.Sprint("GONOSUMDB=", joinGlobs(
+				envOr("GONOSUMDB", os.Getenv("GOPRIVATE")),
+				nosumdbPatterns...,
+			)),
+		)
+	}
+
+	if len(routingRules) == 0 {
+		return
+	}
+
+	var noproxyPatterns []string
+	for _, rr := range routingRules {
+		if rr.Pattern == "" {
+			base.Logger.Fatal().
+				Msg("missing goproxy routing rule pattern")
+		}
+
+		switch rr.Action {
+		case "proxy":
+			u, err := url.Parse(rr.Upstream)
+			if err != nil || (u.Scheme != "http" &&
+				u.Scheme != "https") {
+				base.Logger.Fatal().
+					Str("upstream", rr.Upstream).
+					Msg("invalid goproxy routing rule upstream")
+			}
+
+			rr.upstreamURL = u
+		case "direct":
+			noproxyPatterns = append(noproxyPatterns, rr.Pattern)
+		case "reject":
+			continue
+		default:
+			base.Logger.Fatal().
+				Str("action", rr.Action).
+				Msg("unsupported goproxy routing rule action")
+		}
+	}
+
+	for _, proxy := range strings.FieldsFunc(goproxyUpstreams, func(
+		r rune,
+	) bool {
+		return r == ',' || r == '|'
+	}) {
+		switch proxy {
+		case "direct", "off":
+			continue
+		}
+
+		u, err := url.Parse(proxy)
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to parse goproxy upstream")
+		}
+
+		routingUpstreamURLs = append(routingUpstreamURLs, u)
+	}
+
+	hhGoproxy.GoBinEnv = append(
+		hhGoproxy.GoBinEnv,
+		fmt.Sprint("GONOPROXY=", joinGlobs(
+			envOr("GONOPROXY", os.Getenv("GOPRIVATE")),
+			noproxyPatterns...,
+		)),
+	)
+}
+
+// matchRoutingRule returns the first routing rule that matches the modulePath.
+// It returns nil if there is no match.
+func matchRoutingRule(modulePath string) *routingRule {
+	for _, rr := range routingRules {
+		if module.MatchPrefixPatterns(rr.Pattern, modulePath) {
+			return rr
+		}
+	}
+
+	return nil
+}
+
+// isGoproxyCacheRejected reports whether the Goproxy cache with the name
+// belongs to a module rejected by the routing rules.
+func isGoproxyCacheRejected(name string) bool {
+	modulePath, _, ok := parseGoproxyCacheName(name)
+	if !ok {
+		return false
+	}
+
+	rr := matchRoutingRule(modulePath)
+
+	return rr != nil && rr.Action == "reject"
+}
+
+// routingTransport is an `http.RoundTripper` that redirects the requests to
+// the upstream proxies in the GOPROXY to the upstream of the matched routing
+// rules.
+type routingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (rt *routingTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	for _, u := range routingUpstreamURLs {
+		if req.URL.Scheme != u.Scheme || req.URL.Host != u.Host {
+			continue
+		}
+
+		name, ok := strings.CutPrefix(
+			req.URL.Path,
+			fmt.Sprint(strings.TrimSuffix(u.Path, "/"), "/"),
+		)
+		if !ok {
+			continue
+		}
+
+		if ru := routedUpstreamURL(req.URL, name); ru != req.URL {
+			req = req.Clone(req.Context())
+			req.URL = ru
+			req.Host = ""
+		}
+
+		break
+	}
+
+	return rt.next.RoundTrip(req)
+}
+
+// routedUpstreamURL returns the URL that the u of the Goproxy cache with the
+// name on an upstream proxy in the `goproxyUpstreams` is routed to by the
+// routing rules. It is the u itself if no routing rule with an upstream
+// matches the name.
+func routedUpstreamURL(u *url.URL, name string) *url.URL {
+	modulePath, _, ok := parseGoproxyCacheName(name)
+	if !ok {
+		return u
+	}
+
+	rr := matchRoutingRule(modulePath)
+	if rr == nil || rr.upstreamURL == nil {
+		return u
+	}
+
+	return rr.upstreamURL.JoinPath(name)
+}
+
+// envOr returns the value of the environment variable named by the key, or the
+// fallback if it is empty.
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+
+	return fallback
+}
+
+// joinGlobs joins the globs into the comma-separated globs list.
+func joinGlobs(globs string, morePatterns ...string) string {
+	patterns := make([]string, 0, len(morePatterns)+1)
+	if globs != "" {
+		patterns = append(patterns, globs)
+	}
+
+	return strings.Join(append(patterns, morePatterns...), ",")
+}
@@ -0,0 +1,211 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// contentScanTypes is the file extensions of the Goproxy caches to be
+	// scanned, such as ".zip".
+	contentScanTypes = goproxyViper.GetStringSlice("content_scan_types")
+
+	// contentScanFailClosed indicates whether the Goproxy caches are
+	// refused when the scanning fails. They are cached anyway otherwise.
+	contentScanFailClosed = goproxyViper.GetBool("content_scan_fail_closed")
+
+	// contentScanners is the registered `ContentScanner`s.
+	contentScanners []ContentScanner
+
+	// contentScannersMutex is used to protect the `contentScanners`.
+	contentScannersMutex sync.RWMutex
+)
+
+// contentScanQuarantinePrefix is the prefix of the names of the objects in the
+// Qiniu Cloud Kodo that hold the quarantined Goproxy caches for review.
+const contentScanQuarantinePrefix = "quarantine/"
+
+// ContentScanner scans the Goproxy caches before they are cached, such as for
+// malware or leaked secrets.
+type ContentScanner interface {
+	// ScanContent scans the content of the Goproxy cache with the name. It
+	// returns a non-empty finding if the Goproxy cache should be
+	// quarantined.
+	ScanContent(
+		ctx context.Context,
+		name string,
+		content io.Reader,
+	) (finding string, err error)
+}
+
+func init() {
+	if command := goproxyViper.GetStringSlice(
+		"content_scan_command",
+	); len(command) > 0 {
+		RegisterContentScanner(&commandContentScanner{
+			command: command,
+		})
+	}
+}
+
+// RegisterContentScanner registers the cs to scan the Goproxy caches. It must
+// be called before the server starts serving, typically in an init function.
+func RegisterContentScanner(cs ContentScanner) {
+	contentScannersMutex.Lock()
+	defer contentScannersMutex.Unlock()
+
+	contentScanners = append(contentScanners, cs)
+}
+
+// scanGoproxyCache scans the content of the Goproxy cache with the name with
+// the registered `ContentScanner`s. It quarantines the Goproxy cache and blocks
+// its module version when there is a finding, in which case an error is
+// returned so that it is never cached or served.
+func scanGoproxyCache(
+	ctx context.Context,
+	name string,
+	content io.ReadSeeker,
+) error {
+	if !stringSliceContains(contentScanTypes, path.Ext(name)) {
+		return nil
+	}
+
+	contentScannersMutex.RLock()
+	scanners := contentScanners
+	contentScannersMutex.RUnlock()
+
+	for _, cs := range scanners {
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		finding, err := cs.ScanContent(ctx, name, content)
+		if err != nil {
+			base.Logger.Error().Err(err).
+				Str("name", name).
+				Str("request_id", requestIDOf(ctx)).
+				Msg("failed to scan goproxy cache")
+			if contentScanFailClosed {
+				return fmt.Errorf("scan %s: %w", name, err)
+			}
+
+			continue
+		}
+
+		if finding == "" {
+			continue
+		}
+
+		base.Logger.Warn().
+			Str("name", name).
+			Str("request_id", requestIDOf(ctx)).
+			Str("finding", finding).
+			Msg("quarantined goproxy cache")
+
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		quarantinedContent, err := encryptGoproxyCache(content)
+		if err == nil {
+			err = qiniuKodoUpload(
+				ctx,
+				contentScanQuarantinePrefix+name,
+				quarantinedContent,
+			)
+		}
+
+		if err != nil {
+			base.Logger.Error().Err(err).
+				Str("name", name).
+				Str("request_id", requestIDOf(ctx)).
+				Msg("failed to quarantine goproxy cache")
+		}
+
+		if modulePath, moduleVersion, ok := parseGoproxyCacheName(
+			name,
+		); ok && moduleVersion != "" {
+			if err := blockModule(
+				ctx,
+				fmt.Sprint(modulePath, "@", moduleVersion),
+			); err != nil {
+				base.Logger.Error().Err(err).
+					Str("name", name).
+					Str("request_id", requestIDOf(ctx)).
+					Msg("failed to block quarantined module")
+			}
+		}
+
+		return fmt.Errorf("quarantined %s: %s", name, finding)
+	}
+
+	_, err := content.Seek(0, io.SeekStart)
+
+	return err
+}
+
+// commandContentScanner is a `ContentScanner` that runs an external command
+// with the content on its standard input and the name in the
+// GOPROXY_CACHE_NAME environment variable. Like the clamscan, the exit code 0
+// means clean, 1 means a finding described by the output, and others mean
+// errors.
+type commandContentScanner struct {
+	command []string
+}
+
+// ScanContent implements the `ContentScanner`.
+func (ccs *commandContentScanner) ScanContent(
+	ctx context.Context,
+	name string,
+	content io.Reader,
+) (string, error) {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, ccs.command[0], ccs.command[1:]...)
+	cmd.Env = append(os.Environ(), "GOPROXY_CACHE_NAME="+name)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	// The command may exit without reading all of its standard input, so
+	// the copy error is ignored in favor of the exit code.
+	copyBuffered(stdin, content)
+	stdin.Close()
+
+	if err := cmd.Wait(); err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) && ee.ExitCode() == 1 {
+			finding := strings.TrimSpace(output.String())
+			if finding == "" {
+				finding = "flagged by content scanner"
+			}
+
+			return finding, nil
+		}
+
+		return "", fmt.Errorf(
+			"%w: %s",
+			err,
+			strings.TrimSpace(output.String()),
+		)
+	}
+
+	return "", nil
+}
@@ -0,0 +1,372 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/mod/semver"
+)
+
+var (
+	// searchIndexSchedule is the cron schedule of the module search index
+	// build. The module search is disabled when it is empty.
+	searchIndexSchedule = goproxyViper.GetString("search_index_schedule")
+
+	// searchIndex is the module search index keyed by the module path.
+	searchIndex = map[string]*searchEntry{}
+
+	// searchIndexMutex is used to protect the `searchIndex`.
+	searchIndexMutex sync.RWMutex
+)
+
+// searchIndexObjectName is the name of the object where the module search
+// index is stored in the Qiniu Cloud Kodo.
+const searchIndexObjectName = "search/index"
+
+// searchEntry is an entry of the module search index.
+type searchEntry struct {
+	ModulePath    string `json:"module_path"`
+	LatestVersion string `json:"latest_version"`
+	DownloadCount int    `json:"download_count"`
+}
+
+func init() {
+	if searchIndexSchedule == "" {
+		return
+	}
+
+	if _, err := base.Cron.AddJob(
+		searchIndexSchedule,
+		leaderJob("search", 6*time.Hour, func() {
+			if err := buildSearchIndex(base.Context); err != nil {
+				base.Logger.Error().Err(err).
+					Msg("failed to build search index")
+			}
+		}),
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add search index build cron job")
+	}
+
+	if _, err := base.Cron.AddFunc(
+		"*/10 * * * *", // Every 10 minutes
+		func() {
+			if err := loadSearchIndex(base.Context); err != nil &&
+				!isNotFoundMinIOError(err) {
+				base.Logger.Error().Err(err).
+					Msg("failed to load search index")
+			}
+		},
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add search index load cron job")
+	}
+
+	go func() {
+		if err := loadSearchIndex(base.Context); err != nil &&
+			!isNotFoundMinIOError(err) {
+			base.Logger.Error().Err(err).
+				Msg("failed to load search index")
+		}
+	}()
+
+	base.Air.BATCH(
+		getHeadMethods,
+		"/search",
+		hSearch,
+		authGas("proxy"),
+		minutelyCachemanGas,
+	)
+}
+
+// hSearch handles requests to search the cached modules by the "q" query
+// parameter. The results are ranked by how well their module paths match, and
+// then by their download counts in the last 30 days.
+func hSearch(req *air.Request, res *air.Response) error {
+	var q string
+	if p := req.Param("q"); p != nil {
+		q = strings.ToLower(strings.TrimSpace(p.Value().String()))
+	}
+
+	if q == "" || len(q) > 256 {
+		res.Status = http.StatusBadRequest
+		return errors.New("invalid search query")
+	}
+
+	limit := 20
+	if p := req.Param("limit"); p != nil {
+		var err error
+		if limit, err = p.Value().Int(); err != nil ||
+			limit < 1 ||
+			limit > 100 {
+			res.Status = http.StatusBadRequest
+			return errors.New("invalid limit")
+		}
+	}
+
+	return res.WriteJSON(searchModules(q, limit))
+}
+
+// searchModules returns at most the limit entries in the `searchIndex` that
+// match the q.
+func searchModules(q string, limit int) []searchEntry {
+	type result struct {
+		entry searchEntry
+		rank  int
+	}
+
+	searchIndexMutex.RLock()
+	var results []result
+	for modulePath, entry := range searchIndex {
+		if isModuleBlocked(modulePath, "") {
+			continue
+		}
+
+		if rank := searchMatchRank(q, modulePath); rank >= 0 {
+			results = append(results, result{
+				entry: *entry,
+				rank:  rank,
+			})
+		}
+	}
+	searchIndexMutex.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		ri, rj := results[i], results[j]
+		if ri.rank != rj.rank {
+			return ri.rank < rj.rank
+		}
+
+		if ri.entry.DownloadCount != rj.entry.DownloadCount {
+			return ri.entry.DownloadCount > rj.entry.DownloadCount
+		}
+
+		if len(ri.entry.ModulePath) != len(rj.entry.ModulePath) {
+			return len(ri.entry.ModulePath) < len(rj.entry.ModulePath)
+		}
+
+		return ri.entry.ModulePath < rj.entry.ModulePath
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	entries := make([]searchEntry, 0, len(results))
+	for _, r := range results {
+		entries = append(entries, r.entry)
+	}
+
+	return entries
+}
+
+// searchMatchRank returns how well the q matches the modulePath. The lower the
+// rank the better the match, and -1 means no match. The q must be lowercase.
+//
+// The ranks are: 0 for an exact match, 1 for a prefix match, 2 for a match at
+// the start of a path element or a word, 3 for a substring match and 4 for a
+// fuzzy match where all the characters of the q appear in order.
+func searchMatchRank(q, modulePath string) int {
+	modulePath = strings.ToLower(modulePath)
+	switch {
+	case modulePath == q:
+		return 0
+	case strings.HasPrefix(modulePath, q):
+		return 1
+	}
+
+	if strings.Contains(modulePath, q) {
+		for i := 1; i < len(modulePath); i++ {
+			if strings.IndexByte("/.-_", modulePath[i-1]) >= 0 &&
+				strings.HasPrefix(modulePath[i:], q) {
+				return 2
+			}
+		}
+
+		return 3
+	}
+
+	i := 0
+	for j := 0; i < len(q) && j < len(modulePath); j++ {
+		if q[i] == modulePath[j] {
+			i++
+		}
+	}
+
+	if i == len(q) {
+		return 4
+	}
+
+	return -1
+}
+
+// addSearchEntry adds the module version of the Goproxy .info cache with the
+// name to the `searchIndex` of the current instance, so that new modules show
+// up in the search results before the next build of the index.
+func addSearchEntry(name string) {
+	if searchIndexSchedule == "" || path.Ext(name) != ".info" {
+		return
+	}
+
+	modulePath, moduleVersion, ok := parseGoproxyCacheName(name)
+	if !ok {
+		return
+	}
+
+	searchIndexMutex.Lock()
+	defer searchIndexMutex.Unlock()
+
+	entry := searchIndex[modulePath]
+	if entry == nil {
+		entry = &searchEntry{ModulePath: modulePath}
+		searchIndex[modulePath] = entry
+	}
+
+	if compareSearchVersions(moduleVersion, entry.LatestVersion) > 0 {
+		entry.LatestVersion = moduleVersion
+	}
+}
+
+// compareSearchVersions compares the v and the w like the `semver.Compare`,
+// except that the release versions always outrank the prerelease and the
+// pseudo versions.
+func compareSearchVersions(v, w string) int {
+	vr, wr := semver.Prerelease(v) == "", semver.Prerelease(w) == ""
+	if w == "" || vr && !wr {
+		return 1
+	} else if !vr && wr {
+		return -1
+	}
+
+	return semver.Compare(v, w)
+}
+
+// buildSearchIndex builds the module search index from the Goproxy .info caches
+// in the Qiniu Cloud Kodo and the download counts of the last 30 days, and then
+// stores it in the Qiniu Cloud Kodo.
+func buildSearchIndex(ctx context.Context) error {
+	startTime := time.Now()
+
+	index := map[string]*searchEntry{}
+	for objectInfo := range qiniuKodoClient.ListObjects(
+		ctx,
+		qiniuKodoBucketName,
+		minio.ListObjectsOptions{
+			Recursive: true,
+		},
+	) {
+		if objectInfo.Err != nil {
+			return objectInfo.Err
+		}
+
+		if path.Ext(objectInfo.Key) != ".info" ||
+			!validGoproxyCacheName(objectInfo.Key) {
+			continue
+		}
+
+		modulePath, moduleVersion, ok := parseGoproxyCacheName(
+			objectInfo.Key,
+		)
+		if !ok || isModuleBlocked(modulePath, moduleVersion) {
+			continue
+		}
+
+		entry := index[modulePath]
+		if entry == nil {
+			entry = &searchEntry{ModulePath: modulePath}
+			index[modulePath] = entry
+		}
+
+		if compareSearchVersions(moduleVersion, entry.LatestVersion) > 0 {
+			entry.LatestVersion = moduleVersion
+		}
+	}
+
+	var trends []struct {
+		ModulePath    string `json:"module_path"`
+		DownloadCount int    `json:"download_count"`
+	}
+
+	if err := getStatObject(
+		ctx,
+		"stats/trends/last-30-days",
+		&trends,
+	); err != nil && !isNotFoundMinIOError(err) {
+		return err
+	}
+
+	for _, trend := range trends {
+		if entry := index[trend.ModulePath]; entry != nil {
+			entry.DownloadCount = trend.DownloadCount
+		}
+	}
+
+	entries := make([]*searchEntry, 0, len(index))
+	for _, entry := range index {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModulePath < entries[j].ModulePath
+	})
+
+	if err := putStatObject(ctx, searchIndexObjectName, entries); err != nil {
+		return err
+	}
+
+	searchIndexMutex.Lock()
+	searchIndex = index
+	searchIndexMutex.Unlock()
+
+	base.Logger.Info().
+		Int("module_count", len(entries)).
+		Dur("duration", time.Since(startTime)).
+		Msg("built search index")
+
+	return nil
+}
+
+// loadSearchIndex loads the `searchIndex` from the Qiniu Cloud Kodo.
+func loadSearchIndex(ctx context.Context) error {
+	var entries []*searchEntry
+	if err := getStatObject(
+		ctx,
+		searchIndexObjectName,
+		&entries,
+	); err != nil {
+		return err
+	}
+
+	index := make(map[string]*searchEntry, len(entries))
+	for _, entry := range entries {
+		index[entry.ModulePath] = entry
+	}
+
+	searchIndexMutex.Lock()
+	defer searchIndexMutex.Unlock()
+
+	// Keep the module versions added since the index was built.
+	for modulePath, entry := range searchIndex {
+		if e := index[modulePath]; e == nil {
+			index[modulePath] = entry
+		} else if compareSearchVersions(
+			entry.LatestVersion,
+			e.LatestVersion,
+		) > 0 {
+			e.LatestVersion = entry.LatestVersion
+		}
+	}
+
+	searchIndex = index
+
+	return nil
+}
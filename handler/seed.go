@@ -0,0 +1,418 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/mod/module"
+)
+
+var (
+	// seedJob is the latest seed job. It is nil if there has been none.
+	seedJob *seedJobStatus
+
+	// seedJobCancel cancels the running seed job.
+	seedJobCancel context.CancelFunc
+
+	// seedJobMutex is used to protect the `seedJob` and the
+	// `seedJobCancel`.
+	seedJobMutex sync.Mutex
+
+	// seedHTTPClient is the HTTP client used to walk the module indexes.
+	seedHTTPClient = &http.Client{
+		Timeout: time.Minute,
+	}
+)
+
+// seedIndexPageSize is the number of the module versions requested per page of
+// a module index.
+const seedIndexPageSize = 2000
+
+// seedJobStatus is the status of a seed job.
+type seedJobStatus struct {
+	IndexURL   string    `json:"index_url,omitempty"`
+	Since      time.Time `json:"since"`
+	Running    bool      `json:"running"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Seeded     int64     `json:"seeded"`
+	Skipped    int64     `json:"skipped"`
+	Failed     int64     `json:"failed"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// seedJobRequest is the request to start a seed job.
+type seedJobRequest struct {
+	// IndexURL is the URL of a module index that serves the module
+	// versions as JSON lines in the format of the index.golang.org.
+	IndexURL string `json:"index_url"`
+
+	// Since is where the walk of the `IndexURL` starts.
+	Since time.Time `json:"since"`
+
+	// Modules is the module versions to seed in the form of "path@version".
+	// All the versions in the "/@v/list" are seeded for a bare path.
+	Modules []string `json:"modules"`
+
+	// Concurrency is the number of the module versions seeded at the same
+	// time.
+	Concurrency int `json:"concurrency"`
+}
+
+func init() {
+	if !adminEnabled {
+		return
+	}
+
+	base.Air.GET("/admin/seed", hAdminSeedStatus, adminGas, globalAdminGas)
+	base.Air.POST(
+		"/admin/seed",
+		hAdminStartSeed,
+		adminGas,
+		globalAdminGas,
+		maintenanceGas,
+	)
+	base.Air.DELETE(
+		"/admin/seed",
+		hAdminCancelSeed,
+		adminGas,
+		globalAdminGas,
+	)
+}
+
+// hAdminSeedStatus handles requests to get the status of the latest seed job.
+func hAdminSeedStatus(req *air.Request, res *air.Response) error {
+	seedJobMutex.Lock()
+	defer seedJobMutex.Unlock()
+
+	if seedJob == nil {
+		return NotFound(req, res)
+	}
+
+	return res.WriteJSON(seedJob)
+}
+
+// hAdminStartSeed handles requests to start a seed job, which populates the
+// Goproxy caches in the background from a module index or a module list so
+// that a new deployment can warm up before going live.
+func hAdminStartSeed(req *air.Request, res *air.Response) error {
+	var sjr seedJobRequest
+	if err := json.NewDecoder(req.Body).Decode(&sjr); err != nil {
+		res.Status = http.StatusBadRequest
+		return errors.New("invalid seed job request")
+	}
+
+	if (sjr.IndexURL == "") == (len(sjr.Modules) == 0) {
+		res.Status = http.StatusBadRequest
+		return errors.New("either index_url or modules is required")
+	}
+
+	if sjr.IndexURL != "" {
+		if u, err := url.Parse(sjr.IndexURL); err != nil ||
+			(u.Scheme != "http" && u.Scheme != "https") {
+			res.Status = http.StatusBadRequest
+			return errors.New("invalid index_url")
+		}
+	}
+
+	if sjr.Concurrency <= 0 {
+		sjr.Concurrency = 8
+	}
+
+	seedJobMutex.Lock()
+	defer seedJobMutex.Unlock()
+
+	if seedJob != nil && seedJob.Running {
+		res.Status = http.StatusConflict
+		return errors.New("seed job already running")
+	}
+
+	var ctx context.Context
+	ctx, seedJobCancel = context.WithCancel(base.Context)
+	seedJob = &seedJobStatus{
+		IndexURL:  sjr.IndexURL,
+		Since:     sjr.Since,
+		Running:   true,
+		StartedAt: time.Now(),
+	}
+
+	go runSeedJob(ctx, seedJob, sjr)
+
+	base.Logger.Info().
+		Str("index_url", sjr.IndexURL).
+		Int("module_count", len(sjr.Modules)).
+		Str("client_address", req.ClientAddress()).
+		Msg("started seed job")
+
+	res.Status = http.StatusAccepted
+
+	return res.WriteJSON(seedJob)
+}
+
+// hAdminCancelSeed handles requests to cancel the running seed job.
+func hAdminCancelSeed(req *air.Request, res *air.Response) error {
+	seedJobMutex.Lock()
+	defer seedJobMutex.Unlock()
+
+	if seedJob == nil || !seedJob.Running {
+		return NotFound(req, res)
+	}
+
+	seedJobCancel()
+
+	res.Status = http.StatusNoContent
+
+	return res.Write(nil)
+}
+
+// runSeedJob runs the seed job with the sjs as described by the sjr.
+func runSeedJob(ctx context.Context, sjs *seedJobStatus, sjr seedJobRequest) {
+	mvs := make(chan module.Version)
+
+	var wg sync.WaitGroup
+	for i := 0; i < sjr.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for mv := range mvs {
+				seeded, err := seedModuleVersion(ctx, mv)
+
+				seedJobMutex.Lock()
+				switch {
+				case err != nil:
+					sjs.Failed++
+				case seeded:
+					sjs.Seeded++
+				default:
+					sjs.Skipped++
+				}
+				seedJobMutex.Unlock()
+
+				if err != nil && ctx.Err() == nil {
+					base.Logger.Warn().Err(err).
+						Str("module", mv.String()).
+						Msg("failed to seed module version")
+				}
+			}
+		}()
+	}
+
+	var err error
+	if sjr.IndexURL != "" {
+		err = walkSeedIndex(ctx, sjs, sjr.IndexURL, sjr.Since, mvs)
+	} else {
+		err = walkSeedModules(ctx, sjr.Modules, mvs)
+	}
+
+	close(mvs)
+	wg.Wait()
+
+	seedJobMutex.Lock()
+	defer seedJobMutex.Unlock()
+
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	sjs.Running = false
+	sjs.FinishedAt = time.Now()
+	if err != nil {
+		sjs.Error = err.Error()
+	}
+
+	seedJobCancel()
+
+	base.Logger.Info().Err(err).
+		Int64("seeded", sjs.Seeded).
+		Int64("skipped", sjs.Skipped).
+		Int64("failed", sjs.Failed).
+		Msg("finished seed job")
+}
+
+// walkSeedIndex sends the module versions in the module index at the indexURL
+// since the since to the mvs. It records the walk progress in the sjs so that
+// an interrupted walk can be resumed from there.
+func walkSeedIndex(
+	ctx context.Context,
+	sjs *seedJobStatus,
+	indexURL string,
+	since time.Time,
+	mvs chan<- module.Version,
+) error {
+	for {
+		u, err := url.Parse(indexURL)
+		if err != nil {
+			return err
+		}
+
+		query := u.Query()
+		query.Set("since", since.Format(time.RFC3339Nano))
+		query.Set("limit", strconv.Itoa(seedIndexPageSize))
+		u.RawQuery = query.Encode()
+
+		req, err := http.NewRequestWithContext(
+			ctx,
+			http.MethodGet,
+			u.String(),
+			nil,
+		)
+		if err != nil {
+			return err
+		}
+
+		res, err := seedHTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return fmt.Errorf("%s: %s", u, res.Status)
+		}
+
+		var count int
+		s := bufio.NewScanner(res.Body)
+		for s.Scan() {
+			var entry struct {
+				Path      string
+				Version   string
+				Timestamp time.Time
+			}
+
+			if err := json.Unmarshal(s.Bytes(), &entry); err != nil {
+				res.Body.Close()
+				return err
+			}
+
+			count++
+			since = entry.Timestamp
+
+			select {
+			case mvs <- module.Version{
+				Path:    entry.Path,
+				Version: entry.Version,
+			}:
+			case <-ctx.Done():
+				res.Body.Close()
+				return ctx.Err()
+			}
+		}
+
+		res.Body.Close()
+		if err := s.Err(); err != nil {
+			return err
+		}
+
+		seedJobMutex.Lock()
+		sjs.Since = since
+		seedJobMutex.Unlock()
+
+		if count < seedIndexPageSize {
+			return nil
+		}
+	}
+}
+
+// walkSeedModules sends the module versions targeted by the modules to the
+// mvs. All the versions in the "/@v/list" are sent for a bare module path.
+func walkSeedModules(
+	ctx context.Context,
+	modules []string,
+	mvs chan<- module.Version,
+) error {
+	for _, m := range modules {
+		modulePath, moduleVersion, found := strings.Cut(m, "@")
+
+		versions := []string{moduleVersion}
+		if !found {
+			var err error
+			versions, err = listModuleVersions(ctx, modulePath)
+			if err != nil {
+				base.Logger.Warn().Err(err).
+					Str("module_path", modulePath).
+					Msg("failed to list module versions")
+				continue
+			}
+		}
+
+		for _, version := range versions {
+			select {
+			case mvs <- module.Version{
+				Path:    modulePath,
+				Version: version,
+			}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	return nil
+}
+
+// listModuleVersions returns the versions in the "/@v/list" of the module
+// targeted by the modulePath.
+func listModuleVersions(
+	ctx context.Context,
+	modulePath string,
+) ([]string, error) {
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withGoproxyFetchTimeout(ctx, "list")
+	defer cancel()
+
+	rw := &internalResponseWriter{}
+	if err := serveGoproxyInternally(
+		ctx,
+		rw,
+		fmt.Sprint(escapedModulePath, "/@v/list"),
+	); err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(string(rw.body)), nil
+}
+
+// seedModuleVersion pre-caches the .info, .mod and .zip files of the mv. It
+// reports whether any of them was missing.
+func seedModuleVersion(ctx context.Context, mv module.Version) (bool, error) {
+	if err := module.Check(mv.Path, mv.Version); err != nil {
+		return false, err
+	}
+
+	if isModuleBlocked(mv.Path, mv.Version) ||
+		!isModuleAllowed(mv.Path, mv.Version) {
+		return false, nil
+	}
+
+	seeded := false
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		name, err := goproxyCacheNameOf(mv, ext)
+		if err != nil {
+			return seeded, err
+		}
+
+		fetched, err := ensureGoproxyCache(ctx, name)
+		if err != nil {
+			return seeded, err
+		}
+
+		seeded = seeded || fetched
+	}
+
+	return seeded, nil
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// goproxyTempDir is the temporary directory of the Goproxy. It is
+	// removed on shutdown.
+	goproxyTempDir = newGoproxyTempDir()
+
+	// cachePutDrainTimeout is the maximum duration to wait for the
+	// in-flight Goproxy cache puts on shutdown.
+	cachePutDrainTimeout = goproxyViper.GetDuration("cache_put_drain_timeout")
+
+	// cachePutDraining indicates whether the in-flight Goproxy cache puts
+	// are being drained, in which case no new ones are accepted.
+	cachePutDraining atomic.Bool
+)
+
+func init() {
+	base.Air.AddShutdownJob(removeGoproxyTempDir)
+}
+
+// newGoproxyTempDir returns a new `goproxyTempDir`.
+func newGoproxyTempDir() string {
+	tempDir, err := os.MkdirTemp("", "goproxy.cn-")
+	if err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to create goproxy temporary directory")
+	}
+
+	return tempDir
+}
+
+// DrainGoproxyCachePuts stops accepting new Goproxy cache puts and waits for
+// the in-flight ones and the queued replications (see the
+// `replicateGoproxyCache`) to finish for at most the `cachePutDrainTimeout`. It
+// must be called before the `base.Air` shuts down, since the background puts
+// and the replications stop once the `base.Context` is done.
+func DrainGoproxyCachePuts() {
+	cachePutDraining.Store(true)
+
+	deadline := time.Now().Add(cachePutDrainTimeout)
+	for {
+		inflightCachePuts := inflightGoproxyCachePuts()
+		pendingReplications := replicationPending.Load()
+		if inflightCachePuts == 0 && pendingReplications == 0 {
+			base.Logger.Info().
+				Msg("drained goproxy cache puts")
+			break
+		}
+
+		if time.Now().After(deadline) {
+			base.Logger.Warn().
+				Int("inflight_cache_puts", inflightCachePuts).
+				Int64("pending_replications", pendingReplications).
+				Msg("abandoned goproxy cache puts due to drain " +
+					"timeout")
+			break
+		}
+
+		base.Logger.Info().
+			Int("inflight_cache_puts", inflightCachePuts).
+			Int64("pending_replications", pendingReplications).
+			Dur("remaining", time.Until(deadline)).
+			Msg("draining goproxy cache puts")
+
+		time.Sleep(time.Second)
+	}
+}
+
+// removeGoproxyTempDir removes the `goproxyTempDir`.
+func removeGoproxyTempDir() {
+	if err := os.RemoveAll(goproxyTempDir); err != nil {
+		base.Logger.Error().Err(err).
+			Msg("failed to remove goproxy temporary directory")
+	}
+}
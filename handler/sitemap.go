@@ -0,0 +1,249 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+)
+
+// sitemapSchedule is the cron schedule of the sitemap generation. The sitemaps
+// are disabled when it is empty.
+var sitemapSchedule = goproxyViper.GetString("sitemap_schedule")
+
+const (
+	// sitemapBaseURL is the base URL of the URLs in the sitemaps.
+	sitemapBaseURL = "https://goproxy.cn"
+
+	// sitemapPrefix is the prefix of the objects where the sitemaps are
+	// stored in the Qiniu Cloud Kodo.
+	sitemapPrefix = "sitemaps/"
+
+	// sitemapPageSize is the maximum number of the URLs in a sitemap, which
+	// is the limit of the sitemap protocol.
+	sitemapPageSize = 50000
+)
+
+// sitemapPages is the pages other than the module pages in the sitemaps.
+var sitemapPages = []string{"/", "/faq", "/stats", "/status"}
+
+// sitemapURLSet is a sitemap.
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// sitemapURL is a URL of a sitemap.
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// sitemapIndex is a sitemap index.
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+func init() {
+	if sitemapSchedule == "" {
+		return
+	}
+
+	if _, err := base.Cron.AddJob(
+		sitemapSchedule,
+		leaderJob("sitemap", 6*time.Hour, func() {
+			if err := generateSitemaps(base.Context); err != nil {
+				base.Logger.Error().Err(err).
+					Msg("failed to generate sitemaps")
+			}
+		}),
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add sitemap generation cron job")
+	}
+
+	base.Air.BATCH(
+		getHeadMethods,
+		"/sitemap.xml",
+		hSitemap,
+		authGas("proxy"),
+		hourlyCachemanGas,
+	)
+	base.Air.BATCH(
+		getHeadMethods,
+		"/sitemaps/:Page",
+		hSitemap,
+		authGas("proxy"),
+		hourlyCachemanGas,
+	)
+}
+
+// hSitemap handles requests to get the sitemap index or a sitemap.
+func hSitemap(req *air.Request, res *air.Response) error {
+	name := sitemapPrefix + "index.xml"
+	if p := req.Param("Page"); p != nil {
+		page := p.Value().String()
+		if path.Ext(page) != ".xml" ||
+			strings.Trim(
+				strings.TrimSuffix(page, ".xml"),
+				"0123456789",
+			) != "" {
+			return CacheableNotFound(req, res, 86400)
+		}
+
+		name = sitemapPrefix + page
+	}
+
+	var b []byte
+	if err := retryQiniuKodoDo(req.Context, func(
+		ctx context.Context,
+	) error {
+		object, err := qiniuKodoClient.GetObject(
+			ctx,
+			qiniuKodoBucketName,
+			name,
+			qiniuKodoGetObjectOptions(),
+		)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		b, err = io.ReadAll(object)
+
+		return err
+	}); err != nil {
+		if isNotFoundMinIOError(err) {
+			return CacheableNotFound(req, res, 3600)
+		}
+
+		return err
+	}
+
+	res.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	return res.Write(bytes.NewReader(b))
+}
+
+// generateSitemaps generates the sitemaps of the module pages from the Goproxy
+// .info caches in the Qiniu Cloud Kodo, along with the sitemap index of them,
+// and then stores them in the Qiniu Cloud Kodo. The last modification time of
+// a module page is the time its latest version was cached.
+func generateSitemaps(ctx context.Context) error {
+	startTime := time.Now()
+
+	lastMods := map[string]time.Time{}
+	for objectInfo := range qiniuKodoClient.ListObjects(
+		ctx,
+		qiniuKodoBucketName,
+		minio.ListObjectsOptions{
+			Recursive: true,
+		},
+	) {
+		if objectInfo.Err != nil {
+			return objectInfo.Err
+		}
+
+		if path.Ext(objectInfo.Key) != ".info" ||
+			!validGoproxyCacheName(objectInfo.Key) {
+			continue
+		}
+
+		modulePath, moduleVersion, ok := parseGoproxyCacheName(
+			objectInfo.Key,
+		)
+		if !ok || isModuleBlocked(modulePath, moduleVersion) {
+			continue
+		}
+
+		if objectInfo.LastModified.After(lastMods[modulePath]) {
+			lastMods[modulePath] = objectInfo.LastModified
+		}
+	}
+
+	modulePaths := make([]string, 0, len(lastMods))
+	for modulePath := range lastMods {
+		if _, ok := modulePagePath(modulePath); ok &&
+			!isModuleBlocked(modulePath, "") {
+			modulePaths = append(modulePaths, modulePath)
+		}
+	}
+
+	sort.Strings(modulePaths)
+
+	urls := make([]sitemapURL, 0, len(sitemapPages)+len(modulePaths))
+	for _, page := range sitemapPages {
+		urls = append(urls, sitemapURL{Loc: sitemapBaseURL + page})
+	}
+
+	for _, modulePath := range modulePaths {
+		urls = append(urls, sitemapURL{
+			Loc: sitemapBaseURL + "/" + (&url.URL{
+				Path: modulePath,
+			}).EscapedPath(),
+			LastMod: lastMods[modulePath].UTC().Format("2006-01-02"),
+		})
+	}
+
+	index := sitemapIndex{}
+	lastMod := time.Now().UTC().Format("2006-01-02")
+	for i := 0; i < len(urls); i += sitemapPageSize {
+		page := fmt.Sprint(i/sitemapPageSize+1, ".xml")
+		if err := putSitemapObject(
+			ctx,
+			sitemapPrefix+page,
+			sitemapURLSet{
+				URLs: urls[i:min(i+sitemapPageSize, len(urls))],
+			},
+		); err != nil {
+			return err
+		}
+
+		index.Sitemaps = append(index.Sitemaps, sitemapURL{
+			Loc:     sitemapBaseURL + "/sitemaps/" + page,
+			LastMod: lastMod,
+		})
+	}
+
+	if err := putSitemapObject(
+		ctx,
+		sitemapPrefix+"index.xml",
+		index,
+	); err != nil {
+		return err
+	}
+
+	base.Logger.Info().
+		Int("module_count", len(modulePaths)).
+		Int("sitemap_count", len(index.Sitemaps)).
+		Dur("duration", time.Since(startTime)).
+		Msg("generated sitemaps")
+
+	return nil
+}
+
+// putSitemapObject marshals the v as XML and puts it as the sitemap object with
+// the name to the Qiniu Cloud Kodo.
+func putSitemapObject(ctx context.Context, name string, v any) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return qiniuKodoUpload(
+		ctx,
+		name,
+		strings.NewReader(xml.Header+string(b)),
+	)
+}
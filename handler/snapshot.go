@@ -0,0 +1,393 @@
+package handler
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/mod/module"
+)
+
+func init() {
+	if !adminEnabled {
+		return
+	}
+
+	base.Air.GET(
+		"/admin/snapshot",
+		hAdminExportSnapshot,
+		adminGas,
+		globalAdminGas,
+	)
+	base.Air.POST(
+		"/admin/snapshot",
+		hAdminImportSnapshot,
+		adminGas,
+		globalAdminGas,
+		maintenanceGas,
+	)
+}
+
+// snapshotFilter selects the Goproxy caches of a snapshot.
+type snapshotFilter struct {
+	// patterns is the glob patterns of module path prefixes (see the
+	// `module.MatchPrefixPatterns`). All modules are selected when it is
+	// empty.
+	patterns string
+
+	// modifiedSince selects the Goproxy caches cached since it when it is
+	// not zero.
+	modifiedSince time.Time
+
+	// accessed selects the Goproxy caches of the module versions whose zip
+	// files are in it when it is not nil.
+	accessed map[string]struct{}
+}
+
+// match reports whether the Goproxy cache with the objectInfo is selected by
+// the sf.
+func (sf *snapshotFilter) match(objectInfo minio.ObjectInfo) bool {
+	if !validGoproxyCacheName(objectInfo.Key) {
+		return false
+	}
+
+	modulePath, _, ok := parseGoproxyCacheName(objectInfo.Key)
+	if !ok ||
+		(sf.patterns != "" &&
+			!module.MatchPrefixPatterns(sf.patterns, modulePath)) {
+		return false
+	}
+
+	if !sf.modifiedSince.IsZero() &&
+		objectInfo.LastModified.Before(sf.modifiedSince) {
+		return false
+	}
+
+	if sf.accessed != nil {
+		zipName := strings.TrimSuffix(
+			objectInfo.Key,
+			path.Ext(objectInfo.Key),
+		) + ".zip"
+		if _, ok := sf.accessed[zipName]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// listPrefixes returns the object name prefixes to list for the sf, which are
+// the literal leading parts of the `patterns`.
+func (sf *snapshotFilter) listPrefixes() []string {
+	if sf.patterns == "" {
+		return []string{""}
+	}
+
+	var prefixes []string
+	for _, pattern := range strings.Split(sf.patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+			pattern = pattern[:i]
+		}
+
+		pattern = strings.TrimSuffix(pattern, "/")
+		if pattern == "" {
+			return []string{""}
+		}
+
+		prefix, err := module.EscapePath(pattern)
+		if err != nil {
+			return []string{""}
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	// Drop the prefixes covered by others so that no Goproxy cache is
+	// listed twice.
+	sort.Strings(prefixes)
+	dedupedPrefixes := prefixes[:1]
+	for _, prefix := range prefixes[1:] {
+		if !strings.HasPrefix(
+			prefix,
+			dedupedPrefixes[len(dedupedPrefixes)-1],
+		) {
+			dedupedPrefixes = append(dedupedPrefixes, prefix)
+		}
+	}
+
+	return dedupedPrefixes
+}
+
+// hAdminExportSnapshot handles requests to export a slice of the Goproxy caches
+// as a gzipped tarball. The slice is selected by the "pattern", the
+// "modified_since" and the "accessed_since" (which requires the garbage
+// collection to record the accesses) query parameters. Only the immutable
+// Goproxy caches are exported.
+func hAdminExportSnapshot(req *air.Request, res *air.Response) error {
+	sf := &snapshotFilter{}
+	if p := req.Param("pattern"); p != nil {
+		sf.patterns = p.Value().String()
+	}
+
+	if p := req.Param("modified_since"); p != nil {
+		t, err := time.Parse("2006-01-02", p.Value().String())
+		if err != nil {
+			res.Status = http.StatusBadRequest
+			return errors.New("invalid modified_since")
+		}
+
+		sf.modifiedSince = t
+	}
+
+	if p := req.Param("accessed_since"); p != nil {
+		t, err := time.Parse("2006-01-02", p.Value().String())
+		if err != nil {
+			res.Status = http.StatusBadRequest
+			return errors.New("invalid accessed_since")
+		} else if gcSchedule == "" {
+			res.Status = http.StatusBadRequest
+			return errors.New("accesses are not recorded")
+		}
+
+		sf.accessed, err = loadAccessedGoproxyCaches(req.Context, t)
+		if err != nil {
+			return err
+		}
+	}
+
+	res.Header.Set("Content-Type", "application/gzip")
+	res.Header.Set(
+		"Content-Disposition",
+		`attachment; filename="goproxy-snapshot.tar.gz"`,
+	)
+
+	gw := gzip.NewWriter(res.HTTPResponseWriter())
+	tw := tar.NewWriter(gw)
+
+	count := 0
+	for _, prefix := range sf.listPrefixes() {
+		for objectInfo := range qiniuKodoClient.ListObjects(
+			req.Context,
+			qiniuKodoBucketName,
+			minio.ListObjectsOptions{
+				Prefix:    prefix,
+				Recursive: true,
+			},
+		) {
+			if objectInfo.Err != nil {
+				return objectInfo.Err
+			}
+
+			if !sf.match(objectInfo) {
+				continue
+			}
+
+			if err := writeSnapshotEntry(
+				req.Context,
+				tw,
+				objectInfo,
+			); err != nil {
+				return err
+			}
+
+			count++
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := gw.Close(); err != nil {
+		return err
+	}
+
+	base.Logger.Info().
+		Str("pattern", sf.patterns).
+		Int("count", count).
+		Str("client_address", req.ClientAddress()).
+		Msg("exported goproxy cache snapshot")
+
+	return nil
+}
+
+// writeSnapshotEntry writes the object with the objectInfo to the tw.
+func writeSnapshotEntry(
+	ctx context.Context,
+	tw *tar.Writer,
+	objectInfo minio.ObjectInfo,
+) error {
+	object, err := qiniuKodoClient.GetObject(
+		ctx,
+		qiniuKodoBucketName,
+		objectInfo.Key,
+		qiniuKodoGetObjectOptions(),
+	)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     objectInfo.Key,
+		Size:     objectInfo.Size,
+		Mode:     0o644,
+		ModTime:  objectInfo.LastModified,
+	}); err != nil {
+		return err
+	}
+
+	_, err = copyBuffered(tw, object)
+
+	return err
+}
+
+// loadAccessedGoproxyCaches returns the names of the Goproxy zip caches
+// accessed since the since according to the access records of the garbage
+// collection.
+func loadAccessedGoproxyCaches(
+	ctx context.Context,
+	since time.Time,
+) (map[string]struct{}, error) {
+	accessed := map[string]struct{}{}
+	for objectInfo := range qiniuKodoClient.ListObjects(
+		ctx,
+		qiniuKodoBucketName,
+		minio.ListObjectsOptions{
+			Prefix:    "gc/accesses/",
+			Recursive: true,
+		},
+	) {
+		if objectInfo.Err != nil {
+			return nil, objectInfo.Err
+		}
+
+		date, _, _ := strings.Cut(
+			strings.TrimPrefix(objectInfo.Key, "gc/accesses/"),
+			"/",
+		)
+
+		t, err := time.Parse("2006-01-02", date)
+		if err != nil || t.Before(since) {
+			continue
+		}
+
+		if err := retryQiniuKodoDo(ctx, func(ctx context.Context) error {
+			object, err := qiniuKodoClient.GetObject(
+				ctx,
+				qiniuKodoBucketName,
+				objectInfo.Key,
+				qiniuKodoGetObjectOptions(),
+			)
+			if err != nil {
+				return err
+			}
+			defer object.Close()
+
+			s := bufio.NewScanner(object)
+			for s.Scan() {
+				if name := s.Text(); name != "" {
+					accessed[name] = struct{}{}
+				}
+			}
+
+			return s.Err()
+		}); err != nil && !isNotFoundMinIOError(err) {
+			return nil, err
+		}
+	}
+
+	return accessed, nil
+}
+
+// hAdminImportSnapshot handles requests to import a gzipped tarball exported by
+// the `hAdminExportSnapshot`. The existing Goproxy caches are kept as is.
+//
+// The imported Goproxy caches are trusted as is, so only snapshots from trusted
+// deployments should be imported.
+func hAdminImportSnapshot(req *air.Request, res *air.Response) error {
+	gr, err := gzip.NewReader(req.Body)
+	if err != nil {
+		res.Status = http.StatusBadRequest
+		return errors.New("invalid snapshot")
+	}
+	defer gr.Close()
+
+	var imported, skipped int
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			res.Status = http.StatusBadRequest
+			return errors.New("invalid snapshot")
+		}
+
+		name := strings.TrimPrefix(path.Clean(header.Name), "/")
+		if header.Typeflag != tar.TypeReg ||
+			!validGoproxyCacheName(name) ||
+			isGoproxyCacheBlocked(name) ||
+			!isGoproxyCacheAllowed(name) ||
+			!isGoproxyCacheMissing(req.Context, name) {
+			skipped++
+			continue
+		}
+
+		if err := importSnapshotEntry(req.Context, name, tr); err != nil {
+			return err
+		}
+
+		imported++
+	}
+
+	base.Logger.Info().
+		Int("imported", imported).
+		Int("skipped", skipped).
+		Str("client_address", req.ClientAddress()).
+		Msg("imported goproxy cache snapshot")
+
+	return res.WriteJSON(map[string]int{
+		"imported": imported,
+		"skipped":  skipped,
+	})
+}
+
+// importSnapshotEntry uploads the content of the Goproxy cache with the name
+// read from the r.
+func importSnapshotEntry(ctx context.Context, name string, r io.Reader) error {
+	file, err := os.CreateTemp(goproxyTempDir, "snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := copyBuffered(file, r); err != nil {
+		return err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := scanGoproxyCache(ctx, name, file); err != nil {
+		return err
+	}
+
+	return uploadGoproxyCache(ctx, name, file)
+}
@@ -0,0 +1,279 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+)
+
+var (
+	// softPurges is the soft-purged Goproxy caches keyed by their object
+	// names. It is loaded from the marks in the Qiniu Cloud Kodo (see the
+	// `softPurgeMarkPrefix`), so that it is shared by all the instances and
+	// survives restarts.
+	softPurges = map[string]*softPurge{}
+
+	// softPurgesMutex is used to protect the `softPurges`.
+	softPurgesMutex sync.Mutex
+
+	// softPurgeRefetches is the number of the background refetches of the
+	// soft-purged Goproxy caches.
+	softPurgeRefetches = expvar.NewInt("soft_purge_refetches")
+)
+
+// softPurge is a soft-purged Goproxy cache.
+type softPurge struct {
+	Name     string    `json:"name"`
+	Tenant   string    `json:"tenant,omitempty"`
+	PurgedAt time.Time `json:"purged_at"`
+
+	refetching bool
+}
+
+// softPurgeMarkPrefix is the prefix of the objects that mark the Goproxy caches
+// soft-purged in the Qiniu Cloud Kodo. Each of them is named by the
+// softPurgeMarkPrefix followed by the object name of the Goproxy cache it
+// marks.
+const softPurgeMarkPrefix = "softpurges/"
+
+func init() {
+	if err := loadSoftPurges(base.Context); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to load soft purges")
+	}
+
+	if _, err := base.Cron.AddFunc(
+		"* * * * *", // Every minute
+		func() {
+			if err := loadSoftPurges(base.Context); err != nil {
+				base.Logger.Error().Err(err).
+					Msg("failed to load soft purges")
+			}
+		},
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add soft purge load cron job")
+	}
+}
+
+// loadSoftPurges loads the `softPurges` from the marks in the Qiniu Cloud Kodo.
+// The soft-purged Goproxy caches whose marks are gone have been refetched by
+// other instances, and those being refetched by the current instance are left
+// to it.
+func loadSoftPurges(ctx context.Context) error {
+	objectNames := map[string]bool{}
+	for objectInfo := range qiniuKodoClient.ListObjects(
+		ctx,
+		qiniuKodoBucketName,
+		minio.ListObjectsOptions{
+			Prefix:    softPurgeMarkPrefix,
+			Recursive: true,
+		},
+	) {
+		if objectInfo.Err != nil {
+			return objectInfo.Err
+		}
+
+		objectNames[strings.TrimPrefix(
+			objectInfo.Key,
+			softPurgeMarkPrefix,
+		)] = true
+	}
+
+	softPurgesMutex.Lock()
+	for objectName, sp := range softPurges {
+		if !objectNames[objectName] && !sp.refetching {
+			delete(softPurges, objectName)
+		}
+	}
+
+	var newObjectNames []string
+	for objectName := range objectNames {
+		if _, ok := softPurges[objectName]; !ok {
+			newObjectNames = append(newObjectNames, objectName)
+		}
+	}
+
+	softPurgesMutex.Unlock()
+
+	for _, objectName := range newObjectNames {
+		sp := &softPurge{}
+		if err := getStatObject(
+			ctx,
+			softPurgeMarkPrefix+objectName,
+			sp,
+		); err != nil {
+			if isNotFoundMinIOError(err) {
+				continue
+			}
+
+			return err
+		}
+
+		purgeNegativeCacheEntries(sp.Name)
+		invalidateRedirectCache(objectName)
+		invalidateStatCache(objectName)
+
+		softPurgesMutex.Lock()
+		if _, ok := softPurges[objectName]; !ok {
+			softPurges[objectName] = sp
+		}
+
+		softPurgesMutex.Unlock()
+	}
+
+	return nil
+}
+
+// goproxyCacheRefetchKey is the key of the refetch mark in the context of a
+// request.
+type goproxyCacheRefetchKey struct{}
+
+// withGoproxyCacheRefetch returns a copy of the ctx with which the Goproxy
+// caches are fetched from the upstreams even if they have been cached, and
+// overwrite the cached ones.
+func withGoproxyCacheRefetch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, goproxyCacheRefetchKey{}, true)
+}
+
+// isGoproxyCacheRefetch reports whether the ctx is a copy returned by the
+// `withGoproxyCacheRefetch`.
+func isGoproxyCacheRefetch(ctx context.Context) bool {
+	refetch, _ := ctx.Value(goproxyCacheRefetchKey{}).(bool)
+	return refetch
+}
+
+// softPurgeGoproxyCache marks the Goproxy cache with the name stale instead of
+// removing it, so that it keeps being served while the next request for it
+// refetches it in the background. Only the namespace of the tenant carried by
+// the ctx is soft-purged. The mark is stored in the Qiniu Cloud Kodo, and
+// reaches the other instances within a minute (see the `loadSoftPurges`).
+//
+// The mutable Goproxy caches are fetched from the upstreams by every request
+// anyway, so only their entries in the `mutableCache` are marked stale.
+func softPurgeGoproxyCache(ctx context.Context, name string) error {
+	purgeNegativeCacheEntries(name)
+
+	objectName := goproxyCacheObjectName(ctx, name)
+	invalidateRedirectCache(objectName)
+	invalidateStatCache(objectName)
+
+	if validGoproxyMutableCacheName(name) {
+		markMutableCacheStale(objectName)
+		return nil
+	}
+
+	sp := &softPurge{
+		Name:     name,
+		Tenant:   tenantOf(ctx),
+		PurgedAt: time.Now(),
+	}
+	if err := putStatObject(
+		ctx,
+		softPurgeMarkPrefix+objectName,
+		sp,
+	); err != nil {
+		return err
+	}
+
+	softPurgesMutex.Lock()
+	softPurges[objectName] = sp
+	softPurgesMutex.Unlock()
+
+	return nil
+}
+
+// refetchSoftPurgedGoproxyCache starts refetching the Goproxy cache with the
+// name in the background if it has been soft-purged and is not being
+// refetched yet. Nothing is refetched in the cache-only mode or the maintenance
+// mode, in which case the Goproxy cache stays soft-purged.
+func refetchSoftPurgedGoproxyCache(ctx context.Context, name string) {
+	if goproxyCacheOnly.Load() || maintenanceMode.Load() {
+		return
+	}
+
+	objectName := goproxyCacheObjectName(ctx, name)
+
+	softPurgesMutex.Lock()
+	defer softPurgesMutex.Unlock()
+
+	sp, ok := softPurges[objectName]
+	if !ok || sp.refetching {
+		return
+	}
+
+	sp.refetching = true
+	go refetchGoproxyCache(objectName, sp)
+}
+
+// refetchGoproxyCache refetches the soft-purged Goproxy cache sp with the
+// objectName, and removes it and its mark from the `softPurges` and the Qiniu
+// Cloud Kodo once it has been overwritten. It is kept there to be refetched by
+// a later request if that fails.
+func refetchGoproxyCache(objectName string, sp *softPurge) {
+	softPurgeRefetches.Add(1)
+
+	ctx, cancel := withGoproxyFetchTimeout(
+		withGoproxyCacheRefetch(withTenant(base.Context, sp.Tenant)),
+		goproxyCacheNameType(sp.Name),
+	)
+	defer cancel()
+
+	err := serveGoproxyInternally(
+		ctx,
+		&internalResponseWriter{discard: true},
+		sp.Name,
+	)
+	if err == nil {
+		softPurgesMutex.Lock()
+		current := softPurges[objectName] == sp
+		softPurgesMutex.Unlock()
+
+		// The mark of a later soft purge is kept.
+		if current {
+			err = retryQiniuKodoDo(ctx, func(
+				ctx context.Context,
+			) error {
+				return qiniuKodoClient.RemoveObject(
+					ctx,
+					qiniuKodoBucketName,
+					softPurgeMarkPrefix+objectName,
+					minio.RemoveObjectOptions{},
+				)
+			})
+			if isNotFoundMinIOError(err) {
+				err = nil
+			}
+		}
+	}
+
+	softPurgesMutex.Lock()
+	defer softPurgesMutex.Unlock()
+
+	if err != nil {
+		base.Logger.Warn().Err(err).
+			Str("name", sp.Name).
+			Str("tenant", sp.Tenant).
+			Msg("failed to refetch soft-purged goproxy cache")
+		sp.refetching = false
+		return
+	}
+
+	if softPurges[objectName] == sp {
+		delete(softPurges, objectName)
+	}
+
+	invalidateRedirectCache(objectName)
+	invalidateStatCache(objectName)
+
+	base.Logger.Info().
+		Str("name", sp.Name).
+		Str("tenant", sp.Tenant).
+		Dur("stale_duration", time.Since(sp.PurgedAt)).
+		Msg("refetched soft-purged goproxy cache")
+}
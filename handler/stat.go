@@ -4,24 +4,32 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aofei/air"
 	"github.com/goproxy/goproxy.cn/base"
 	"github.com/minio/minio-go/v7"
 	"golang.org/x/mod/module"
+	"golang.org/x/sync/singleflight"
 )
 
 // moduleVersionStat is the module version statastic.
 type moduleVersionStat struct {
-	DownloadCount int `json:"download_count"`
-	Last30Days    []struct {
+	DownloadCount        int `json:"download_count"`
+	DailyDownloadCount   int `json:"daily_download_count"`
+	WeeklyDownloadCount  int `json:"weekly_download_count"`
+	MonthlyDownloadCount int `json:"monthly_download_count"`
+	Last30Days           []struct {
 		Date          time.Time `json:"date"`
 		DownloadCount int       `json:"download_count"`
 	} `json:"last_30_days"`
@@ -29,6 +37,11 @@ type moduleVersionStat struct {
 		ModuleVersion string `json:"module_version"`
 		DownloadCount int    `json:"download_count"`
 	} `json:"top_10_module_versions,omitempty"`
+
+	// AggregatedDate is the date of the last daily aggregate added to the
+	// mvs, so that no daily aggregate is added twice when the aggregation
+	// is retried.
+	AggregatedDate time.Time `json:"aggregated_date"`
 }
 
 // updateLast30Days updates `mvs.Last30Days` to the date.
@@ -49,8 +62,78 @@ func (mvs *moduleVersionStat) updateLast30Days(date time.Time) {
 	}
 
 	mvs.Last30Days = last30Days
+	mvs.updatePeriodicDownloadCounts()
+}
+
+// updatePeriodicDownloadCounts updates the daily, weekly and monthly download
+// counts of the mvs based on the `mvs.Last30Days`.
+func (mvs *moduleVersionStat) updatePeriodicDownloadCounts() {
+	mvs.DailyDownloadCount = 0
+	mvs.WeeklyDownloadCount = 0
+	mvs.MonthlyDownloadCount = 0
+	for i, d := range mvs.Last30Days {
+		if i == 0 {
+			mvs.DailyDownloadCount += d.DownloadCount
+		}
+
+		if i < 7 {
+			mvs.WeeklyDownloadCount += d.DownloadCount
+		}
+
+		mvs.MonthlyDownloadCount += d.DownloadCount
+	}
+}
+
+// addDownloadCount adds the downloadCount of the date to the mvs. It reports
+// false if the downloadCount of the date or a later one has already been
+// added.
+func (mvs *moduleVersionStat) addDownloadCount(
+	date time.Time,
+	downloadCount int,
+) bool {
+	if !date.After(mvs.AggregatedDate) {
+		return false
+	}
+
+	mvs.AggregatedDate = date
+	mvs.updateLast30Days(date)
+	mvs.DownloadCount += downloadCount
+	mvs.Last30Days[0].DownloadCount += downloadCount
+	mvs.updatePeriodicDownloadCounts()
+
+	return true
+}
+
+// moduleGrowthTrend is the download growth trend of a module.
+type moduleGrowthTrend struct {
+	ModulePath            string `json:"module_path"`
+	DownloadCount         int    `json:"download_count"`
+	PreviousDownloadCount int    `json:"previous_download_count"`
+	Growth                int    `json:"growth"`
 }
 
+var (
+	// moduleGrowthTrends is the cached module growth trends keyed by the
+	// window in days.
+	moduleGrowthTrends = map[int][]*moduleGrowthTrend{}
+
+	// moduleGrowthTrendsExpiries is the expiries of the
+	// `moduleGrowthTrends`.
+	moduleGrowthTrendsExpiries = map[int]time.Time{}
+
+	// moduleGrowthTrendsMutex is used to protect the `moduleGrowthTrends`
+	// and the `moduleGrowthTrendsExpiries`.
+	moduleGrowthTrendsMutex sync.Mutex
+
+	// moduleGrowthTrendsGroup is used to merge the concurrent computations
+	// of the `moduleGrowthTrends` of the same window.
+	moduleGrowthTrendsGroup singleflight.Group
+)
+
+// moduleGrowthTrendsTimeout is the maximum duration allowed to compute the
+// module growth trends of a window.
+const moduleGrowthTrendsTimeout = time.Minute
+
 func init() {
 	base.Air.BATCH(
 		getHeadMethods,
@@ -59,14 +142,36 @@ func init() {
 		minutelyCachemanGas,
 	)
 
+	base.Air.BATCH(
+		getHeadMethods,
+		"/stats/trends",
+		hStatGrowthTrends,
+		authGas("proxy"),
+		hourlyCachemanGas,
+	)
+
 	base.Air.BATCH(
 		getHeadMethods,
 		"/stats/trends/:Trend",
 		hStatTrend,
+		authGas("proxy"),
 		hourlyCachemanGas,
 	)
 
-	base.Air.BATCH(getHeadMethods, "/stats/*", hStat, hourlyCachemanGas)
+	base.Air.BATCH(
+		getHeadMethods,
+		"/stats/regions/:Trend",
+		hStatRegions,
+		hourlyCachemanGas,
+	)
+
+	base.Air.BATCH(
+		getHeadMethods,
+		"/stats/*",
+		hStat,
+		authGas("proxy"),
+		hourlyCachemanGas,
+	)
 
 	base.Air.BATCH(getHeadMethods, "/stats", hStatsPage)
 }
@@ -85,7 +190,7 @@ func hStatSummary(req *air.Request, res *air.Response) error {
 			ctx,
 			qiniuKodoBucketName,
 			"stats/summary",
-			minio.GetObjectOptions{},
+			qiniuKodoGetObjectOptions(),
 		)
 		if err != nil {
 			return err
@@ -125,6 +230,23 @@ func hStatTrend(req *air.Request, res *air.Response) error {
 		return NotFound(req, res)
 	}
 
+	return serveStatObject(req, res, fmt.Sprint("stats/trends/", trend))
+}
+
+// hStatRegions handles requests to query the download counts by client region.
+func hStatRegions(req *air.Request, res *air.Response) error {
+	trend := req.ParamValue("Trend").String()
+	switch trend {
+	case "latest", "last-7-days", "last-30-days":
+	default:
+		return NotFound(req, res)
+	}
+
+	return serveStatObject(req, res, fmt.Sprint("stats/regions/", trend))
+}
+
+// serveStatObject serves the statistic object with the name.
+func serveStatObject(req *air.Request, res *air.Response, name string) error {
 	var (
 		object     *minio.Object
 		objectInfo minio.ObjectInfo
@@ -136,8 +258,8 @@ func hStatTrend(req *air.Request, res *air.Response) error {
 		object, err = qiniuKodoClient.GetObject(
 			ctx,
 			qiniuKodoBucketName,
-			fmt.Sprint("stats/trends/", trend),
-			minio.GetObjectOptions{},
+			name,
+			qiniuKodoGetObjectOptions(),
 		)
 		if err != nil {
 			return err
@@ -168,6 +290,167 @@ func hStatTrend(req *air.Request, res *air.Response) error {
 	return res.Write(object)
 }
 
+// hStatGrowthTrends handles requests to query the top modules by download
+// growth.
+func hStatGrowthTrends(req *air.Request, res *air.Response) error {
+	window, limit := 7, 100
+	if p := req.Param("window"); p != nil {
+		var err error
+		if window, err = p.Value().Int(); err != nil ||
+			window < 1 ||
+			window > 15 {
+			res.Status = http.StatusBadRequest
+			return errors.New("invalid window")
+		}
+	}
+
+	if p := req.Param("limit"); p != nil {
+		var err error
+		if limit, err = p.Value().Int(); err != nil ||
+			limit < 1 ||
+			limit > 1000 {
+			res.Status = http.StatusBadRequest
+			return errors.New("invalid limit")
+		}
+	}
+
+	trends, err := getModuleGrowthTrends(req.Context, window)
+	if err != nil {
+		return err
+	}
+
+	if len(trends) > limit {
+		trends = trends[:limit]
+	}
+
+	return res.WriteJSON(trends)
+}
+
+// getModuleGrowthTrends returns the module growth trends by comparing the
+// download counts of the most recent window days with the window days before
+// them. The concurrent computations of the same window are merged into one,
+// which is not canceled with the ctx, so that a canceled request cannot fail
+// the others waiting for it.
+func getModuleGrowthTrends(
+	ctx context.Context,
+	window int,
+) ([]*moduleGrowthTrend, error) {
+	moduleGrowthTrendsMutex.Lock()
+	if time.Now().Before(moduleGrowthTrendsExpiries[window]) {
+		trends := moduleGrowthTrends[window]
+		moduleGrowthTrendsMutex.Unlock()
+		return trends, nil
+	}
+	moduleGrowthTrendsMutex.Unlock()
+
+	ch := moduleGrowthTrendsGroup.DoChan(
+		strconv.Itoa(window),
+		func() (any, error) {
+			ctx, cancel := context.WithTimeout(
+				base.Context,
+				moduleGrowthTrendsTimeout,
+			)
+			defer cancel()
+
+			trends, err := computeModuleGrowthTrends(ctx, window)
+			if err != nil {
+				return nil, err
+			}
+
+			moduleGrowthTrendsMutex.Lock()
+			moduleGrowthTrends[window] = trends
+			moduleGrowthTrendsExpiries[window] = time.Now().Add(
+				time.Hour,
+			)
+			moduleGrowthTrendsMutex.Unlock()
+
+			return trends, nil
+		},
+	)
+
+	select {
+	case r := <-ch:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+
+		return r.Val.([]*moduleGrowthTrend), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// computeModuleGrowthTrends computes the module growth trends of the window
+// (see the `getModuleGrowthTrends`).
+func computeModuleGrowthTrends(
+	ctx context.Context,
+	window int,
+) ([]*moduleGrowthTrend, error) {
+	date := time.Now().UTC()
+	date = time.Date(
+		date.Year(),
+		date.Month(),
+		date.Day()-1,
+		0,
+		0,
+		0,
+		0,
+		time.UTC,
+	)
+
+	trendMap := map[string]*moduleGrowthTrend{}
+	for i := 0; i < 2*window; i++ {
+		var da statDailyAggregate
+		if err := getStatObject(
+			ctx,
+			path.Join(
+				"stats",
+				"daily",
+				date.AddDate(0, 0, -i).Format("2006-01-02"),
+			),
+			&da,
+		); err != nil && !isNotFoundMinIOError(err) {
+			return nil, err
+		}
+
+		for modulePath, ma := range da.Modules {
+			trend := trendMap[modulePath]
+			if trend == nil {
+				trend = &moduleGrowthTrend{
+					ModulePath: modulePath,
+				}
+				trendMap[modulePath] = trend
+			}
+
+			if i < window {
+				trend.DownloadCount += ma.DownloadCount
+			} else {
+				trend.PreviousDownloadCount += ma.DownloadCount
+			}
+		}
+	}
+
+	trends := make([]*moduleGrowthTrend, 0, len(trendMap))
+	for _, trend := range trendMap {
+		trend.Growth = trend.DownloadCount - trend.PreviousDownloadCount
+		trends = append(trends, trend)
+	}
+
+	sort.Slice(trends, func(i, j int) bool {
+		if trends[i].Growth != trends[j].Growth {
+			return trends[i].Growth > trends[j].Growth
+		}
+
+		return trends[i].ModulePath < trends[j].ModulePath
+	})
+
+	if len(trends) > 1000 {
+		trends = trends[:1000]
+	}
+
+	return trends, nil
+}
+
 // hStat handles requests to query stat.
 func hStat(req *air.Request, res *air.Response) error {
 	const downloadCountBadgeSuffix = "/badges/download-count.svg"
@@ -198,6 +481,21 @@ func hStat(req *air.Request, res *air.Response) error {
 		)) != nil {
 			return CacheableNotFound(req, res, 86400)
 		}
+	} else if path, version, found := strings.Cut(
+		name,
+		"/@v/",
+	); found {
+		path, err := module.UnescapePath(path)
+		if err != nil {
+			return CacheableNotFound(req, res, 86400)
+		}
+
+		version, err := module.UnescapeVersion(version)
+		if err != nil || module.Check(path, version) != nil {
+			return CacheableNotFound(req, res, 86400)
+		}
+
+		name = fmt.Sprint(path, "@", version)
 	} else if path, version, found := strings.Cut(name, "@"); found {
 		if module.Check(path, version) != nil {
 			return CacheableNotFound(req, res, 86400)
@@ -230,7 +528,7 @@ func hStat(req *air.Request, res *air.Response) error {
 			ctx,
 			qiniuKodoBucketName,
 			path.Join("stats", name),
-			minio.GetObjectOptions{},
+			qiniuKodoGetObjectOptions(),
 		)
 		if err != nil {
 			return err
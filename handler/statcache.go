@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+var (
+	// statCacheTTL is how long the object infos of the Goproxy caches got
+	// from the Qiniu Cloud Kodo are cached. Nothing is cached when it is
+	// not positive.
+	statCacheTTL = goproxyViper.GetDuration("stat_cache_ttl")
+
+	// statCacheNegativeTTL is how long the absences of the Goproxy caches
+	// from the Qiniu Cloud Kodo are cached. It should be short, since the
+	// other instances may upload them at any time. Absences are not cached
+	// when it is not positive.
+	statCacheNegativeTTL = goproxyViper.GetDuration(
+		"stat_cache_negative_ttl",
+	)
+
+	// statCacheMaxEntries is the maximum number of the entries of the
+	// `statCache`.
+	statCacheMaxEntries = goproxyViper.GetInt("stat_cache_max_entries")
+
+	// statCache is the cached object infos of the Goproxy caches keyed by
+	// their object names. The absent ones have nil object infos.
+	statCache = map[string]*statCacheEntry{}
+
+	// statCacheMutex is used to protect the `statCache`.
+	statCacheMutex sync.Mutex
+
+	// statCacheHits is the number of the Qiniu Cloud Kodo calls saved by
+	// the `statCache`.
+	statCacheHits = expvar.NewInt("stat_cache_hits")
+
+	// statCacheMisses is the number of the Qiniu Cloud Kodo calls made
+	// since the `statCache` could not answer them.
+	statCacheMisses = expvar.NewInt("stat_cache_misses")
+)
+
+// statCacheEntry is an entry of the `statCache`.
+type statCacheEntry struct {
+	objectInfo *minio.ObjectInfo
+	expiresAt  time.Time
+}
+
+// statGoproxyCacheObject returns the object info of the Goproxy cache with the
+// objectName from the Qiniu Cloud Kodo, or from the `statCache` if it is there.
+// The error is a not found one (see the `isNotFoundMinIOError`) if the Goproxy
+// cache is absent.
+func statGoproxyCacheObject(
+	ctx context.Context,
+	objectName string,
+) (minio.ObjectInfo, error) {
+	statCacheMutex.Lock()
+	sce, ok := statCache[objectName]
+	statCacheMutex.Unlock()
+	if ok && time.Now().Before(sce.expiresAt) {
+		statCacheHits.Add(1)
+		if sce.objectInfo == nil {
+			return minio.ObjectInfo{}, minio.ErrorResponse{
+				StatusCode: http.StatusNotFound,
+				Code:       "NoSuchKey",
+				Message:    "The specified key does not exist.",
+				BucketName: qiniuKodoBucketName,
+				Key:        objectName,
+			}
+		}
+
+		return *sce.objectInfo, nil
+	}
+
+	statCacheMisses.Add(1)
+
+	var objectInfo minio.ObjectInfo
+	err := retryQiniuKodoDo(ctx, func(ctx context.Context) (err error) {
+		objectInfo, err = qiniuKodoClient.StatObject(
+			ctx,
+			qiniuKodoBucketName,
+			objectName,
+			qiniuKodoGetObjectOptions(),
+		)
+		return err
+	})
+	switch {
+	case err == nil:
+		storeStatCache(objectName, &objectInfo, statCacheTTL)
+	case isNotFoundMinIOError(err):
+		storeStatCache(objectName, nil, statCacheNegativeTTL)
+	}
+
+	return objectInfo, err
+}
+
+// storeStatCache stores the objectInfo of the Goproxy cache with the
+// objectName in the `statCache` for the ttl. When the `statCache` is full, the
+// expired entries are removed, or arbitrary ones if none has expired.
+func storeStatCache(
+	objectName string,
+	objectInfo *minio.ObjectInfo,
+	ttl time.Duration,
+) {
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	statCacheMutex.Lock()
+	defer statCacheMutex.Unlock()
+
+	if len(statCache) >= statCacheMaxEntries {
+		for k, v := range statCache {
+			if !now.Before(v.expiresAt) {
+				delete(statCache, k)
+			}
+		}
+
+		for k := range statCache {
+			if len(statCache) < statCacheMaxEntries {
+				break
+			}
+
+			delete(statCache, k)
+		}
+	}
+
+	statCache[objectName] = &statCacheEntry{
+		objectInfo: objectInfo,
+		expiresAt:  now.Add(ttl),
+	}
+}
+
+// invalidateStatCache removes the entry of the Goproxy cache with the
+// objectName from the `statCache` of the current instance.
+func invalidateStatCache(objectName string) {
+	statCacheMutex.Lock()
+	defer statCacheMutex.Unlock()
+
+	delete(statCache, objectName)
+}
@@ -0,0 +1,755 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/mod/module"
+)
+
+var (
+	// statsViper is used to get the configuration items of the statistics.
+	statsViper = base.Viper.Sub("stats")
+
+	// statPipelineEnabled indicates whether the statistics pipeline is
+	// enabled.
+	statPipelineEnabled = statsViper.GetBool("pipeline_enabled")
+
+	// statClientCountryHeader is the name of the request header that
+	// carries the client country code, usually set by the CDN.
+	statClientCountryHeader = statsViper.GetString("client_country_header")
+
+	// statAggregationSchedule is the cron schedule of the statistics
+	// aggregation.
+	statAggregationSchedule = statsViper.GetString("aggregation_schedule")
+
+	// statEventRetention is how long the raw statistic events are kept
+	// after they have been aggregated. They are kept forever when it is not
+	// positive.
+	statEventRetention = statsViper.GetDuration("event_retention")
+
+	// statEvents is the statistic events recorded since the last flush.
+	statEvents []*statEvent
+
+	// statEventsMutex is used to protect the `statEvents`.
+	statEventsMutex sync.Mutex
+)
+
+// statEventsMaxBuffered is the maximum number of statistic events that can be
+// buffered between two flushes. Events beyond it are dropped.
+const statEventsMaxBuffered = 1 << 20
+
+// statEvent is the statistic event of a successful module fetch.
+type statEvent struct {
+	ModulePath     string    `json:"module_path"`
+	ModuleVersion  string    `json:"module_version"`
+	FileType       string    `json:"file_type"`
+	Size           int64     `json:"size"`
+	ClientCountry  string    `json:"client_country,omitempty"`
+	ClientProvince string    `json:"client_province,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+// statDailyAggregate is the aggregate of the statistic events of a day.
+type statDailyAggregate struct {
+	Date      time.Time                       `json:"date"`
+	Modules   map[string]*statModuleAggregate `json:"modules"`
+	Files     map[string]*statFileAggregate   `json:"files"`
+	Countries map[string]int                  `json:"countries,omitempty"`
+	Provinces map[string]int                  `json:"provinces,omitempty"`
+}
+
+// statModuleAggregate is the aggregate of the statistic events of a module.
+type statModuleAggregate struct {
+	DownloadCount int            `json:"download_count"`
+	Versions      map[string]int `json:"versions"`
+}
+
+// statFileAggregate is the aggregate of the statistic events of a file type.
+type statFileAggregate struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// statState is the state of the statistics pipeline.
+type statState struct {
+	LastAggregatedDate time.Time `json:"last_aggregated_date"`
+}
+
+func init() {
+	if !statPipelineEnabled {
+		return
+	}
+
+	if _, err := base.Cron.AddFunc(
+		"* * * * *", // Every minute
+		flushStatEvents,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add stat event flush cron job")
+	}
+
+	base.Air.AddShutdownJob(flushStatEvents)
+
+	if _, err := base.Cron.AddJob(
+		statAggregationSchedule,
+		leaderJob("stats", 6*time.Hour, func() {
+			if err := rollUpStats(base.Context); err != nil {
+				base.Logger.Error().Err(err).
+					Msg("failed to roll up stats")
+			}
+		}),
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add stat aggregation cron job")
+	}
+}
+
+// recordStatEvent records a statistic event for the successful fetch of the
+// Goproxy cache with the name.
+func recordStatEvent(req *air.Request, name string, size int64) {
+	if req.Method != http.MethodGet || !validGoproxyCacheName(name) {
+		return
+	}
+
+	if path.Ext(name) == ".zip" {
+		addLiveCounters(0, 0, 1)
+	}
+
+	if !statPipelineEnabled && statExportQueue == nil {
+		return
+	}
+
+	escapedModulePath, nameBase, _ := strings.Cut(name, "/@v/")
+	modulePath, _ := module.UnescapePath(escapedModulePath)
+	fileType := path.Ext(nameBase)
+	moduleVersion, _ := module.UnescapeVersion(
+		strings.TrimSuffix(nameBase, fileType),
+	)
+
+	se := &statEvent{
+		ModulePath:    modulePath,
+		ModuleVersion: moduleVersion,
+		FileType:      fileType,
+		Size:          size,
+		Time:          time.Now().UTC(),
+	}
+
+	// The country set by the CDN takes precedence over the one resolved
+	// from the client IP address, since the latter may be the address of
+	// a proxy.
+	se.ClientCountry, se.ClientProvince = lookupGeoIP(req.ClientHost())
+	if statClientCountryHeader != "" {
+		country := strings.ToUpper(
+			req.Header.Get(statClientCountryHeader),
+		)
+		if country != "" && country != se.ClientCountry {
+			se.ClientCountry, se.ClientProvince = country, ""
+		}
+	}
+
+	queueStatExport(se)
+
+	if !statPipelineEnabled {
+		return
+	}
+
+	statEventsMutex.Lock()
+	if len(statEvents) < statEventsMaxBuffered {
+		statEvents = append(statEvents, se)
+	}
+	statEventsMutex.Unlock()
+}
+
+// flushStatEvents flushes the `statEvents` to the Qiniu Cloud Kodo.
+func flushStatEvents() {
+	statEventsMutex.Lock()
+	events := statEvents
+	statEvents = nil
+	statEventsMutex.Unlock()
+
+	if len(events) == 0 {
+		return
+	}
+
+	buffers := map[string]*bytes.Buffer{}
+	for _, se := range events {
+		date := se.Time.Format("2006-01-02")
+		if buffers[date] == nil {
+			buffers[date] = &bytes.Buffer{}
+		}
+
+		b, err := json.Marshal(se)
+		if err != nil {
+			continue
+		}
+
+		buffers[date].Write(b)
+		buffers[date].WriteByte('\n')
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	now := time.Now().UTC()
+	for date, buf := range buffers {
+		name := path.Join(
+			"stats",
+			"events",
+			date,
+			leaderID+"-"+now.Format("150405"),
+		)
+		if err := qiniuKodoUpload(
+			ctx,
+			name,
+			bytes.NewReader(buf.Bytes()),
+		); err != nil {
+			base.Logger.Error().Err(err).
+				Str("date", date).
+				Msg("failed to flush stat events")
+		}
+	}
+}
+
+// statRollUpMaxCatchUpDays is the maximum number of the past days whose
+// statistic events are aggregated by a rollup when previous rollups were
+// missed.
+const statRollUpMaxCatchUpDays = 30
+
+// rollUpStats aggregates the statistic events of the days since the last
+// aggregated date up to yesterday, and then prunes the raw statistic events
+// beyond the `statEventRetention`.
+func rollUpStats(ctx context.Context) error {
+	now := time.Now().UTC()
+	yesterday := time.Date(
+		now.Year(),
+		now.Month(),
+		now.Day()-1,
+		0,
+		0,
+		0,
+		0,
+		time.UTC,
+	)
+
+	var state statState
+	if err := getStatObject(ctx, "stats/state", &state); err != nil &&
+		!isNotFoundMinIOError(err) {
+		return err
+	}
+
+	date := yesterday
+	if !state.LastAggregatedDate.IsZero() {
+		date = state.LastAggregatedDate.AddDate(0, 0, 1)
+		if earliest := yesterday.AddDate(
+			0,
+			0,
+			1-statRollUpMaxCatchUpDays,
+		); date.Before(earliest) {
+			date = earliest
+		}
+	}
+
+	for ; !date.After(yesterday); date = date.AddDate(0, 0, 1) {
+		if err := aggregateStats(ctx, date); err != nil {
+			return err
+		}
+	}
+
+	if statEventRetention <= 0 {
+		return nil
+	}
+
+	return pruneStatEvents(ctx, now.Add(-statEventRetention), yesterday)
+}
+
+// pruneStatEvents removes the raw statistic events of the days before the
+// before and not after the lastAggregatedDate.
+func pruneStatEvents(
+	ctx context.Context,
+	before time.Time,
+	lastAggregatedDate time.Time,
+) error {
+	var pruned int
+	for prefixInfo := range qiniuKodoClient.ListObjects(
+		ctx,
+		qiniuKodoBucketName,
+		minio.ListObjectsOptions{
+			Prefix: "stats/events/",
+		},
+	) {
+		if prefixInfo.Err != nil {
+			return prefixInfo.Err
+		}
+
+		date, err := time.Parse("2006-01-02", strings.TrimSuffix(
+			strings.TrimPrefix(prefixInfo.Key, "stats/events/"),
+			"/",
+		))
+		if err != nil ||
+			!date.AddDate(0, 0, 1).Before(before) ||
+			date.After(lastAggregatedDate) {
+			continue
+		}
+
+		for objectInfo := range qiniuKodoClient.ListObjects(
+			ctx,
+			qiniuKodoBucketName,
+			minio.ListObjectsOptions{
+				Prefix:    prefixInfo.Key,
+				Recursive: true,
+			},
+		) {
+			if objectInfo.Err != nil {
+				return objectInfo.Err
+			}
+
+			if err := retryQiniuKodoDo(ctx, func(
+				ctx context.Context,
+			) error {
+				return qiniuKodoClient.RemoveObject(
+					ctx,
+					qiniuKodoBucketName,
+					objectInfo.Key,
+					minio.RemoveObjectOptions{},
+				)
+			}); err != nil && !isNotFoundMinIOError(err) {
+				return err
+			}
+
+			pruned++
+		}
+	}
+
+	if pruned > 0 {
+		base.Logger.Info().
+			Int("pruned", pruned).
+			Msg("pruned stat events")
+	}
+
+	return nil
+}
+
+// aggregateStats aggregates the statistic events of the date into the daily
+// aggregate, the module (version) statistics and the trends.
+func aggregateStats(ctx context.Context, date time.Time) error {
+	date = time.Date(
+		date.Year(),
+		date.Month(),
+		date.Day(),
+		0,
+		0,
+		0,
+		0,
+		time.UTC,
+	)
+
+	var state statState
+	if err := getStatObject(ctx, "stats/state", &state); err != nil &&
+		!isNotFoundMinIOError(err) {
+		return err
+	} else if !date.After(state.LastAggregatedDate) {
+		return nil
+	}
+
+	da, err := aggregateStatEvents(ctx, date)
+	if err != nil {
+		return err
+	}
+
+	if err := putStatObject(
+		ctx,
+		path.Join("stats", "daily", date.Format("2006-01-02")),
+		da,
+	); err != nil {
+		return err
+	}
+
+	if err := updateModuleStats(ctx, da); err != nil {
+		return err
+	}
+
+	if err := updateStatTrends(ctx, date); err != nil {
+		return err
+	}
+
+	state.LastAggregatedDate = date
+
+	return putStatObject(ctx, "stats/state", state)
+}
+
+// aggregateStatEvents aggregates the statistic events of the date.
+func aggregateStatEvents(
+	ctx context.Context,
+	date time.Time,
+) (*statDailyAggregate, error) {
+	da := &statDailyAggregate{
+		Date:      date,
+		Modules:   map[string]*statModuleAggregate{},
+		Files:     map[string]*statFileAggregate{},
+		Countries: map[string]int{},
+		Provinces: map[string]int{},
+	}
+
+	for objectInfo := range qiniuKodoClient.ListObjects(
+		ctx,
+		qiniuKodoBucketName,
+		minio.ListObjectsOptions{
+			Prefix: path.Join(
+				"stats",
+				"events",
+				date.Format("2006-01-02"),
+			) + "/",
+			Recursive: true,
+		},
+	) {
+		if objectInfo.Err != nil {
+			return nil, objectInfo.Err
+		}
+
+		var b []byte
+		if err := retryQiniuKodoDo(ctx, func(
+			ctx context.Context,
+		) error {
+			object, err := qiniuKodoClient.GetObject(
+				ctx,
+				qiniuKodoBucketName,
+				objectInfo.Key,
+				qiniuKodoGetObjectOptions(),
+			)
+			if err != nil {
+				return err
+			}
+			defer object.Close()
+
+			b, err = io.ReadAll(object)
+
+			return err
+		}); err != nil {
+			return nil, err
+		}
+
+		s := bufio.NewScanner(bytes.NewReader(b))
+		s.Buffer(nil, 1<<20)
+		for s.Scan() {
+			var se statEvent
+			if json.Unmarshal(s.Bytes(), &se) != nil {
+				continue
+			}
+
+			da.add(&se)
+		}
+	}
+
+	return da, nil
+}
+
+// add adds the se to the da.
+func (da *statDailyAggregate) add(se *statEvent) {
+	fa := da.Files[se.FileType]
+	if fa == nil {
+		fa = &statFileAggregate{}
+		da.Files[se.FileType] = fa
+	}
+
+	fa.Count++
+	fa.Bytes += se.Size
+
+	if se.FileType != ".zip" {
+		return
+	}
+
+	ma := da.Modules[se.ModulePath]
+	if ma == nil {
+		ma = &statModuleAggregate{
+			Versions: map[string]int{},
+		}
+		da.Modules[se.ModulePath] = ma
+	}
+
+	ma.DownloadCount++
+	ma.Versions[se.ModuleVersion]++
+
+	if se.ClientCountry != "" {
+		da.Countries[se.ClientCountry]++
+	}
+
+	if se.ClientProvince != "" {
+		da.Provinces[se.ClientProvince]++
+	}
+}
+
+// updateModuleStats updates the module (version) statistics with the da.
+func updateModuleStats(ctx context.Context, da *statDailyAggregate) error {
+	modulePaths := make(chan string)
+	errs := make(chan error, 1)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for modulePath := range modulePaths {
+				err := updateModuleStat(
+					ctx,
+					modulePath,
+					da.Date,
+					da.Modules[modulePath],
+				)
+				if err == nil {
+					continue
+				}
+
+				select {
+				case errs <- err:
+				default:
+				}
+			}
+		}()
+	}
+
+	for modulePath := range da.Modules {
+		modulePaths <- modulePath
+	}
+
+	close(modulePaths)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+
+	return nil
+}
+
+// updateModuleStat updates the statistics of the module targeted by the
+// modulePath and its versions with the ma of the date. Each statistic records
+// the date it has been updated with, so that retrying the update after a
+// partial failure does not count the ma twice.
+func updateModuleStat(
+	ctx context.Context,
+	modulePath string,
+	date time.Time,
+	ma *statModuleAggregate,
+) error {
+	versionDownloadCounts := make(map[string]int, len(ma.Versions))
+	for moduleVersion, downloadCount := range ma.Versions {
+		var stat moduleVersionStat
+		name := path.Join("stats", modulePath+"@"+moduleVersion)
+		if err := getStatObject(ctx, name, &stat); err != nil &&
+			!isNotFoundMinIOError(err) {
+			return err
+		}
+
+		if stat.addDownloadCount(date, downloadCount) {
+			if err := putStatObject(ctx, name, stat); err != nil {
+				return err
+			}
+		}
+
+		versionDownloadCounts[moduleVersion] = stat.DownloadCount
+	}
+
+	var stat moduleVersionStat
+	name := path.Join("stats", modulePath)
+	if err := getStatObject(ctx, name, &stat); err != nil &&
+		!isNotFoundMinIOError(err) {
+		return err
+	}
+
+	if !stat.addDownloadCount(date, ma.DownloadCount) {
+		return nil
+	}
+
+	for _, mv := range stat.Top10ModuleVersions {
+		if _, ok := versionDownloadCounts[mv.ModuleVersion]; !ok {
+			versionDownloadCounts[mv.ModuleVersion] = mv.DownloadCount
+		}
+	}
+
+	stat.Top10ModuleVersions = stat.Top10ModuleVersions[:0]
+	for moduleVersion, downloadCount := range versionDownloadCounts {
+		stat.Top10ModuleVersions = append(
+			stat.Top10ModuleVersions,
+			struct {
+				ModuleVersion string `json:"module_version"`
+				DownloadCount int    `json:"download_count"`
+			}{moduleVersion, downloadCount},
+		)
+	}
+
+	sort.Slice(stat.Top10ModuleVersions, func(i, j int) bool {
+		return stat.Top10ModuleVersions[i].DownloadCount >
+			stat.Top10ModuleVersions[j].DownloadCount
+	})
+
+	if len(stat.Top10ModuleVersions) > 10 {
+		stat.Top10ModuleVersions = stat.Top10ModuleVersions[:10]
+	}
+
+	return putStatObject(ctx, name, stat)
+}
+
+// updateStatTrends updates the trends ending at the date.
+func updateStatTrends(ctx context.Context, date time.Time) error {
+	type moduleTrend struct {
+		ModulePath    string `json:"module_path"`
+		DownloadCount int    `json:"download_count"`
+	}
+
+	downloadCounts := map[string]int{}
+	countryDownloadCounts := map[string]int{}
+	provinceDownloadCounts := map[string]int{}
+	for i := 0; i < 30; i++ {
+		var da statDailyAggregate
+		if err := getStatObject(
+			ctx,
+			path.Join(
+				"stats",
+				"daily",
+				date.AddDate(0, 0, -i).Format("2006-01-02"),
+			),
+			&da,
+		); err != nil && !isNotFoundMinIOError(err) {
+			return err
+		}
+
+		for modulePath, ma := range da.Modules {
+			downloadCounts[modulePath] += ma.DownloadCount
+		}
+
+		for country, downloadCount := range da.Countries {
+			countryDownloadCounts[country] += downloadCount
+		}
+
+		for province, downloadCount := range da.Provinces {
+			provinceDownloadCounts[province] += downloadCount
+		}
+
+		var trend string
+		switch i {
+		case 0:
+			trend = "latest"
+		case 6:
+			trend = "last-7-days"
+		case 29:
+			trend = "last-30-days"
+		default:
+			continue
+		}
+
+		mts := make([]moduleTrend, 0, len(downloadCounts))
+		for modulePath, downloadCount := range downloadCounts {
+			mts = append(mts, moduleTrend{
+				ModulePath:    modulePath,
+				DownloadCount: downloadCount,
+			})
+		}
+
+		sort.Slice(mts, func(i, j int) bool {
+			return mts[i].DownloadCount > mts[j].DownloadCount
+		})
+
+		if len(mts) > 1000 {
+			mts = mts[:1000]
+		}
+
+		if err := putStatObject(
+			ctx,
+			path.Join("stats", "trends", trend),
+			mts,
+		); err != nil {
+			return err
+		}
+
+		if err := putStatObject(
+			ctx,
+			path.Join("stats", "regions", trend),
+			map[string][]statRegionDownloadCount{
+				"countries": sortedStatRegionDownloadCounts(
+					countryDownloadCounts,
+				),
+				"provinces": sortedStatRegionDownloadCounts(
+					provinceDownloadCounts,
+				),
+			},
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// statRegionDownloadCount is the download count of a region.
+type statRegionDownloadCount struct {
+	Region        string `json:"region"`
+	DownloadCount int    `json:"download_count"`
+}
+
+// sortedStatRegionDownloadCounts returns the downloadCounts keyed by the region
+// sorted by the download count in descending order.
+func sortedStatRegionDownloadCounts(
+	downloadCounts map[string]int,
+) []statRegionDownloadCount {
+	rdcs := make([]statRegionDownloadCount, 0, len(downloadCounts))
+	for region, downloadCount := range downloadCounts {
+		rdcs = append(rdcs, statRegionDownloadCount{
+			Region:        region,
+			DownloadCount: downloadCount,
+		})
+	}
+
+	sort.Slice(rdcs, func(i, j int) bool {
+		if rdcs[i].DownloadCount != rdcs[j].DownloadCount {
+			return rdcs[i].DownloadCount > rdcs[j].DownloadCount
+		}
+
+		return rdcs[i].Region < rdcs[j].Region
+	})
+
+	return rdcs
+}
+
+// getStatObject gets the statistic object with the name from the Qiniu Cloud
+// Kodo and unmarshals it into the v.
+func getStatObject(ctx context.Context, name string, v any) error {
+	return retryQiniuKodoDo(ctx, func(ctx context.Context) error {
+		object, err := qiniuKodoClient.GetObject(
+			ctx,
+			qiniuKodoBucketName,
+			name,
+			qiniuKodoGetObjectOptions(),
+		)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		return json.NewDecoder(object).Decode(v)
+	})
+}
+
+// putStatObject marshals the v and puts it as the statistic object with the
+// name to the Qiniu Cloud Kodo.
+func putStatObject(ctx context.Context, name string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return qiniuKodoUpload(ctx, name, bytes.NewReader(b))
+}
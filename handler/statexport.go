@@ -0,0 +1,348 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+)
+
+var (
+	// statExportURL is the URL of the HTTP sink that the statistic events
+	// are exported to as JSON lines, such as the HTTP interface of a
+	// ClickHouse with an "INSERT ... FORMAT JSONEachRow" query. The export
+	// is disabled when it is empty.
+	statExportURL = statsViper.GetString("export_url")
+
+	// statExportBatchSize is the maximum number of the statistic events
+	// exported in a request.
+	statExportBatchSize = statsViper.GetInt("export_batch_size")
+
+	// statExportFlushInterval is the maximum duration that a statistic
+	// event waits in a partial batch before being exported.
+	statExportFlushInterval = statsViper.GetDuration("export_flush_interval")
+
+	// statExportQueue is the queue of the statistic events waiting to be
+	// exported. It is nil when the export is disabled.
+	statExportQueue chan *statEvent
+
+	// statExportStop is closed to stop the statistic event exporter.
+	statExportStop = make(chan struct{})
+
+	// statExportDone is closed when the statistic event exporter stops.
+	statExportDone = make(chan struct{})
+
+	// statExportHTTPClient is the HTTP client used to export the statistic
+	// events.
+	statExportHTTPClient = &http.Client{
+		Timeout: time.Minute,
+	}
+
+	// statExportExported is the number of the exported statistic events.
+	statExportExported atomic.Int64
+
+	// statExportDropped is the number of the statistic events dropped
+	// because the `statExportQueue` was full.
+	statExportDropped atomic.Int64
+
+	// statExportRetries is the number of the retried export requests.
+	statExportRetries atomic.Int64
+
+	// statExportSpooled is the number of the statistic events spooled to
+	// the Qiniu Cloud Kodo at shutdown.
+	statExportSpooled atomic.Int64
+)
+
+// statExportSpoolPrefix is the prefix of the objects where the statistic
+// events that have not been exported at shutdown are spooled.
+const statExportSpoolPrefix = "stats/export-spool/"
+
+func init() {
+	if statExportURL == "" {
+		return
+	}
+
+	if statExportBatchSize < 1 {
+		statExportBatchSize = 1
+	}
+
+	if statExportFlushInterval <= 0 {
+		base.Logger.Fatal().
+			Msg("invalid stat export flush interval")
+	}
+
+	statExportQueue = make(
+		chan *statEvent,
+		statsViper.GetInt("export_queue_size"),
+	)
+
+	go exportStatEvents()
+	go exportSpooledStatEvents()
+
+	base.Air.AddShutdownJob(func() {
+		close(statExportStop)
+		<-statExportDone
+	})
+
+	expvar.Publish("stat_export", expvar.Func(func() any {
+		return map[string]int64{
+			"queue_length": int64(len(statExportQueue)),
+			"exported":     statExportExported.Load(),
+			"dropped":      statExportDropped.Load(),
+			"retries":      statExportRetries.Load(),
+			"spooled":      statExportSpooled.Load(),
+		}
+	}))
+}
+
+// queueStatExport queues the se for export. The se is dropped if the queue is
+// full, which only happens when the sink has been failing for long enough, so
+// that the requests are never blocked by the sink.
+func queueStatExport(se *statEvent) {
+	if statExportQueue == nil {
+		return
+	}
+
+	select {
+	case statExportQueue <- se:
+	default:
+		statExportDropped.Add(1)
+	}
+}
+
+// exportStatEvents exports the statistic events in the `statExportQueue` in
+// batches until the `statExportStop` is closed. A batch is retried until the
+// sink accepts it, during which the `statExportQueue` fills up. The batch and
+// the queued statistic events left at shutdown are spooled to the Qiniu Cloud
+// Kodo, and are exported again on the next start, so every statistic event is
+// delivered at least once unless dropped.
+func exportStatEvents() {
+	defer close(statExportDone)
+
+	ticker := time.NewTicker(statExportFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*statEvent, 0, statExportBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		b, err := marshalStatEvents(batch)
+		if err != nil {
+			base.Logger.Error().Err(err).
+				Msg("failed to marshal stat events")
+			batch = batch[:0]
+			return
+		}
+
+		if err := postStatExportBatch(b); err != nil {
+			return // Left for the spool.
+		}
+
+		statExportExported.Add(int64(len(batch)))
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case se := <-statExportQueue:
+			batch = append(batch, se)
+			if len(batch) >= statExportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-statExportStop:
+			for len(statExportQueue) > 0 {
+				batch = append(batch, <-statExportQueue)
+			}
+
+			spoolStatEvents(batch)
+
+			return
+		}
+	}
+}
+
+// marshalStatEvents returns the ses as JSON lines.
+func marshalStatEvents(ses []*statEvent) ([]byte, error) {
+	buf := bytes.Buffer{}
+	for _, se := range ses {
+		b, err := json.Marshal(se)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes(), nil
+}
+
+// postStatExportBatch posts the batch of JSON lines to the `statExportURL`. It
+// retries with an exponential backoff until the sink accepts the batch, and
+// only gives up when the `base.Context` is done.
+func postStatExportBatch(batch []byte) error {
+	backoff := time.Second
+	for {
+		err := postStatExport(base.Context, batch)
+		if err == nil {
+			return nil
+		}
+
+		if base.Context.Err() != nil {
+			return base.Context.Err()
+		}
+
+		statExportRetries.Add(1)
+		base.Logger.Warn().Err(err).
+			Dur("backoff", backoff).
+			Msg("failed to export stat events")
+
+		select {
+		case <-time.After(backoff):
+		case <-base.Context.Done():
+			return base.Context.Err()
+		}
+
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// postStatExport posts the batch of JSON lines to the `statExportURL` once.
+func postStatExport(ctx context.Context, batch []byte) error {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		statExportURL,
+		bytes.NewReader(batch),
+	)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	res, err := statExportHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < http.StatusOK ||
+		res.StatusCode >= http.StatusMultipleChoices {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(b))
+	}
+
+	return nil
+}
+
+// spoolStatEvents spools the ses to the Qiniu Cloud Kodo.
+func spoolStatEvents(ses []*statEvent) {
+	if len(ses) == 0 {
+		return
+	}
+
+	b, err := marshalStatEvents(ses)
+	if err != nil {
+		base.Logger.Error().Err(err).
+			Msg("failed to marshal stat events")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	name := path.Join(
+		statExportSpoolPrefix,
+		leaderID+"-"+time.Now().UTC().Format("20060102150405"),
+	)
+	if err := qiniuKodoUpload(ctx, name, bytes.NewReader(b)); err != nil {
+		base.Logger.Error().Err(err).
+			Int("count", len(ses)).
+			Msg("failed to spool stat events")
+		return
+	}
+
+	statExportSpooled.Add(int64(len(ses)))
+}
+
+// exportSpooledStatEvents exports the statistic events spooled by the previous
+// runs, and removes the spools once exported.
+func exportSpooledStatEvents() {
+	for objectInfo := range qiniuKodoClient.ListObjects(
+		base.Context,
+		qiniuKodoBucketName,
+		minio.ListObjectsOptions{
+			Prefix:    statExportSpoolPrefix,
+			Recursive: true,
+		},
+	) {
+		if objectInfo.Err != nil {
+			base.Logger.Error().Err(objectInfo.Err).
+				Msg("failed to list stat export spools")
+			return
+		}
+
+		var b []byte
+		if err := retryQiniuKodoDo(base.Context, func(
+			ctx context.Context,
+		) error {
+			object, err := qiniuKodoClient.GetObject(
+				ctx,
+				qiniuKodoBucketName,
+				objectInfo.Key,
+				qiniuKodoGetObjectOptions(),
+			)
+			if err != nil {
+				return err
+			}
+			defer object.Close()
+
+			b, err = io.ReadAll(object)
+
+			return err
+		}); err != nil {
+			if !isNotFoundMinIOError(err) {
+				base.Logger.Error().Err(err).
+					Str("name", objectInfo.Key).
+					Msg("failed to read stat export spool")
+			}
+
+			continue
+		}
+
+		if err := postStatExportBatch(b); err != nil {
+			return
+		}
+
+		if err := retryQiniuKodoDo(base.Context, func(
+			ctx context.Context,
+		) error {
+			return qiniuKodoClient.RemoveObject(
+				ctx,
+				qiniuKodoBucketName,
+				objectInfo.Key,
+				minio.RemoveObjectOptions{},
+			)
+		}); err != nil && !isNotFoundMinIOError(err) {
+			base.Logger.Error().Err(err).
+				Str("name", objectInfo.Key).
+				Msg("failed to remove stat export spool")
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+// statusWindow is the number of the minutes covered by the status page.
+const statusWindow = 60
+
+// statusComponents is the components shown on the status page.
+var statusComponents = []string{"upstream", "sumdb", "kodo"}
+
+// statusBucket is the samples of a component recorded in a minute.
+type statusBucket struct {
+	minute  int64
+	count   int64
+	errors  int64
+	latency time.Duration
+}
+
+// statusSeries is the rolling samples of a component in the last
+// `statusWindow` minutes.
+type statusSeries struct {
+	buckets [statusWindow]statusBucket
+	mutex   sync.Mutex
+}
+
+// statusPoint is a point of the status graphs of a component.
+type statusPoint struct {
+	Time      time.Time `json:"time"`
+	Count     int64     `json:"count"`
+	Errors    int64     `json:"errors"`
+	ErrorRate float64   `json:"error_rate"`
+	LatencyMS float64   `json:"latency_ms"`
+}
+
+// statusSerieses is the `statusSeries` of the `statusComponents`.
+var statusSerieses = newStatusSerieses()
+
+// newStatusSerieses returns a new `statusSerieses`.
+func newStatusSerieses() map[string]*statusSeries {
+	serieses := make(map[string]*statusSeries, len(statusComponents))
+	for _, component := range statusComponents {
+		serieses[component] = &statusSeries{}
+	}
+
+	return serieses
+}
+
+func init() {
+	base.Air.BATCH(getHeadMethods, "/status", hStatusPage)
+	base.Air.BATCH(
+		getHeadMethods,
+		"/status/metrics",
+		hStatusMetrics,
+		minutelyCachemanGas,
+	)
+}
+
+// recordStatusSample records a sample of the component that took the latency.
+func recordStatusSample(component string, latency time.Duration, failed bool) {
+	ss, ok := statusSerieses[component]
+	if !ok {
+		return
+	}
+
+	minute := time.Now().Unix() / 60
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	b := &ss.buckets[minute%statusWindow]
+	if b.minute != minute {
+		*b = statusBucket{minute: minute}
+	}
+
+	b.count++
+	b.latency += latency
+	if failed {
+		b.errors++
+	}
+}
+
+// points returns the points of the ss in the last `statusWindow` minutes,
+// oldest first.
+func (ss *statusSeries) points() []statusPoint {
+	minute := time.Now().Unix() / 60
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	points := make([]statusPoint, statusWindow)
+	for i := range points {
+		m := minute - statusWindow + 1 + int64(i)
+		points[i].Time = time.Unix(m*60, 0).UTC()
+
+		b := ss.buckets[m%statusWindow]
+		if b.minute != m || b.count == 0 {
+			continue
+		}
+
+		points[i].Count = b.count
+		points[i].Errors = b.errors
+		points[i].ErrorRate = float64(b.errors) / float64(b.count)
+		points[i].LatencyMS = float64(b.latency.Microseconds()) /
+			1000 / float64(b.count)
+	}
+
+	return points
+}
+
+// hStatusMetrics handles requests to query the rolling metrics of the status
+// page.
+func hStatusMetrics(req *air.Request, res *air.Response) error {
+	metrics := make(map[string][]statusPoint, len(statusSerieses))
+	for component, ss := range statusSerieses {
+		metrics[component] = ss.points()
+	}
+
+	return res.WriteJSON(metrics)
+}
+
+// hStatusPage handles requests to get status page. The metrics are those of
+// the instance serving the request, so that users can tell whether slowness is
+// caused by the service or by their network.
+func hStatusPage(req *air.Request, res *air.Response) error {
+	type component struct {
+		Name          string
+		Status        string
+		LatencyMS     string
+		ErrorRate     string
+		LatencyPoints string
+		ErrorPoints   string
+	}
+
+	names := map[string]string{
+		"upstream": req.LocalizedString("Upstream Proxies"),
+		"sumdb":    req.LocalizedString("Checksum Databases"),
+		"kodo":     req.LocalizedString("Object Storage"),
+	}
+
+	components := make([]component, 0, len(statusComponents))
+	for _, name := range statusComponents {
+		points := statusSerieses[name].points()
+
+		// The summary is taken from the last 5 minutes.
+		var (
+			count, failures int64
+			latencyMS       float64
+		)
+
+		for _, p := range points[len(points)-5:] {
+			count += p.Count
+			failures += p.Errors
+			latencyMS += p.LatencyMS * float64(p.Count)
+		}
+
+		c := component{
+			Name:          names[name],
+			Status:        req.LocalizedString("No Data"),
+			LatencyMS:     "-",
+			ErrorRate:     "-",
+			LatencyPoints: statusGraphPoints(points, false),
+			ErrorPoints:   statusGraphPoints(points, true),
+		}
+
+		if count > 0 {
+			errorRate := float64(failures) / float64(count)
+			c.LatencyMS = fmt.Sprintf("%.0f", latencyMS/float64(count))
+			c.ErrorRate = fmt.Sprintf("%.1f%%", 100*errorRate)
+			c.Status = req.LocalizedString("Operational")
+			if errorRate >= 0.05 {
+				c.Status = req.LocalizedString("Degraded")
+			}
+		}
+
+		components = append(components, c)
+	}
+
+	return res.Render(map[string]any{
+		"PageTitle":     req.LocalizedString("Status"),
+		"CanonicalPath": "/status",
+		"IsStatusPage":  true,
+		"Components":    components,
+	}, "status.html", "layouts/default.html")
+}
+
+// statusGraphPoints returns the points of the SVG polyline of the points in a
+// 600x100 view box. The error rates are drawn when the errorRate is true,
+// otherwise the latencies are drawn.
+func statusGraphPoints(points []statusPoint, errorRate bool) string {
+	values := make([]float64, len(points))
+	maxValue := 0.0
+	for i, p := range points {
+		values[i] = p.LatencyMS
+		if errorRate {
+			values[i] = p.ErrorRate
+		}
+
+		if values[i] > maxValue {
+			maxValue = values[i]
+		}
+	}
+
+	if errorRate || maxValue == 0 {
+		maxValue = 1
+	}
+
+	var sb strings.Builder
+	for i, v := range values {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+
+		fmt.Fprintf(
+			&sb,
+			"%.1f,%.1f",
+			600*float64(i)/float64(len(values)-1),
+			100-95*v/maxValue,
+		)
+	}
+
+	return sb.String()
+}
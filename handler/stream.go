@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/mod/module"
+)
+
+// streamColdZips indicates whether the uncached zip files are streamed to the
+// clients while they are being downloaded from the upstream proxy, instead of
+// after they have been downloaded, verified and cached.
+var streamColdZips atomic.Bool
+
+// goproxyStreamURL returns the URL of the upstream proxy that the uncached
+// Goproxy cache with the name can be streamed from. It returns nil if the name
+// cannot be streamed, in which case it must be served by the `hhGoproxy` as
+// usual.
+func goproxyStreamURL(req *air.Request, name string) *url.URL {
+	if !streamColdZips.Load() ||
+		goproxyCacheOnly.Load() ||
+		req.Method != http.MethodGet ||
+		req.Header.Get("Range") != "" ||
+		goproxyCacheNameType(name) != "zip" ||
+		!validGoproxyCacheName(name) {
+		return nil
+	}
+
+	modulePath, _, ok := parseGoproxyCacheName(name)
+	if !ok || module.MatchPrefixPatterns(goBinEnv("GONOPROXY"), modulePath) {
+		return nil
+	}
+
+	// Only the first upstream proxy is used, since it is the one that the
+	// `hhGoproxy` tries first, unless the routing rules route the name to
+	// another one.
+	proxy := goproxyUpstreams
+	if i := strings.IndexAny(proxy, ",|"); i >= 0 {
+		proxy = proxy[:i]
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+
+	// Build the URL the same way as the `hhGoproxy` and the
+	// `routingTransport`, so that both requests are coalesced by the
+	// `coalescingTransport`.
+	u.Path = path.Join(u.Path, name)
+	u.RawPath = path.Join(
+		u.RawPath,
+		strings.ReplaceAll(url.PathEscape(name), "%2F", "/"),
+	)
+
+	return routedUpstreamURL(u, name)
+}
+
+// isGoproxyCacheMissing reports whether the Goproxy cache with the name is
+// known to be missing from the Qiniu Cloud Kodo for the tenant carried by the
+// ctx.
+func isGoproxyCacheMissing(ctx context.Context, name string) bool {
+	_, err := statGoproxyCacheObject(
+		ctx,
+		goproxyCacheObjectName(ctx, name),
+	)
+	return isNotFoundMinIOError(err)
+}
+
+// streamGoproxyCache streams the uncached Goproxy cache with the name from the
+// u to the res while the `hhGoproxy` downloads, verifies and caches it in the
+// background. Both share a single upstream download via the
+// `coalescingTransport`, and the fetch lock (see the `lockGoproxyFetch`) taken
+// before the download is held until the background fetch finishes. It reports
+// whether the req has been served, which it is not if another instance has
+// cached the Goproxy cache in the meantime.
+//
+// The streamed bytes are not verified against the checksum database yet, so
+// they are never stored by any cache on the way to the client, and only the
+// verified ones are ever cached by the Goproxy.
+func streamGoproxyCache(
+	req *air.Request,
+	res *air.Response,
+	name string,
+	u *url.URL,
+) bool {
+	unlock := lockGoproxyFetch(req.Context, name)
+	if unlock == nil {
+		if !isGoproxyCacheMissing(req.Context, name) {
+			return false
+		}
+
+		unlock = func() {}
+	}
+
+	ureq, err := http.NewRequestWithContext(
+		req.Context,
+		http.MethodGet,
+		u.String(),
+		nil,
+	)
+	if err != nil {
+		unlock()
+		return false
+	}
+
+	ures, err := hhGoproxy.Transport.RoundTrip(ureq)
+	if err != nil {
+		unlock()
+		return false
+	} else if ures.StatusCode != http.StatusOK {
+		ures.Body.Close()
+		unlock()
+		return false
+	}
+
+	// The response body is held until the background fetch finishes, so
+	// that the background fetch joins the same upstream download even when
+	// the streaming finishes first.
+	fetchDone := make(chan struct{})
+	go func() {
+		defer close(fetchDone)
+
+		ctx, cancel := withGoproxyFetchTimeout(withTenant(
+			context.WithValue(
+				base.Context,
+				requestIDKey{},
+				requestIDOf(req.Context),
+			),
+			tenantOf(req.Context),
+		), "zip")
+		defer cancel()
+
+		if err := serveGoproxyInternally(
+			ctx,
+			&internalResponseWriter{discard: true},
+			name,
+		); err != nil {
+			base.Logger.Warn().Err(err).
+				Str("name", name).
+				Str("request_id", requestIDOf(ctx)).
+				Msg("failed to cache streamed goproxy cache")
+		}
+	}()
+
+	defer func() {
+		go func() {
+			<-fetchDone
+			ures.Body.Close()
+			unlock()
+		}()
+	}()
+
+	setCacheOutcome(req.Context, "miss")
+
+	res.Header.Set("Content-Type", "application/zip")
+	if ures.ContentLength >= 0 {
+		res.Header.Set(
+			"Content-Length",
+			strconv.FormatInt(ures.ContentLength, 10),
+		)
+	}
+
+	// Not cacheable, since the zip file has not been verified.
+	res.Header.Set("Cache-Control", "private, no-store")
+
+	rw := res.HTTPResponseWriter()
+	rw.WriteHeader(http.StatusOK)
+	if _, err := copyBuffered(rw, ures.Body); err != nil {
+		base.Logger.Debug().Err(err).
+			Str("name", name).
+			Str("request_id", requestIDOf(req.Context)).
+			Msg("failed to stream goproxy cache")
+		return true
+	}
+
+	recordStatEvent(req, name, res.ContentLength)
+
+	return true
+}
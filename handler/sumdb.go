@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/mod/module"
+)
+
+var (
+	// sumdbLookupCacheTTL is how long the cached lookup responses of the
+	// proxied checksum databases are served without asking the upstream.
+	// The lookup responses are never served from the cache unless the
+	// upstream fails when it is not positive.
+	sumdbLookupCacheTTL = goproxyViper.GetDuration("sumdb_lookup_cache_ttl")
+
+	// sumdbCacheNames is the Goproxy cache name prefixes of the proxied
+	// checksum databases keyed by their upstream URLs.
+	sumdbCacheNames = newSUMDBCacheNames()
+
+	// sumdbBypassPatterns is the glob patterns of module path prefixes
+	// (see the `module.MatchPrefixPatterns`) that bypass the checksum
+	// databases, like the GONOSUMDB. The matched modules are neither
+	// verified against the checksum databases nor looked up through the
+	// proxied checksum databases, so that their paths are never leaked.
+	sumdbBypassPatterns = goproxyViper.GetStringSlice(
+		"sumdb_bypass_modules",
+	)
+)
+
+// newSUMDBCacheNames returns a new `sumdbCacheNames`.
+func newSUMDBCacheNames() map[string]string {
+	cacheNames := map[string]string{}
+	for _, proxiedSUMDB := range goproxyViper.GetStringSlice(
+		"proxied_sumdbs",
+	) {
+		name, sumdbURL, ok := parseProxiedSUMDB(proxiedSUMDB)
+		if !ok {
+			continue
+		}
+
+		cacheNames[sumdbURL.Host+strings.TrimSuffix(sumdbURL.Path, "/")] =
+			"sumdb/" + name
+	}
+
+	return cacheNames
+}
+
+// parseProxiedSUMDB parses the name and the upstream URL of the proxiedSUMDB,
+// which is in the form of "<name> [<url>]" like the GOSUMDB. It reports false
+// if the proxiedSUMDB is invalid.
+func parseProxiedSUMDB(proxiedSUMDB string) (string, *url.URL, bool) {
+	sumdbParts := strings.Fields(proxiedSUMDB)
+	if len(sumdbParts) == 0 {
+		return "", nil, false
+	}
+
+	rawSUMDBURL := sumdbParts[0]
+	if len(sumdbParts) > 1 {
+		rawSUMDBURL = sumdbParts[1]
+	}
+
+	if !strings.Contains(rawSUMDBURL, "://") {
+		rawSUMDBURL = "https://" + rawSUMDBURL
+	}
+
+	sumdbURL, err := url.Parse(rawSUMDBURL)
+	if err != nil {
+		return "", nil, false
+	}
+
+	return sumdbParts[0], sumdbURL, true
+}
+
+// sumdbCachingTransport is an `http.RoundTripper` that serves the requests to
+// the proxied checksum databases from the Goproxy caches when possible. The
+// tiles are immutable, so they are always served from the Goproxy caches once
+// cached. The lookups are served from the Goproxy caches for the
+// `sumdbLookupCacheTTL`.
+type sumdbCachingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (sct *sumdbCachingTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return sct.next.RoundTrip(req)
+	}
+
+	name, ttl, ok := sumdbCacheName(req.URL)
+	if !ok {
+		return sct.next.RoundTrip(req)
+	}
+
+	var (
+		object     *minio.Object
+		objectInfo minio.ObjectInfo
+	)
+
+	if err := retryQiniuKodoDo(req.Context(), func(
+		ctx context.Context,
+	) (err error) {
+		object, err = qiniuKodoClient.GetObject(
+			ctx,
+			qiniuKodoBucketName,
+			name,
+			qiniuKodoGetObjectOptions(),
+		)
+		if err != nil {
+			return err
+		}
+
+		objectInfo, err = object.Stat()
+		if err != nil {
+			object.Close()
+		}
+
+		return err
+	}); err != nil {
+		return sct.next.RoundTrip(req)
+	}
+
+	body, objectInfo, err := decryptGoproxyCacheObject(object, objectInfo)
+	if err != nil {
+		return sct.next.RoundTrip(req)
+	}
+
+	if ttl > 0 &&
+		time.Since(objectInfo.LastModified) > ttl &&
+		!goproxyCacheOnly.Load() {
+		body.Close()
+		return sct.next.RoundTrip(req)
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          body,
+		ContentLength: objectInfo.Size,
+		Request:       req,
+	}, nil
+}
+
+// sumdbCacheName returns the Goproxy cache name of the u, and how long the
+// Goproxy cache can be served for, which is zero for the immutable ones. It
+// reports false if the u is not cacheable.
+func sumdbCacheName(u *url.URL) (string, time.Duration, bool) {
+	for prefix, namePrefix := range sumdbCacheNames {
+		p, ok := strings.CutPrefix(u.Host+u.Path, prefix)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(p, "/tile/"):
+			return namePrefix + p, 0, true
+		case strings.HasPrefix(p, "/lookup/") && sumdbLookupCacheTTL > 0:
+			return namePrefix + p, sumdbLookupCacheTTL, true
+		}
+
+		return "", 0, false
+	}
+
+	return "", 0, false
+}
+
+// isSUMDBURL reports whether the u targets one of the proxied checksum
+// databases.
+func isSUMDBURL(u *url.URL) bool {
+	for prefix := range sumdbCacheNames {
+		if strings.HasPrefix(u.Host+u.Path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isSUMDBBypassed reports whether the module targeted by the modulePath bypasses
+// the checksum databases, either by the `sumdbBypassPatterns` or by a private
+// routing rule.
+func isSUMDBBypassed(modulePath string) bool {
+	for _, pattern := range sumdbBypassPatterns {
+		if module.MatchPrefixPatterns(pattern, modulePath) {
+			return true
+		}
+	}
+
+	rr := matchRoutingRule(modulePath)
+
+	return rr != nil && rr.Private
+}
+
+// isSUMDBLookupBypassed reports whether the Goproxy cache with the name is a
+// lookup of a proxied checksum database for a module that bypasses the
+// checksum databases.
+func isSUMDBLookupBypassed(name string) bool {
+	if !strings.HasPrefix(name, "sumdb/") {
+		return false
+	}
+
+	_, lookup, ok := strings.Cut(name, "/lookup/")
+	if !ok {
+		return false
+	}
+
+	escapedModulePath, _, _ := strings.Cut(lookup, "@")
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		modulePath = escapedModulePath
+	}
+
+	return isSUMDBBypassed(modulePath)
+}
+
+// isSUMDBLookupCacheName reports whether the Goproxy cache with the name is a
+// lookup response of a proxied checksum database.
+func isSUMDBLookupCacheName(name string) bool {
+	return strings.HasPrefix(name, "sumdb/") &&
+		strings.Contains(name, "/lookup/")
+}
@@ -0,0 +1,636 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// sumdbMirrors is the verifying mirrors of the proxied checksum databases keyed
+// by their upstream URLs without the schemes (see the `sumdbCacheNames`). A
+// proxied checksum database is mirrored when its verifier key is listed in the
+// "sumdb_mirror_verifier_keys".
+var sumdbMirrors = newSUMDBMirrors()
+
+// sumdbMirrorTileHeight is the tile height of the mirrored checksum databases.
+const sumdbMirrorTileHeight = 8
+
+// errSUMDBSecurity is the error returned when a mirrored checksum database is
+// caught misbehaving.
+var errSUMDBSecurity = errors.New("sumdb security error")
+
+// sumdbMirror is a verifying mirror of a proxied checksum database. It checks
+// the signed tree heads and the lookup records served by the checksum database
+// against the latest tree head it has verified, stores the tiles it has
+// verified in the Qiniu Cloud Kodo, and keeps serving the latest verified tree
+// head when the checksum database is unreachable.
+type sumdbMirror struct {
+	name      string
+	baseURL   string
+	cacheName string
+	verifiers note.Verifiers
+
+	latest       tlog.Tree
+	latestNote   []byte
+	latestLoaded bool
+	latestMutex  sync.Mutex
+}
+
+// newSUMDBMirrors returns a new `sumdbMirrors`.
+func newSUMDBMirrors() map[string]*sumdbMirror {
+	verifiers := map[string]note.Verifier{}
+	for _, vkey := range goproxyViper.GetStringSlice(
+		"sumdb_mirror_verifier_keys",
+	) {
+		verifier, err := note.NewVerifier(vkey)
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Str("verifier_key", vkey).
+				Msg("invalid sumdb mirror verifier key")
+		}
+
+		verifiers[verifier.Name()] = verifier
+	}
+
+	mirrors := map[string]*sumdbMirror{}
+	for _, proxiedSUMDB := range goproxyViper.GetStringSlice(
+		"proxied_sumdbs",
+	) {
+		name, sumdbURL, ok := parseProxiedSUMDB(proxiedSUMDB)
+		if !ok || verifiers[name] == nil {
+			continue
+		}
+
+		prefix := sumdbURL.Host + strings.TrimSuffix(sumdbURL.Path, "/")
+		mirrors[prefix] = &sumdbMirror{
+			name:      name,
+			baseURL:   sumdbURL.Scheme + "://" + prefix,
+			cacheName: "sumdb/" + name,
+			verifiers: note.VerifierList(verifiers[name]),
+		}
+	}
+
+	return mirrors
+}
+
+// sumdbMirrorOf returns the `sumdbMirror` targeted by the u and the path of the
+// u relative to the mirrored checksum database.
+func sumdbMirrorOf(u *url.URL) (*sumdbMirror, string, bool) {
+	for prefix, sm := range sumdbMirrors {
+		if p, ok := strings.CutPrefix(u.Host+u.Path, prefix); ok {
+			return sm, p, true
+		}
+	}
+
+	return nil, "", false
+}
+
+// latestObjectName returns the name of the object that persists the latest
+// verified tree head of the sm in the Qiniu Cloud Kodo. It is kept apart from
+// the Goproxy caches, which hold whatever the checksum database served.
+func (sm *sumdbMirror) latestObjectName() string {
+	return "sumdb-mirror/" + sm.name + "/latest"
+}
+
+// openTree verifies the signed tree head msg and returns the tree in it.
+func (sm *sumdbMirror) openTree(msg []byte) (tlog.Tree, error) {
+	n, err := note.Open(msg, sm.verifiers)
+	if err != nil {
+		return tlog.Tree{}, fmt.Errorf("%w: %v", errSUMDBSecurity, err)
+	}
+
+	return tlog.ParseTree([]byte(n.Text))
+}
+
+// loadLatest loads the latest verified tree head of the sm from the Qiniu Cloud
+// Kodo if it has not been loaded. The caller must hold the `latestMutex`.
+func (sm *sumdbMirror) loadLatest(ctx context.Context) error {
+	if sm.latestLoaded {
+		return nil
+	}
+
+	var msg []byte
+	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) error {
+		object, err := qiniuKodoClient.GetObject(
+			ctx,
+			qiniuKodoBucketName,
+			sm.latestObjectName(),
+			qiniuKodoGetObjectOptions(),
+		)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		msg, err = io.ReadAll(object)
+
+		return err
+	}); err != nil && !isNotFoundMinIOError(err) {
+		return err
+	}
+
+	if len(msg) > 0 {
+		tree, err := sm.openTree(msg)
+		if err != nil {
+			return err
+		}
+
+		sm.latest, sm.latestNote = tree, msg
+	}
+
+	sm.latestLoaded = true
+
+	return nil
+}
+
+// mergeLatest checks that the tree in the signed tree head msg and the latest
+// verified tree of the sm are on the same timeline, and then advances the
+// latest verified tree to it if it is newer. It returns the tree in the msg.
+func (sm *sumdbMirror) mergeLatest(
+	ctx context.Context,
+	next http.RoundTripper,
+	msg []byte,
+) (tlog.Tree, error) {
+	tree, err := sm.openTree(msg)
+	if err != nil {
+		return tlog.Tree{}, err
+	}
+
+	for {
+		sm.latestMutex.Lock()
+		if err := sm.loadLatest(ctx); err != nil {
+			sm.latestMutex.Unlock()
+			return tlog.Tree{}, err
+		}
+
+		latest, latestNote := sm.latest, sm.latestNote
+		sm.latestMutex.Unlock()
+
+		switch {
+		case tree.N == latest.N:
+			if tree.Hash != latest.Hash {
+				return tlog.Tree{}, sm.securityError(
+					"conflicting tree heads",
+					latestNote,
+					msg,
+				)
+			}
+
+			return tree, nil
+		case tree.N < latest.N:
+			err = sm.checkTrees(ctx, next, tree, latest)
+		default:
+			err = sm.checkTrees(ctx, next, latest, tree)
+		}
+
+		if err != nil {
+			if errors.Is(err, errSUMDBSecurity) {
+				return tlog.Tree{}, sm.securityError(
+					err.Error(),
+					latestNote,
+					msg,
+				)
+			}
+
+			return tlog.Tree{}, err
+		}
+
+		if tree.N < latest.N {
+			return tree, nil
+		}
+
+		sm.latestMutex.Lock()
+		if sm.latest != latest {
+			// Another lookup advanced the latest verified tree in
+			// the meantime, so check again against it.
+			sm.latestMutex.Unlock()
+			continue
+		}
+
+		if err := qiniuKodoUpload(
+			ctx,
+			sm.latestObjectName(),
+			bytes.NewReader(msg),
+		); err != nil {
+			sm.latestMutex.Unlock()
+			return tlog.Tree{}, err
+		}
+
+		sm.latest, sm.latestNote = tree, msg
+		sm.latestMutex.Unlock()
+
+		return tree, nil
+	}
+}
+
+// checkTrees checks that the older tree is contained in the newer tree.
+func (sm *sumdbMirror) checkTrees(
+	ctx context.Context,
+	next http.RoundTripper,
+	older tlog.Tree,
+	newer tlog.Tree,
+) error {
+	if older.N == 0 {
+		return nil
+	}
+
+	thr := tlog.TileHashReader(newer, &sumdbMirrorTileReader{
+		ctx:  ctx,
+		sm:   sm,
+		next: next,
+	})
+
+	p, err := tlog.ProveTree(newer.N, older.N, thr)
+	if err != nil {
+		return err
+	}
+
+	if err := tlog.CheckTree(
+		p,
+		newer.N,
+		newer.Hash,
+		older.N,
+		older.Hash,
+	); err != nil {
+		return fmt.Errorf(
+			"%w: tree of size %d is not contained in tree of "+
+				"size %d: %v",
+			errSUMDBSecurity,
+			older.N,
+			newer.N,
+			err,
+		)
+	}
+
+	return nil
+}
+
+// verifyLookup verifies the lookup response body of the sm, which is a record
+// followed by a signed tree head that the record must be contained in.
+func (sm *sumdbMirror) verifyLookup(
+	ctx context.Context,
+	next http.RoundTripper,
+	body []byte,
+) error {
+	id, text, treeMsg, err := tlog.ParseRecord(body)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSUMDBSecurity, err)
+	}
+
+	tree, err := sm.mergeLatest(ctx, next, treeMsg)
+	if err != nil {
+		return err
+	}
+
+	if id >= tree.N {
+		return fmt.Errorf(
+			"%w: record %d is not in tree of size %d",
+			errSUMDBSecurity,
+			id,
+			tree.N,
+		)
+	}
+
+	thr := tlog.TileHashReader(tree, &sumdbMirrorTileReader{
+		ctx:  ctx,
+		sm:   sm,
+		next: next,
+	})
+
+	p, err := tlog.ProveRecord(tree.N, id, thr)
+	if err != nil {
+		return err
+	}
+
+	if err := tlog.CheckRecord(
+		p,
+		tree.N,
+		tree.Hash,
+		id,
+		tlog.RecordHash(text),
+	); err != nil {
+		return fmt.Errorf(
+			"%w: record %d does not match tree of size %d: %v",
+			errSUMDBSecurity,
+			id,
+			tree.N,
+			err,
+		)
+	}
+
+	return nil
+}
+
+// securityError logs the evidence of the misbehavior of the checksum database
+// of the sm and returns the `errSUMDBSecurity`.
+func (sm *sumdbMirror) securityError(
+	reason string,
+	latestNote []byte,
+	msg []byte,
+) error {
+	base.Logger.Error().
+		Str("sumdb", sm.name).
+		Str("reason", reason).
+		Bytes("latest_verified_tree", latestNote).
+		Bytes("served_tree", msg).
+		Msg("sumdb misbehavior detected")
+
+	return errSUMDBSecurity
+}
+
+// sumdbMirrorTileReader is a `tlog.TileReader` that reads the tiles of a
+// `sumdbMirror` from the Goproxy caches, or from its checksum database if they
+// are not cached. The tiles read from the checksum database are cached once
+// they have been verified.
+type sumdbMirrorTileReader struct {
+	ctx  context.Context
+	sm   *sumdbMirror
+	next http.RoundTripper
+
+	remoteTiles sync.Map
+}
+
+// Height implements the `tlog.TileReader`.
+func (smtr *sumdbMirrorTileReader) Height() int {
+	return sumdbMirrorTileHeight
+}
+
+// ReadTiles implements the `tlog.TileReader`.
+func (smtr *sumdbMirrorTileReader) ReadTiles(
+	tiles []tlog.Tile,
+) ([][]byte, error) {
+	data := make([][]byte, len(tiles))
+	errs := make([]error, len(tiles))
+
+	var wg sync.WaitGroup
+	for i, tile := range tiles {
+		wg.Add(1)
+		go func(i int, tile tlog.Tile) {
+			defer wg.Done()
+			data[i], errs[i] = smtr.readTile(tile)
+		}(i, tile)
+	}
+
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// readTile reads the tile. A partial tile is also satisfied by the prefix of
+// its full tile, since the partial tiles are removed from the checksum database
+// once they are full.
+func (smtr *sumdbMirrorTileReader) readTile(tile tlog.Tile) ([]byte, error) {
+	full := tile
+	full.W = 1 << uint(tile.H)
+
+	candidates := []tlog.Tile{tile}
+	if full != tile {
+		candidates = append(candidates, full)
+	}
+
+	for _, t := range candidates {
+		data, err := smtr.readCachedTile(t)
+		if err == nil && len(data) >= tile.W*tlog.HashSize {
+			return data[:tile.W*tlog.HashSize], nil
+		}
+	}
+
+	var err error
+	for _, t := range candidates {
+		var data []byte
+		data, err = smtr.readRemoteTile(t)
+		if err == nil && len(data) >= tile.W*tlog.HashSize {
+			if t == tile {
+				smtr.remoteTiles.Store(tile, true)
+			}
+
+			return data[:tile.W*tlog.HashSize], nil
+		} else if err == nil {
+			err = fmt.Errorf("%s: short tile", t.Path())
+		}
+	}
+
+	return nil, err
+}
+
+// readCachedTile reads the tile from the Goproxy caches.
+func (smtr *sumdbMirrorTileReader) readCachedTile(
+	tile tlog.Tile,
+) ([]byte, error) {
+	var data []byte
+	err := retryQiniuKodoDo(smtr.ctx, func(ctx context.Context) error {
+		object, err := qiniuKodoClient.GetObject(
+			ctx,
+			qiniuKodoBucketName,
+			smtr.sm.cacheName+"/"+tile.Path(),
+			qiniuKodoGetObjectOptions(),
+		)
+		if err != nil {
+			return err
+		}
+
+		objectInfo, err := object.Stat()
+		if err != nil {
+			object.Close()
+			return err
+		}
+
+		body, _, err := decryptGoproxyCacheObject(object, objectInfo)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		data, err = io.ReadAll(body)
+
+		return err
+	})
+
+	return data, err
+}
+
+// readRemoteTile reads the tile from the checksum database.
+func (smtr *sumdbMirrorTileReader) readRemoteTile(
+	tile tlog.Tile,
+) ([]byte, error) {
+	req, err := http.NewRequestWithContext(
+		smtr.ctx,
+		http.MethodGet,
+		smtr.sm.baseURL+"/"+tile.Path(),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := smtr.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", req.URL, res.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(
+		res.Body,
+		int64(tile.W*tlog.HashSize),
+	))
+}
+
+// SaveTiles implements the `tlog.TileReader`.
+func (smtr *sumdbMirrorTileReader) SaveTiles(
+	tiles []tlog.Tile,
+	data [][]byte,
+) {
+	for i, tile := range tiles {
+		if _, ok := smtr.remoteTiles.LoadAndDelete(tile); !ok {
+			continue
+		}
+
+		// The tiles share the Goproxy caches, so they are encrypted
+		// like them.
+		content, err := encryptGoproxyCache(bytes.NewReader(data[i]))
+		if err == nil {
+			err = qiniuKodoUpload(
+				smtr.ctx,
+				smtr.sm.cacheName+"/"+tile.Path(),
+				content,
+			)
+		}
+
+		if err != nil {
+			base.Logger.Error().Err(err).
+				Str("sumdb", smtr.sm.name).
+				Str("tile", tile.Path()).
+				Msg("failed to save sumdb tile")
+		}
+	}
+}
+
+// sumdbVerifyingTransport is an `http.RoundTripper` that verifies the responses
+// of the mirrored checksum databases (see the `sumdbMirrors`).
+//
+// A lookup response or a signed tree head that fails the verification gets a
+// "404 Not Found" response with a "bad upstream" body, which makes the Goproxy
+// fall back to the Goproxy caches. When the checksum database fails to serve
+// its latest signed tree head, the latest verified one is served instead.
+type sumdbVerifyingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (svt *sumdbVerifyingTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	sm, p, ok := sumdbMirrorOf(req.URL)
+	if !ok || req.Method != http.MethodGet {
+		return svt.next.RoundTrip(req)
+	}
+
+	isLookup := strings.HasPrefix(p, "/lookup/")
+	if !isLookup && p != "/latest" {
+		return svt.next.RoundTrip(req)
+	}
+
+	res, err := svt.next.RoundTrip(req)
+	if p == "/latest" && (err != nil || res.StatusCode >= 500) {
+		if latestRes := sm.latestResponse(req); latestRes != nil {
+			if res != nil {
+				res.Body.Close()
+			}
+
+			return latestRes, nil
+		}
+	}
+
+	if err != nil || res.StatusCode != http.StatusOK {
+		return res, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), time.Minute)
+	defer cancel()
+
+	if isLookup {
+		err = sm.verifyLookup(ctx, svt.next, body)
+	} else {
+		_, err = sm.mergeLatest(ctx, svt.next, body)
+	}
+
+	if errors.Is(err, errSUMDBSecurity) {
+		return &http.Response{
+			Status:     "404 Not Found",
+			StatusCode: http.StatusNotFound,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body: io.NopCloser(strings.NewReader(
+				"bad upstream: sumdb verification failed",
+			)),
+			ContentLength: -1,
+			Request:       req,
+		}, nil
+	} else if err != nil {
+		// The go command verifies the responses by itself, so they are
+		// not held back when they just cannot be verified for now.
+		base.Logger.Warn().Err(err).
+			Str("sumdb", sm.name).
+			Str("path", p).
+			Msg("failed to verify sumdb response")
+	}
+
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Del("Content-Length")
+
+	return res, nil
+}
+
+// latestResponse returns a response of the latest verified tree head of the sm
+// for the req. It returns nil if there is none.
+func (sm *sumdbMirror) latestResponse(req *http.Request) *http.Response {
+	sm.latestMutex.Lock()
+	defer sm.latestMutex.Unlock()
+
+	if err := sm.loadLatest(req.Context()); err != nil ||
+		len(sm.latestNote) == 0 {
+		return nil
+	}
+
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": []string{"text/plain; charset=utf-8"},
+		},
+		Body:          io.NopCloser(bytes.NewReader(sm.latestNote)),
+		ContentLength: int64(len(sm.latestNote)),
+		Request:       req,
+	}
+}
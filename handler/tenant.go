@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+)
+
+var (
+	// tenantQuotas is the storage quotas of the tenants keyed by their
+	// names.
+	tenantQuotas = map[string]tenantQuota{}
+
+	// tenantCacheBytes is the bytes of the Goproxy caches stored in the
+	// namespaces of the tenants keyed by their names, as of the last
+	// measurement plus what has been uploaded since then.
+	tenantCacheBytes = map[string]int64{}
+
+	// tenantCacheBytesMutex is used to protect the `tenantCacheBytes`.
+	tenantCacheBytesMutex sync.Mutex
+)
+
+// tenantCachePrefix is the prefix of the namespaces of the tenants in the
+// Qiniu Cloud Kodo. The Goproxy caches of a tenant are stored under the
+// tenantCachePrefix followed by the name of the tenant and a slash.
+const tenantCachePrefix = "tenants/"
+
+// tenantKey is the key of the tenant in the context of a request.
+type tenantKey struct{}
+
+// tenantQuota is the storage quota of a tenant.
+type tenantQuota struct {
+	Name string `json:"name" mapstructure:"name"`
+
+	// MaxCacheBytes is the maximum bytes of the Goproxy caches stored in
+	// the namespace of the tenant. There is no limit when it is not
+	// positive.
+	MaxCacheBytes int64 `json:"max_cache_bytes" mapstructure:"max_cache_bytes"`
+}
+
+func init() {
+	if !authEnabled {
+		return
+	}
+
+	var quotas []tenantQuota
+	if err := authViper.UnmarshalKey("tenants", &quotas); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to unmarshal tenants")
+	}
+
+	for _, tq := range quotas {
+		if !validTenantName(tq.Name) {
+			base.Logger.Fatal().
+				Str("tenant", tq.Name).
+				Msg("invalid tenant name")
+		}
+
+		tenantQuotas[tq.Name] = tq
+	}
+
+	if len(tenantQuotas) > 0 {
+		go measureTenantCacheBytes()
+		if _, err := base.Cron.AddFunc(
+			"0 * * * *", // Every hour
+			measureTenantCacheBytes,
+		); err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to add tenant cache measure cron job")
+		}
+	}
+
+	base.Air.GET("/admin/tenants", hAdminTenants, adminGas)
+}
+
+// validTenantName reports whether the name is a valid tenant name, which is
+// made of lowercase letters, digits, hyphens and underscores, so that it can
+// be safely used as a single path element of the object names.
+func validTenantName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// withTenant returns a copy of the ctx that carries the tenant. The ctx is
+// returned as is if the tenant is empty.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	if tenant == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantOf returns the tenant carried by the ctx, or an empty string if there
+// is none.
+func tenantOf(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// goproxyCacheObjectName returns the name of the object where the Goproxy cache
+// with the name is stored in the Qiniu Cloud Kodo for the tenant carried by the
+// ctx. It is the name itself if there is no tenant.
+func goproxyCacheObjectName(ctx context.Context, name string) string {
+	if tenant := tenantOf(ctx); tenant != "" {
+		return tenantCachePrefix + tenant + "/" + name
+	}
+
+	return name
+}
+
+// isTenantCacheFull reports whether the namespace of the tenant has reached its
+// storage quota.
+func isTenantCacheFull(tenant string) bool {
+	tq, ok := tenantQuotas[tenant]
+	if !ok || tq.MaxCacheBytes <= 0 {
+		return false
+	}
+
+	tenantCacheBytesMutex.Lock()
+	defer tenantCacheBytesMutex.Unlock()
+
+	return tenantCacheBytes[tenant] >= tq.MaxCacheBytes
+}
+
+// addTenantCacheBytes adds the n bytes uploaded to the namespace of the tenant
+// to the `tenantCacheBytes`.
+func addTenantCacheBytes(tenant string, n int64) {
+	tenantCacheBytesMutex.Lock()
+	tenantCacheBytes[tenant] += n
+	tenantCacheBytesMutex.Unlock()
+}
+
+// measureTenantCacheBytes measures the `tenantCacheBytes` of the tenants that
+// have storage quotas by listing their namespaces in the Qiniu Cloud Kodo.
+func measureTenantCacheBytes() {
+	for tenant, tq := range tenantQuotas {
+		if tq.MaxCacheBytes <= 0 {
+			continue
+		}
+
+		var size int64
+		for objectInfo := range qiniuKodoClient.ListObjects(
+			base.Context,
+			qiniuKodoBucketName,
+			minio.ListObjectsOptions{
+				Prefix:    tenantCachePrefix + tenant + "/",
+				Recursive: true,
+			},
+		) {
+			if objectInfo.Err != nil {
+				base.Logger.Error().Err(objectInfo.Err).
+					Str("tenant", tenant).
+					Msg("failed to measure tenant cache bytes")
+				size = -1
+				break
+			}
+
+			size += objectInfo.Size
+		}
+
+		if size < 0 {
+			continue
+		}
+
+		tenantCacheBytesMutex.Lock()
+		tenantCacheBytes[tenant] = size
+		tenantCacheBytesMutex.Unlock()
+	}
+}
+
+// hAdminTenants handles requests to list the tenants with their storage quotas
+// and usages. The admins confined to a tenant only see their own.
+func hAdminTenants(req *air.Request, res *air.Response) error {
+	tenantCacheBytesMutex.Lock()
+	defer tenantCacheBytesMutex.Unlock()
+
+	type tenantUsage struct {
+		tenantQuota
+		CacheBytes int64 `json:"cache_bytes"`
+	}
+
+	own := tenantOf(req.Context)
+	tus := make([]tenantUsage, 0, len(tenantQuotas))
+	for name, tq := range tenantQuotas {
+		if own != "" && name != own {
+			continue
+		}
+
+		tus = append(tus, tenantUsage{
+			tenantQuota: tq,
+			CacheBytes:  tenantCacheBytes[name],
+		})
+	}
+
+	sort.Slice(tus, func(i, j int) bool {
+		return tus[i].Name < tus[j].Name
+	})
+
+	return res.WriteJSON(tus)
+}
+
+// tenantOfPurge returns the tenant whose namespace the purge request req is
+// scoped to. The admins confined to a tenant can only purge their own
+// namespace, while the others can choose one with the "tenant" param.
+func tenantOfPurge(req *air.Request, res *air.Response) (string, error) {
+	tenant := tenantOf(req.Context)
+
+	p := req.Param("tenant")
+	if p == nil {
+		return tenant, nil
+	}
+
+	t := p.Value().String()
+	switch {
+	case !validTenantName(t):
+		res.Status = http.StatusBadRequest
+		return "", errors.New("invalid tenant")
+	case tenant != "" && t != tenant:
+		res.Status = http.StatusForbidden
+		return "", errors.New("tenant not allowed")
+	}
+
+	return t, nil
+}
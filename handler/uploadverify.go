@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+var (
+	// qiniuKodoVerifyUploads indicates whether the objects uploaded to the
+	// Qiniu Cloud Kodo are verified against their local contents, so that
+	// a corrupted upload is never left behind.
+	qiniuKodoVerifyUploads = qiniuViper.GetBool("kodo_verify_uploads")
+
+	// uploadVerificationFailures is the number of the uploads that failed
+	// the verification.
+	uploadVerificationFailures = expvar.NewInt(
+		"upload_verification_failures",
+	)
+)
+
+// contentMD5 returns the MD5 checksum of the size bytes of the content starting
+// at the offset.
+func contentMD5(content io.ReadSeeker, offset, size int64) ([]byte, error) {
+	var r io.Reader
+	if ra, ok := content.(io.ReaderAt); ok {
+		r = io.NewSectionReader(ra, offset, size)
+	} else if _, err := content.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	} else {
+		r = io.LimitReader(content, size)
+	}
+
+	h := md5.New()
+	if n, err := io.Copy(h, r); err != nil {
+		return nil, err
+	} else if n != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return h.Sum(nil), nil
+}
+
+// base64OrEmpty returns the standard base64 encoding of the checksum, or an
+// empty string if the checksum is empty.
+func base64OrEmpty(checksum []byte) string {
+	if len(checksum) == 0 {
+		return ""
+	}
+
+	return base64.StdEncoding.EncodeToString(checksum)
+}
+
+// qiniuKodoMultipartETag returns the ETag that the Qiniu Cloud Kodo is expected
+// to assign to an object uploaded in the parts with the partMD5s, which is the
+// hex-encoded MD5 checksum of the concatenated MD5 checksums of the parts
+// followed by a hyphen and the number of the parts.
+func qiniuKodoMultipartETag(partMD5s [][]byte) string {
+	h := md5.New()
+	for _, partMD5 := range partMD5s {
+		h.Write(partMD5)
+	}
+
+	return fmt.Sprintf(
+		"%s-%d",
+		hex.EncodeToString(h.Sum(nil)),
+		len(partMD5s),
+	)
+}
+
+// verifyQiniuKodoUpload verifies that the object with the name uploaded to the
+// Qiniu Cloud Kodo has the size and the eTag of its local content. The eTag is
+// not compared when the object is encrypted with the SSE-KMS or the SSE-C,
+// since the ETags of those are not derived from their contents. The object is
+// removed if it fails the verification, so that it is fetched again instead of
+// being served corrupted forever.
+func verifyQiniuKodoUpload(
+	ctx context.Context,
+	name string,
+	size int64,
+	eTag string,
+) error {
+	var objectInfo minio.ObjectInfo
+	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) (err error) {
+		objectInfo, err = qiniuKodoClient.StatObject(
+			ctx,
+			qiniuKodoBucketName,
+			name,
+			qiniuKodoGetObjectOptions(),
+		)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	compareETag := qiniuKodoSSE == nil || qiniuKodoSSE.Type() == encrypt.S3
+
+	var reason string
+	switch {
+	case objectInfo.Size != size:
+		reason = "size mismatch"
+	case compareETag && !strings.EqualFold(
+		strings.Trim(objectInfo.ETag, `"`),
+		eTag,
+	):
+		reason = "etag mismatch"
+	default:
+		return nil
+	}
+
+	uploadVerificationFailures.Add(1)
+	base.Logger.Error().
+		Str("name", name).
+		Str("request_id", requestIDOf(ctx)).
+		Str("reason", reason).
+		Int64("size", size).
+		Int64("stored_size", objectInfo.Size).
+		Str("etag", eTag).
+		Str("stored_etag", objectInfo.ETag).
+		Msg("failed to verify qiniu kodo upload")
+
+	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) error {
+		return qiniuKodoClient.RemoveObject(
+			ctx,
+			qiniuKodoBucketName,
+			name,
+			minio.RemoveObjectOptions{},
+		)
+	}); err != nil && !isNotFoundMinIOError(err) {
+		return err
+	}
+
+	return fmt.Errorf("verify upload of %s: %s", name, reason)
+}
@@ -0,0 +1,259 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// goproxyUpstreams is the GOPROXY used by the Goproxy. When the
+	// "upstreams" is configured, the upstream proxies are tried in order
+	// and any error falls back to the next one. Otherwise, it is the
+	// GOPROXY of the environment.
+	goproxyUpstreams = newGoproxyUpstreams(
+		goproxyViper.GetStringSlice("upstreams"),
+	)
+
+	// upstreamCircuitBreakerThreshold is the number of consecutive failures
+	// of an upstream host that opens its circuit breaker. The circuit
+	// breakers are disabled when it is not positive.
+	upstreamCircuitBreakerThreshold = goproxyViper.GetInt64(
+		"circuit_breaker_threshold",
+	)
+
+	// upstreamCircuitBreakerCooldown is how long an open circuit breaker
+	// waits before letting a trial request through.
+	upstreamCircuitBreakerCooldown = goproxyViper.GetDuration(
+		"circuit_breaker_cooldown",
+	)
+
+	// upstreamHealths is the health of the upstream hosts.
+	upstreamHealths = map[string]*upstreamHealth{}
+
+	// upstreamHealthsMutex is used to protect the `upstreamHealths`.
+	upstreamHealthsMutex sync.Mutex
+)
+
+// newGoproxyUpstreams returns the GOPROXY that tries the upstreams in order.
+func newGoproxyUpstreams(upstreams []string) string {
+	if len(upstreams) == 0 {
+		if goproxy := os.Getenv("GOPROXY"); goproxy != "" {
+			return goproxy
+		}
+
+		return "https://proxy.golang.org,direct"
+	}
+
+	return strings.Join(upstreams, "|")
+}
+
+// upstreamHealth is the health of an upstream host.
+type upstreamHealth struct {
+	Host                string    `json:"host"`
+	Successes           int64     `json:"successes"`
+	Failures            int64     `json:"failures"`
+	ConsecutiveFailures int64     `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastSuccessAt       time.Time `json:"last_success_at,omitempty"`
+	LastFailureAt       time.Time `json:"last_failure_at,omitempty"`
+	OpenUntil           time.Time `json:"open_until,omitempty"`
+
+	trialing bool
+}
+
+func init() {
+	expvar.Publish("upstreams", expvar.Func(func() any {
+		return upstreamHealthList()
+	}))
+
+	if !adminEnabled {
+		return
+	}
+
+	base.Air.GET(
+		"/admin/upstreams",
+		hAdminUpstreams,
+		adminGas,
+		globalAdminGas,
+	)
+}
+
+// hAdminUpstreams handles requests to get the health of the upstream hosts.
+func hAdminUpstreams(req *air.Request, res *air.Response) error {
+	return res.WriteJSON(upstreamHealthList())
+}
+
+// upstreamHealthList returns a snapshot of the `upstreamHealths` sorted by
+// host.
+func upstreamHealthList() []upstreamHealth {
+	upstreamHealthsMutex.Lock()
+	defer upstreamHealthsMutex.Unlock()
+
+	uhs := make([]upstreamHealth, 0, len(upstreamHealths))
+	for _, uh := range upstreamHealths {
+		uhs = append(uhs, *uh)
+	}
+
+	sort.Slice(uhs, func(i, j int) bool {
+		return uhs[i].Host < uhs[j].Host
+	})
+
+	return uhs
+}
+
+// recordUpstreamResult records the result of a request to the upstream host.
+// A nil err means success.
+func recordUpstreamResult(host string, err error) {
+	if err != nil {
+		publishUpstreamFailureStreamEvent(host, err)
+	}
+
+	upstreamHealthsMutex.Lock()
+	defer upstreamHealthsMutex.Unlock()
+
+	uh, ok := upstreamHealths[host]
+	if !ok {
+		uh = &upstreamHealth{Host: host}
+		upstreamHealths[host] = uh
+	}
+
+	if err == nil {
+		uh.Successes++
+		uh.ConsecutiveFailures = 0
+		uh.LastSuccessAt = time.Now()
+		uh.OpenUntil = time.Time{}
+		uh.trialing = false
+		return
+	}
+
+	uh.Failures++
+	uh.ConsecutiveFailures++
+	uh.LastError = err.Error()
+	uh.LastFailureAt = time.Now()
+
+	if upstreamCircuitBreakerThreshold > 0 && (uh.trialing ||
+		uh.ConsecutiveFailures == upstreamCircuitBreakerThreshold) {
+		uh.OpenUntil = uh.LastFailureAt.Add(
+			upstreamCircuitBreakerCooldown,
+		)
+		uh.trialing = false
+
+		base.Logger.Warn().
+			Str("host", host).
+			Int64("consecutive_failures", uh.ConsecutiveFailures).
+			Time("open_until", uh.OpenUntil).
+			Msg("opened upstream circuit breaker")
+	}
+}
+
+// allowUpstreamRequest reports whether a request to the upstream host is
+// allowed by its circuit breaker. After the cooldown of an open circuit
+// breaker, one trial request is allowed in each cooldown until its result
+// closes the circuit breaker.
+func allowUpstreamRequest(host string) bool {
+	if upstreamCircuitBreakerThreshold <= 0 {
+		return true
+	}
+
+	upstreamHealthsMutex.Lock()
+	defer upstreamHealthsMutex.Unlock()
+
+	uh, ok := upstreamHealths[host]
+	if !ok || uh.OpenUntil.IsZero() {
+		return true
+	}
+
+	now := time.Now()
+	if now.Before(uh.OpenUntil) {
+		return false
+	}
+
+	uh.OpenUntil = now.Add(upstreamCircuitBreakerCooldown)
+	uh.trialing = true
+
+	return true
+}
+
+// upstreamTransport is an `http.RoundTripper` that tracks the health of the
+// upstream hosts and fast-fails the requests to those whose circuit breakers
+// are open.
+//
+// A fast-failed request gets a "404 Not Found" response with a "bad upstream"
+// body, which makes the Goproxy fall back to the next upstream in the
+// `goproxyUpstreams` without retrying, and finally to the cache for the
+// mutable endpoints, without the failure being cached by the clients.
+type upstreamTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (ut *upstreamTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	if !allowUpstreamRequest(req.URL.Host) {
+		return &http.Response{
+			Status:     "404 Not Found",
+			StatusCode: http.StatusNotFound,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body: io.NopCloser(strings.NewReader(
+				"bad upstream: circuit breaker open",
+			)),
+			ContentLength: -1,
+			Request:       req,
+		}, nil
+	}
+
+	statusComponent := "upstream"
+	if isSUMDBURL(req.URL) {
+		statusComponent = "sumdb"
+	}
+
+	startTime := time.Now()
+	res, err := ut.next.RoundTrip(req)
+	if err != nil {
+		if !errors.Is(req.Context().Err(), context.Canceled) {
+			recordUpstreamResult(req.URL.Host, err)
+			recordStatusSample(
+				statusComponent,
+				time.Since(startTime),
+				true,
+			)
+		}
+
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		recordUpstreamResult(req.URL.Host, fmt.Errorf(
+			"GET %s: %s",
+			req.URL.Redacted(),
+			res.Status,
+		))
+		recordStatusSample(statusComponent, time.Since(startTime), true)
+	default:
+		recordUpstreamResult(req.URL.Host, nil)
+		recordStatusSample(statusComponent, time.Since(startTime), false)
+	}
+
+	return res, nil
+}
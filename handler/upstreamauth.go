@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+// upstreamCredential is the credential used to fetch from a private upstream
+// proxy or VCS host.
+type upstreamCredential struct {
+	// Host is the host (with the port, if any) that the credential is sent
+	// to.
+	Host string `mapstructure:"host"`
+
+	// Username and Password are the basic authentication credential.
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+
+	// Token is the bearer token sent to the upstream proxies instead of
+	// the basic authentication credential. The VCS hosts get it as the
+	// password of the basic authentication, with the `Username` defaulting
+	// to "oauth2".
+	Token string `mapstructure:"token"`
+}
+
+// upstreamCredentials is the credentials of the private upstream proxies and
+// VCS hosts keyed by their hosts.
+var upstreamCredentials = map[string]*upstreamCredential{}
+
+func init() {
+	var ucs []*upstreamCredential
+	if err := goproxyViper.UnmarshalKey(
+		"upstream_credentials",
+		&ucs,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to unmarshal goproxy upstream credentials")
+	}
+
+	if netrcFile := goproxyViper.GetString(
+		"upstream_netrc_file",
+	); netrcFile != "" {
+		netrcUCs, err := parseNetrc(netrcFile)
+		if err != nil {
+			base.Logger.Fatal().Err(err).Msg(
+				"failed to parse goproxy upstream netrc file",
+			)
+		}
+
+		ucs = append(ucs, netrcUCs...)
+	}
+
+	for _, uc := range ucs {
+		if uc.Host == "" {
+			base.Logger.Fatal().
+				Msg("missing goproxy upstream credential host")
+		}
+
+		if _, ok := upstreamCredentials[uc.Host]; ok {
+			continue // The first one wins, like in a netrc file.
+		}
+
+		upstreamCredentials[uc.Host] = uc
+	}
+
+	if len(upstreamCredentials) == 0 {
+		return
+	}
+
+	netrcFile, err := writeUpstreamNetrc()
+	if err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to write goproxy upstream netrc file")
+	}
+
+	hhGoproxy.GoBinEnv = append(
+		hhGoproxy.GoBinEnv,
+		fmt.Sprint("NETRC=", netrcFile),
+	)
+	hhGoproxy.GoBinEnv = append(
+		hhGoproxy.GoBinEnv,
+		upstreamGitConfigEnv()...,
+	)
+}
+
+// vcsCredential returns the basic authentication credential of the uc used for
+// the VCS hosts.
+func (uc *upstreamCredential) vcsCredential() (string, string) {
+	if uc.Token == "" {
+		return uc.Username, uc.Password
+	}
+
+	if uc.Username == "" {
+		return "oauth2", uc.Token
+	}
+
+	return uc.Username, uc.Token
+}
+
+// parseNetrc parses the "machine" entries of the netrc file at the name into
+// the upstream credentials. The "default" entry and the macros are ignored.
+func parseNetrc(name string) ([]*upstreamCredential, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Split(bufio.ScanWords)
+
+	var (
+		ucs []*upstreamCredential
+		uc  *upstreamCredential
+	)
+
+	for s.Scan() {
+		switch s.Text() {
+		case "machine":
+			uc = &upstreamCredential{}
+			if s.Scan() {
+				uc.Host = s.Text()
+			}
+
+			ucs = append(ucs, uc)
+		case "default":
+			uc = nil
+		case "login":
+			if s.Scan() && uc != nil {
+				uc.Username = s.Text()
+			}
+		case "password":
+			if s.Scan() && uc != nil {
+				uc.Password = s.Text()
+			}
+		}
+	}
+
+	return ucs, s.Err()
+}
+
+// writeUpstreamNetrc writes the `upstreamCredentials` into a netrc file in the
+// `goproxyTempDir`, which is used by the go command, and returns its name.
+func writeUpstreamNetrc() (string, error) {
+	var sb strings.Builder
+	for host, uc := range upstreamCredentials {
+		username, password := uc.vcsCredential()
+		fmt.Fprintf(
+			&sb,
+			"machine %s login %s password %s\n",
+			strings.Split(host, ":")[0],
+			username,
+			password,
+		)
+	}
+
+	name := filepath.Join(goproxyTempDir, "netrc")
+	if err := os.WriteFile(name, []byte(sb.String()), 0o600); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// upstreamGitConfigEnv returns the environment variables that make the git,
+// which does not read the netrc file by itself, send the
+// `upstreamCredentials` to the VCS hosts over HTTPS. The git configurations
+// already passed through the environment variables are kept.
+func upstreamGitConfigEnv() []string {
+	count, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+
+	var env []string
+	for host, uc := range upstreamCredentials {
+		username, password := uc.vcsCredential()
+		baseURL := "https://" + host + "/"
+		authURL := "https://" + url.UserPassword(
+			username,
+			password,
+		).String() + "@" + host + "/"
+		env = append(
+			env,
+			fmt.Sprintf(
+				"GIT_CONFIG_KEY_%d=url.%s.insteadOf",
+				count,
+				authURL,
+			),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count, baseURL),
+		)
+		count++
+	}
+
+	return append(env, fmt.Sprint("GIT_CONFIG_COUNT=", count))
+}
+
+// upstreamAuthTransport is an `http.RoundTripper` that sends the
+// `upstreamCredentials` to the upstream proxies over HTTPS. The credentials
+// are never sent to other hosts, including those redirected to.
+type upstreamAuthTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (uat *upstreamAuthTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	uc, ok := upstreamCredentials[req.URL.Host]
+	if !ok ||
+		req.URL.Scheme != "https" ||
+		req.Header.Get("Authorization") != "" {
+		return uat.next.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	if uc.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+uc.Token)
+	} else {
+		req.SetBasicAuth(uc.Username, uc.Password)
+	}
+
+	return uat.next.RoundTrip(req)
+}
@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// vanityViper is used to get the configuration items of the vanity
+	// imports.
+	vanityViper = base.Viper.Sub("vanity")
+
+	// vanityEnabled indicates whether the vanity imports are served.
+	vanityEnabled = vanityViper.GetBool("enabled")
+
+	// vanityDocsURL is the base URL of the documentation site where the
+	// browsers visiting the vanity import paths are redirected to.
+	vanityDocsURL = strings.TrimSuffix(
+		vanityViper.GetString("docs_url"),
+		"/",
+	)
+
+	// vanityImports is the vanity imports keyed by their hosts.
+	vanityImports map[string][]*vanityImport
+)
+
+// vanityImport is a vanity import path prefix that maps to a VCS repository.
+type vanityImport struct {
+	// Prefix is the import path prefix, such as "go.example.com/foo",
+	// which must be the root path of the module in the repository.
+	Prefix string `mapstructure:"prefix"`
+
+	// VCS is the version control system of the repository, such as
+	// "git".
+	VCS string `mapstructure:"vcs"`
+
+	// RepoURL is the URL of the repository.
+	RepoURL string `mapstructure:"repo_url"`
+}
+
+func init() {
+	if !vanityEnabled {
+		return
+	}
+
+	var vis []*vanityImport
+	if err := vanityViper.UnmarshalKey("imports", &vis); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to unmarshal vanity imports")
+	}
+
+	vanityImports = map[string][]*vanityImport{}
+	for _, vi := range vis {
+		vi.Prefix = strings.Trim(vi.Prefix, "/")
+		host, _, _ := strings.Cut(vi.Prefix, "/")
+		if host == "" {
+			base.Logger.Fatal().
+				Str("prefix", vi.Prefix).
+				Msg("invalid vanity import prefix")
+		}
+
+		vi.Prefix = strings.ToLower(host) + vi.Prefix[len(host):]
+		host = strings.ToLower(host)
+
+		switch vi.VCS {
+		case "bzr", "fossil", "git", "hg", "svn", "mod":
+		default:
+			base.Logger.Fatal().
+				Str("vcs", vi.VCS).
+				Msg("unsupported vanity import vcs")
+		}
+
+		if u, err := url.Parse(vi.RepoURL); err != nil ||
+			u.Scheme == "" ||
+			u.Host == "" {
+			base.Logger.Fatal().
+				Str("repo_url", vi.RepoURL).
+				Msg("invalid vanity import repo url")
+		}
+
+		vanityImports[host] = append(vanityImports[host], vi)
+	}
+}
+
+// VanityGas is used to serve the vanity import paths. The requests with the
+// "go-get=1" query to the vanity import paths are answered with the go-import
+// meta tags, and the others to them are redirected to their documentation.
+// The requests to other paths are left to the next.
+func VanityGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if !vanityEnabled ||
+			(req.Method != http.MethodGet &&
+				req.Method != http.MethodHead) {
+			return next(req, res)
+		}
+
+		hr := req.HTTPRequest()
+		importPath, vi := matchVanityImport(req.Authority, hr.URL.Path)
+		if vi == nil {
+			return next(req, res)
+		}
+
+		return minutelyCachemanGas(func(
+			req *air.Request,
+			res *air.Response,
+		) error {
+			docsURL := vanityDocsURL + "/" + importPath
+			if hr.URL.Query().Get("go-get") != "1" {
+				return res.Redirect(docsURL)
+			}
+
+			return res.Render(map[string]any{
+				"ImportPath": importPath,
+				"Prefix":     vi.Prefix,
+				"VCS":        vi.VCS,
+				"RepoURL":    vi.RepoURL,
+				"DocsURL":    docsURL,
+			}, "vanity.html")
+		})(req, res)
+	}
+}
+
+// matchVanityImport returns the import path targeted by the authority and the
+// urlPath, and the vanity import with the longest prefix matching it. It
+// returns nil if there is no match.
+func matchVanityImport(
+	authority string,
+	urlPath string,
+) (string, *vanityImport) {
+	host := authority
+	if h, _, err := net.SplitHostPort(authority); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(host)
+
+	vis, ok := vanityImports[host]
+	if !ok {
+		return "", nil
+	}
+
+	importPath := strings.TrimSuffix(host+path.Clean("/"+urlPath), "/")
+
+	var matched *vanityImport
+	for _, vi := range vis {
+		if importPath != vi.Prefix &&
+			!strings.HasPrefix(importPath, vi.Prefix+"/") {
+			continue
+		}
+
+		if matched == nil || len(vi.Prefix) > len(matched.Prefix) {
+			matched = vi
+		}
+	}
+
+	return importPath, matched
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/mod/module"
+)
+
+var (
+	// warmupSchedule is the cron schedule of the Goproxy cache warm-up. The
+	// warm-up is disabled when it is empty.
+	warmupSchedule = goproxyViper.GetString("warmup_schedule")
+
+	// warmupTopK is the number of the most downloaded modules to warm up.
+	warmupTopK = goproxyViper.GetInt("warmup_top_k")
+)
+
+func init() {
+	if warmupSchedule == "" {
+		return
+	}
+
+	if _, err := base.Cron.AddJob(
+		warmupSchedule,
+		leaderJob("warmup", time.Hour, func() {
+			if err := warmUpGoproxyCaches(base.Context); err != nil {
+				base.Logger.Error().Err(err).
+					Msg("failed to warm up goproxy caches")
+			}
+		}),
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add warm-up cron job")
+	}
+}
+
+// warmUpGoproxyCaches resolves the latest versions of the `warmupTopK` most
+// downloaded modules in the last 7 days and pre-caches their .info, .mod and
+// .zip files.
+func warmUpGoproxyCaches(ctx context.Context) error {
+	var trends []struct {
+		ModulePath string `json:"module_path"`
+	}
+
+	if err := getStatObject(
+		ctx,
+		"stats/trends/last-7-days",
+		&trends,
+	); err != nil {
+		return err
+	}
+
+	if len(trends) > warmupTopK {
+		trends = trends[:warmupTopK]
+	}
+
+	var warmedUp int
+	for _, trend := range trends {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := warmUpModule(ctx, trend.ModulePath); err != nil {
+			base.Logger.Warn().Err(err).
+				Str("module_path", trend.ModulePath).
+				Msg("failed to warm up module")
+			continue
+		}
+
+		warmedUp++
+	}
+
+	base.Logger.Info().
+		Int("module_count", warmedUp).
+		Msg("warmed up goproxy caches")
+
+	return nil
+}
+
+// warmUpModule resolves the latest version of the module targeted by the
+// modulePath and pre-caches its .info, .mod and .zip files.
+func warmUpModule(ctx context.Context, modulePath string) error {
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withGoproxyFetchTimeout(ctx, "zip")
+	defer cancel()
+
+	rw := &internalResponseWriter{}
+	if err := serveGoproxyInternally(
+		ctx,
+		rw,
+		fmt.Sprint(escapedModulePath, "/@latest"),
+	); err != nil {
+		return err
+	}
+
+	var info struct {
+		Version string
+	}
+
+	if err := json.Unmarshal(rw.body, &info); err != nil {
+		return err
+	}
+
+	escapedModuleVersion, err := module.EscapeVersion(info.Version)
+	if err != nil {
+		return err
+	}
+
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		if err := serveGoproxyInternally(
+			ctx,
+			&internalResponseWriter{discard: true},
+			fmt.Sprint(
+				escapedModulePath,
+				"/@v/",
+				escapedModuleVersion,
+				ext,
+			),
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
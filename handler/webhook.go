@@ -0,0 +1,384 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/mod/module"
+)
+
+var (
+	// webhooks is the registered webhooks.
+	webhooks []webhook
+
+	// webhooksMutex is used to protect the `webhooks`.
+	webhooksMutex sync.RWMutex
+
+	// webhookQueue is the queue of the webhook deliveries.
+	webhookQueue = make(chan *webhookDelivery, 1000)
+
+	// webhookHTTPClient is the HTTP client used to deliver the webhooks.
+	webhookHTTPClient = &http.Client{
+		Timeout: 10 * time.Second,
+	}
+)
+
+const (
+	// webhooksObjectName is the name of the object that persists the
+	// webhooks in the Qiniu Cloud Kodo.
+	webhooksObjectName = "webhooks"
+
+	// webhookDeliveryWorkers is the number of the concurrent webhook
+	// deliveries.
+	webhookDeliveryWorkers = 4
+
+	// webhookDeliveryAttempts is the maximum number of the attempts of a
+	// webhook delivery.
+	webhookDeliveryAttempts = 3
+)
+
+// webhook is a webhook that is fired when a new version of a module matching
+// the pattern (see the `module.MatchPrefixPatterns`) is first cached.
+type webhook struct {
+	ID      string `json:"id"`
+	Pattern string `json:"pattern"`
+	URL     string `json:"url"`
+	Secret  string `json:"secret,omitempty"`
+}
+
+// webhookPayload is the payload of a webhook delivery.
+type webhookPayload struct {
+	Event         string    `json:"event"`
+	ModulePath    string    `json:"module_path"`
+	ModuleVersion string    `json:"module_version"`
+	CachedAt      time.Time `json:"cached_at"`
+}
+
+// webhookDelivery is a pending delivery of a webhook.
+type webhookDelivery struct {
+	webhook webhook
+	payload []byte
+}
+
+func init() {
+	if err := loadWebhooks(base.Context); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to load webhooks")
+	}
+
+	if _, err := base.Cron.AddFunc(
+		"* * * * *", // Every minute
+		func() {
+			if err := loadWebhooks(base.Context); err != nil {
+				base.Logger.Error().Err(err).
+					Msg("failed to load webhooks")
+			}
+		},
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add webhook load cron job")
+	}
+
+	for i := 0; i < webhookDeliveryWorkers; i++ {
+		go func() {
+			for wd := range webhookQueue {
+				deliverWebhook(wd)
+			}
+		}()
+	}
+
+	if !adminEnabled {
+		return
+	}
+
+	base.Air.GET(
+		"/admin/webhooks",
+		hAdminWebhooks,
+		adminGas,
+		globalAdminGas,
+	)
+	base.Air.POST(
+		"/admin/webhooks",
+		hAdminAddWebhook,
+		adminGas,
+		globalAdminGas,
+	)
+	base.Air.DELETE(
+		"/admin/webhooks",
+		hAdminRemoveWebhook,
+		adminGas,
+		globalAdminGas,
+	)
+}
+
+// loadWebhooks loads the `webhooks` from the Qiniu Cloud Kodo.
+func loadWebhooks(ctx context.Context) error {
+	var whs []webhook
+	if err := getStatObject(
+		ctx,
+		webhooksObjectName,
+		&whs,
+	); err != nil && !isNotFoundMinIOError(err) {
+		return err
+	}
+
+	webhooksMutex.Lock()
+	webhooks = whs
+	webhooksMutex.Unlock()
+
+	return nil
+}
+
+// updateWebhooks updates the `webhooks` with the f and persists them to the
+// Qiniu Cloud Kodo.
+func updateWebhooks(ctx context.Context, f func([]webhook) []webhook) error {
+	if err := loadWebhooks(ctx); err != nil {
+		return err
+	}
+
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+
+	whs := f(append([]webhook(nil), webhooks...))
+	if err := putStatObject(ctx, webhooksObjectName, whs); err != nil {
+		return err
+	}
+
+	webhooks = whs
+
+	return nil
+}
+
+// fireWebhooks queues the deliveries of the webhooks matching the newly cached
+// mv. The deliveries are dropped if the queue is full, so that the caching is
+// never blocked by the webhook receivers.
+func fireWebhooks(mv module.Version) {
+	webhooksMutex.RLock()
+	defer webhooksMutex.RUnlock()
+
+	var payload []byte
+	for _, wh := range webhooks {
+		if !module.MatchPrefixPatterns(wh.Pattern, mv.Path) {
+			continue
+		}
+
+		if payload == nil {
+			payload, _ = json.Marshal(webhookPayload{
+				Event:         "module_version_cached",
+				ModulePath:    mv.Path,
+				ModuleVersion: mv.Version,
+				CachedAt:      time.Now().UTC(),
+			})
+		}
+
+		select {
+		case webhookQueue <- &webhookDelivery{
+			webhook: wh,
+			payload: payload,
+		}:
+		default:
+			base.Logger.Warn().
+				Str("webhook_id", wh.ID).
+				Str("module", mv.String()).
+				Msg("dropped webhook delivery due to full queue")
+		}
+	}
+}
+
+// deliverWebhook delivers the wd, retrying up to `webhookDeliveryAttempts`
+// times with an exponential backoff.
+func deliverWebhook(wd *webhookDelivery) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(base.Context, wd)
+		if err == nil {
+			return
+		}
+
+		if base.Context.Err() != nil ||
+			attempt == webhookDeliveryAttempts {
+			base.Logger.Error().Err(err).
+				Str("webhook_id", wd.webhook.ID).
+				Msg("failed to deliver webhook")
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-base.Context.Done():
+			return
+		}
+
+		backoff *= 2
+	}
+}
+
+// postWebhook posts the payload of the wd to its webhook once. The payload is
+// signed with the secret of the webhook as an HMAC-SHA256 in the
+// X-Goproxy-Signature header, so that the receiver can verify it.
+func postWebhook(ctx context.Context, wd *webhookDelivery) error {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		wd.webhook.URL,
+		bytes.NewReader(wd.payload),
+	)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "goproxy.cn-webhook")
+	req.Header.Set("X-Goproxy-Event", "module_version_cached")
+	if wd.webhook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wd.webhook.Secret))
+		mac.Write(wd.payload)
+		req.Header.Set(
+			"X-Goproxy-Signature",
+			"sha256="+hex.EncodeToString(mac.Sum(nil)),
+		)
+	}
+
+	res, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<20))
+
+	if res.StatusCode < http.StatusOK ||
+		res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("POST %s: %s", wd.webhook.URL, res.Status)
+	}
+
+	return nil
+}
+
+// hAdminWebhooks handles requests to list the webhooks. The secrets are
+// omitted.
+func hAdminWebhooks(req *air.Request, res *air.Response) error {
+	webhooksMutex.RLock()
+	defer webhooksMutex.RUnlock()
+
+	whs := make([]webhook, 0, len(webhooks))
+	for _, wh := range webhooks {
+		wh.Secret = ""
+		whs = append(whs, wh)
+	}
+
+	return res.WriteJSON(whs)
+}
+
+// hAdminAddWebhook handles requests to register a webhook. The response carries
+// the generated secret of the webhook, which is never shown again.
+func hAdminAddWebhook(req *air.Request, res *air.Response) error {
+	var pattern, rawURL string
+	if p := req.Param("pattern"); p != nil {
+		pattern = p.Value().String()
+	}
+
+	if p := req.Param("url"); p != nil {
+		rawURL = p.Value().String()
+	}
+
+	if pattern == "" || strings.ContainsAny(pattern, ",@") {
+		res.Status = http.StatusBadRequest
+		return errors.New("invalid module pattern")
+	}
+
+	if u, err := url.Parse(rawURL); err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		res.Status = http.StatusBadRequest
+		return errors.New("invalid webhook url")
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	wh := webhook{
+		ID:      hex.EncodeToString(b[:8]),
+		Pattern: pattern,
+		URL:     rawURL,
+		Secret:  hex.EncodeToString(b[8:]),
+	}
+
+	if err := updateWebhooks(req.Context, func(
+		whs []webhook,
+	) []webhook {
+		return append(whs, wh)
+	}); err != nil {
+		return err
+	}
+
+	base.Logger.Info().
+		Str("webhook_id", wh.ID).
+		Str("pattern", wh.Pattern).
+		Str("url", wh.URL).
+		Str("client_address", req.ClientAddress()).
+		Msg("added webhook")
+
+	res.Status = http.StatusCreated
+
+	return res.WriteJSON(wh)
+}
+
+// hAdminRemoveWebhook handles requests to remove a webhook.
+func hAdminRemoveWebhook(req *air.Request, res *air.Response) error {
+	var id string
+	if p := req.Param("id"); p != nil {
+		id = p.Value().String()
+	}
+
+	if id == "" {
+		res.Status = http.StatusBadRequest
+		return errors.New("invalid webhook id")
+	}
+
+	found := false
+	if err := updateWebhooks(req.Context, func(
+		whs []webhook,
+	) []webhook {
+		for i, wh := range whs {
+			if wh.ID == id {
+				found = true
+				return append(whs[:i], whs[i+1:]...)
+			}
+		}
+
+		return whs
+	}); err != nil {
+		return err
+	}
+
+	if !found {
+		return NotFound(req, res)
+	}
+
+	base.Logger.Info().
+		Str("webhook_id", id).
+		Str("client_address", req.ClientAddress()).
+		Msg("removed webhook")
+
+	res.Status = http.StatusNoContent
+
+	return res.Write(nil)
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// zipSizeLimit is the maximum size of the zip files that can be fetched
+	// and cached. There is no limit when it is not positive.
+	zipSizeLimit = goproxyViper.GetInt64("max_zip_size")
+
+	// zipSizeRejections is the number of the rejected oversized zip files.
+	zipSizeRejections = expvar.NewInt("zip_size_rejections")
+
+	// errZipTooLarge is the error returned when a zip file exceeds the
+	// `zipSizeLimit`.
+	errZipTooLarge = errors.New("zip file too large")
+)
+
+// zipSizeLimitKey is the key of the `zipSizeLimitState` in the context of a
+// request.
+type zipSizeLimitKey struct{}
+
+// zipSizeLimitState records whether the zip file fetched for a request has
+// been rejected for exceeding the `zipSizeLimit`.
+type zipSizeLimitState struct {
+	exceeded atomic.Bool
+}
+
+// withZipSizeLimit returns a copy of the ctx that records whether the zip file
+// fetched with it is rejected for exceeding the `zipSizeLimit`.
+func withZipSizeLimit(ctx context.Context) context.Context {
+	if zipSizeLimit <= 0 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, zipSizeLimitKey{}, &zipSizeLimitState{})
+}
+
+// isZipTooLarge reports whether the zip file fetched with the ctx has been
+// rejected for exceeding the `zipSizeLimit`.
+func isZipTooLarge(ctx context.Context) bool {
+	zsls, ok := ctx.Value(zipSizeLimitKey{}).(*zipSizeLimitState)
+	return ok && zsls.exceeded.Load()
+}
+
+// rejectZip records the rejection of the oversized zip file fetched by the req
+// with at least the size.
+func rejectZip(req *http.Request, size int64) {
+	zsls, ok := req.Context().Value(zipSizeLimitKey{}).(*zipSizeLimitState)
+	if ok {
+		zsls.exceeded.Store(true)
+	}
+
+	zipSizeRejections.Add(1)
+	base.Logger.Warn().
+		Str("url", req.URL.String()).
+		Str("request_id", requestIDOf(req.Context())).
+		Int64("size", size).
+		Int64("max_zip_size", zipSizeLimit).
+		Msg("rejected oversized zip file")
+}
+
+// zipSizeLimitingTransport is an `http.RoundTripper` that rejects the zip files
+// exceeding the `zipSizeLimit`, either by their Content-Length or once too
+// many bytes of them have been read, so that they never reach the disk or the
+// Qiniu Cloud Kodo.
+type zipSizeLimitingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (zslt *zipSizeLimitingTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	if zipSizeLimit <= 0 ||
+		req.Method != http.MethodGet ||
+		!strings.HasSuffix(req.URL.Path, ".zip") {
+		return zslt.next.RoundTrip(req)
+	}
+
+	res, err := zslt.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return res, nil
+	}
+
+	if res.ContentLength > zipSizeLimit {
+		res.Body.Close()
+		rejectZip(req, res.ContentLength)
+		return nil, errZipTooLarge
+	}
+
+	res.Body = &zipSizeLimitedBody{
+		ReadCloser: res.Body,
+		req:        req,
+	}
+
+	return res, nil
+}
+
+// zipSizeLimitedBody is the body of a zip file that fails once more than the
+// `zipSizeLimit` bytes have been read from it.
+type zipSizeLimitedBody struct {
+	io.ReadCloser
+
+	req  *http.Request
+	read int64
+}
+
+// Read implements the `io.Reader`.
+func (zslb *zipSizeLimitedBody) Read(p []byte) (int, error) {
+	if zslb.read > zipSizeLimit {
+		return 0, errZipTooLarge
+	}
+
+	n, err := zslb.ReadCloser.Read(p)
+	zslb.read += int64(n)
+	if zslb.read > zipSizeLimit {
+		rejectZip(zslb.req, zslb.read)
+		return n, errZipTooLarge
+	}
+
+	return n, err
+}
+
+// zipSizeLimitResponseWriter is an `http.ResponseWriter` that replaces the
+// error response of a request whose zip file has been rejected for exceeding
+// the `zipSizeLimit` with a 413 response.
+type zipSizeLimitResponseWriter struct {
+	http.ResponseWriter
+
+	ctx      context.Context
+	rejected bool
+}
+
+// WriteHeader implements the `http.ResponseWriter`.
+func (zslrw *zipSizeLimitResponseWriter) WriteHeader(status int) {
+	if status < http.StatusBadRequest || !isZipTooLarge(zslrw.ctx) {
+		zslrw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	zslrw.rejected = true
+	writeZipTooLarge(zslrw.ResponseWriter)
+}
+
+// Write implements the `http.ResponseWriter`.
+func (zslrw *zipSizeLimitResponseWriter) Write(b []byte) (int, error) {
+	if zslrw.rejected {
+		return len(b), nil
+	}
+
+	return zslrw.ResponseWriter.Write(b)
+}
+
+// writeZipTooLarge writes the 413 response of a rejected oversized zip file to
+// the rw.
+func writeZipTooLarge(rw http.ResponseWriter) {
+	rw.Header().Del("Content-Length")
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Cache-Control", "public, max-age=60")
+	rw.WriteHeader(http.StatusRequestEntityTooLarge)
+	io.WriteString(rw, errZipTooLarge.Error())
+}
@@ -0,0 +1,491 @@
+// Package cacheencryption implements the format of the Goproxy caches that are
+// encrypted on the client side.
+//
+// An encrypted Goproxy cache starts with a header made of the `Magic`, the
+// length and the ID of the key, and a random salt of the `SaltSize`, followed
+// by the content in chunks of the `ChunkSize` sealed with the AES-GCM under the
+// data key derived from the key and the salt. Each chunk is sealed separately
+// so that it can be seeked without being decrypted from the start, and the
+// last one is marked so that the truncation at a chunk boundary can be
+// detected.
+package cacheencryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// Magic is the magic number that starts the header of an encrypted
+	// Goproxy cache.
+	Magic = "GPCE\x01"
+
+	// KeySize is the size of the keys.
+	KeySize = 32
+
+	// SaltSize is the size of the random salt in the header of an
+	// encrypted Goproxy cache, from which its data key is derived.
+	SaltSize = 32
+
+	// ChunkSize is the size of the plaintext chunks of an encrypted Goproxy
+	// cache.
+	ChunkSize = 64 << 10
+
+	// Overhead is the size of the authentication tag of each chunk of an
+	// encrypted Goproxy cache.
+	Overhead = 16
+
+	// sealedChunkSize is the size of each sealed chunk but the last.
+	sealedChunkSize = ChunkSize + Overhead
+)
+
+// Encrypter is an `io.ReadSeeker` that encrypts a content. It seals the chunks
+// as they are read.
+type Encrypter struct {
+	chunkCipher
+
+	keyID   string
+	key     []byte
+	salt    []byte
+	content io.ReadSeeker
+}
+
+// ReaderAtEncrypter is an `Encrypter` of a content that is also an
+// `io.ReaderAt`, which makes it an `io.ReaderAt` too.
+type ReaderAtEncrypter struct {
+	*Encrypter
+}
+
+// NewEncrypter returns a new instance of the `Encrypter` that encrypts the
+// content with the key whose ID is the keyID, under a random salt. It returns
+// a `ReaderAtEncrypter` if the content is an `io.ReaderAt`.
+func NewEncrypter(
+	keyID string,
+	key []byte,
+	content io.ReadSeeker,
+) (io.ReadSeeker, error) {
+	if keyID == "" || len(keyID) > 255 {
+		return nil, fmt.Errorf("invalid key id %q", keyID)
+	}
+
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key size %d", len(key))
+	}
+
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Encrypter{
+		chunkCipher: chunkCipher{plainSize: size},
+		keyID:       keyID,
+		key:         key,
+		content:     content,
+	}
+	if err := e.SetSalt(nil); err != nil {
+		return nil, err
+	}
+
+	if _, ok := content.(io.ReaderAt); ok {
+		return ReaderAtEncrypter{e}, nil
+	}
+
+	return e, nil
+}
+
+// EncrypterOf returns the `Encrypter` of the r, or nil if the r is not one.
+func EncrypterOf(r io.Reader) *Encrypter {
+	switch r := r.(type) {
+	case *Encrypter:
+		return r
+	case ReaderAtEncrypter:
+		return r.Encrypter
+	}
+
+	return nil
+}
+
+// Salt returns the salt of the e.
+func (e *Encrypter) Salt() []byte {
+	return e.salt
+}
+
+// SetSalt sets the salt of the e, or a random one if the salt is nil, and
+// seeks the e back to the start. Reusing a salt for a different content breaks
+// the encryption, so the `Fingerprint` must be checked first.
+func (e *Encrypter) SetSalt(salt []byte) error {
+	if salt == nil {
+		salt = make([]byte, SaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+	} else if len(salt) != SaltSize {
+		return fmt.Errorf("invalid salt size %d", len(salt))
+	}
+
+	aead, err := dataKeyAEAD(e.key, salt)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, len(Magic)+1+len(e.keyID)+SaltSize)
+	header = append(header, Magic...)
+	header = append(header, byte(len(e.keyID)))
+	header = append(header, e.keyID...)
+	header = append(header, salt...)
+
+	e.aead = aead
+	e.header = header
+	e.salt = bytes.Clone(salt)
+	e.offset = 0
+	e.chunk = -1
+	e.buf = nil
+
+	return nil
+}
+
+// Fingerprint returns the HMAC-SHA256 of the content of the e keyed by the key
+// of the e and bound to its header. It tells whether two `Encrypter`s with the
+// same salt encrypt the same content without revealing anything about it.
+func (e *Encrypter) Fingerprint() ([]byte, error) {
+	var r io.Reader
+	if ra, ok := e.content.(io.ReaderAt); ok {
+		r = io.NewSectionReader(ra, 0, e.plainSize)
+	} else if _, err := e.content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	} else {
+		r = io.LimitReader(e.content, e.plainSize)
+	}
+
+	// The content is seeked by the `Read` again before it is read.
+	e.chunk = -1
+
+	mac := hmac.New(sha256.New, e.key)
+	mac.Write(e.header)
+	if n, err := io.Copy(mac, r); err != nil {
+		return nil, err
+	} else if n != e.plainSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return mac.Sum(nil), nil
+}
+
+// Size returns the size of the encrypted content of the e.
+func (e *Encrypter) Size() int64 {
+	return int64(len(e.header)) + e.plainSize + e.chunks()*Overhead
+}
+
+// Read implements the `io.Reader`.
+func (e *Encrypter) Read(b []byte) (int, error) {
+	if e.offset >= e.Size() {
+		return 0, io.EOF
+	}
+
+	if e.offset < int64(len(e.header)) {
+		n := copy(b, e.header[e.offset:])
+		e.offset += int64(n)
+		return n, nil
+	}
+
+	pos := e.offset - int64(len(e.header))
+	i := pos / sealedChunkSize
+	if i != e.chunk {
+		if _, err := e.content.Seek(
+			i*ChunkSize,
+			io.SeekStart,
+		); err != nil {
+			return 0, err
+		}
+
+		plain := make([]byte, e.chunkPlainSize(i))
+		if _, err := io.ReadFull(e.content, plain); err != nil {
+			return 0, err
+		}
+
+		e.buf = e.seal(i, plain)
+		e.chunk = i
+	}
+
+	n := copy(b, e.buf[pos-i*sealedChunkSize:])
+	e.offset += int64(n)
+
+	return n, nil
+}
+
+// Seek implements the `io.Seeker`.
+func (e *Encrypter) Seek(offset int64, whence int) (int64, error) {
+	return e.seek(offset, whence, e.Size())
+}
+
+// seal seals the plain as the i-th chunk of the e.
+func (e *Encrypter) seal(i int64, plain []byte) []byte {
+	nonce, ad := e.nonceAndAD(i)
+	return e.aead.Seal(plain[:0], nonce, plain, ad)
+}
+
+// ReadAt implements the `io.ReaderAt`. Unlike the `Read`, it leaves the state
+// of the rae untouched, so it can be called concurrently, and the chunks can
+// be sealed in parallel.
+func (rae ReaderAtEncrypter) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	ra := rae.content.(io.ReaderAt)
+	size := rae.Size()
+	n := 0
+	for n < len(b) && off < size {
+		var m int
+		if off < int64(len(rae.header)) {
+			m = copy(b[n:], rae.header[off:])
+		} else {
+			pos := off - int64(len(rae.header))
+			i := pos / sealedChunkSize
+			plain := make([]byte, rae.chunkPlainSize(i))
+			if _, err := io.ReadFull(io.NewSectionReader(
+				ra,
+				i*ChunkSize,
+				int64(len(plain)),
+			), plain); err != nil {
+				return n, err
+			}
+
+			sealed := rae.seal(i, plain)
+			m = copy(b[n:], sealed[pos-i*sealedChunkSize:])
+		}
+
+		n += m
+		off += int64(m)
+	}
+
+	if n < len(b) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Decrypter is an `io.ReadSeekCloser` that decrypts an encrypted object. It
+// opens the chunks as they are read, and fails if any of them has been
+// tampered with.
+type Decrypter struct {
+	chunkCipher
+
+	object    io.ReadSeekCloser
+	objectPos int64
+}
+
+// NewDecrypter returns a new instance of the `Decrypter` for the object with
+// the size, whose key is looked up by its ID with the keyOf. It returns nil if
+// the object has not been encrypted, in which case the object is seeked back
+// to the start.
+func NewDecrypter(
+	object io.ReadSeekCloser,
+	size int64,
+	keyOf func(keyID string) []byte,
+) (*Decrypter, error) {
+	prefix := make([]byte, len(Magic)+1)
+	if n, err := io.ReadFull(object, prefix); err != nil ||
+		string(prefix[:len(Magic)]) != Magic {
+		if n == 0 && err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if _, err := object.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+
+	rest := make([]byte, int(prefix[len(prefix)-1])+SaltSize)
+	if _, err := io.ReadFull(object, rest); err != nil {
+		return nil, err
+	}
+
+	keyID := string(rest[:len(rest)-SaltSize])
+	key := keyOf(keyID)
+	if key == nil {
+		return nil, fmt.Errorf("unknown key id %q", keyID)
+	}
+
+	aead, err := dataKeyAEAD(key, rest[len(rest)-SaltSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(prefix, rest...)
+	sealedSize := size - int64(len(header))
+	chunks := max((sealedSize+sealedChunkSize-1)/sealedChunkSize, 1)
+	plainSize := sealedSize - chunks*Overhead
+	if plainSize < 0 {
+		return nil, errors.New("truncated encrypted object")
+	}
+
+	return &Decrypter{
+		chunkCipher: chunkCipher{
+			aead:      aead,
+			header:    header,
+			plainSize: plainSize,
+			chunk:     -1,
+		},
+		object:    object,
+		objectPos: int64(len(header)),
+	}, nil
+}
+
+// Size returns the size of the decrypted object of the d.
+func (d *Decrypter) Size() int64 {
+	return d.plainSize
+}
+
+// Read implements the `io.Reader`.
+func (d *Decrypter) Read(b []byte) (int, error) {
+	// The only chunk of an empty content is still opened to authenticate
+	// it.
+	if d.offset >= d.plainSize && (d.plainSize > 0 || d.chunk == 0) {
+		return 0, io.EOF
+	}
+
+	i := min(d.offset, d.plainSize) / ChunkSize
+	if i != d.chunk {
+		// The object is only seeked when it is not read sequentially,
+		// since a seek makes it issue a new request.
+		pos := int64(len(d.header)) + i*sealedChunkSize
+		if pos != d.objectPos {
+			if _, err := d.object.Seek(
+				pos,
+				io.SeekStart,
+			); err != nil {
+				return 0, err
+			}
+
+			d.objectPos = pos
+		}
+
+		sealed := make([]byte, d.chunkPlainSize(i)+Overhead)
+		n, err := io.ReadFull(d.object, sealed)
+		d.objectPos += int64(n)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+
+			return 0, err
+		}
+
+		// The current chunk is kept if the i-th one fails to open,
+		// so that it can still be read after seeking back to it.
+		nonce, ad := d.nonceAndAD(i)
+		buf, err := d.aead.Open(sealed[:0], nonce, sealed, ad)
+		if err != nil {
+			return 0, err
+		}
+
+		d.buf = buf
+		d.chunk = i
+	}
+
+	if d.offset >= d.plainSize {
+		return 0, io.EOF
+	}
+
+	n := copy(b, d.buf[d.offset-i*ChunkSize:])
+	d.offset += int64(n)
+
+	return n, nil
+}
+
+// Seek implements the `io.Seeker`.
+func (d *Decrypter) Seek(offset int64, whence int) (int64, error) {
+	return d.seek(offset, whence, d.plainSize)
+}
+
+// Close implements the `io.Closer`.
+func (d *Decrypter) Close() error {
+	return d.object.Close()
+}
+
+// chunkCipher is the state shared by the `Encrypter` and the `Decrypter`.
+type chunkCipher struct {
+	aead      cipher.AEAD
+	header    []byte
+	plainSize int64
+	offset    int64
+	chunk     int64
+	buf       []byte
+}
+
+// chunks returns the number of the chunks of the c, which is at least one so
+// that the truncation of an empty content can be detected.
+func (c *chunkCipher) chunks() int64 {
+	return max((c.plainSize+ChunkSize-1)/ChunkSize, 1)
+}
+
+// chunkPlainSize returns the plaintext size of the i-th chunk of the c.
+func (c *chunkCipher) chunkPlainSize(i int64) int {
+	return int(min(c.plainSize-i*ChunkSize, ChunkSize))
+}
+
+// nonceAndAD returns the nonce and the additional data of the i-th chunk of the
+// c. The additional data marks the last chunk.
+func (c *chunkCipher) nonceAndAD(i int64) ([]byte, []byte) {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(i))
+
+	ad := append(bytes.Clone(c.header), 0)
+	if i == c.chunks()-1 {
+		ad[len(ad)-1] = 1
+	}
+
+	return nonce, ad
+}
+
+// seek implements the `io.Seeker` with the size.
+func (c *chunkCipher) seek(
+	offset int64,
+	whence int,
+	size int64,
+) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.offset
+	case io.SeekEnd:
+		offset += size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	c.offset = offset
+
+	return offset, nil
+}
+
+// dataKeyAEAD returns the `cipher.AEAD` of the data key derived from the key
+// and the salt.
+func dataKeyAEAD(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,365 @@
+package cacheencryption
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var (
+	testKeyID = "test"
+	testKey   = bytes.Repeat([]byte{0x42}, KeySize)
+)
+
+// readSeekNopCloser is an `io.ReadSeekCloser` whose Close does nothing.
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+// Close implements the `io.Closer`.
+func (readSeekNopCloser) Close() error {
+	return nil
+}
+
+// readSeeker hides all methods of its `io.ReadSeeker` but the Read and the
+// Seek, such as the ReadAt of the `bytes.Reader`.
+type readSeeker struct {
+	io.ReadSeeker
+}
+
+func testContent(size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(b)
+	return b
+}
+
+func testKeyOf(keyID string) []byte {
+	if keyID == testKeyID {
+		return testKey
+	}
+
+	return nil
+}
+
+func encrypt(t *testing.T, content io.ReadSeeker) (io.ReadSeeker, []byte) {
+	t.Helper()
+
+	e, err := NewEncrypter(testKeyID, testKey, content)
+	if err != nil {
+		t.Fatalf("NewEncrypter: %v", err)
+	}
+
+	sealed, err := io.ReadAll(e)
+	if err != nil {
+		t.Fatalf("reading encrypter: %v", err)
+	}
+
+	if got, want := int64(len(sealed)), EncrypterOf(e).Size(); got != want {
+		t.Fatalf("got %d encrypted bytes, want %d", got, want)
+	}
+
+	return e, sealed
+}
+
+func newDecrypter(t *testing.T, sealed []byte) *Decrypter {
+	t.Helper()
+
+	d, err := NewDecrypter(
+		readSeekNopCloser{bytes.NewReader(sealed)},
+		int64(len(sealed)),
+		testKeyOf,
+	)
+	if err != nil {
+		t.Fatalf("NewDecrypter: %v", err)
+	} else if d == nil {
+		t.Fatal("NewDecrypter returned nil for encrypted object")
+	}
+
+	return d
+}
+
+var testSizes = []int{
+	0,
+	1,
+	ChunkSize - 1,
+	ChunkSize,
+	ChunkSize + 1,
+	3*ChunkSize + 5,
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, size := range testSizes {
+		plain := testContent(size)
+		for _, content := range []io.ReadSeeker{
+			bytes.NewReader(plain),
+			readSeeker{bytes.NewReader(plain)},
+		} {
+			_, sealed := encrypt(t, content)
+
+			d := newDecrypter(t, sealed)
+			if got := d.Size(); got != int64(size) {
+				t.Errorf("size %d: got decrypted size %d",
+					size, got)
+			}
+
+			got, err := io.ReadAll(d)
+			if err != nil {
+				t.Fatalf("size %d: reading decrypter: %v",
+					size, err)
+			}
+
+			if !bytes.Equal(got, plain) {
+				t.Errorf("size %d: decrypted content differs",
+					size)
+			}
+		}
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	for _, size := range testSizes {
+		plain := testContent(size)
+		e, sealed := encrypt(t, bytes.NewReader(plain))
+
+		rae, ok := e.(io.ReaderAt)
+		if !ok {
+			t.Fatalf("size %d: encrypter is not io.ReaderAt", size)
+		}
+
+		got := make([]byte, len(sealed))
+		if n, err := rae.ReadAt(got, 0); err != nil || n != len(got) {
+			t.Fatalf("size %d: ReadAt = %d, %v", size, n, err)
+		}
+
+		if !bytes.Equal(got, sealed) {
+			t.Errorf("size %d: ReadAt differs from Read", size)
+		}
+
+		// Reads straddling the chunk boundaries.
+		headerSize := len(sealed) - int(EncrypterOf(e).plainSize) -
+			int(EncrypterOf(e).chunks())*Overhead
+		for off := headerSize - 3; off < len(sealed); {
+			b := make([]byte, 7)
+			n, err := rae.ReadAt(b, int64(off))
+			want := sealed[off:min(off+len(b), len(sealed))]
+			if !bytes.Equal(b[:n], want) {
+				t.Errorf("size %d: ReadAt at %d differs",
+					size, off)
+			}
+
+			if n < len(b) && err != io.EOF {
+				t.Errorf("size %d: short ReadAt at %d: %v",
+					size, off, err)
+			}
+
+			off += sealedChunkSize
+		}
+
+		if _, err := rae.ReadAt(
+			make([]byte, 1),
+			int64(len(sealed)),
+		); err != io.EOF {
+			t.Errorf("size %d: got %v at the end, want io.EOF",
+				size, err)
+		}
+	}
+
+	if _, ok := encryptNoReaderAt(t).(io.ReaderAt); ok {
+		t.Error("encrypter of a non-io.ReaderAt is an io.ReaderAt")
+	}
+}
+
+func encryptNoReaderAt(t *testing.T) io.ReadSeeker {
+	t.Helper()
+
+	e, _ := encrypt(t, readSeeker{bytes.NewReader(testContent(10))})
+	return e
+}
+
+func TestSeekAtChunkBoundaries(t *testing.T) {
+	size := 3*ChunkSize + 5
+	plain := testContent(size)
+	e, sealed := encrypt(t, bytes.NewReader(plain))
+	d := newDecrypter(t, sealed)
+
+	for _, off := range []int{
+		2 * ChunkSize,
+		0,
+		ChunkSize - 1,
+		ChunkSize,
+		ChunkSize + 1,
+		3 * ChunkSize,
+		size - 1,
+		size,
+	} {
+		if pos, err := d.Seek(int64(off), io.SeekStart); err != nil ||
+			pos != int64(off) {
+			t.Fatalf("Seek(%d) = %d, %v", off, pos, err)
+		}
+
+		got, err := io.ReadAll(io.LimitReader(d, 100))
+		if err != nil {
+			t.Fatalf("reading at %d: %v", off, err)
+		}
+
+		if want := plain[off:min(off+100, size)]; !bytes.Equal(
+			got,
+			want,
+		) {
+			t.Errorf("decrypted content at %d differs", off)
+		}
+	}
+
+	if pos, err := d.Seek(-1, io.SeekEnd); err != nil ||
+		pos != int64(size-1) {
+		t.Errorf("Seek(-1, io.SeekEnd) = %d, %v", pos, err)
+	}
+
+	headerSize := len(sealed) - size - 4*Overhead
+	for i := 0; i < 4; i++ {
+		off := headerSize + i*sealedChunkSize
+		if _, err := e.Seek(int64(off), io.SeekStart); err != nil {
+			t.Fatalf("Seek(%d): %v", off, err)
+		}
+
+		got, err := io.ReadAll(e)
+		if err != nil {
+			t.Fatalf("reading encrypter at %d: %v", off, err)
+		}
+
+		if !bytes.Equal(got, sealed[off:]) {
+			t.Errorf("encrypted content at %d differs", off)
+		}
+	}
+}
+
+func TestTamperedChunk(t *testing.T) {
+	size := 3*ChunkSize + 5
+	plain := testContent(size)
+	_, sealed := encrypt(t, bytes.NewReader(plain))
+	headerSize := len(sealed) - size - 4*Overhead
+
+	tampered := bytes.Clone(sealed)
+	tampered[headerSize+sealedChunkSize+10] ^= 1
+
+	d := newDecrypter(t, tampered)
+	if _, err := io.ReadAll(d); err == nil {
+		t.Error("reading a tampered chunk succeeded")
+	}
+
+	// The chunks that are intact are still readable.
+	if _, err := d.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, ChunkSize)
+	if _, err := io.ReadFull(d, got); err != nil {
+		t.Fatalf("reading an intact chunk: %v", err)
+	} else if !bytes.Equal(got, plain[:ChunkSize]) {
+		t.Error("intact chunk differs")
+	}
+
+	swapped := bytes.Clone(sealed)
+	copy(
+		swapped[headerSize:],
+		sealed[headerSize+sealedChunkSize:headerSize+2*sealedChunkSize],
+	)
+	copy(
+		swapped[headerSize+sealedChunkSize:],
+		sealed[headerSize:headerSize+sealedChunkSize],
+	)
+	if _, err := io.ReadAll(newDecrypter(t, swapped)); err == nil {
+		t.Error("reading swapped chunks succeeded")
+	}
+
+	truncated := sealed[:headerSize+3*sealedChunkSize]
+	if _, err := io.ReadAll(newDecrypter(t, truncated)); err == nil {
+		t.Error("reading a truncated object succeeded")
+	}
+
+	_, emptySealed := encrypt(t, bytes.NewReader(nil))
+	emptySealed[len(emptySealed)-1] ^= 1
+	if _, err := io.ReadAll(newDecrypter(t, emptySealed)); err == nil {
+		t.Error("reading a tampered empty object succeeded")
+	}
+}
+
+func TestNotEncrypted(t *testing.T) {
+	for _, plain := range [][]byte{
+		nil,
+		[]byte("GPC"),
+		testContent(100),
+	} {
+		object := readSeekNopCloser{bytes.NewReader(plain)}
+		d, err := NewDecrypter(object, int64(len(plain)), testKeyOf)
+		if err != nil || d != nil {
+			t.Fatalf("NewDecrypter = %v, %v, want nil, nil", d, err)
+		}
+
+		got, err := io.ReadAll(object)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("object not seeked back to the start")
+		}
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	_, sealed := encrypt(t, bytes.NewReader(testContent(10)))
+	if _, err := NewDecrypter(
+		readSeekNopCloser{bytes.NewReader(sealed)},
+		int64(len(sealed)),
+		func(string) []byte { return nil },
+	); err == nil {
+		t.Error("NewDecrypter succeeded with an unknown key")
+	}
+}
+
+func TestSetSalt(t *testing.T) {
+	plain := testContent(2*ChunkSize + 1)
+	e1, sealed1 := encrypt(t, bytes.NewReader(plain))
+	e2, _ := encrypt(t, bytes.NewReader(plain))
+
+	if err := EncrypterOf(e2).SetSalt(EncrypterOf(e1).Salt()); err != nil {
+		t.Fatalf("SetSalt: %v", err)
+	}
+
+	sealed2, err := io.ReadAll(e2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(sealed1, sealed2) {
+		t.Error("same content and salt encrypted differently")
+	}
+
+	fp1, err := EncrypterOf(e1).Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp2, err := EncrypterOf(e2).Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fp1, fp2) {
+		t.Error("same content and salt fingerprinted differently")
+	}
+
+	other := bytes.Clone(plain)
+	other[ChunkSize] ^= 1
+	e3, _ := encrypt(t, bytes.NewReader(other))
+	if err := EncrypterOf(e3).SetSalt(EncrypterOf(e1).Salt()); err != nil {
+		t.Fatal(err)
+	}
+
+	fp3, err := EncrypterOf(e3).Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(fp1, fp3) {
+		t.Error("different contents fingerprinted the same")
+	}
+}
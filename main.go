@@ -13,7 +13,6 @@ import (
 	"github.com/air-gases/defibrillator"
 	"github.com/air-gases/langman"
 	"github.com/air-gases/limiter"
-	"github.com/air-gases/logger"
 	"github.com/aofei/air"
 	"github.com/goproxy/goproxy.cn/base"
 	"github.com/goproxy/goproxy.cn/handler"
@@ -26,10 +25,10 @@ func main() {
 	base.Air.ErrorLogger = log.New(base.Logger, "", 0)
 
 	base.Air.Pregases = []air.Gas{
-		logger.Gas(logger.GasConfig{
-			Logger:               &base.Logger,
-			IncludeClientAddress: true,
-		}),
+		handler.ClientIPGas,
+		handler.RequestIDGas,
+		handler.AccessLogGas,
+		handler.IPAccessGas,
 		defibrillator.Gas(defibrillator.GasConfig{}),
 		limiter.BodySizeGas(limiter.BodySizeGasConfig{
 			MaxBytes: 1 << 20,
@@ -48,6 +47,7 @@ func main() {
 				return next(req, res)
 			}
 		},
+		handler.VanityGas,
 	}
 
 	base.Air.Gases = []air.Gas{
@@ -63,10 +63,24 @@ func main() {
 		}
 	}()
 
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	go func() {
+		for range reloadChan {
+			if err := base.ReloadConfig(); err != nil {
+				base.Logger.Error().Err(err).
+					Msg("failed to reload configuration file")
+			}
+		}
+	}()
+
 	shutdownChan := make(chan os.Signal, 1)
 	signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
 	<-shutdownChan
 
+	handler.Drain()
+	handler.DrainGoproxyCachePuts()
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 